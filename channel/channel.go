@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teacat/chaturbate-dvr/chaturbate"
@@ -21,14 +24,44 @@ type Channel struct {
 	LogCh           chan string
 	UpdateCh        chan bool
 
-	IsOnline   bool
-	RoomStatus string // public, private, group, away, offline
-	StreamedAt int64
-	Duration   float64 // Seconds
-	Filesize   int     // Bytes
-	Sequence   int
+	IsOnline       bool
+	IsDormant      bool   // set after `--dormant-after` consecutive offline checks
+	IsRegionLocked bool   // set after regionLockAfter consecutive checks every edge refused the stream
+	IsQueued       bool   // online but waiting for a slot of `--max-concurrent-recordings`
+	RoomStatus     string // public, private, group, away, offline, region-locked
+	EdgeRegion     string // CDN edge region the stream is fetched from, e.g. "sin"
+	StreamedAt     int64
+	Duration       float64 // Seconds
+	Filesize       int     // Bytes
+	Sequence       int
+	Bitrate        float64 // Bits per second, rolling average over bitrateWindow
 
-	Logs []string
+	bitrateSamples []bitrateSample
+	offlineChecks  int
+	lockedChecks   int       // consecutive checks every edge refused the stream, see markRegionLocked
+	nextCheck      time.Time // next minute of the schedule while outside of it, see checkSchedule
+
+	window         *internal.Window // daily window the segments are written in, nil for all day
+	skippingWindow bool             // outside the window, the segments are dropped, see outsideWindow
+
+	// Seconds of the video and the separate audio still to drop at the start of the broadcast, see armTrimStart.
+	trimVideo, trimAudio float64
+	inBroadcast          bool // a broadcast was recorded and wasn't seen ending since, see armTrimStart
+
+	// Segment download times over the last fetchWindow segments, see updateFetchStats.
+	FetchAvg     float64 // Seconds
+	FetchMax     float64 // Seconds
+	FetchRatio   float64 // total download time / total segment duration
+	fetchSamples []fetchSample
+	fetchWarned  bool
+
+	Logs        []string
+	Compressing string // progress of the running compression, e.g. "42%"
+
+	// Room metadata from the API, updated whenever the stream is fetched.
+	RoomTitle string
+	Gender    string
+	Tags      []string
 
 	File             *os.File
 	AudioFile        *os.File
@@ -38,6 +71,41 @@ type Channel struct {
 	AudioInitSegment []byte // fMP4 audio init segment for LL-HLS streams
 	HasSeparateAudio bool
 	switchRequested  bool // set by HandleSegment, consumed by OnPollComplete
+	streamEnding     bool // the last file of the stream is being closed, see endStream
+	lastSegmentAt    time.Time
+	nextPTS          int64 // first timestamp the next `.ts` segment should have, see timestampJump
+	nextPTSKnown     bool
+	chunkEndsAt      time.Time // wall-clock end of the current file with `--chunk-duration`
+	fileStartedAt    time.Time // when the current file was created, logged and embedded as its creation time
+	variant          int       // resolution recorded alongside the main recording with `--resolutions`, 0 for the main one
+
+	monitors sync.WaitGroup // running Monitor, waited for by Shutdown
+
+	// Starting and stopping Monitor, see startMonitor.
+	controlMu     sync.Mutex    // serializes Resume and Pause, held while the previous Monitor exits
+	isMonitoring  atomic.Bool   // a Monitor runs and wasn't canceled, prevents starting a second one
+	monitorDone   chan struct{} // closed once the last started Monitor exited, nil if none was started
+	resumePending bool          // Resume waits for its start delay
+	dormant       atomic.Bool   // IsDormant, read by Wake, see setDormant
+	recording     atomic.Bool   // RecordStream records, Recheck is refused meanwhile
+
+	limitsMu sync.RWMutex // guards MaxDuration, MaxFilesize and Compress of Config, see ApplyRuntime
+
+	muxer *liveMuxer // replaces File and AudioFile with `--live-mux`
+	pipe  *os.File   // replaces File with `--output-pipe`, opened once and never closed
+
+	// Segments held in memory with `--buffer-whole-file`, written when the file is closed.
+	videoBuf *wholeFileBuffer
+	audioBuf *wholeFileBuffer
+
+	subtitles subtitles // the `.vtt` sidecar of the current file with `--subtitles`
+	poster    poster    // the `.poster.jpg` of the current file with `--poster`
+
+	// Resume state for reconnecting into the same HLS source, see resumeSequence.
+	lastSource   string
+	lastSeq      int
+	audioLastSeq int
+	lastSeqAt    time.Time
 }
 
 // New creates a new channel instance with the given manager and configuration.
@@ -84,50 +152,269 @@ func (ch *Channel) WithCancel(ctx context.Context) (context.Context, context.Can
 
 // Info logs an informational message.
 func (ch *Channel) Info(format string, a ...any) {
-	ch.LogCh <- fmt.Sprintf("%s [INFO] %s", time.Now().Format("15:04"), fmt.Sprintf(format, a...))
-	log.Printf(" INFO [%s] %s", ch.Config.Username, fmt.Sprintf(format, a...))
+	msg := ch.logPrefix() + fmt.Sprintf(format, a...)
+	ch.LogCh <- fmt.Sprintf("%s [INFO] %s", formatTimestamp(time.Now()), msg)
+	log.Printf(" INFO [%s] %s", ch.Config.Username, msg)
 }
 
 // Error logs an error message.
 func (ch *Channel) Error(format string, a ...any) {
-	ch.LogCh <- fmt.Sprintf("%s [ERROR] %s", time.Now().Format("15:04"), fmt.Sprintf(format, a...))
-	log.Printf("ERROR [%s] %s", ch.Config.Username, fmt.Sprintf(format, a...))
+	msg := ch.logPrefix() + fmt.Sprintf(format, a...)
+	ch.LogCh <- fmt.Sprintf("%s [ERROR] %s", formatTimestamp(time.Now()), msg)
+	log.Printf("ERROR [%s] %s", ch.Config.Username, msg)
+}
+
+// limits returns the max duration, max filesize and compression of the channel, see ApplyRuntime.
+func (ch *Channel) limits() (maxDuration, maxFilesize int, compress bool) {
+	ch.limitsMu.RLock()
+	defer ch.limitsMu.RUnlock()
+	return ch.Config.MaxDuration, ch.Config.MaxFilesize, ch.Config.Compress
+}
+
+// ApplyRuntime changes the max duration, max filesize and compression of the channel that were left at the previous
+// defaults prev to the new defaults next, the ones set for the channel are kept. It reports whether any changed,
+// the current file is split by the new limits.
+func (ch *Channel) ApplyRuntime(prev, next *entity.RuntimeConfig) bool {
+	ch.limitsMu.Lock()
+	defer ch.limitsMu.Unlock()
+	duration := applyDefault(&ch.Config.MaxDuration, prev.MaxDuration, next.MaxDuration)
+	filesize := applyDefault(&ch.Config.MaxFilesize, prev.MaxFilesize, next.MaxFilesize)
+	compress := applyDefault(&ch.Config.Compress, prev.Compress, next.Compress)
+	return duration || filesize || compress
+}
+
+// applyDefault sets value to next if it's at the previous default prev, it reports whether it changed.
+func applyDefault[T comparable](value *T, prev, next T) bool {
+	if *value != prev || prev == next {
+		return false
+	}
+	*value = next
+	return true
+}
+
+// ConfigCopy returns a copy of the config of the channel that's safe to read while ApplyRuntime changes it.
+func (ch *Channel) ConfigCopy() *entity.ChannelConfig {
+	ch.limitsMu.RLock()
+	defer ch.limitsMu.RUnlock()
+	conf := *ch.Config
+	return &conf
 }
 
 // ExportInfo exports the channel information as a ChannelInfo struct.
 func (ch *Channel) ExportInfo() *entity.ChannelInfo {
-	var filename string
-	if ch.CurrentFilename != "" && ch.HasSeparateAudio {
-		filename = ch.CurrentFilename + ".mp4"
-	} else if ch.File != nil {
-		filename = ch.File.Name()
-	}
 	var streamedAt string
 	if ch.StreamedAt != 0 {
-		streamedAt = time.Unix(ch.StreamedAt, 0).Format("2006-01-02 15:04 AM")
+		streamedAt = formatTimestamp(time.Unix(ch.StreamedAt, 0))
 	}
+	var nextCheck string
+	if !ch.nextCheck.IsZero() {
+		nextCheck = formatTimestamp(ch.nextCheck)
+	}
+	maxDuration, maxFilesize, _ := ch.limits()
 	return &entity.ChannelInfo{
-		IsOnline:     ch.IsOnline,
-		IsPaused:     ch.Config.IsPaused,
-		RoomStatus:   ch.RoomStatus,
-		Username:     ch.Config.Username,
-		MaxDuration:  internal.FormatDuration(float64(ch.Config.MaxDuration * 60)), // MaxDuration from config is in minutes
-		MaxFilesize:  internal.FormatFilesize(ch.Config.MaxFilesize * 1024 * 1024), // MaxFilesize from config is in MB
-		StreamedAt:   streamedAt,
-		CreatedAt:    ch.Config.CreatedAt,
-		Duration:     internal.FormatDuration(ch.Duration),
-		Filesize:     internal.FormatFilesize(ch.Filesize),
-		Filename:     filename,
-		Logs:         ch.Logs,
-		GlobalConfig: server.Config,
-	}
-}
-
-// Pause pauses the channel and cancels the context.
+		IsOnline:       ch.IsOnline,
+		IsPaused:       ch.Config.IsPaused,
+		IsDormant:      ch.IsDormant,
+		IsRegionLocked: ch.IsRegionLocked,
+		IsQueued:       ch.IsQueued,
+		RoomStatus:     ch.RoomStatus,
+		EdgeRegion:     ch.EdgeRegion,
+		Username:       ch.Config.Username,
+		MaxDuration:    internal.FormatDuration(float64(maxDuration * 60)), // MaxDuration from config is in minutes
+		MaxFilesize:    internal.FormatFilesize(maxFilesize * 1024 * 1024), // MaxFilesize from config is in MB
+		StreamedAt:     streamedAt,
+		Schedule:       ch.Config.Schedule,
+		NextCheck:      nextCheck,
+		Window:         ch.Config.Window,
+		OutsideWindow:  ch.skippingWindow,
+		CreatedAt:      ch.Config.CreatedAt,
+		Duration:       internal.FormatDuration(ch.Duration),
+		Filesize:       internal.FormatFilesize(ch.Filesize),
+		Bitrate:        internal.FormatBitrate(ch.Bitrate),
+		Lifetime:       ch.lifetimeTotals(),
+		FetchAvg:       formatFetchTime(ch.FetchAvg),
+		FetchMax:       formatFetchTime(ch.FetchMax),
+		FetchPercent:   int(ch.FetchRatio * 100),
+		Compressing:    ch.Compressing,
+		RoomTitle:      ch.RoomTitle,
+		Gender:         ch.Gender,
+		Tags:           ch.Tags,
+		Filename:       ch.OutputName(),
+		Poster:         ch.posterURL(),
+		PosterPath:     ch.CurrentFilename + ".poster.jpg",
+		Logs:           ch.Logs,
+		GlobalConfig:   server.Config.Copy(),
+	}
+}
+
+// lifetimeTotals formats the lifetime totals of the completed recordings of the channel, empty if there's none.
+func (ch *Channel) lifetimeTotals() string {
+	if server.Totals == nil {
+		return ""
+	}
+	return internal.FormatTotals(server.Totals.Channel(ch.Config.Username))
+}
+
+// setRoom stores the room metadata of the fetched stream.
+func (ch *Channel) setRoom(room *chaturbate.APIResponse) {
+	if room == nil {
+		return
+	}
+	ch.RoomTitle = room.RoomTitle
+	ch.Gender = room.BroadcasterGender
+	ch.Tags = room.Tags()
+}
+
+// recordingMetadata returns the ffmpeg arguments embedding the room metadata into a recording.
+func (ch *Channel) recordingMetadata() []string {
+	args := []string{"-metadata", "artist=" + ch.Config.Username}
+	if !ch.fileStartedAt.IsZero() {
+		args = append(args, "-metadata", "creation_time="+formatTimestamp(ch.fileStartedAt))
+	}
+	if ch.RoomTitle != "" {
+		args = append(args, "-metadata", "title="+ch.RoomTitle)
+	}
+	if len(ch.Tags) > 0 {
+		args = append(args, "-metadata", "genre="+strings.Join(ch.Tags, ", "))
+	}
+	return args
+}
+
+// formatTimestamp formats t in ISO 8601 (RFC 3339) with the UTC offset of `--timezone`.
+func formatTimestamp(t time.Time) string {
+	return server.Config.FormatTime(t)
+}
+
+// bitrateWindow is the amount of content, in seconds, the rolling bitrate is averaged over.
+const bitrateWindow = 30.0
+
+// bitrateSample is the size and duration of a recorded segment.
+type bitrateSample struct {
+	bytes    int
+	duration float64
+}
+
+// updateBitrate adds a segment to the rolling window and recomputes ch.Bitrate.
+func (ch *Channel) updateBitrate(bytes int, duration float64) {
+	if duration <= 0 {
+		return
+	}
+	ch.bitrateSamples = append(ch.bitrateSamples, bitrateSample{bytes, duration})
+
+	var totalBytes int
+	var totalDuration float64
+	for i := len(ch.bitrateSamples) - 1; i >= 0; i-- {
+		if totalDuration >= bitrateWindow {
+			ch.bitrateSamples = ch.bitrateSamples[i+1:]
+			break
+		}
+		totalBytes += ch.bitrateSamples[i].bytes
+		totalDuration += ch.bitrateSamples[i].duration
+	}
+	ch.Bitrate = float64(totalBytes*8) / totalDuration
+}
+
+// resetBitrate clears the rolling window, used when a new stream starts.
+func (ch *Channel) resetBitrate() {
+	ch.bitrateSamples = nil
+	ch.Bitrate = 0
+}
+
+// fetchWindow is the number of recent segments the download times are computed over.
+const fetchWindow = 30
+
+// Download time to segment duration ratios to warn about falling behind, and to clear the warning again.
+const (
+	fetchRatioWarn  = 0.8
+	fetchRatioClear = 0.5
+)
+
+// fetchSample is the download time and duration of a segment.
+type fetchSample struct {
+	fetch    time.Duration
+	duration float64
+}
+
+// updateFetchStats adds a segment download to the window and recomputes the fetch stats,
+// it warns once the downloads take most of the segment duration, the recording falls behind from there.
+func (ch *Channel) updateFetchStats(fetch time.Duration, duration float64) {
+	if duration <= 0 {
+		return
+	}
+	ch.fetchSamples = append(ch.fetchSamples, fetchSample{fetch, duration})
+	if len(ch.fetchSamples) > fetchWindow {
+		ch.fetchSamples = ch.fetchSamples[len(ch.fetchSamples)-fetchWindow:]
+	}
+
+	var totalFetch time.Duration
+	var totalDuration float64
+	ch.FetchMax = 0
+	for _, s := range ch.fetchSamples {
+		totalFetch += s.fetch
+		totalDuration += s.duration
+		ch.FetchMax = max(ch.FetchMax, s.fetch.Seconds())
+	}
+	ch.FetchAvg = totalFetch.Seconds() / float64(len(ch.fetchSamples))
+	ch.FetchRatio = totalFetch.Seconds() / totalDuration
+
+	// Wait for a few segments so a single slow one doesn't warn
+	switch {
+	case len(ch.fetchSamples) >= 5 && ch.FetchRatio >= fetchRatioWarn && !ch.fetchWarned:
+		ch.fetchWarned = true
+		ch.Error("segment downloads take %.0f%% of the segment duration (avg %s, max %s), the recording may fall behind", ch.FetchRatio*100, formatFetchTime(ch.FetchAvg), formatFetchTime(ch.FetchMax))
+	case ch.FetchRatio < fetchRatioClear && ch.fetchWarned:
+		ch.fetchWarned = false
+		ch.Info("segment downloads are keeping up again (%.0f%% of the segment duration)", ch.FetchRatio*100)
+	}
+}
+
+// adaptiveSamples is how many segments of a variant are downloaded before `--adaptive` judges whether they keep up.
+const adaptiveSamples = 10
+
+// shouldDowngrade reports whether the recording steps down to a lower variant with `--adaptive`,
+// once the downloads take most of the segment duration like the warning of updateFetchStats.
+func (ch *Channel) shouldDowngrade() bool {
+	if server.Config == nil || !server.Config.Adaptive {
+		return false
+	}
+	return len(ch.fetchSamples) >= adaptiveSamples && ch.FetchRatio >= fetchRatioWarn
+}
+
+// handleSegmentBreaker logs when the segment fetches pause after too many failed, and when they work again.
+func (ch *Channel) handleSegmentBreaker(paused bool, failed, total int, cooldown time.Duration) {
+	if paused {
+		ch.Error("%d of the last %d segment fetches failed, pausing the fetches for %s", failed, total, cooldown)
+		return
+	}
+	ch.Info("segment fetches work again, resuming")
+}
+
+// resetFetchStats clears the download times, used when a new stream starts.
+func (ch *Channel) resetFetchStats() {
+	ch.fetchSamples = nil
+	ch.fetchWarned = false
+	ch.FetchAvg, ch.FetchMax, ch.FetchRatio = 0, 0, 0
+}
+
+// formatFetchTime formats a download time in seconds, empty if there's none.
+func formatFetchTime(seconds float64) string {
+	if seconds <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.2fs", seconds)
+}
+
+// Pause pauses the channel and cancels the context, it's a no-op if the channel is already paused.
 func (ch *Channel) Pause() {
+	ch.controlMu.Lock()
+	defer ch.controlMu.Unlock()
+	if ch.Config.IsPaused {
+		return
+	}
 	// Stop the monitoring loop, this also updates `ch.IsOnline` to false
 	// `context.Canceled` → `ch.Monitor()` → `onRetry` → `ch.UpdateOnlineStatus(false)`.
 	ch.CancelFunc()
+	ch.isMonitoring.Store(false)
 
 	ch.Config.IsPaused = true
 	ch.Update()
@@ -145,19 +432,151 @@ func (ch *Channel) Stop() {
 	ch.Info("channel stopped")
 }
 
-// Resume resumes the channel monitoring.
+// Resume resumes the channel monitoring, it's a no-op if the channel is already being monitored.
 //
 // `startSeq` is used to prevent all channels from starting at the same time, preventing TooManyRequests errors.
 // It's only be used when program starting and trying to resume all channels at once.
 func (ch *Channel) Resume(startSeq int) {
+	ch.controlMu.Lock()
+	if ch.isMonitoring.Load() || ch.resumePending {
+		ch.controlMu.Unlock()
+		return
+	}
+	ch.resumePending = true
 	ch.PauseCancelFunc()
 	ch.Config.IsPaused = false
+	ch.controlMu.Unlock()
 
 	ch.Update()
 	ch.Info("channel resumed")
 
 	<-time.After(time.Duration(startSeq) * time.Second)
-	go ch.Monitor()
+
+	ch.controlMu.Lock()
+	defer ch.controlMu.Unlock()
+	ch.resumePending = false
+	// Paused again during the delay
+	if ch.Config.IsPaused {
+		return
+	}
+	ch.startMonitor()
+}
+
+// startMonitor runs Monitor in a goroutine once the previous one exited, so they never write the same file at once.
+// It's registered in monitors first so a Shutdown right after waits for it. The caller holds controlMu.
+func (ch *Channel) startMonitor() {
+	ch.stopMonitor()
+	ctx, _ := ch.WithCancel(context.Background())
+	done := make(chan struct{})
+	ch.monitorDone = done
+	ch.isMonitoring.Store(true)
+	ch.monitors.Add(1)
+	go ch.Monitor(ctx, done)
+}
+
+// stopMonitor cancels the running Monitor and waits until it exited and finalized its file. The caller holds controlMu.
+func (ch *Channel) stopMonitor() {
+	if ch.monitorDone != nil {
+		ch.CancelFunc()
+		<-ch.monitorDone
+	}
+}
+
+// restartMonitor stops the running Monitor, then starts a new one that checks the channel right away.
+// The dormancy is reset in between, once the previous Monitor can't update it anymore. The caller holds controlMu.
+func (ch *Channel) restartMonitor(reason string) {
+	ch.stopMonitor()
+	ch.setDormant(false)
+	ch.offlineChecks = 0
+
+	ch.Update()
+	ch.Info("%s", reason)
+	ch.startMonitor()
+}
+
+// Shutdown stops the channel like Stop, then waits for the monitoring to finish the current recording.
+func (ch *Channel) Shutdown() {
+	ch.CancelFunc()
+	ch.PauseCancelFunc()
+	ch.monitors.Wait()
+}
+
+// Wake restarts the monitoring of a dormant channel so it's checked right away, it's a no-op otherwise.
+func (ch *Channel) Wake() {
+	ch.controlMu.Lock()
+	defer ch.controlMu.Unlock()
+	if !ch.dormant.Load() || ch.Config.IsPaused {
+		return
+	}
+	// Interrupt the dormant delay, the old Monitor exits on `context.Canceled` before the new one starts
+	ch.restartMonitor("channel woken up")
+}
+
+// Recheck restarts the monitoring so the channel is checked right away instead of waiting for the interval.
+// It's refused while the channel is recording or paused, so it never starts a second recording.
+func (ch *Channel) Recheck() error {
+	ch.controlMu.Lock()
+	defer ch.controlMu.Unlock()
+	if ch.Config.IsPaused {
+		return internal.ErrPaused
+	}
+	if ch.recording.Load() {
+		return internal.ErrChannelRecording
+	}
+	// Interrupt the retry delay, the old Monitor exits on `context.Canceled` before the new one starts
+	ch.restartMonitor("checking the channel now")
+	return nil
+}
+
+// Recording reports whether RecordStream is recording the channel.
+func (ch *Channel) Recording() bool {
+	return ch.recording.Load()
+}
+
+// setDormant sets IsDormant, and dormant for Wake to read from another goroutine.
+func (ch *Channel) setDormant(dormant bool) {
+	ch.IsDormant = dormant
+	ch.dormant.Store(dormant)
+}
+
+// markOffline counts a consecutive offline check and marks the channel dormant once it reaches `--dormant-after`.
+func (ch *Channel) markOffline() {
+	ch.offlineChecks++
+	if ch.IsDormant || server.Config.DormantAfter <= 0 || ch.offlineChecks < server.Config.DormantAfter {
+		return
+	}
+	ch.setDormant(true)
+	ch.Update()
+	ch.Info("channel is dormant after %d offline checks, checking every %d min(s)", ch.offlineChecks, server.Config.DormantInterval)
+}
+
+// regionLockAfter is how many checks in a row every edge must refuse the stream before the channel is
+// marked region-locked, a single refusal may be a temporary block.
+const regionLockAfter = 3
+
+// markRegionLocked counts a consecutive check every edge refused the stream and marks the channel region-locked
+// once it reaches regionLockAfter, it's checked every `--dormant-interval` from then on.
+func (ch *Channel) markRegionLocked() {
+	ch.lockedChecks++
+	if ch.lockedChecks < regionLockAfter {
+		return
+	}
+	// Set on every check, an offline check in between replaces the status
+	wasLocked := ch.IsRegionLocked
+	ch.IsRegionLocked, ch.RoomStatus = true, chaturbate.StatusRegionLocked
+	ch.Update()
+	if wasLocked {
+		return
+	}
+	ch.Info("every edge refused the stream %d checks in a row, the broadcaster is likely not available in this region; checking every %d min(s)", ch.lockedChecks, server.Config.DormantInterval)
+}
+
+// markOnline resets the offline and region-locked checks and wakes up the channel if it was dormant.
+func (ch *Channel) markOnline() {
+	ch.offlineChecks = 0
+	ch.setDormant(false)
+	ch.lockedChecks = 0
+	ch.IsRegionLocked = false
 }
 
 // UpdateOnlineStatus updates the online status of the channel.
@@ -170,7 +589,7 @@ func (ch *Channel) UpdateOnlineStatus(isOnline bool) {
 // so the UI can still distinguish online/private/offline states.
 func (ch *Channel) CheckOnlineWhilePaused(ctx context.Context, startSeq int) {
 	client := chaturbate.NewClient()
-	baseIntervalMinutes := max(server.Config.Interval, 15)
+	baseIntervalMinutes := max(server.Config.CheckInterval(), 15)
 	cfBlockCount := 0
 
 	initialDelay := time.Duration(startSeq*5) * time.Second
@@ -213,7 +632,7 @@ func (ch *Channel) CheckOnlineWhilePaused(ctx context.Context, startSeq int) {
 			}
 		}
 
-		timer := time.NewTimer(waitInterval)
+		timer := time.NewTimer(withJitter(waitInterval, server.Config.IntervalJitter))
 		select {
 		case <-ctx.Done():
 			if !timer.Stop() {
@@ -0,0 +1,79 @@
+package channel
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// wholeFileBuffer keeps the segments of a file in memory with `--buffer-whole-file`,
+// so the file is written once in a single sequential write when it's closed.
+// Once the buffer would exceed its limit it's written out and the file is written segment by segment again.
+// A nil buffer writes to the file directly.
+type wholeFileBuffer struct {
+	buf        bytes.Buffer
+	limit      int
+	streaming  bool   // the limit was exceeded
+	onOverflow func() // called once the limit is exceeded
+}
+
+// newFileBuffer returns the buffer for a new file, nil unless `--buffer-whole-file` is set.
+func (ch *Channel) newFileBuffer(kind string) *wholeFileBuffer {
+	if server.Config == nil || !server.Config.BufferWholeFile {
+		return nil
+	}
+	limit := server.Config.BufferMaxSize * 1024 * 1024
+	return &wholeFileBuffer{
+		limit: limit,
+		onOverflow: func() {
+			ch.Info("buffer-whole-file: %s file exceeds %d MB, writing it segment by segment", kind, server.Config.BufferMaxSize)
+		},
+	}
+}
+
+// Write buffers p, or writes it to file once the limit is exceeded.
+func (b *wholeFileBuffer) Write(file *os.File, p []byte) (int, error) {
+	if b == nil || b.streaming {
+		return file.Write(p)
+	}
+	if b.buf.Len()+len(p) <= b.limit {
+		return b.buf.Write(p)
+	}
+	b.streaming = true
+	if b.onOverflow != nil {
+		b.onOverflow()
+	}
+	if err := b.Flush(file); err != nil {
+		return 0, err
+	}
+	return file.Write(p)
+}
+
+// Flush writes the buffered segments to file, e.g. before the file is closed or renamed.
+func (b *wholeFileBuffer) Flush(file *os.File) error {
+	if b == nil || b.buf.Len() == 0 {
+		return nil
+	}
+	if _, err := file.Write(b.buf.Bytes()); err != nil {
+		return fmt.Errorf("flush buffer: %w", err)
+	}
+	b.buf.Reset()
+	return nil
+}
+
+// flushBuffers writes the buffered segments of the open files.
+func (ch *Channel) flushBuffers() error {
+	if ch.File != nil {
+		if err := ch.videoBuf.Flush(ch.File); err != nil {
+			return fmt.Errorf("video: %w", err)
+		}
+	}
+	if ch.AudioFile != nil {
+		if err := ch.audioBuf.Flush(ch.AudioFile); err != nil {
+			return fmt.Errorf("audio: %w", err)
+		}
+	}
+	return nil
+}
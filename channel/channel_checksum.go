@@ -0,0 +1,49 @@
+package channel
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// checksumEnabled reports whether `--checksum` is set.
+func (ch *Channel) checksumEnabled() bool {
+	return server.Config != nil && server.Config.Checksum != ""
+}
+
+// WriteChecksum saves the SHA-256 checksum of the recording next to it in the `sha256sum` format,
+// e.g. `video.mkv` → `video.mkv.sha256`, so it can be verified with `sha256sum -c`. Errors are non-fatal.
+func (ch *Channel) WriteChecksum(path string) {
+	sum, err := fileSHA256(path)
+	if err != nil {
+		ch.Error("checksum: failed %s - %s", filepath.Base(path), err.Error())
+		return
+	}
+	sumPath := path + ".sha256"
+	if err := os.WriteFile(sumPath, []byte(fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))), 0666); err != nil {
+		ch.Error("checksum: failed to write %s - %s", filepath.Base(sumPath), err.Error())
+		return
+	}
+	ch.applyPermissions(sumPath, false)
+	ch.Info("checksum: saved %s", filepath.Base(sumPath))
+}
+
+// fileSHA256 returns the hex SHA-256 of the file, it's read in chunks instead of at once.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
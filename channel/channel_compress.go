@@ -1,16 +1,25 @@
 package channel
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Eyevinn/mp4ff/mp4"
 	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
 )
 
 // Track IDs for muxed output
@@ -46,12 +55,69 @@ var availableEncoders = []videoEncoder{
 	{"CPU", "libx264", []string{"-preset", "medium", "-crf", "23"}},
 }
 
+// encoderCodecs lists the ffmpeg codecs of each encoder for h264, hevc and av1, empty if unsupported.
+var encoderCodecs = map[string][3]string{
+	"NVENC":        {"h264_nvenc", "hevc_nvenc", "av1_nvenc"},
+	"AMF":          {"h264_amf", "hevc_amf", "av1_amf"},
+	"QSV":          {"h264_qsv", "hevc_qsv", "av1_qsv"},
+	"VideoToolbox": {"h264_videotoolbox", "hevc_videotoolbox", ""},
+	"CPU":          {"libx264", "libx265", "libsvtav1"},
+}
+
+// encoderHWAccel lists the ffmpeg hardware decoder of each encoder family, used with `--hw-decode`.
+var encoderHWAccel = map[string]string{
+	"NVENC":        "cuda",
+	"AMF":          "d3d11va",
+	"QSV":          "qsv",
+	"VideoToolbox": "videotoolbox",
+}
+
+// hwDecodeArgs returns the input arguments decoding on the same hardware as the encoder with `--hw-decode`,
+// on the selected device if there is one (see gpuDeviceArgs). It's empty for the CPU encoder.
+func hwDecodeArgs(encoder videoEncoder, device int) []string {
+	hwaccel, ok := encoderHWAccel[encoder.name]
+	if server.Config == nil || !server.Config.HWDecode || !ok {
+		return nil
+	}
+	args := []string{"-hwaccel", hwaccel}
+	if device >= 0 {
+		args = append(args, "-hwaccel_device", strconv.Itoa(device))
+	}
+	return args
+}
+
+// codecAvailable tests if the codec works by encoding a short blank video with it and the extra encoder arguments,
+// being listed by ffmpeg is not enough since the hardware or driver may be missing. A probe running longer than
+// `--encoder-detect-timeout` is killed and the codec counts as unavailable.
+func codecAvailable(codec string, args ...string) bool {
+	ctx := context.Background()
+	if timeout := encoderDetectTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmdArgs := append([]string{"-hide_banner", "-f", "lavfi", "-i", "nullsrc=s=256x256:d=1", "-c:v", codec}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(cmdArgs, "-f", "null", "-")...)
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("WARNING: probing %s took longer than %s, skipping it", codec, encoderDetectTimeout())
+		return false
+	}
+	return err == nil
+}
+
+// encoderDetectTimeout returns how long an encoder probe may take, 0 for no limit.
+func encoderDetectTimeout() time.Duration {
+	if server.Config == nil {
+		return 0
+	}
+	return time.Duration(server.Config.EncoderDetectTimeout) * time.Second
+}
+
 // detectEncoder finds the best available encoder
 func detectEncoder() (videoEncoder, string) {
 	for _, enc := range availableEncoders {
-		// Test if encoder is available by running ffmpeg with it
-		cmd := exec.Command("ffmpeg", "-hide_banner", "-f", "lavfi", "-i", "nullsrc=s=256x256:d=1", "-c:v", enc.codec, "-f", "null", "-")
-		if err := cmd.Run(); err == nil {
+		if codecAvailable(enc.codec) {
 			return enc, enc.name
 		}
 	}
@@ -59,8 +125,85 @@ func detectEncoder() (videoEncoder, string) {
 	return availableEncoders[len(availableEncoders)-1], "CPU"
 }
 
-// getEncoder returns the cached encoder or detects one
+// PrintEncoders probes every encoder for h264, hevc and av1 and prints which are available,
+// followed by the encoder compression uses.
+func PrintEncoders(w io.Writer) {
+	fmt.Fprintf(w, "%-14s %-6s %-6s %-6s\n", "ENCODER", "H264", "HEVC", "AV1")
+	for _, enc := range availableEncoders {
+		fmt.Fprintf(w, "%-14s", enc.name)
+		for _, codec := range encoderCodecs[enc.name] {
+			status := "-"
+			if codec != "" {
+				status = "no"
+				if codecAvailable(codec) {
+					status = "yes"
+				}
+			}
+			fmt.Fprintf(w, " %-6s", status)
+		}
+		fmt.Fprintln(w)
+	}
+	enc := getEncoder()
+	fmt.Fprintf(w, "\nCompression uses: %s (%s)\n", enc.name, enc.codec)
+}
+
+// encoderByName returns the encoder with the case-insensitive name, e.g. "nvenc" or "cpu".
+func encoderByName(name string) (videoEncoder, bool) {
+	for _, enc := range availableEncoders {
+		if strings.EqualFold(enc.name, name) {
+			return enc, true
+		}
+	}
+	return videoEncoder{}, false
+}
+
+// ValidateEncoder checks the encoder forced by `--encoder` exists and works on this machine.
+func ValidateEncoder(name string) error {
+	enc, ok := encoderByName(name)
+	if !ok {
+		return fmt.Errorf("unknown encoder %q", name)
+	}
+	if !codecAvailable(enc.codec) {
+		return fmt.Errorf("%s (%s) is not available, run with --list-encoders to see the available ones", enc.name, enc.codec)
+	}
+	return nil
+}
+
+// nextGPUDevice picks the device of the next compression, they're spread across `--gpu-device` in turn.
+var nextGPUDevice atomic.Uint64
+
+// gpuDeviceArgs returns the encoder arguments selecting the GPU for the next compression,
+// and the selected device or -1 if there is none.
+func gpuDeviceArgs(encoder videoEncoder) ([]string, int) {
+	if server.Config == nil || len(server.Config.GPUDevices) == 0 || encoder.name != "NVENC" {
+		return nil, -1
+	}
+	devices := server.Config.GPUDevices
+	device := devices[(nextGPUDevice.Add(1)-1)%uint64(len(devices))]
+	return []string{"-gpu", strconv.Itoa(device)}, device
+}
+
+// ValidateGPUDevices checks the devices of `--gpu-device` exist, they can only be selected with NVENC.
+func ValidateGPUDevices(devices []int) error {
+	encoder := getEncoder()
+	if encoder.name != "NVENC" {
+		return fmt.Errorf("device selection requires NVENC, compression uses %s", encoder.name)
+	}
+	for _, device := range devices {
+		if !codecAvailable(encoder.codec, "-gpu", strconv.Itoa(device)) {
+			return fmt.Errorf("GPU %d is not available for %s", device, encoder.codec)
+		}
+	}
+	return nil
+}
+
+// getEncoder returns the encoder forced by `--encoder`, or the cached encoder or detects one
 func getEncoder() videoEncoder {
+	if server.Config != nil && server.Config.Encoder != "" {
+		if enc, ok := encoderByName(server.Config.Encoder); ok {
+			return enc
+		}
+	}
 	detectedEncoderOnce.Do(func() {
 		enc, name := detectEncoder()
 		detectedEncoder = name
@@ -77,9 +220,18 @@ func getEncoder() videoEncoder {
 
 // CompressFile compresses a video file (.ts or .mp4) to .mkv format using ffmpeg in the background.
 // Uses hardware GPU encoding if available, falls back to CPU (libx264).
-// After successful compression, the original file is deleted.
-func (ch *Channel) CompressFile(srcPath string) {
+// After successful compression, the original file is deleted. The returned channel is closed once it's done.
+func (ch *Channel) CompressFile(srcPath string) <-chan struct{} {
+	// The recorded duration is used for the progress, read it before Cleanup resets it
+	duration := ch.Duration
+	metadata := ch.recordingMetadata()
+
+	done := make(chan struct{})
+	compressions.Add(1)
 	go func() {
+		defer compressions.Done()
+		defer close(done)
+
 		ext := filepath.Ext(srcPath)
 		mkvPath := strings.TrimSuffix(srcPath, ext) + ".mkv"
 		srcFilename := filepath.Base(srcPath)
@@ -93,35 +245,102 @@ func (ch *Channel) CompressFile(srcPath string) {
 		}
 		srcSize := srcInfo.Size()
 
-		// Get the best available encoder
+		// With `--temp-dir` ffmpeg writes into the temp dir, the file is moved into place once done
+		workPath, err := ch.compressWorkPath(mkvPath)
+		if err != nil {
+			ch.Error("compress: temp-dir: %s", err.Error())
+			return
+		}
+		discard := func() {
+			if workPath == mkvPath {
+				return
+			}
+			if err := os.Remove(workPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				ch.Error("compress: failed to remove temp file %s - %s", workPath, err.Error())
+			}
+		}
+
+		// With `--compress-concurrency` wait for a free slot, the channels with a higher priority go first.
+		// A queued compression outlives a pause or a restart of the monitoring, only CancelCompressions stops the wait.
+		if slots := compressQueue(); slots != nil {
+			ch.setCompressing("queued")
+			if err := slots.Acquire(compressCtx, ch.Config.Priority); err != nil {
+				ch.setCompressing("")
+				ch.Error("compress: canceled while queued, keeping %s - %s", srcFilename, err.Error())
+				return
+			}
+			defer slots.Release()
+		}
+
+		// Get the best available encoder, two-pass encodes to a target bitrate on the CPU instead
 		encoder := getEncoder()
+		twoPass := server.Config != nil && server.Config.TwoPass
+		if twoPass {
+			encoder = twoPassEncoder(server.Config.TargetBitrate)
+		}
+		encoderName := encoder.name
+		deviceArgs, device := gpuDeviceArgs(encoder)
+		if device >= 0 {
+			encoder.args = append(append([]string{}, encoder.args...), deviceArgs...)
+			encoderName = fmt.Sprintf("%s (GPU %d)", encoder.name, device)
+		}
+		inputArgs := hwDecodeArgs(encoder, device)
+		if len(inputArgs) > 0 {
+			encoderName += ", " + inputArgs[1] + " decoding"
+		}
+
+		ch.Info("compress: encoding %s (%s) using %s", srcFilename, internal.FormatFilesize(int(srcSize)), encoderName)
 
-		ch.Info("compress: encoding %s (%s) using %s", srcFilename, internal.FormatFilesize(int(srcSize)), encoder.name)
+		audioCodec, audioBitrate := "aac", "128k"
+		if server.Config != nil {
+			audioCodec, audioBitrate = server.Config.AudioCodec, server.Config.AudioBitrate
+		}
+		if audioCodec == "aac_he" && !HEAACAvailable() {
+			ch.Error("compress: HE-AAC requires ffmpeg built with libfdk_aac, falling back to aac")
+			audioCodec = "aac"
+		}
 
-		// Build ffmpeg command
-		args := []string{"-y", "-i", srcPath, "-c:v", encoder.codec}
-		args = append(args, encoder.args...)
-		args = append(args, "-c:a", "aac", "-b:a", "128k", mkvPath)
+		ch.setCompressing("in progress")
+		defer ch.setCompressing("")
+		onProgress := ch.compressProgress(srcFilename, duration)
 
-		cmd := exec.Command("ffmpeg", args...)
-		output, err := cmd.CombinedOutput()
+		run := func(codec string) ([]byte, error) {
+			outputArgs := append(audioCodecArgs(codec, audioBitrate), metadata...)
+			if server.Config != nil {
+				// Last so they override the defaults, e.g. `-c:a copy`
+				outputArgs = append(outputArgs, server.Config.FFmpegExtraArgs...)
+			}
+			// Before the extra args, which may override them
+			outputArgs = append(timestampOutputArgs(srcPath), outputArgs...)
+			if twoPass {
+				return ch.runTwoPass(srcPath, workPath, encoder, outputArgs, duration, onProgress)
+			}
+			return runCompress(srcPath, workPath, encoder, append(timestampInputArgs(srcPath), inputArgs...), outputArgs, onProgress)
+		}
+		output, err := run(audioCodec)
+		if err != nil && len(inputArgs) > 0 {
+			// The hardware decoder may not support the stream or fail to initialize, the software decoder always works
+			ch.Error("compress: hardware decoding failed for %s, retrying with software decoding - %s", srcFilename, err.Error())
+			inputArgs = nil
+			output, err = run(audioCodec)
+		}
+		if err != nil && audioCodec != "aac" {
+			// Opus and HE-AAC are picky about their input (sample rates, channel layouts), keep the recording with AAC instead
+			ch.Error("compress: %s encoding failed for %s, falling back to aac - %s", audioCodec, srcFilename, err.Error())
+			output, err = run("aac")
+		}
 		if err != nil {
 			ch.Error("compress: failed %s - %s", srcFilename, err.Error())
-			if len(output) > 0 {
-				// Only show last 500 chars of ffmpeg output to avoid flooding logs
-				outStr := string(output)
-				if len(outStr) > 500 {
-					outStr = outStr[len(outStr)-500:]
-				}
-				ch.Error("compress: ffmpeg: %s", outStr)
-			}
+			ch.logFFmpegOutput("compress", output)
+			discard()
 			return
 		}
 
 		// Get compressed file size
-		mkvInfo, err := os.Stat(mkvPath)
+		mkvInfo, err := os.Stat(workPath)
 		if err != nil {
 			ch.Error("compress: failed to stat mkv: %s", err.Error())
+			discard()
 			return
 		}
 		mkvSize := mkvInfo.Size()
@@ -129,6 +348,19 @@ func (ch *Channel) CompressFile(srcPath string) {
 		// Calculate compression ratio
 		ratio := float64(mkvSize) / float64(srcSize) * 100
 
+		// Move the file out of the temp dir next to the original, unless the output dir takes it anyway
+		if workPath != mkvPath && ch.outputDir() == "" {
+			mkvPath = uniqueDestPath(mkvPath)
+			if err := moveFile(workPath, mkvPath); err != nil {
+				ch.Error("compress: failed to move %s from temp dir - %s", mkvFilename, err.Error())
+				discard()
+				return
+			}
+			mkvFilename = filepath.Base(mkvPath)
+		} else {
+			mkvPath = workPath
+		}
+
 		// Delete the original file after successful compression
 		if err := os.Remove(srcPath); err != nil {
 			ch.Error("compress: failed to delete %s - %s", srcFilename, err.Error())
@@ -136,9 +368,291 @@ func (ch *Channel) CompressFile(srcPath string) {
 		}
 
 		ch.Info("compress: done %s -> %s (%s, %.1f%%)", srcFilename, mkvFilename, internal.FormatFilesize(int(mkvSize)), ratio)
+		ch.moveSubtitles(srcPath, mkvPath)
+
+		// Flagged after it's indexed, at its final path
+		path := ch.MoveToOutputDir(mkvPath, duration)
+		ch.reportFFmpegWarnings(path, ffmpegWarnings(output))
+	}()
+	return done
+}
+
+// compressions tracks the running CompressFile and RemuxFile goroutines, see WaitCompressions.
+// The queued ones stop waiting for a slot once compressCtx is canceled, see CancelCompressions.
+var (
+	compressions                    sync.WaitGroup
+	compressCtx, cancelCompressions = context.WithCancel(context.Background())
+)
+
+// WaitCompressions waits for the running compressions and remuxes to finish, the shutdown and the self-test wait for them.
+func WaitCompressions() {
+	compressions.Wait()
+}
+
+// CancelCompressions stops the compressions waiting for a `--compress-concurrency` slot, e.g. when the shutdown
+// timed out, their recordings are kept uncompressed. The running ones finish.
+func CancelCompressions() {
+	cancelCompressions()
+}
 
-		ch.MoveToOutputDir(mkvPath)
+// compressSlots bounds how many compressions run at the same time (`--compress-concurrency`).
+var (
+	compressSlots     *internal.PrioritySlots
+	compressSlotsOnce sync.Once
+)
+
+// compressQueue returns the compression slots, nil if the concurrency is unlimited.
+func compressQueue() *internal.PrioritySlots {
+	compressSlotsOnce.Do(func() {
+		if server.Config != nil && server.Config.CompressConcurrency > 0 {
+			compressSlots = internal.NewPrioritySlots(server.Config.CompressConcurrency)
+		}
+	})
+	return compressSlots
+}
+
+// compressWorkPath returns where ffmpeg writes the compressed mkvPath, which is in `--temp-dir` if set.
+func (ch *Channel) compressWorkPath(mkvPath string) (string, error) {
+	if server.Config == nil || server.Config.TempDir == "" {
+		return mkvPath, nil
+	}
+	if err := ch.mkdirAll(server.Config.TempDir); err != nil {
+		return "", err
+	}
+	return uniqueDestPath(filepath.Join(server.Config.TempDir, filepath.Base(mkvPath))), nil
+}
+
+// runCompress runs ffmpeg to encode srcPath into mkvPath with the given encoder, input (decoding) and output arguments (audio, metadata).
+// onProgress is called with the encoded duration in seconds, it returns the ffmpeg error output.
+func runCompress(srcPath, mkvPath string, encoder videoEncoder, inputArgs, outputArgs []string, onProgress func(seconds float64)) ([]byte, error) {
+	return runFFmpegProgress(compressArgs(srcPath, mkvPath, encoder, inputArgs, outputArgs), onProgress)
+}
+
+// compressArgs returns the ffmpeg arguments of runCompress, the output arguments follow the encoder's so they override them.
+func compressArgs(srcPath, mkvPath string, encoder videoEncoder, inputArgs, outputArgs []string) []string {
+	args := append([]string{"-y", "-nostats", "-progress", "pipe:1"}, inputArgs...)
+	args = append(args, "-i", srcPath, "-c:v", encoder.codec)
+	args = append(args, encoder.args...)
+	args = append(args, outputArgs...)
+	return append(args, mkvPath)
+}
+
+// twoPassEncoder returns the CPU encoder targeting the bitrate (e.g. "2500k"), used with `--two-pass`.
+func twoPassEncoder(bitrate string) videoEncoder {
+	return videoEncoder{"CPU (two-pass)", "libx264", []string{"-preset", "medium", "-b:v", bitrate}}
+}
+
+// runTwoPass encodes srcPath into mkvPath in two passes, the first one only analyzes the video into a pass log
+// next to the output, which is removed afterwards. The progress of each pass counts for half of the duration.
+func (ch *Channel) runTwoPass(srcPath, mkvPath string, encoder videoEncoder, outputArgs []string, duration float64, onProgress func(seconds float64)) ([]byte, error) {
+	passLog := strings.TrimSuffix(mkvPath, filepath.Ext(mkvPath)) + ".passlog"
+	defer func() {
+		// libx264 writes the log as <prefix>-0.log and <prefix>-0.log.mbtree, libx265 as <prefix> and <prefix>.cutree
+		logs, _ := filepath.Glob(passLog + "*")
+		for _, p := range logs {
+			if err := os.Remove(p); err != nil {
+				ch.Error("compress: failed to remove pass log %s - %s", filepath.Base(p), err.Error())
+			}
+		}
 	}()
+
+	var extraArgs []string
+	if server.Config != nil {
+		extraArgs = server.Config.FFmpegExtraArgs
+	}
+	args := twoPassArgs(srcPath, mkvPath, passLog, encoder, 1, extraArgs, outputArgs)
+	output, err := runFFmpegProgress(args, func(seconds float64) { onProgress(seconds / 2) })
+	if err != nil {
+		return output, fmt.Errorf("pass 1: %w", err)
+	}
+	ch.Info("compress: pass 1 of %s done, encoding pass 2", filepath.Base(srcPath))
+
+	args = twoPassArgs(srcPath, mkvPath, passLog, encoder, 2, extraArgs, outputArgs)
+	output, err = runFFmpegProgress(args, func(seconds float64) { onProgress(duration/2 + seconds/2) })
+	if err != nil {
+		return output, fmt.Errorf("pass 2: %w", err)
+	}
+	return output, nil
+}
+
+// twoPassArgs returns the ffmpeg arguments of the pass (1 or 2). The first pass gets the extra arguments too,
+// so its stats match the frames of the second one, its null output comes last so it still wins.
+// The second pass gets outputArgs, which end with the extra arguments, and writes mkvPath.
+func twoPassArgs(srcPath, mkvPath, passLog string, encoder videoEncoder, pass int, extraArgs, outputArgs []string) []string {
+	args := append([]string{"-y", "-nostats", "-progress", "pipe:1"}, timestampInputArgs(srcPath)...)
+	args = append(args, "-i", srcPath, "-c:v", encoder.codec)
+	args = append(args, encoder.args...)
+	passArgs := passLogArgs(internal.VideoCodecArg(extraArgs, encoder.codec), pass, passLog)
+	if pass == 1 {
+		args = append(args, extraArgs...)
+		args = append(args, passArgs...)
+		return append(args, "-an", "-f", "null", os.DevNull)
+	}
+	args = append(args, passArgs...)
+	args = append(args, outputArgs...)
+	return append(args, mkvPath)
+}
+
+// passLogArgs returns the arguments of the pass writing or reading the pass log, libx265 takes them as x265 params
+// since ffmpeg's `-pass` only applies to libx264. The colons and backslashes of the path are escaped for them.
+func passLogArgs(codec string, pass int, passLog string) []string {
+	if codec == "libx265" {
+		stats := strings.NewReplacer(`\`, `\\`, ":", `\:`, "'", `\'`).Replace(passLog)
+		return []string{"-x265-params", fmt.Sprintf("pass=%d:stats=%s", pass, stats)}
+	}
+	return []string{"-pass", strconv.Itoa(pass), "-passlogfile", passLog}
+}
+
+// runFFmpegProgress runs ffmpeg with `-progress pipe:1` in args, onProgress is called with the encoded
+// duration in seconds. It returns the ffmpeg error output.
+func runFFmpegProgress(args []string, onProgress func(seconds float64)) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// The progress is reported as `key=value` lines, `out_time_us` is the encoded duration
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		if key != "out_time_us" {
+			continue
+		}
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && onProgress != nil {
+			onProgress(float64(us) / 1e6)
+		}
+	}
+	return stderr.Bytes(), cmd.Wait()
+}
+
+// compressProgress returns a progress handler for runCompress, which updates the compressing state
+// and logs the progress with an ETA every compressLogInterval. The duration is the recorded duration
+// of the source in seconds, the progress is unknown if it's 0.
+func (ch *Channel) compressProgress(filename string, duration float64) func(seconds float64) {
+	start := time.Now()
+	lastLog := start
+	lastPercent := -1
+
+	return func(seconds float64) {
+		if duration <= 0 {
+			return
+		}
+		percent := min(int(seconds/duration*100), 99)
+		if percent <= lastPercent || percent <= 0 {
+			return
+		}
+		lastPercent = percent
+		ch.setCompressing(fmt.Sprintf("%d%%", percent))
+
+		if time.Since(lastLog) < compressLogInterval {
+			return
+		}
+		lastLog = time.Now()
+		eta := time.Since(start).Seconds() * float64(100-percent) / float64(percent)
+		ch.Info("compress: %s %d%%, ETA %s", filename, percent, internal.FormatDuration(eta))
+	}
+}
+
+// compressLogInterval is how often the compression progress is logged.
+const compressLogInterval = 30 * time.Second
+
+// setCompressing updates the compression progress shown in the UI, empty when not compressing.
+func (ch *Channel) setCompressing(progress string) {
+	if ch.Compressing == progress {
+		return
+	}
+	ch.Compressing = progress
+	ch.Update()
+}
+
+// ffmpegErrorPatterns are fragments of ffmpeg output lines explaining why it failed, matched case-insensitively.
+var ffmpegErrorPatterns = []string{
+	"unknown encoder",
+	"error initializing output stream",
+	"error while opening encoder",
+	"cannot load",
+	"no capable devices found",
+	"no nvenc capable devices",
+	"openencodesessionex failed",
+	"device creation failed",
+	"no space left on device",
+	"permission denied",
+	"no such file or directory",
+	"invalid data found when processing input",
+	"cannot allocate memory",
+}
+
+// ffmpegErrorLines returns the distinct lines of the ffmpeg output matching ffmpegErrorPatterns.
+func ffmpegErrorLines(output []byte) []string {
+	var lines []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || seen[line] {
+			continue
+		}
+		lower := strings.ToLower(line)
+		for _, pattern := range ffmpegErrorPatterns {
+			if strings.Contains(lower, pattern) {
+				lines = append(lines, line)
+				seen[line] = true
+				break
+			}
+		}
+	}
+	return lines
+}
+
+// logFFmpegOutput logs the known errors found in the output of a failed ffmpeg,
+// or the last `--ffmpeg-log-size` characters if there are none.
+func (ch *Channel) logFFmpegOutput(prefix string, output []byte) {
+	if len(output) == 0 {
+		return
+	}
+	if lines := ffmpegErrorLines(output); len(lines) > 0 {
+		ch.Error("%s: ffmpeg: %s", prefix, strings.Join(lines, " | "))
+		return
+	}
+	// Only show the tail of the output to avoid flooding logs
+	size := 500
+	if server.Config != nil && server.Config.FFmpegLogSize > 0 {
+		size = server.Config.FFmpegLogSize
+	}
+	outStr := strings.TrimSpace(string(output))
+	if len(outStr) > size {
+		outStr = outStr[len(outStr)-size:]
+	}
+	ch.Error("%s: ffmpeg: %s", prefix, outStr)
+}
+
+// HEAACAvailable reports whether ffmpeg is built with libfdk_aac, the native aac encoder has no HE-AAC profile.
+// The result is cached after the first check.
+var HEAACAvailable = sync.OnceValue(func() bool {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-encoders").Output()
+	return err == nil && bytes.Contains(out, []byte("libfdk_aac"))
+})
+
+// audioCodecArgs returns the ffmpeg audio arguments for the codec (aac, aac_he or opus).
+func audioCodecArgs(codec, bitrate string) []string {
+	if bitrate == "" {
+		bitrate = "128k"
+	}
+	switch codec {
+	case "aac_he":
+		return []string{"-c:a", "libfdk_aac", "-profile:a", "aac_he", "-b:a", bitrate}
+	case "opus":
+		// libopus refuses layouts like 5.1(side) with the default mapping family,
+		// so downmix to the nearest layout it accepts.
+		return []string{"-c:a", "libopus", "-b:a", bitrate, "-af", "aformat=channel_layouts=7.1|5.1|stereo|mono"}
+	default:
+		return []string{"-c:a", "aac", "-b:a", bitrate}
+	}
 }
 
 // MuxAV combines separate video and audio source files into a single MP4 container.
@@ -174,13 +688,7 @@ func (ch *Channel) MuxAV(videoPath, audioPath, outputPath string) error {
 	cmd := exec.Command("ffmpeg", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		if len(output) > 0 {
-			outStr := string(output)
-			if len(outStr) > 500 {
-				outStr = outStr[len(outStr)-500:]
-			}
-			ch.Error("mux: ffmpeg: %s", outStr)
-		}
+		ch.logFFmpegOutput("mux", output)
 		return fmt.Errorf("mux audio/video: %w", err)
 	}
 
@@ -356,3 +864,22 @@ func collectFragments(file *mp4.File) []*mp4.Fragment {
 	return fragments
 }
 
+// compressWorthwhile reports whether the recording at path is long and large enough to be compressed with
+// `--compress-min-duration` and `--compress-min-size`, it logs why if it isn't. An unknown duration (0) isn't checked.
+func (ch *Channel) compressWorthwhile(path string, duration float64) bool {
+	if server.Config == nil {
+		return true
+	}
+	if limit := server.Config.CompressMinDuration; limit > 0 && duration > 0 && duration < float64(limit) {
+		ch.Info("compress: skipping %s, %s is shorter than --compress-min-duration %ds", filepath.Base(path), internal.FormatDuration(duration), limit)
+		return false
+	}
+	if limit := server.Config.CompressMinSize; limit > 0 {
+		info, err := os.Stat(path)
+		if err == nil && info.Size() < int64(limit)*1024*1024 {
+			ch.Info("compress: skipping %s, %s is smaller than --compress-min-size %d MB", filepath.Base(path), internal.FormatFilesize(int(info.Size())), limit)
+			return false
+		}
+	}
+	return true
+}
@@ -4,27 +4,24 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/avast/retry-go/v4"
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/notify"
 	"github.com/teacat/chaturbate-dvr/server"
 )
 
-// Pattern holds the date/time and sequence information for the filename pattern
-type Pattern struct {
-	Username string
-	Year     string
-	Month    string
-	Day      string
-	Hour     string
-	Minute   string
-	Second   string
-	Sequence int
-}
-
 // NextFile prepares the next file to be created, by cleaning up the last file and generating a new one
 func (ch *Channel) NextFile() error {
 	if err := ch.Cleanup(); err != nil {
@@ -34,10 +31,23 @@ func (ch *Channel) NextFile() error {
 	if err != nil {
 		return err
 	}
+	if server.Config != nil && !ch.pipeEnabled() {
+		if filename, err = ch.resolveExisting(filename, server.Config.OnExisting); err != nil {
+			return err
+		}
+	}
 	ch.CurrentFilename = filename
+	ch.fileStartedAt = time.Now()
+	ch.resetPoster()
 	if err := ch.CreateNewFile(filename); err != nil {
 		return err
 	}
+	if !ch.pipeEnabled() {
+		ch.Info("recording started at %s", formatTimestamp(ch.fileStartedAt))
+	}
+	if server.Config != nil && server.Config.ChunkDuration > 0 {
+		ch.chunkEndsAt = nextChunkBoundary(server.Config.Now(), time.Duration(server.Config.ChunkDuration)*time.Minute)
+	}
 
 	// Increment the sequence number for the next file
 	ch.Sequence++
@@ -46,14 +56,40 @@ func (ch *Channel) NextFile() error {
 
 // Cleanup cleans the file and resets it, called when the stream errors out or before next file was created.
 func (ch *Channel) Cleanup() error {
+	if ch.CurrentFilename != "" && ch.pipe == nil && !ch.fileStartedAt.IsZero() {
+		ch.Info("recording stopped at %s, started at %s", formatTimestamp(time.Now()), formatTimestamp(ch.fileStartedAt))
+	}
+	ch.closeSubtitles()
+	ch.waitPoster()
+	if ch.muxer != nil {
+		defer func() {
+			ch.CurrentFilename = ""
+			ch.Filesize = 0
+			ch.Duration = 0
+		}()
+		return ch.finishLiveMux()
+	}
+	if ch.pipe != nil {
+		ch.CurrentFilename = ""
+		ch.Filesize = 0
+		ch.Duration = 0
+		return nil
+	}
 	if ch.File == nil && ch.AudioFile == nil {
 		return nil
 	}
 	currentFilename := ch.CurrentFilename
 
+	// With `--buffer-whole-file` this is the single write of the file
+	if err := ch.flushBuffers(); err != nil {
+		ch.Error("buffer-whole-file: %s", err.Error())
+	}
+
 	defer func() {
 		ch.File = nil
 		ch.AudioFile = nil
+		ch.videoBuf = nil
+		ch.audioBuf = nil
 		ch.CurrentFilename = ""
 		ch.Filesize = 0
 		ch.Duration = 0
@@ -67,6 +103,28 @@ func (ch *Channel) Cleanup() error {
 	if err != nil {
 		return err
 	}
+	// Separate tracks kept after a failed mux are still picked up by `--recover` without the marker
+	if currentFilename != "" {
+		defer os.Remove(recordingMarker(currentFilename))
+	}
+
+	_, _, compress := ch.limits()
+	if (videoInfo != nil || audioInfo != nil) && server.Config != nil && ch.shortBroadcast(server.Config.MinDuration) {
+		if !ch.keepShortBroadcast() {
+			for _, file := range []string{videoFilename, audioFilename} {
+				if file == "" {
+					continue
+				}
+				if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+					ch.Error("min-duration: failed to remove %s - %s", filepath.Base(file), err.Error())
+				}
+			}
+			_ = os.Remove(currentFilename + ".vtt")
+			_ = os.Remove(currentFilename + ".poster.jpg")
+			return nil
+		}
+		compress = false
+	}
 
 	if ch.HasSeparateAudio {
 		switch {
@@ -74,19 +132,11 @@ func (ch *Channel) Cleanup() error {
 			return nil
 		case videoInfo == nil:
 			ch.Info("mux: video track missing; preserving audio-only file %s", filepath.Base(audioFilename))
-			if ch.Config.Compress {
-				ch.CompressFile(audioFilename)
-			} else {
-				ch.MoveToOutputDir(audioFilename)
-			}
+			ch.finishFile(audioFilename, compress)
 			return nil
 		case audioInfo == nil:
 			ch.Info("mux: audio track missing; preserving video-only file %s", filepath.Base(videoFilename))
-			if ch.Config.Compress {
-				ch.CompressFile(videoFilename)
-			} else {
-				ch.MoveToOutputDir(videoFilename)
-			}
+			ch.finishFile(videoFilename, compress)
 			return nil
 		}
 
@@ -110,20 +160,12 @@ func (ch *Channel) Cleanup() error {
 		_ = os.Remove(videoFilename)
 		_ = os.Remove(audioFilename)
 
-		if ch.Config.Compress {
-			ch.CompressFile(finalOutput)
-		} else {
-			ch.MoveToOutputDir(finalOutput)
-		}
+		ch.finishFile(finalOutput, compress)
 		return nil
 	}
 
 	if videoInfo != nil && videoInfo.Size() > 0 {
-		if ch.Config.Compress {
-			ch.CompressFile(videoFilename)
-		} else {
-			ch.MoveToOutputDir(videoFilename)
-		}
+		ch.finishFile(videoFilename, compress)
 	}
 
 	return nil
@@ -152,18 +194,101 @@ func muxOutputLooksValid(outputPath string, videoInfo, audioInfo os.FileInfo) (b
 	return true, ""
 }
 
-// MoveToOutputDir relocates a finalized recording into server.Config.OutputDir.
+// finishFile compresses the file if it's over the thresholds of compressWorthwhile, remuxes it to regenerate its timestamps or moves it straight to the output directory.
+func (ch *Channel) finishFile(path string, compress bool) {
+	switch {
+	case compress && ch.compressWorthwhile(path, ch.Duration):
+		ch.CompressFile(path)
+	case regenerateTimestamps(path):
+		ch.RemuxFile(path)
+	default:
+		ch.MoveToOutputDir(path, ch.Duration)
+	}
+}
+
+// MoveToOutputDir relocates a finalized recording into the output directory (see outputDir),
+// then adds it to the recordings index and the lifetime totals with the duration in seconds, generates its thumbnail and checksum and uploads it with `--sftp` and `--s3-bucket` if enabled.
 // Errors are non-fatal: the recording is already safely written at srcPath.
-func (ch *Channel) MoveToOutputDir(srcPath string) string {
-	if server.Config == nil || server.Config.OutputDir == "" {
+func (ch *Channel) MoveToOutputDir(srcPath string, duration float64) string {
+	path := ch.moveToOutputDir(srcPath)
+	if server.Recordings != nil {
+		if err := server.Recordings.Add(path, ch.Config.Username, duration); err != nil {
+			ch.Error("index: failed to add %s - %s", filepath.Base(path), err.Error())
+		}
+	}
+	if server.Totals != nil {
+		if err := server.Totals.Add(path, ch.Config.Username, duration); err != nil {
+			ch.Error("totals: failed to count %s - %s", filepath.Base(path), err.Error())
+		}
+	}
+	// The upload waits for the thumbnail and checksum so they're uploaded along
+	var sidecars sync.WaitGroup
+	if ch.thumbnailEnabled() {
+		sidecars.Add(1)
+		go func() {
+			defer sidecars.Done()
+			ch.GenerateThumbnail(path)
+		}()
+	}
+	if ch.checksumEnabled() {
+		sidecars.Add(1)
+		go func() {
+			defer sidecars.Done()
+			ch.WriteChecksum(path)
+		}()
+	}
+	if ch.uploadEnabled() {
+		// The key prefix is rendered now, the channel may be on its next broadcast once the upload starts
+		prefix := ch.s3Prefix()
+		uploads.Add(1)
+		go func() {
+			defer uploads.Done()
+			sidecars.Wait()
+			ch.Upload(path, prefix)
+		}()
+	}
+	ch.notifyFinished(path, duration)
+	return path
+}
+
+// notifyFinished sends the notification of a completed recording.
+func (ch *Channel) notifyFinished(path string, duration float64) {
+	var filesize string
+	if info, err := os.Stat(path); err == nil {
+		filesize = internal.FormatFilesize(int(info.Size()))
+	}
+	notify.Send(notify.Data{
+		Event:     notify.EventFinished,
+		Username:  ch.Config.Username,
+		RoomTitle: ch.RoomTitle,
+		Filename:  filepath.Base(path),
+		Filesize:  filesize,
+		Duration:  internal.FormatDuration(duration),
+	})
+}
+
+// outputDir returns the output directory of the channel, or the global `--output-dir`, empty if none.
+func (ch *Channel) outputDir() string {
+	if ch.Config.OutputDir != "" {
+		return ch.Config.OutputDir
+	}
+	if server.Config != nil {
+		return server.Config.OutputDir
+	}
+	return ""
+}
+
+func (ch *Channel) moveToOutputDir(srcPath string) string {
+	destDir := ch.outputDir()
+	if destDir == "" {
+		ch.applyPermissions(srcPath, false)
 		return srcPath
 	}
 
-	destDir := server.Config.OutputDir
-	if server.Config.PerModelFolder {
+	if server.Config != nil && server.Config.PerModelFolder {
 		destDir = filepath.Join(destDir, ch.Config.Username)
 	}
-	if err := os.MkdirAll(destDir, 0777); err != nil {
+	if err := ch.mkdirAll(destDir); err != nil {
 		ch.Error("output-dir: mkdir %s: %s", destDir, err.Error())
 		return srcPath
 	}
@@ -173,10 +298,44 @@ func (ch *Channel) MoveToOutputDir(srcPath string) string {
 		ch.Error("output-dir: move %s: %s", filepath.Base(srcPath), err.Error())
 		return srcPath
 	}
+	ch.applyPermissions(destPath, false)
 	ch.Info("output-dir: moved %s -> %s", filepath.Base(srcPath), destPath)
+	ch.moveSubtitles(srcPath, destPath)
+	ch.movePoster(srcPath, destPath)
 	return destPath
 }
 
+// mkdirAll creates the directory and applies the configured mode and ownership.
+func (ch *Channel) mkdirAll(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	ch.applyPermissions(dir, true)
+	return nil
+}
+
+// applyPermissions applies `--file-mode`/`--dir-mode` and `--chown` to the path.
+// The default configuration leaves the path untouched, errors are non-fatal.
+func (ch *Channel) applyPermissions(path string, isDir bool) {
+	if server.Config == nil {
+		return
+	}
+	mode := server.Config.FileMode
+	if isDir {
+		mode = server.Config.DirMode
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			ch.Error("chmod %s: %s", path, err.Error())
+		}
+	}
+	if server.Config.Chown && runtime.GOOS != "windows" {
+		if err := os.Chown(path, server.Config.ChownUID, server.Config.ChownGID); err != nil {
+			ch.Error("chown %s: %s", path, err.Error())
+		}
+	}
+}
+
 // uniqueDestPath returns path if it does not exist, otherwise appends
 // " (n)" before the extension until an unused path is found. Gives up
 // after 1000 tries and returns the last candidate.
@@ -239,38 +398,163 @@ func (ch *Channel) GenerateFilename() (string, error) {
 		return "", fmt.Errorf("filename pattern error: %w", err)
 	}
 
-	// Get the current time based on the Unix timestamp when the stream was started
-	t := time.Unix(ch.StreamedAt, 0)
-	pattern := &Pattern{
+	if err := tpl.Execute(&buf, ch.pattern()); err != nil {
+		return "", fmt.Errorf("template execution error: %w", err)
+	}
+	if ch.variant > 0 {
+		fmt.Fprintf(&buf, "_%dp", ch.variant)
+	}
+
+	// Windows limits the whole path as well, not only each name
+	maxPath := 0
+	if runtime.GOOS == "windows" {
+		maxPath = maxPathBytes - filenameReserve
+	}
+	filename, truncated := truncateFilename(buf.String(), maxNameBytes-filenameReserve, maxPath)
+	if truncated {
+		ch.Info("filename too long, truncated to %s", filename)
+	}
+	return filename, nil
+}
+
+// pattern returns the template data of the current file, the time is when the stream was started, in `--timezone`.
+func (ch *Channel) pattern() *internal.Pattern {
+	t := server.Config.In(time.Unix(ch.StreamedAt, 0))
+	return &internal.Pattern{
 		Username: ch.Config.Username,
-		Sequence: ch.Sequence,
+		Sequence: internal.SequenceNumber(ch.Sequence),
 		Year:     t.Format("2006"),
 		Month:    t.Format("01"),
 		Day:      t.Format("02"),
 		Hour:     t.Format("15"),
 		Minute:   t.Format("04"),
 		Second:   t.Format("05"),
+		Timezone: t.Format("-0700"),
+		ISO8601:  t.Format("20060102T150405-0700"),
 	}
+}
 
-	if err := tpl.Execute(&buf, pattern); err != nil {
-		return "", fmt.Errorf("template execution error: %w", err)
+// Filename limits of most filesystems and of Windows paths (MAX_PATH). The reserve leaves room for
+// the extensions and suffixes added to a generated filename, e.g. ".video.mp4", "_2" or " (1)".
+const (
+	maxNameBytes    = 255
+	maxPathBytes    = 260
+	filenameReserve = 32
+)
+
+// truncateFilename shortens the path components of filename longer than maxName bytes, and the last one
+// so the absolute path fits in maxPath bytes if maxPath > 0. A truncated name ends with a hash of the
+// original one, so long names sharing a prefix stay unique. It reports whether the filename was truncated.
+func truncateFilename(filename string, maxName, maxPath int) (string, bool) {
+	parts := strings.Split(filepath.ToSlash(filename), "/")
+	truncated := false
+	for i, part := range parts {
+		if len(part) > maxName {
+			parts[i] = truncateName(part, maxName)
+			truncated = true
+		}
+	}
+
+	if maxPath > 0 {
+		if abs, err := filepath.Abs(filepath.FromSlash(strings.Join(parts, "/"))); err == nil && len(abs) > maxPath {
+			last := parts[len(parts)-1]
+			// Keep enough of the name to stay recognizable, the path is then still too long but fails with a clear error
+			parts[len(parts)-1] = truncateName(last, max(len(last)-(len(abs)-maxPath), 24))
+			truncated = true
+		}
+	}
+	return filepath.FromSlash(strings.Join(parts, "/")), truncated
+}
+
+// truncateName cuts name to limit bytes on a UTF-8 boundary, ending with "_" and a hash of the whole name.
+func truncateName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("_%08x", h.Sum32())
+
+	keep := max(limit-len(suffix), 0)
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	return name[:keep] + suffix
+}
+
+// existingOutputExts are the extensions a recording of a filename may end up with.
+var existingOutputExts = []string{".ts", ".mp4", ".mkv", ".video.ts", ".video.mp4", ".audio.ts", ".audio.mp4"}
+
+// existingOutputs returns the files of a previous recording with the same filename.
+func existingOutputs(filename string) []string {
+	var paths []string
+	for _, ext := range existingOutputExts {
+		if _, err := os.Stat(filename + ext); err == nil {
+			paths = append(paths, filename+ext)
+		}
 	}
-	return buf.String(), nil
+	return paths
+}
+
+// maxRenameSuffix is the highest suffix `--on-existing rename` tries before giving up.
+const maxRenameSuffix = 1000
+
+// resolveExisting applies the `--on-existing` mode when the filename was already used by a previous recording,
+// it returns the filename to record to.
+func (ch *Channel) resolveExisting(filename, mode string) (string, error) {
+	existing := existingOutputs(filename)
+	if len(existing) == 0 {
+		return filename, nil
+	}
+
+	switch mode {
+	case entity.OnExistingOverwrite:
+		for _, path := range existing {
+			if err := os.Remove(path); err != nil {
+				return "", fmt.Errorf("remove existing file: %w", err)
+			}
+		}
+		ch.Info("overwriting existing recording %s", filepath.Base(filename))
+	case entity.OnExistingRename:
+		for i := 1; i <= maxRenameSuffix; i++ {
+			candidate := fmt.Sprintf("%s_%d", filename, i)
+			if len(existingOutputs(candidate)) == 0 {
+				ch.Info("%s already exists, recording to %s", filepath.Base(filename), filepath.Base(candidate))
+				return candidate, nil
+			}
+		}
+		return "", fmt.Errorf("%s_1 to _%d: %w", filepath.Base(filename), maxRenameSuffix, internal.ErrFileExists)
+	case entity.OnExistingSkip:
+		// The pattern resolves to the same file on every retry, so the channel stops instead
+		return "", retry.Unrecoverable(fmt.Errorf("%s: %w", filepath.Base(existing[0]), internal.ErrFileExists))
+	}
+	// entity.OnExistingAppend, new segments are appended to the existing file
+	return filename, nil
 }
 
 // CreateNewFile creates a new file for the channel using the given filename
 func (ch *Channel) CreateNewFile(filename string) error {
 	// Ensure the directory exists before creating the file
-	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+	if err := ch.mkdirAll(filepath.Dir(filename)); err != nil {
 		return fmt.Errorf("mkdir all: %w", err)
 	}
 
+	if ch.pipeEnabled() {
+		return ch.startPipe()
+	}
+	if ch.liveMuxEnabled() {
+		return ch.startLiveMux(filename+".mkv", nil)
+	}
+
 	videoPath := ch.videoPath(filename)
 	file, err := os.OpenFile(videoPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0777)
 	if err != nil {
 		return fmt.Errorf("cannot open file: %s: %w", filename, err)
 	}
 	ch.File = file
+	ch.videoBuf = ch.newFileBuffer("video")
+	ch.applyPermissions(videoPath, false)
+	ch.markRecording(filename)
 
 	if len(ch.InitSegment) > 0 {
 		n, err := ch.File.Write(ch.InitSegment)
@@ -289,6 +573,8 @@ func (ch *Channel) CreateNewFile(filename string) error {
 			return fmt.Errorf("cannot open audio file: %s: %w", filename, err)
 		}
 		ch.AudioFile = audioFile
+		ch.audioBuf = ch.newFileBuffer("audio")
+		ch.applyPermissions(audioPath, false)
 
 		if len(ch.AudioInitSegment) > 0 {
 			if _, err := ch.AudioFile.Write(ch.AudioInitSegment); err != nil {
@@ -304,6 +590,21 @@ func (ch *Channel) CreateNewFile(filename string) error {
 	return nil
 }
 
+// OutputName returns the name of the file currently being recorded, or empty if none.
+func (ch *Channel) OutputName() string {
+	switch {
+	case ch.pipe != nil:
+		return server.Config.OutputPipe
+	case ch.muxer != nil:
+		return ch.muxer.output
+	case ch.CurrentFilename != "" && ch.HasSeparateAudio:
+		return ch.CurrentFilename + ".mp4"
+	case ch.File != nil:
+		return ch.File.Name()
+	}
+	return ""
+}
+
 func (ch *Channel) videoPath(filename string) string {
 	if ch.HasSeparateAudio {
 		ext := ".video.ts"
@@ -328,6 +629,30 @@ func (ch *Channel) audioPath(filename string) string {
 	return filename + ext
 }
 
+// shortBroadcast reports whether the stream ended and the current file is the whole broadcast, shorter than minDuration
+// seconds (`--min-duration`), it's always false if minDuration is 0. A file closed by a split while the stream goes on
+// is kept, and so is the last part of a split broadcast however short it is.
+func (ch *Channel) shortBroadcast(minDuration int) bool {
+	return minDuration > 0 && ch.streamEnding && ch.Sequence <= 1 && ch.Duration < float64(minDuration)
+}
+
+// endStream finalizes the last file of a stream that ended, the only file `--min-duration` may discard.
+func (ch *Channel) endStream() error {
+	ch.streamEnding = true
+	defer func() { ch.streamEnding = false }()
+	return ch.Cleanup()
+}
+
+// keepShortBroadcast logs the short broadcast and reports whether `--on-short` keeps it, uncompressed.
+func (ch *Channel) keepShortBroadcast() bool {
+	if server.Config.OnShort == entity.OnShortKeep {
+		ch.Info("min-duration: broadcast ended after %.0fs, keeping %s uncompressed", ch.Duration, filepath.Base(ch.CurrentFilename))
+		return true
+	}
+	ch.Info("min-duration: broadcast ended after %.0fs, discarding %s", ch.Duration, filepath.Base(ch.CurrentFilename))
+	return false
+}
+
 func closeTrackedFile(file *os.File) (string, os.FileInfo, error) {
 	if file == nil {
 		return "", nil, nil
@@ -355,11 +680,26 @@ func closeTrackedFile(file *os.File) (string, os.FileInfo, error) {
 	return filename, fileInfo, nil
 }
 
-// ShouldSwitchFile determines whether a new file should be created.
+// ShouldSwitchFile determines whether a new file should be created. `--max-duration` is checked against
+// Duration, the sum of the `#EXTINF` durations of the written segments, so a file holds that much content
+// even if the download fell behind the wall clock. Only `--chunk-duration` follows the wall clock.
 func (ch *Channel) ShouldSwitchFile() bool {
-	maxFilesizeBytes := ch.Config.MaxFilesize * 1024 * 1024
-	maxDurationSeconds := ch.Config.MaxDuration * 60
+	maxDuration, maxFilesize, _ := ch.limits()
+	maxFilesizeBytes := maxFilesize * 1024 * 1024
+	maxDurationSeconds := maxDuration * 60
 
-	return (ch.Duration >= float64(maxDurationSeconds) && ch.Config.MaxDuration > 0) ||
-		(ch.Filesize >= maxFilesizeBytes && ch.Config.MaxFilesize > 0)
+	return (ch.Duration >= float64(maxDurationSeconds) && maxDuration > 0) ||
+		(ch.Filesize >= maxFilesizeBytes && maxFilesize > 0) ||
+		(!ch.chunkEndsAt.IsZero() && ch.Duration > 0 && !time.Now().Before(ch.chunkEndsAt))
+}
+
+// nextChunkBoundary returns the first wall-clock multiple of chunk after t (`--chunk-duration`),
+// counted from the local midnight, so a 30 minute chunk ends at :00 and :30. The chunks restart every day.
+func nextChunkBoundary(t time.Time, chunk time.Duration) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	next := midnight.Add((t.Sub(midnight)/chunk + 1) * chunk)
+	if nextDay := midnight.AddDate(0, 0, 1); next.After(nextDay) {
+		return nextDay
+	}
+	return next
 }
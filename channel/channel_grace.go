@@ -0,0 +1,75 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/chaturbate"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// offlineGraceApplies reports whether err is a stream going offline that `--offline-grace` waits out,
+// a room gone offline, away or private, or a playlist that's gone. A playlist ending with EXT-X-ENDLIST ended for good.
+func offlineGraceApplies(err error) bool {
+	if server.Config == nil || server.Config.OfflineGrace <= 0 || errors.Is(err, internal.ErrStreamEndlist) {
+		return false
+	}
+	return errors.Is(err, internal.ErrStreamEnded) || errors.Is(err, internal.ErrChannelOffline) || errors.Is(err, internal.ErrPrivateStream)
+}
+
+// awaitReturn checks the stream `--offline-grace` times, `--offline-grace-interval` apart, after it went offline with err
+// while the file stays open. It returns the playlist once the stream is back, or the error of the last check if it isn't.
+func (ch *Channel) awaitReturn(ctx context.Context, client *chaturbate.Client, err error) (*chaturbate.Playlist, error) {
+	checks := server.Config.OfflineGrace
+	interval := time.Duration(server.Config.OfflineGraceInterval) * time.Second
+	ch.Info("stream went offline (%s), checking it %d more time(s) before finalizing the file", err.Error(), checks)
+
+	for i := 1; i <= checks; i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		playlist, fetchErr := ch.fetchPlaylist(ctx, client)
+		if fetchErr == nil {
+			return playlist, nil
+		}
+		if errors.Is(fetchErr, context.Canceled) {
+			return nil, fetchErr
+		}
+		err = fetchErr
+	}
+	ch.Info("stream still offline after %d check(s), finalizing the file", checks)
+	return nil, err
+}
+
+// continueStream carries the recording over from prev to the playlist of the stream that came back within `--offline-grace`.
+// The same source resumes after the last segment, a different audio layout can't go into the same file and starts a new one.
+func (ch *Channel) continueStream(prev, next *chaturbate.Playlist) error {
+	ch.lastSource = streamSource(next.PlaylistURL)
+	if ch.lastSource == streamSource(prev.PlaylistURL) {
+		next.LastSeq, next.AudioLastSeq = prev.LastSeq, prev.AudioLastSeq
+	}
+	next.OnDiscontinuity, next.OnSequenceReset, next.OnSegmentFetched = prev.OnDiscontinuity, prev.OnSequenceReset, prev.OnSegmentFetched
+	next.OnVariantSwitch, next.OnSegmentBreaker = prev.OnVariantSwitch, prev.OnSegmentBreaker
+	next.ShouldDowngrade, next.OnVariantDowngrade = prev.ShouldDowngrade, prev.OnVariantDowngrade
+	if prev.OnSubtitleSegment != nil && next.SubtitlePlaylistURL != "" {
+		next.OnSubtitleSegment = prev.OnSubtitleSegment
+	}
+
+	if separateAudio := next.AudioPlaylistURL != ""; separateAudio != ch.HasSeparateAudio {
+		ch.InitSegment, ch.AudioInitSegment = nil, nil
+		ch.HasSeparateAudio = separateAudio
+		ch.switchRequested = false
+		if err := ch.NextFile(); err != nil {
+			return fmt.Errorf("next file: %w", err)
+		}
+		ch.Info("stream is back with a different audio layout, new file created: %s", ch.OutputName())
+		return nil
+	}
+	ch.Info("stream is back at %dp, continuing in %s", next.Resolution, ch.OutputName())
+	return nil
+}
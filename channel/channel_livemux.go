@@ -0,0 +1,292 @@
+package channel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// liveMuxer pipes the recorded segments into a long-running ffmpeg process,
+// which muxes the video and the optional separate audio rendition into a single
+// MKV file while recording. ffmpeg takes care of the timestamps, so the output is
+// playable right away without the mux/compress step afterwards.
+type liveMuxer struct {
+	cmd    *exec.Cmd
+	output string
+	video  *queuedPipe
+	audio  *queuedPipe
+	stderr *tailBuffer
+	done   chan struct{}
+	err    error
+}
+
+// liveMuxTimeout is how long a write may wait for ffmpeg to read and how long ffmpeg may take to exit once
+// the pipes are closed, a hung ffmpeg is killed after it instead of blocking the recording.
+const liveMuxTimeout = 30 * time.Second
+
+// errPipeStalled is returned by queuedPipe.Write when ffmpeg stopped reading.
+var errPipeStalled = errors.New("ffmpeg stopped reading")
+
+// startLiveMuxer starts ffmpeg writing to output, with the video read from stdin
+// and the audio (if withAudio) read from the extra file descriptor 3.
+// The output "pipe:1" writes to stdout, which is then required. The metadata are extra ffmpeg output arguments.
+func startLiveMuxer(output string, withAudio bool, stdout io.Writer, metadata []string) (*liveMuxer, error) {
+	videoR, videoW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("video pipe: %w", err)
+	}
+	args := []string{"-y", "-hide_banner", "-loglevel", "error", "-i", "pipe:0"}
+
+	var audioR, audioW *os.File
+	if withAudio {
+		if audioR, audioW, err = os.Pipe(); err != nil {
+			videoR.Close()
+			videoW.Close()
+			return nil, fmt.Errorf("audio pipe: %w", err)
+		}
+		args = append(args, "-i", "pipe:3", "-map", "0:v:0", "-map", "1:a:0")
+	}
+	args = append(args, "-c", "copy")
+	args = append(args, metadata...)
+	args = append(args, "-f", "matroska", output)
+
+	m := &liveMuxer{
+		cmd:    exec.Command("ffmpeg", args...),
+		output: output,
+		stderr: &tailBuffer{max: 500},
+		done:   make(chan struct{}),
+	}
+	m.cmd.Stdin = videoR
+	m.cmd.Stdout = stdout
+	m.cmd.Stderr = m.stderr
+	if withAudio {
+		m.cmd.ExtraFiles = []*os.File{audioR}
+	}
+
+	err = m.cmd.Start()
+	// The read ends belong to ffmpeg now.
+	videoR.Close()
+	if audioR != nil {
+		audioR.Close()
+	}
+	if err != nil {
+		videoW.Close()
+		if audioW != nil {
+			audioW.Close()
+		}
+		return nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+
+	m.video = newQueuedPipe(videoW, liveMuxTimeout)
+	if audioW != nil {
+		m.audio = newQueuedPipe(audioW, liveMuxTimeout)
+	}
+	go func() {
+		m.err = m.cmd.Wait()
+		close(m.done)
+	}()
+	return m, nil
+}
+
+// Close closes the pipes so ffmpeg finalizes the output, then waits for it to exit. ffmpeg is killed if
+// a write stalled or it doesn't exit within liveMuxTimeout, whatever it wrote so far is kept.
+func (m *liveMuxer) Close() error {
+	closed := make(chan struct{})
+	go func() {
+		m.video.Close()
+		if m.audio != nil {
+			m.audio.Close()
+		}
+		<-m.done
+		close(closed)
+	}()
+
+	timeout := liveMuxTimeout
+	if m.stalled() {
+		timeout = 0
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-closed:
+	case <-timer.C:
+		// The blocked writes fail once the read ends are gone
+		_ = m.cmd.Process.Kill()
+		<-closed
+	}
+	if m.err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", m.err, strings.TrimSpace(m.stderr.String()))
+	}
+	return nil
+}
+
+// stalled reports whether ffmpeg stopped reading one of the pipes.
+func (m *liveMuxer) stalled() bool {
+	return errors.Is(m.video.Err(), errPipeStalled) || (m.audio != nil && errors.Is(m.audio.Err(), errPipeStalled))
+}
+
+// queuedPipe writes to a pipe from a goroutine, so a blocked pipe (e.g. ffmpeg
+// still probing the video input) never blocks writing to the other one.
+type queuedPipe struct {
+	w       io.WriteCloser
+	queue   chan []byte
+	done    chan struct{}
+	timeout time.Duration // how long Write waits for room in a full queue
+
+	mu  sync.Mutex
+	err error
+}
+
+func newQueuedPipe(w io.WriteCloser, timeout time.Duration) *queuedPipe {
+	p := &queuedPipe{
+		w:       w,
+		queue:   make(chan []byte, 64),
+		done:    make(chan struct{}),
+		timeout: timeout,
+	}
+	go p.loop()
+	return p
+}
+
+func (p *queuedPipe) loop() {
+	defer close(p.done)
+	for b := range p.queue {
+		if p.Err() != nil {
+			continue // drain the queue so writers never block on a dead process
+		}
+		if _, err := p.w.Write(b); err != nil {
+			p.setErr(err)
+		}
+	}
+}
+
+// Write queues b, it returns the error of a previous write if the pipe is broken. If the queue stays full
+// for the timeout, the reader is considered hung and errPipeStalled is returned from then on.
+func (p *queuedPipe) Write(b []byte) (int, error) {
+	if err := p.Err(); err != nil {
+		return 0, err
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case p.queue <- b:
+		return len(b), nil
+	case <-timer.C:
+		p.setErr(errPipeStalled)
+		return 0, errPipeStalled
+	}
+}
+
+// setErr keeps the first error.
+func (p *queuedPipe) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// Err returns the first write error.
+func (p *queuedPipe) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Close flushes the queue and closes the pipe.
+func (p *queuedPipe) Close() {
+	close(p.queue)
+	<-p.done
+	p.w.Close()
+}
+
+// tailBuffer keeps the last max bytes written to it, used to capture ffmpeg errors.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(b), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+// liveMuxEnabled reports whether segments should be piped into ffmpeg instead of written to files.
+// Separate audio needs an extra file descriptor for ffmpeg, which is not supported on Windows.
+func (ch *Channel) liveMuxEnabled() bool {
+	if server.Config == nil || !server.Config.LiveMux {
+		return false
+	}
+	return !ch.HasSeparateAudio || runtime.GOOS != "windows"
+}
+
+// startLiveMux starts a new live muxer for the output and writes the known init segments.
+func (ch *Channel) startLiveMux(output string, stdout io.Writer) error {
+	muxer, err := startLiveMuxer(output, ch.HasSeparateAudio, stdout, ch.recordingMetadata())
+	if err != nil {
+		return fmt.Errorf("live-mux: %w", err)
+	}
+	ch.muxer = muxer
+
+	if len(ch.InitSegment) > 0 {
+		n, err := muxer.video.Write(ch.InitSegment)
+		if err != nil {
+			return fmt.Errorf("live-mux: write init segment: %w", err)
+		}
+		ch.Filesize += n
+	}
+	if muxer.audio != nil && len(ch.AudioInitSegment) > 0 {
+		if _, err := muxer.audio.Write(ch.AudioInitSegment); err != nil {
+			return fmt.Errorf("live-mux: write audio init segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// finishLiveMux stops the live muxer and moves the finalized output.
+func (ch *Channel) finishLiveMux() error {
+	muxer := ch.muxer
+	ch.muxer = nil
+
+	if err := muxer.Close(); err != nil {
+		// ffmpeg may have died mid-stream, whatever it wrote so far is still kept
+		ch.Error("live-mux: %s", err.Error())
+	}
+	if muxer.cmd.Stdout != nil {
+		return nil // piped by `--output-pipe`, there's no file
+	}
+	info, err := os.Stat(muxer.output)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat live-mux output: %w", err)
+	}
+	if info.Size() == 0 || (server.Config != nil && ch.shortBroadcast(server.Config.MinDuration) && !ch.keepShortBroadcast()) {
+		_ = os.Remove(subtitlePath(muxer.output))
+		_ = os.Remove(posterPath(muxer.output))
+		return os.Remove(muxer.output)
+	}
+	ch.MoveToOutputDir(muxer.output, ch.Duration)
+	return nil
+}
@@ -0,0 +1,38 @@
+package channel
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// pipeEnabled reports whether the recording is written to `--output-pipe` instead of files.
+func (ch *Channel) pipeEnabled() bool {
+	return server.Config != nil && server.Config.OutputPipe != ""
+}
+
+// startPipe opens the output pipe on first use, "-" is stdout, anything else a named pipe.
+// Opening a named pipe blocks until the other end is opened for reading.
+//
+// A single stream is written to the pipe as-is, separate audio is muxed by ffmpeg
+// into a Matroska stream first since a pipe can only carry one of them.
+func (ch *Channel) startPipe() error {
+	if ch.pipe == nil {
+		path := server.Config.OutputPipe
+		if path == "-" {
+			ch.pipe = os.Stdout
+		} else {
+			ch.Info("waiting for a reader on %s", path)
+			file, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				return fmt.Errorf("open output pipe: %w", err)
+			}
+			ch.pipe = file
+		}
+	}
+	if ch.HasSeparateAudio {
+		return ch.startLiveMux("pipe:1", ch.pipe)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// posterAttempts bounds the frames grabbed for the poster of a file, posterEvery is the seconds of content between them.
+// A grab is killed after posterTimeout, the file isn't finalized until it's done.
+const (
+	posterAttempts = 4
+	posterEvery    = 30.0
+	posterTimeout  = 20 * time.Second
+)
+
+// poster grabs the `.poster.jpg` of the current file from its segments while it's recorded (`--poster`).
+type poster struct {
+	attempts int
+	nextAt   float64        // Duration of the file the next frame is grabbed at
+	running  atomic.Bool    // a frame is being grabbed, the segments meanwhile are skipped
+	updated  atomic.Int64   // unix nanoseconds the poster was last replaced, 0 if there's none
+	grabs    sync.WaitGroup // the running grab, see waitPoster
+}
+
+// posterEnabled reports whether `--poster` is set.
+func (ch *Channel) posterEnabled() bool {
+	return server.Config != nil && server.Config.Poster
+}
+
+// posterPath returns the poster of a recording, e.g. `video.mkv` → `video.poster.jpg`.
+func posterPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".poster.jpg"
+}
+
+// resetPoster starts the poster of a new file.
+func (ch *Channel) resetPoster() {
+	ch.poster.attempts, ch.poster.nextAt = 0, 0
+	ch.poster.updated.Store(0)
+}
+
+// capturePoster grabs a frame of the segment for the poster of the current file in the background, at the first
+// segment and then every posterEvery seconds up to posterAttempts times. The segments are never held back for it.
+func (ch *Channel) capturePoster(segment []byte) {
+	p := &ch.poster
+	if !ch.posterEnabled() || ch.pipe != nil || ch.CurrentFilename == "" || p.attempts >= posterAttempts || ch.Duration < p.nextAt {
+		return
+	}
+	if !p.running.CompareAndSwap(false, true) {
+		return
+	}
+	p.attempts++
+	p.nextAt = ch.Duration + posterEvery
+
+	// An fMP4 segment only decodes after its init segment
+	data := make([]byte, 0, len(ch.InitSegment)+len(segment))
+	data = append(append(data, ch.InitSegment...), segment...)
+	path := ch.CurrentFilename + ".poster.jpg"
+	p.grabs.Add(1)
+	go func() {
+		defer p.grabs.Done()
+		defer p.running.Store(false)
+		replaced, err := ch.grabPoster(path, data)
+		if err != nil {
+			ch.Error("poster: %s", err.Error())
+			return
+		}
+		if replaced {
+			p.updated.Store(time.Now().UnixNano())
+			ch.Update()
+		}
+	}()
+}
+
+// grabPoster decodes a representative frame of the segment and saves it to path, unless the poster there holds
+// more detail. A black or blurry frame compresses to a smaller JPEG, so the larger one is kept.
+func (ch *Channel) grabPoster(path string, segment []byte) (replaced bool, err error) {
+	tmp := strings.TrimSuffix(path, ".jpg") + ".part.jpg"
+	defer os.Remove(tmp)
+
+	ctx, cancel := context.WithTimeout(context.Background(), posterTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vf", "thumbnail,scale=640:-2", "-frames:v", "1", "-q:v", "4", tmp)
+	cmd.Stdin = bytes.NewReader(segment)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		ch.logFFmpegOutput("poster", output)
+		return false, fmt.Errorf("grab %s: %w", filepath.Base(path), err)
+	}
+
+	grabbed, err := os.Stat(tmp)
+	if err != nil {
+		return false, fmt.Errorf("stat %s: %w", filepath.Base(tmp), err)
+	}
+	if current, err := os.Stat(path); err == nil && current.Size() >= grabbed.Size() {
+		return false, nil
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return false, fmt.Errorf("rename %s: %w", filepath.Base(tmp), err)
+	}
+	ch.applyPermissions(path, false)
+	return true, nil
+}
+
+// waitPoster waits for the running grab of the poster of the current file, so it isn't written next to
+// the file after the file was removed or moved to the output directory.
+func (ch *Channel) waitPoster() {
+	ch.poster.grabs.Wait()
+}
+
+// posterURL returns the URL of the poster of the current file, with its update time so it's reloaded once replaced,
+// empty if there's none yet.
+func (ch *Channel) posterURL() string {
+	updated := ch.poster.updated.Load()
+	if updated == 0 || ch.CurrentFilename == "" {
+		return ""
+	}
+	return fmt.Sprintf("/poster/%s?v=%d", ch.Config.Username, updated)
+}
+
+// movePoster moves the poster of the recording along with it to the output directory.
+func (ch *Channel) movePoster(srcPath, destPath string) {
+	src, dest := posterPath(srcPath), posterPath(destPath)
+	if src == dest {
+		return
+	}
+	if _, err := os.Stat(src); err != nil {
+		return
+	}
+	if err := moveFile(src, dest); err != nil {
+		ch.Error("poster: move %s: %s", filepath.Base(src), err.Error())
+		return
+	}
+	ch.applyPermissions(dest, false)
+}
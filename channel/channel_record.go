@@ -1,29 +1,41 @@
 package channel
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/avast/retry-go/v4"
 	"github.com/teacat/chaturbate-dvr/chaturbate"
+	"github.com/teacat/chaturbate-dvr/entity"
 	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/notify"
 	"github.com/teacat/chaturbate-dvr/server"
 )
 
 // Monitor starts monitoring the channel for live streams and records them.
-func (ch *Channel) Monitor() {
+// It's started by startMonitor with ctx, which Pause, Stop or a restart cancel, and closes done once it exited.
+func (ch *Channel) Monitor(ctx context.Context, done chan struct{}) {
+	defer ch.monitors.Done()
+	defer close(done)
+	// Resume starts a new Monitor once this one exited on its own, e.g. on an unrecoverable error
+	defer ch.isMonitoring.Store(false)
+	// The segment downloads wait for a `--global-segment-concurrency` slot by the priority too
+	ctx = internal.WithPriority(ctx, ch.Config.Priority)
+
 	client := chaturbate.NewClient()
+	client.RoomPassword = ch.Config.RoomPassword
 	ch.Info("starting to record `%s`", ch.Config.Username)
 
-	// Create a new context with a cancel function,
-	// the CancelFunc will be stored in the channel's CancelFunc field
-	// and will be called by `Pause` or `Stop` functions
-	ctx, _ := ch.WithCancel(context.Background())
+	sched := ch.parseSchedule()
 
 	var err error
 	for {
@@ -32,6 +44,9 @@ func (ch *Channel) Monitor() {
 		}
 
 		pipeline := func() error {
+			if err := ch.checkSchedule(sched, server.Config.Now()); err != nil {
+				return err
+			}
 			return ch.RecordStream(ctx, client)
 		}
 
@@ -42,26 +57,68 @@ func (ch *Channel) Monitor() {
 
 			if isCFBlock(err) {
 				cfBlockCount++
-				delay := cfBackoffMinutes(cfBlockCount, server.Config.Interval)
+				delay := cfBackoffMinutes(cfBlockCount, server.Config.CheckInterval())
 				ch.Info("blocked by Cloudflare (attempt %d); try with `-cookies` and `-user-agent`? try again in %d min(s)", cfBlockCount, delay)
 			} else if errors.Is(err, internal.ErrChannelOffline) || errors.Is(err, internal.ErrPrivateStream) {
 				cfBlockCount = 0
 				ch.RoomStatus = client.LastRoomStatus
 				ch.Update()
-				ch.Info("channel is %s, try again in %d min(s)", ch.RoomStatus, server.Config.Interval)
+				ch.markOffline()
+				if ch.RoomStatus == chaturbate.StatusOffline {
+					ch.broadcastEnded()
+				}
+				if !ch.IsDormant {
+					ch.Info("channel is %s, try again in %d min(s)", ch.RoomStatus, server.Config.CheckInterval())
+				}
+			} else if errors.Is(err, internal.ErrRegionLocked) {
+				cfBlockCount = 0
+				ch.markRegionLocked()
+				if !ch.IsRegionLocked {
+					ch.Info("%s, try again in %d min(s)", err.Error(), server.Config.CheckInterval())
+				}
+			} else if errors.Is(err, internal.ErrGeoBlocked) {
+				// Some edge failed otherwise than 403, so it's not a persistent region lock
+				cfBlockCount = 0
+				ch.lockedChecks = 0
+				ch.Error("on retry: %s: retrying in %d min(s)", err.Error(), server.Config.CheckInterval())
+			} else if errors.Is(err, internal.ErrStreamEndlist) {
+				cfBlockCount = 0
+				ch.broadcastEnded()
+				ch.Info("stream ended (endlist), try again in %d min(s)", server.Config.CheckInterval())
+			} else if errors.Is(err, internal.ErrStreamEnded) {
+				cfBlockCount = 0
+				ch.Info("stream ended, try again in %d min(s)", server.Config.CheckInterval())
+			} else if errors.Is(err, internal.ErrResolutionTooLow) || errors.Is(err, internal.ErrNoAllowedVariant) || errors.Is(err, internal.ErrNoVariants) {
+				cfBlockCount = 0
+				ch.Info("%s, try again in %d min(s)", err.Error(), server.Config.CheckInterval())
+			} else if errors.Is(err, internal.ErrRoomPassword) || errors.Is(err, internal.ErrWrongRoomPassword) {
+				cfBlockCount = 0
+				ch.RoomStatus = client.LastRoomStatus
+				ch.Update()
+				ch.Error("%s, try again in %d min(s)", err.Error(), server.Config.CheckInterval())
+			} else if errors.Is(err, internal.ErrOutsideSchedule) {
+				cfBlockCount = 0
+				ch.Update()
+				ch.Info("outside the schedule, next check at %s", formatTimestamp(ch.nextCheck))
 			} else if errors.Is(err, context.Canceled) {
 				cfBlockCount = 0
 			} else {
 				cfBlockCount = 0
-				ch.Error("on retry: %s: retrying in %d min(s)", err.Error(), server.Config.Interval)
+				ch.Error("on retry: %s: retrying in %d min(s)", err.Error(), server.Config.CheckInterval())
 			}
 		}
 
 		customDelay := func(_ uint, err error, _ *retry.Config) time.Duration {
+			if errors.Is(err, internal.ErrOutsideSchedule) {
+				return time.Until(ch.nextCheck)
+			}
 			if isCFBlock(err) {
-				return time.Duration(cfBackoffMinutes(cfBlockCount, server.Config.Interval)) * time.Minute
+				return withJitter(time.Duration(cfBackoffMinutes(cfBlockCount, server.Config.CheckInterval()))*time.Minute, server.Config.IntervalJitter)
+			}
+			if ch.IsDormant || ch.IsRegionLocked {
+				return withJitter(time.Duration(server.Config.DormantInterval)*time.Minute, server.Config.IntervalJitter)
 			}
-			return time.Duration(server.Config.Interval) * time.Minute
+			return withJitter(time.Duration(server.Config.CheckInterval())*time.Minute, server.Config.IntervalJitter)
 		}
 
 		if err = retry.Do(
@@ -95,21 +152,45 @@ func (ch *Channel) Update() {
 // RecordStream records the stream of the channel using the provided client.
 // It retrieves the stream information and starts watching the segments.
 func (ch *Channel) RecordStream(ctx context.Context, client *chaturbate.Client) error {
-	stream, err := client.GetStream(ctx, ch.Config.Username)
+	playlist, err := ch.fetchPlaylist(ctx, client)
 	if err != nil {
-		return fmt.Errorf("get stream: %w", err)
+		return err
 	}
-	playlist, err := stream.GetPlaylist(ctx, ch.Config.Resolution, ch.Config.Framerate)
+
+	release, queued, err := ch.acquireRecordSlot(ctx)
 	if err != nil {
-		return fmt.Errorf("get playlist: %w", err)
+		return err
+	}
+	// Released after the cleanup below, once the file is finalized
+	defer release()
+	if queued {
+		// The playlist URL may have expired while waiting, or the stream ended
+		if playlist, err = ch.fetchPlaylist(ctx, client); err != nil {
+			return err
+		}
 	}
 
+	ch.markOnline()
+	ch.recording.Store(true)
+	defer ch.recording.Store(false)
+	// The start of a stream reconnected into isn't the start of the broadcast
+	resumed := ch.resumeSequence(playlist)
+	// A closure, the playlist is replaced when the stream comes back within `--offline-grace`
+	defer func() { ch.saveSequence(playlist) }()
+
 	ch.StreamedAt = time.Now().Unix()
 	ch.Sequence = 0
+	ch.resetBitrate()
+	ch.resetFetchStats()
 	ch.InitSegment = nil
 	ch.AudioInitSegment = nil
 	ch.HasSeparateAudio = playlist.AudioPlaylistURL != ""
 	ch.switchRequested = false
+	ch.armTrimStart(resumed)
+	ch.window, ch.skippingWindow = ch.parseWindow(), false
+	if !resumed {
+		ch.skipBackfill(ctx, playlist)
+	}
 
 	if err := ch.NextFile(); err != nil {
 		return fmt.Errorf("next file: %w", err)
@@ -117,30 +198,302 @@ func (ch *Channel) RecordStream(ctx context.Context, client *chaturbate.Client)
 
 	// Ensure file is cleaned up when this function exits in any case
 	defer func() {
-		if err := ch.Cleanup(); err != nil {
+		if err := ch.endStream(); err != nil {
 			ch.Error("cleanup on record stream exit: %s", err.Error())
 		}
 	}()
 
 	ch.RoomStatus = chaturbate.StatusPublic
+	if client.LastRoomStatus == chaturbate.StatusPrivate {
+		ch.RoomStatus = chaturbate.StatusPrivate // with `--record-private`
+	}
 	ch.UpdateOnlineStatus(true) // after GetPlaylist succeeds
 
+	playlist.OnDiscontinuity = ch.HandleDiscontinuity
+	playlist.OnSequenceReset = ch.HandleSequenceReset
+	playlist.OnSegmentFetched = ch.updateFetchStats
+	playlist.OnSegmentBreaker = ch.handleSegmentBreaker
+	playlist.ShouldDowngrade, playlist.OnVariantDowngrade = ch.shouldDowngrade, ch.HandleVariantDowngrade
+	if server.Config == nil || server.Config.OnVariant404 != entity.OnVariant404Stop {
+		playlist.OnVariantSwitch = ch.HandleVariantSwitch
+	}
+	if ch.subtitlesEnabled() && playlist.SubtitlePlaylistURL != "" {
+		playlist.OnSubtitleSegment = ch.HandleSubtitleSegment
+	}
+
 	ch.Info("stream quality - resolution %dp (target: %dp), framerate %dfps (target: %dfps)", playlist.Resolution, ch.Config.Resolution, playlist.Framerate, ch.Config.Framerate)
+	if ch.EdgeRegion != "" {
+		ch.Info("recording from the `%s` edge region", ch.EdgeRegion)
+	}
+	notify.Send(notify.Data{
+		Event:      notify.EventStarted,
+		Username:   ch.Config.Username,
+		Resolution: playlist.Resolution,
+		Framerate:  playlist.Framerate,
+		RoomTitle:  ch.RoomTitle,
+	})
 	if ch.HasSeparateAudio {
 		ch.Info("detected separate audio rendition, recording and muxing audio/video streams")
 	}
+	if playlist.OnSubtitleSegment != nil {
+		ch.Info("detected subtitle rendition, recording it to a .vtt sidecar")
+	}
+
+	// Stopped before the cleanup above, so their files are finalized by the time the recording slot is released
+	stopVariants := ch.startVariants(ctx, playlist)
+	defer func() { stopVariants() }()
+
+	for {
+		err := playlist.WatchAVSegments(ctx, ch.HandleSegment, ch.HandleInitSegment, ch.HandleAudioSegment, ch.HandleAudioInitSegment, ch.OnPollComplete)
+		if !offlineGraceApplies(err) {
+			return err
+		}
+		next, err := ch.awaitReturn(ctx, client, err)
+		if err != nil {
+			return err
+		}
+		if err := ch.continueStream(playlist, next); err != nil {
+			return err
+		}
+		playlist = next
+		stopVariants()
+		stopVariants = ch.startVariants(ctx, playlist)
+	}
+}
+
+// checkSlots bounds how many channels fetch their stream and playlist at the same time (`--startup-concurrency`).
+var (
+	checkSlots     *internal.PrioritySlots
+	checkSlotsOnce sync.Once
+)
+
+// fetchPlaylist fetches the stream and picks the playlist, then confirms its resolution with `--resolution-confirm`.
+func (ch *Channel) fetchPlaylist(ctx context.Context, client *chaturbate.Client) (*chaturbate.Playlist, error) {
+	stream, playlist, err := ch.fetchStream(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if server.Config != nil && server.Config.ResolutionConfirm > 0 {
+		return ch.confirmResolution(ctx, stream, playlist, time.Duration(server.Config.ResolutionConfirm)*time.Second, server.Config.MinResolution)
+	}
+	return playlist, nil
+}
+
+// fetchStream fetches the stream and picks the playlist,
+// waiting for a free check slot first if the concurrency is limited, the channels with a higher priority go first.
+func (ch *Channel) fetchStream(ctx context.Context, client *chaturbate.Client) (*chaturbate.Stream, *chaturbate.Playlist, error) {
+	checkSlotsOnce.Do(func() {
+		if server.Config != nil && server.Config.StartupConcurrency > 0 {
+			checkSlots = internal.NewPrioritySlots(server.Config.StartupConcurrency)
+		}
+	})
+	if checkSlots != nil {
+		if err := checkSlots.Acquire(ctx, ch.Config.Priority); err != nil {
+			return nil, nil, err
+		}
+		defer checkSlots.Release()
+	}
+
+	stream, err := client.GetStream(ctx, ch.Config.Username)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get stream: %w", err)
+	}
+	ch.setRoom(stream.Room)
+	ch.EdgeRegion = stream.EdgeRegion
+	playlist, err := stream.GetPlaylist(ctx, ch.Config.Resolution, ch.Config.Framerate, ch.Config.MaxBitrate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get playlist: %w", err)
+	}
+	// Refuse a lower resolution than `--min-resolution` rather than recording it, the stream is checked again later
+	if server.Config != nil {
+		if err := checkMinResolution(playlist, server.Config.MinResolution); err != nil {
+			return nil, nil, err
+		}
+	}
+	return stream, playlist, nil
+}
+
+// checkMinResolution returns ErrResolutionTooLow if the playlist is below minResolution.
+func checkMinResolution(playlist *chaturbate.Playlist, minResolution int) error {
+	if playlist.Resolution < minResolution {
+		return fmt.Errorf("%w: stream is %dp, minimum is %dp", internal.ErrResolutionTooLow, playlist.Resolution, minResolution)
+	}
+	return nil
+}
+
+// confirmResolution picks the playlist of the stream again until it has stayed at the same resolution,
+// at least minResolution, for the whole window. A stream starting at a low variant and ramping up
+// is recorded once it settles, instead of beginning the recording with a low resolution chunk.
+func (ch *Channel) confirmResolution(ctx context.Context, stream *chaturbate.Stream, playlist *chaturbate.Playlist, window time.Duration, minResolution int) (*chaturbate.Playlist, error) {
+	ch.Info("stream is %dp, confirming the resolution for %s before recording", playlist.Resolution, window)
+	poll := min(2*time.Second, window/3)
+	confirmedAt := time.Now().Add(window)
+	for time.Now().Before(confirmedAt) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(poll):
+		}
+		next, err := stream.GetPlaylist(ctx, ch.Config.Resolution, ch.Config.Framerate, ch.Config.MaxBitrate)
+		if err != nil {
+			return nil, fmt.Errorf("get playlist: %w", err)
+		}
+		if err := checkMinResolution(next, minResolution); err != nil {
+			return nil, err
+		}
+		if next.Resolution != playlist.Resolution {
+			ch.Info("stream changed from %dp to %dp, confirming again", playlist.Resolution, next.Resolution)
+			confirmedAt = time.Now().Add(window)
+		}
+		playlist = next
+	}
+	return playlist, nil
+}
+
+// recordSlots bounds how many channels record at the same time (`--max-concurrent-recordings`).
+var (
+	recordSlots     *internal.PrioritySlots
+	recordSlotsOnce sync.Once
+)
+
+// acquireRecordSlot waits for a free recording slot if the recordings are limited, the channels with a higher priority go first.
+// The channel is shown as queued while it waits, queued reports whether it did. release must be called when the recording ends.
+func (ch *Channel) acquireRecordSlot(ctx context.Context) (release func(), queued bool, err error) {
+	recordSlotsOnce.Do(func() {
+		if server.Config != nil && server.Config.MaxRecordings > 0 {
+			recordSlots = internal.NewPrioritySlots(server.Config.MaxRecordings)
+		}
+	})
+	if recordSlots == nil {
+		return func() {}, false, nil
+	}
+	if recordSlots.TryAcquire() {
+		return recordSlots.Release, false, nil
+	}
+
+	ch.Info("channel is online but %d recording(s) are running already, queued until one ends", server.Config.MaxRecordings)
+	ch.IsQueued = true
+	ch.Update()
+	err = recordSlots.Acquire(ctx, ch.Config.Priority)
+	ch.IsQueued = false
+	ch.Update()
+	if err != nil {
+		return nil, true, err
+	}
+	ch.Info("recording slot is free, starting to record")
+	return recordSlots.Release, true, nil
+}
+
+// seqResumeWindow is how long after the last written segment a reconnect into
+// the same HLS source may continue from the saved sequence number.
+const seqResumeWindow = 10 * time.Minute
+
+// resumeSequence presets the playlist's sequence cursors from the previous
+// recording when it reconnects into the same HLS source shortly after, so
+// segments that were already written are not downloaded and appended again.
+// The cursors are reset whenever the stream source changes. It reports whether it resumed.
+func (ch *Channel) resumeSequence(playlist *chaturbate.Playlist) bool {
+	source := streamSource(playlist.PlaylistURL)
+	resumed := source != "" && source == ch.lastSource && time.Since(ch.lastSeqAt) < seqResumeWindow && ch.lastSeq >= 0
+	if resumed {
+		playlist.LastSeq = ch.lastSeq
+		playlist.AudioLastSeq = ch.audioLastSeq
+		ch.Info("reconnected to the same stream, resuming after segment %d", ch.lastSeq)
+	}
+	ch.lastSource = source
+	return resumed
+}
+
+// skipBackfill starts the playlist after the segments it lists now with `--no-backfill`, so the recording starts
+// at the live edge. The listed segments are recorded if the playlist can't be fetched.
+func (ch *Channel) skipBackfill(ctx context.Context, playlist *chaturbate.Playlist) {
+	if server.Config == nil || !server.Config.NoBackfill {
+		return
+	}
+	if err := playlist.SkipBackfill(ctx); err != nil {
+		ch.Error("no-backfill: %s, recording the listed segments", err.Error())
+		return
+	}
+	ch.Info("no-backfill: starting after segment %d", playlist.LastSeq)
+}
 
-	return playlist.WatchAVSegments(ctx, ch.HandleSegment, ch.HandleInitSegment, ch.HandleAudioSegment, ch.HandleAudioInitSegment, ch.OnPollComplete)
+// saveSequence stores the playlist's sequence cursors for a later resumeSequence.
+func (ch *Channel) saveSequence(playlist *chaturbate.Playlist) {
+	ch.lastSeq = playlist.LastSeq
+	ch.audioLastSeq = playlist.AudioLastSeq
+	ch.lastSeqAt = time.Now()
+}
+
+// streamSource identifies an HLS source by its variant playlist URL without
+// the query string, since session tokens change on every reconnect.
+func streamSource(playlistURL string) string {
+	u, err := url.Parse(playlistURL)
+	if err != nil {
+		return playlistURL
+	}
+	return u.Host + u.Path
 }
 
 // HandleInitSegment stores the fMP4 init segment and reopens the file with the correct extension.
+// A different init segment in the middle of a recording starts a new file, the old one can't decode the new segments.
 func (ch *Channel) HandleInitSegment(initData []byte) error {
+	previous := ch.InitSegment
 	ch.InitSegment = initData
 
+	if ch.pipe != nil && ch.muxer == nil {
+		// A single stream, the consumer reinitializes on the new init segment
+		n, err := ch.pipe.Write(initData)
+		if err != nil {
+			return fmt.Errorf("write init segment to pipe: %w", err)
+		}
+		ch.Filesize += n
+		return nil
+	}
+
+	// The stream came back within `--offline-grace`, the file has it already
+	if ch.Duration > 0 && bytes.Equal(previous, initData) {
+		return nil
+	}
+	if len(previous) > 0 && ch.Duration > 0 && !bytes.Equal(previous, initData) {
+		// Right away even with separate audio, the current file can't decode the segments of the new init segment.
+		// Both tracks rotate, so the audio segments of this poll land in the new file too.
+		ch.Info("init segment changed, starting a new file")
+		return ch.NextFile()
+	}
+
+	if ch.muxer != nil {
+		n, err := ch.muxer.video.Write(initData)
+		if err != nil {
+			return fmt.Errorf("live-mux: write init segment: %w", err)
+		}
+		ch.Filesize += n
+		return nil
+	}
+
 	if ch.File == nil {
 		return nil
 	}
+	if err := ch.renameFileToMP4(); err != nil {
+		return err
+	}
+
+	n, err := ch.File.Write(initData)
+	if err != nil {
+		name := ch.File.Name()
+		_ = ch.File.Close()
+		ch.File = nil
+		_ = os.Remove(name)
+		return fmt.Errorf("write init segment: %w", err)
+	}
+	ch.Filesize += n
+	return nil
+}
 
+// renameFileToMP4 closes the video file, renames it to `.mp4` and reopens it for appending.
+func (ch *Channel) renameFileToMP4() error {
+	if err := ch.videoBuf.Flush(ch.File); err != nil {
+		return err
+	}
 	oldName := ch.File.Name()
 	if err := ch.File.Close(); err != nil {
 		return fmt.Errorf("close file for rename: %w", err)
@@ -158,26 +511,40 @@ func (ch *Channel) HandleInitSegment(initData []byte) error {
 		return fmt.Errorf("reopen file as mp4: %w", err)
 	}
 	ch.File = file
-
-	n, err := ch.File.Write(initData)
-	if err != nil {
-		_ = ch.File.Close()
-		ch.File = nil
-		_ = os.Remove(newName)
-		return fmt.Errorf("write init segment: %w", err)
-	}
-	ch.Filesize += n
 	return nil
 }
 
 // HandleAudioInitSegment stores the fMP4 audio init segment and reopens the audio file with the correct extension.
 func (ch *Channel) HandleAudioInitSegment(initData []byte) error {
+	previous := ch.AudioInitSegment
 	ch.AudioInitSegment = initData
+	if ch.Duration > 0 && bytes.Equal(previous, initData) {
+		return nil // the stream came back within `--offline-grace`
+	}
+	if len(previous) > 0 && ch.Duration > 0 && ch.continuousEnabled() {
+		// The init segments are kept across quality changes with `--split-on-resolution-change=false`,
+		// the audio file can't decode the new segments, so it starts a new file right away like HandleInitSegment
+		ch.Info("audio init segment changed, starting a new file")
+		return ch.NextFile()
+	}
+
+	if ch.muxer != nil {
+		if ch.muxer.audio == nil {
+			return nil
+		}
+		if _, err := ch.muxer.audio.Write(initData); err != nil {
+			return fmt.Errorf("live-mux: write audio init segment: %w", err)
+		}
+		return nil
+	}
 
 	if ch.AudioFile == nil {
 		return nil
 	}
 
+	if err := ch.audioBuf.Flush(ch.AudioFile); err != nil {
+		return err
+	}
 	oldName := ch.AudioFile.Name()
 	if err := ch.AudioFile.Close(); err != nil {
 		return fmt.Errorf("close audio file for rename: %w", err)
@@ -205,6 +572,16 @@ func (ch *Channel) HandleAudioInitSegment(initData []byte) error {
 	return nil
 }
 
+// withJitter randomizes d by up to ±percent so channels sharing the same
+// interval don't hit the API at the same moment.
+func withJitter(d time.Duration, percent int) time.Duration {
+	if percent <= 0 || d <= 0 {
+		return d
+	}
+	spread := int64(d) * int64(min(percent, 100)) / 100
+	return d + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
 func isCFBlock(err error) bool {
 	return errors.Is(err, internal.ErrCloudflareBlocked) || errors.Is(err, internal.ErrAgeVerification)
 }
@@ -223,15 +600,40 @@ func (ch *Channel) HandleSegment(b []byte, duration float64) error {
 	if ch.Config.IsPaused {
 		return retry.Unrecoverable(internal.ErrPaused)
 	}
+	if trimSegment(&ch.trimVideo, duration) {
+		return nil
+	}
+	if outside, err := ch.outsideWindow(server.Config.Now()); outside || err != nil {
+		return err
+	}
+
+	// fMP4 segments without an `EXT-X-MAP` are self-initializing, byte appending them
+	// is only valid in an `.mp4` container, so fix the extension picked for TS.
+	if ch.File != nil && ch.Filesize == 0 && len(ch.InitSegment) == 0 && filepath.Ext(ch.File.Name()) == ".ts" && internal.IsFMP4(b) {
+		if err := ch.renameFileToMP4(); err != nil {
+			return err
+		}
+	}
 
-	n, err := ch.File.Write(b)
+	// Separate tracks are muxed into an `.mp4` by their own timestamps, only a single `.ts` is split
+	if ch.File != nil && !ch.HasSeparateAudio && regenerateTimestamps(ch.File.Name()) && ch.timestampJump(b, duration) {
+		if err := ch.NextFile(); err != nil {
+			return fmt.Errorf("next file: %w", err)
+		}
+		ch.Info("timestamps jumped, new file created: %s", ch.OutputName())
+	}
+
+	n, err := ch.writeVideo(b)
 	if err != nil {
 		return fmt.Errorf("write file: %w", err)
 	}
 
 	ch.Filesize += n
 	ch.Duration += duration
-	ch.Info("duration: %s, filesize: %s", internal.FormatDuration(ch.Duration), internal.FormatFilesize(ch.Filesize))
+	ch.lastSegmentAt = time.Now()
+	ch.capturePoster(b)
+	ch.updateBitrate(n, duration)
+	ch.Info("duration: %s, filesize: %s, bitrate: %s", internal.FormatDuration(ch.Duration), internal.FormatFilesize(ch.Filesize), internal.FormatBitrate(ch.Bitrate))
 
 	// Send an SSE update to update the view
 	ch.Update()
@@ -253,7 +655,82 @@ func (ch *Channel) HandleSegment(b []byte, duration float64) error {
 	if err := ch.NextFile(); err != nil {
 		return fmt.Errorf("next file: %w", err)
 	}
-	ch.Info("max filesize or duration exceeded, new file created: %s", ch.File.Name())
+	ch.Info("max filesize, duration or chunk time reached, new file created: %s", ch.OutputName())
+	return nil
+}
+
+// HandleDiscontinuity starts a new file when the stream signals a discontinuity
+// (ad insertion, encoder restart), so segments with different encoding parameters
+// or timestamps are never concatenated into the same file.
+func (ch *Channel) HandleDiscontinuity(seq int) error {
+	if ch.Duration == 0 {
+		ch.Info("discontinuity at segment %d, current file is empty, keep writing", seq)
+		return nil
+	}
+	// A changed fMP4 init segment still starts a new file, see HandleInitSegment
+	if ch.continuousEnabled() {
+		ch.Info("discontinuity at segment %d, continuing in the same file", seq)
+		return nil
+	}
+	// Same pairing concern as HandleSegment, defer the rotation for separate audio
+	// even though the segments of this poll still land in the current file.
+	if ch.HasSeparateAudio {
+		ch.Info("discontinuity at segment %d, new file will be created after this poll", seq)
+		ch.switchRequested = true
+		return nil
+	}
+	if err := ch.NextFile(); err != nil {
+		return fmt.Errorf("next file: %w", err)
+	}
+	ch.Info("discontinuity at segment %d, new file created: %s", seq, ch.OutputName())
+	return nil
+}
+
+// continuousEnabled reports whether quality changes continue in the current file (`--split-on-resolution-change=false`).
+func (ch *Channel) continuousEnabled() bool {
+	return server.Config != nil && server.Config.Continuous
+}
+
+// HandleSequenceReset starts a new file when the stream restarted with lower sequence numbers,
+// the new stream's timestamps don't continue the current file.
+func (ch *Channel) HandleSequenceReset(lastSeq, seq int) error {
+	ch.Info("segment sequence restarted at %d after %d, the stream restarted", seq, lastSeq)
+	return ch.HandleDiscontinuity(seq)
+}
+
+// HandleVariantSwitch starts a new file after the video playlist kept returning 404 and another variant replaced it
+// (`--on-variant-404 switch`), the init segment and timestamps of the new variant don't continue the current file.
+func (ch *Channel) HandleVariantSwitch(resolution, framerate int, separateAudio bool) error {
+	ch.Info("the variant playlist returned 404, switched to resolution %dp, framerate %dfps", resolution, framerate)
+	return ch.continueVariant(separateAudio)
+}
+
+// HandleVariantDowngrade is called after the video stepped down to a lower variant with `--adaptive`,
+// the download times of the previous variant don't apply to it anymore.
+func (ch *Channel) HandleVariantDowngrade(resolution, framerate int, separateAudio bool) error {
+	ch.Info("segment downloads can't keep up (%.0f%% of the segment duration), stepped down to resolution %dp, framerate %dfps", ch.FetchRatio*100, resolution, framerate)
+	ch.resetFetchStats()
+	return ch.continueVariant(separateAudio)
+}
+
+// continueVariant continues the recording in the same file after the variant changed if it can, or starts a new one.
+func (ch *Channel) continueVariant(separateAudio bool) error {
+	audioChanged := separateAudio != ch.HasSeparateAudio
+	if ch.continuousEnabled() && ch.Duration > 0 && !audioChanged {
+		// The init segments are kept, so a new one of the variant is compared to them and only a different one splits
+		ch.Info("continuing in the same file")
+		return nil
+	}
+	ch.InitSegment, ch.AudioInitSegment = nil, nil
+	ch.HasSeparateAudio = separateAudio
+	ch.switchRequested = false
+	if ch.Duration == 0 && !audioChanged {
+		return nil
+	}
+	if err := ch.NextFile(); err != nil {
+		return fmt.Errorf("next file: %w", err)
+	}
+	ch.Info("new file created for the new variant: %s", ch.OutputName())
 	return nil
 }
 
@@ -261,6 +738,14 @@ func (ch *Channel) HandleSegment(b []byte, duration float64) error {
 // Called by WatchAVSegments after both video and audio playlists have been
 // processed, guaranteeing that rotation never splits an A/V pair.
 func (ch *Channel) OnPollComplete() error {
+	if server.Config != nil && ch.idleTimedOut(time.Duration(server.Config.IdleSplit)*time.Second) {
+		ch.switchRequested = false
+		if err := ch.NextFile(); err != nil {
+			return fmt.Errorf("next file: %w", err)
+		}
+		ch.Info("no new segments for %ds, file finalized, the stream continues in: %s", server.Config.IdleSplit, ch.OutputName())
+		return nil
+	}
 	if !ch.switchRequested {
 		return nil
 	}
@@ -268,12 +753,31 @@ func (ch *Channel) OnPollComplete() error {
 	if err := ch.NextFile(); err != nil {
 		return fmt.Errorf("next file: %w", err)
 	}
-	ch.Info("max filesize or duration exceeded, new file created: %s", ch.File.Name())
+	ch.Info("max filesize, duration or chunk time reached, new file created: %s", ch.OutputName())
 	return nil
 }
 
+// idleTimedOut reports whether the current file has content but no new segments for the timeout (`--idle-split`),
+// it's always false if the timeout is 0.
+func (ch *Channel) idleTimedOut(timeout time.Duration) bool {
+	return timeout > 0 && ch.Duration > 0 && !ch.lastSegmentAt.IsZero() && time.Since(ch.lastSegmentAt) >= timeout
+}
+
 // HandleAudioSegment processes and writes audio segment data to a sidecar file.
-func (ch *Channel) HandleAudioSegment(b []byte, _ float64) error {
+func (ch *Channel) HandleAudioSegment(b []byte, duration float64) error {
+	if trimSegment(&ch.trimAudio, duration) || ch.skippingWindow {
+		return nil
+	}
+	if ch.muxer != nil {
+		if ch.muxer.audio == nil {
+			return nil
+		}
+		if _, err := ch.muxer.audio.Write(b); err != nil {
+			// The video write restarts ffmpeg, this audio segment is lost with the dead process
+			ch.Error("live-mux: write audio: %s", err.Error())
+		}
+		return nil
+	}
 	if ch.AudioFile == nil {
 		return nil
 	}
@@ -281,8 +785,28 @@ func (ch *Channel) HandleAudioSegment(b []byte, _ float64) error {
 		return retry.Unrecoverable(internal.ErrPaused)
 	}
 
-	if _, err := ch.AudioFile.Write(b); err != nil {
+	if _, err := ch.audioBuf.Write(ch.AudioFile, b); err != nil {
 		return fmt.Errorf("write audio file: %w", err)
 	}
 	return nil
 }
+
+// writeVideo writes a video segment to the file, or to the live muxer.
+// If ffmpeg died mid-stream, the muxer is restarted into a new file and the write is retried once.
+func (ch *Channel) writeVideo(b []byte) (int, error) {
+	if ch.muxer == nil {
+		if ch.pipe != nil {
+			return ch.pipe.Write(b)
+		}
+		return ch.videoBuf.Write(ch.File, b)
+	}
+	n, err := ch.muxer.video.Write(b)
+	if err == nil {
+		return n, nil
+	}
+	ch.Error("live-mux: ffmpeg stopped (%s), restarting into a new file", err.Error())
+	if err := ch.NextFile(); err != nil {
+		return 0, fmt.Errorf("restart live-mux: %w", err)
+	}
+	return ch.muxer.video.Write(b)
+}
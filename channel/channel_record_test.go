@@ -2,13 +2,27 @@ package channel
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/Eyevinn/mp4ff/mp4"
+	"github.com/avast/retry-go/v4"
+	"github.com/teacat/chaturbate-dvr/chaturbate"
 	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
 	"github.com/teacat/chaturbate-dvr/server"
 )
 
@@ -18,6 +32,9 @@ func (noopManager) CreateChannel(*entity.ChannelConfig, bool) error { return nil
 func (noopManager) StopChannel(string) error                        { return nil }
 func (noopManager) PauseChannel(string) error                       { return nil }
 func (noopManager) ResumeChannel(string) error                      { return nil }
+func (noopManager) WakeChannel(string) error                        { return nil }
+func (noopManager) RecheckChannel(string) error                     { return nil }
+func (noopManager) SetRuntime(*entity.RuntimeConfig) error          { return nil }
 func (noopManager) ChannelInfo() []*entity.ChannelInfo              { return nil }
 func (noopManager) Publish(string, *entity.ChannelInfo)             {}
 func (noopManager) Subscriber(http.ResponseWriter, *http.Request)   {}
@@ -170,6 +187,96 @@ func TestCleanupNativeMuxesSeparateTracksWhenFFmpegUnavailable(t *testing.T) {
 	}
 }
 
+func TestHandleInitSegmentStartsNewFileWhenChanged(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ch := New(&entity.ChannelConfig{
+		Username: "alice",
+		Pattern:  filepath.Join(dir, "recording{{if .Sequence}}_{{.Sequence}}{{end}}"),
+	})
+	ch.StreamedAt = 1
+
+	if err := ch.NextFile(); err != nil {
+		t.Fatalf("NextFile() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ch.Cleanup() })
+
+	if err := ch.HandleInitSegment([]byte("init-1")); err != nil {
+		t.Fatalf("HandleInitSegment() error = %v", err)
+	}
+	if err := ch.HandleSegment([]byte("seg-1"), 1); err != nil {
+		t.Fatalf("HandleSegment() error = %v", err)
+	}
+	if err := ch.HandleInitSegment([]byte("init-2")); err != nil {
+		t.Fatalf("HandleInitSegment() error = %v", err)
+	}
+	if err := ch.HandleSegment([]byte("seg-2"), 1); err != nil {
+		t.Fatalf("HandleSegment() error = %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"recording.mp4":   "init-1seg-1",
+		"recording_1.mp4": "init-2seg-2",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", name, err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHandleInitSegmentWithSeparateAudioStartsNewFileRightAway(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ch := New(&entity.ChannelConfig{
+		Username: "alice",
+		Pattern:  filepath.Join(dir, "recording{{if .Sequence}}_{{.Sequence}}{{end}}"),
+	})
+	ch.StreamedAt = 1
+	ch.HasSeparateAudio = true
+
+	if err := ch.NextFile(); err != nil {
+		t.Fatalf("NextFile() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ch.Cleanup() })
+
+	// The segments of the new init segment in the same poll go to the new file, not after the rotation.
+	// Without audio segments the video-only files are kept as they are.
+	steps := []func() error{
+		func() error { return ch.HandleInitSegment([]byte("init-1")) },
+		func() error { return ch.HandleSegment([]byte("seg-1"), 1) },
+		func() error { return ch.HandleInitSegment([]byte("init-2")) },
+		func() error { return ch.HandleSegment([]byte("seg-2"), 1) },
+		ch.OnPollComplete,
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d error = %v", i, err)
+		}
+	}
+	if err := ch.Cleanup(); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"recording.video.mp4":   "init-1seg-1",
+		"recording_1.video.mp4": "init-2seg-2",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", name, err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
 func TestCreateNewFileKeepsLegacyHLSAsTS(t *testing.T) {
 	t.Parallel()
 
@@ -193,6 +300,42 @@ func TestCreateNewFileKeepsLegacyHLSAsTS(t *testing.T) {
 	}
 }
 
+func TestHandleSegmentDetectsSegmentFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		segment []byte
+		wantExt string
+	}{
+		{name: "ts", segment: []byte{0x47, 0x40, 0x00, 0x10, 0x00, 0x00, 0xb0, 0x0d}, wantExt: ".ts"},
+		{name: "fmp4", segment: []byte("\x00\x00\x00\x18styp-moof-mdat"), wantExt: ".mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			base := filepath.Join(dir, "recording")
+			ch := New(&entity.ChannelConfig{Username: "alice", Pattern: base})
+
+			if err := ch.CreateNewFile(base); err != nil {
+				t.Fatalf("CreateNewFile() error = %v", err)
+			}
+			t.Cleanup(func() { _ = ch.Cleanup() })
+
+			if err := ch.HandleSegment(tt.segment, 1); err != nil {
+				t.Fatalf("HandleSegment() error = %v", err)
+			}
+			got, err := os.ReadFile(base + tt.wantExt)
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.segment) {
+				t.Fatalf("file content = %q, want %q", got, tt.segment)
+			}
+		})
+	}
+}
+
 func TestHandleSegmentDefersRotationForSeparateAudio(t *testing.T) {
 	t.Parallel()
 
@@ -367,3 +510,1338 @@ func TestMuxOutputLooksValid(t *testing.T) {
 		t.Fatalf("expected invalid for missing output")
 	}
 }
+
+func TestResumeSequenceOnReconnectToSameSource(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+
+	first := &chaturbate.Playlist{PlaylistURL: "https://edge1-lax.live.mmcdn.com/live/alice/chunklist.m3u8?token=a", LastSeq: -1, AudioLastSeq: -1}
+	ch.resumeSequence(first)
+	if first.LastSeq != -1 {
+		t.Fatalf("first connect LastSeq = %d, want -1", first.LastSeq)
+	}
+	first.LastSeq, first.AudioLastSeq = 102, 51
+	ch.saveSequence(first)
+
+	// Reconnect into the same stream with a fresh session token.
+	again := &chaturbate.Playlist{PlaylistURL: "https://edge1-lax.live.mmcdn.com/live/alice/chunklist.m3u8?token=b", LastSeq: -1, AudioLastSeq: -1}
+	ch.resumeSequence(again)
+	if again.LastSeq != 102 || again.AudioLastSeq != 51 {
+		t.Fatalf("reconnect cursors = (%d, %d), want (102, 51)", again.LastSeq, again.AudioLastSeq)
+	}
+	ch.saveSequence(again)
+
+	// A different source must start over.
+	other := &chaturbate.Playlist{PlaylistURL: "https://edge1-lax.live.mmcdn.com/live/alice-new/chunklist.m3u8", LastSeq: -1, AudioLastSeq: -1}
+	ch.resumeSequence(other)
+	if other.LastSeq != -1 || other.AudioLastSeq != -1 {
+		t.Fatalf("new source cursors = (%d, %d), want (-1, -1)", other.LastSeq, other.AudioLastSeq)
+	}
+}
+
+func TestWithJitterStaysWithinBounds(t *testing.T) {
+	t.Parallel()
+
+	base := time.Minute
+	if got := withJitter(base, 0); got != base {
+		t.Fatalf("withJitter(0%%) = %s, want %s", got, base)
+	}
+	for i := 0; i < 1000; i++ {
+		got := withJitter(base, 20)
+		if got < 48*time.Second || got > 72*time.Second {
+			t.Fatalf("withJitter(20%%) = %s, want within 48s..72s", got)
+		}
+	}
+}
+
+func TestUpdateBitrateUsesRollingWindow(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+
+	// 10 segments of 2s at 4 Mbps, then 20 segments of 2s at 1 Mbps fill the 30s window.
+	for i := 0; i < 10; i++ {
+		ch.updateBitrate(1000*1000, 2)
+	}
+	if ch.Bitrate != 4*1000*1000 {
+		t.Fatalf("Bitrate = %.0f, want 4000000", ch.Bitrate)
+	}
+	for i := 0; i < 20; i++ {
+		ch.updateBitrate(250*1000, 2)
+	}
+	if ch.Bitrate != 1000*1000 {
+		t.Fatalf("Bitrate = %.0f, want 1000000 once old segments leave the window", ch.Bitrate)
+	}
+}
+
+func TestResolveExisting(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "recording")
+	for _, name := range []string{"recording.mp4", "recording_1.mkv"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("old"), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	ch := New(&entity.ChannelConfig{Username: "alice", Pattern: base})
+
+	if got, err := ch.resolveExisting(base, entity.OnExistingAppend); err != nil || got != base {
+		t.Fatalf("append: got %q, %v, want %q", got, err, base)
+	}
+	if got, err := ch.resolveExisting(base, entity.OnExistingRename); err != nil || got != base+"_2" {
+		t.Fatalf("rename: got %q, %v, want %q", got, err, base+"_2")
+	}
+	if _, err := ch.resolveExisting(base, entity.OnExistingSkip); !errors.Is(err, internal.ErrFileExists) || retry.IsRecoverable(err) {
+		t.Fatalf("skip: err = %v, want an unrecoverable %v", err, internal.ErrFileExists)
+	}
+	if got, err := ch.resolveExisting(base, entity.OnExistingOverwrite); err != nil || got != base {
+		t.Fatalf("overwrite: got %q, %v, want %q", got, err, base)
+	}
+	if _, err := os.Stat(base + ".mp4"); !os.IsNotExist(err) {
+		t.Fatalf("overwrite: expected existing file to be removed, stat err = %v", err)
+	}
+
+	// Every suffix taken, rename gives up instead of looping on
+	for i := 0; i <= maxRenameSuffix; i++ {
+		name := fmt.Sprintf("%s_%d.ts", base, i)
+		if i == 0 {
+			name = base + ".ts"
+		}
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	if _, err := ch.resolveExisting(base, entity.OnExistingRename); !errors.Is(err, internal.ErrFileExists) {
+		t.Fatalf("rename with every suffix taken: err = %v, want %v", err, internal.ErrFileExists)
+	}
+}
+
+func TestTruncateFilename(t *testing.T) {
+	t.Parallel()
+
+	short := filepath.Join("videos", "alice_2024-01-01_00-00-00")
+	if got, truncated := truncateFilename(short, 100, 0); truncated || got != short {
+		t.Fatalf("short: got %q, %v, want it unchanged", got, truncated)
+	}
+
+	long := strings.Repeat("é", 100) + "_2024-01-01_00-00-00"
+	got, truncated := truncateFilename(filepath.Join("videos", long), 100, 0)
+	if !truncated {
+		t.Fatal("long: expected the filename to be truncated")
+	}
+	name := filepath.Base(got)
+	if len(name) > 100 || !utf8.ValidString(name) || filepath.Dir(got) != "videos" {
+		t.Fatalf("long: got %q (%d bytes), want a valid name of at most 100 bytes in videos", got, len(name))
+	}
+
+	// Names sharing the kept prefix must not collide
+	other, _ := truncateFilename(filepath.Join("videos", long+"_1"), 100, 0)
+	if other == got {
+		t.Fatalf("truncated names collide: %q", got)
+	}
+
+	abs, err := filepath.Abs(got)
+	if err != nil {
+		t.Fatalf("Abs() error = %v", err)
+	}
+	maxPath := len(abs) - 10
+	limited, _ := truncateFilename(got, 100, maxPath)
+	if limitedAbs, _ := filepath.Abs(limited); len(limitedAbs) > maxPath {
+		t.Fatalf("path limit: got %q (%d bytes), want at most %d bytes", limitedAbs, len(limitedAbs), maxPath)
+	}
+}
+
+func TestFFmpegErrorLines(t *testing.T) {
+	t.Parallel()
+
+	output := []byte(`ffmpeg version 7.0
+[h264_nvenc @ 0x1] OpenEncodeSessionEx failed: unsupported device (2): (no details)
+[h264_nvenc @ 0x1] No capable devices found
+[vost#0:0/h264_nvenc @ 0x2] Error while opening encoder - maybe incorrect parameters such as bit_rate, rate, width or height.
+Conversion failed!
+`)
+	got := ffmpegErrorLines(output)
+	if len(got) != 3 || !strings.Contains(got[0], "OpenEncodeSessionEx") || !strings.Contains(got[2], "Error while opening encoder") {
+		t.Fatalf("ffmpegErrorLines() = %q, want the 3 encoder errors", got)
+	}
+	if got := ffmpegErrorLines([]byte("Conversion failed!\n")); len(got) != 0 {
+		t.Fatalf("ffmpegErrorLines() = %q, want none for unknown errors", got)
+	}
+}
+
+func TestUpdateFetchStatsWarnsWhenFallingBehind(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+
+	for i := 0; i < 5; i++ {
+		ch.updateFetchStats(500*time.Millisecond, 2)
+	}
+	if ch.FetchAvg != 0.5 || ch.FetchMax != 0.5 || ch.FetchRatio != 0.25 || ch.fetchWarned {
+		t.Fatalf("avg %.2f, max %.2f, ratio %.2f, warned %v, want 0.5, 0.5, 0.25 and no warning", ch.FetchAvg, ch.FetchMax, ch.FetchRatio, ch.fetchWarned)
+	}
+
+	// 20 segments of 2s taking 2s each push the ratio of the 25 segments over the warning threshold
+	for i := 0; i < 20; i++ {
+		ch.updateFetchStats(2*time.Second, 2)
+	}
+	if ch.FetchMax != 2 || ch.FetchRatio < fetchRatioWarn || !ch.fetchWarned {
+		t.Fatalf("max %.2f, ratio %.2f, warned %v, want 2, >= %.2f and a warning", ch.FetchMax, ch.FetchRatio, ch.fetchWarned, fetchRatioWarn)
+	}
+
+	// Fast segments fill the window and clear the warning
+	for i := 0; i < fetchWindow; i++ {
+		ch.updateFetchStats(100*time.Millisecond, 2)
+	}
+	if ch.FetchMax != 0.1 || ch.fetchWarned || len(ch.fetchSamples) != fetchWindow {
+		t.Fatalf("max %.2f, warned %v, samples %d, want 0.1, no warning and %d samples", ch.FetchMax, ch.fetchWarned, len(ch.fetchSamples), fetchWindow)
+	}
+}
+
+func TestMoveToOutputDirUsesChannelOutputDir(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "recording.mp4")
+	if err := os.WriteFile(src, []byte("video"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	outputDir := filepath.Join(dir, "archive")
+	ch := New(&entity.ChannelConfig{Username: "alice", OutputDir: outputDir})
+
+	if got, want := ch.moveToOutputDir(src), filepath.Join(outputDir, "recording.mp4"); got != want {
+		t.Fatalf("moveToOutputDir() = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "recording.mp4")); err != nil {
+		t.Fatalf("expected the recording in the channel output dir: %v", err)
+	}
+}
+
+func TestWriteChecksum(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "recording.mkv")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	ch.WriteChecksum(path)
+
+	got, err := os.ReadFile(path + ".sha256")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad  recording.mkv\n"
+	if string(got) != want {
+		t.Fatalf("checksum file = %q, want %q", got, want)
+	}
+}
+
+func TestIdleTimedOut(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	ch.Duration = 10
+	ch.lastSegmentAt = time.Now().Add(-2 * time.Minute)
+
+	if ch.idleTimedOut(0) {
+		t.Fatal("idleTimedOut(0) = true, want false when disabled")
+	}
+	if ch.idleTimedOut(5 * time.Minute) {
+		t.Fatal("idleTimedOut(5m) = true, want false before the timeout")
+	}
+	if !ch.idleTimedOut(time.Minute) {
+		t.Fatal("idleTimedOut(1m) = false, want true after the timeout")
+	}
+	// A finalized file has no duration, it's not split again while the stream stays idle
+	ch.Duration = 0
+	if ch.idleTimedOut(time.Minute) {
+		t.Fatal("idleTimedOut(1m) = true, want false for an empty file")
+	}
+}
+
+func TestRecheckRefusesWhileRecordingOrPaused(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	ch.recording.Store(true) // set by RecordStream
+	if err := ch.Recheck(); !errors.Is(err, internal.ErrChannelRecording) {
+		t.Fatalf("Recheck() error = %v, want %v", err, internal.ErrChannelRecording)
+	}
+
+	ch.Config.IsPaused = true
+	if err := ch.Recheck(); !errors.Is(err, internal.ErrPaused) {
+		t.Fatalf("Recheck() error = %v, want %v", err, internal.ErrPaused)
+	}
+}
+
+func TestNextChunkBoundary(t *testing.T) {
+	t.Parallel()
+
+	at := func(hour, min, sec int) time.Time { return time.Date(2024, 1, 2, hour, min, sec, 0, time.UTC) }
+	tests := []struct {
+		now   time.Time
+		chunk time.Duration
+		want  time.Time
+	}{
+		{at(10, 7, 0), 30 * time.Minute, at(10, 30, 0)},
+		{at(10, 30, 0), 30 * time.Minute, at(11, 0, 0)},
+		{at(10, 59, 59), time.Hour, at(11, 0, 0)},
+		{at(23, 50, 0), 45 * time.Minute, at(24, 0, 0)},
+		// 25 minutes doesn't divide a day, the last chunk of the day is cut at midnight
+		{at(23, 55, 0), 25 * time.Minute, at(24, 0, 0)},
+	}
+	for _, tt := range tests {
+		if got := nextChunkBoundary(tt.now, tt.chunk); !got.Equal(tt.want) {
+			t.Errorf("nextChunkBoundary(%s, %s) = %s, want %s", tt.now.Format(time.TimeOnly), tt.chunk, got, tt.want)
+		}
+	}
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	ch.chunkEndsAt = time.Now().Add(-time.Second)
+	if ch.ShouldSwitchFile() {
+		t.Fatal("ShouldSwitchFile() = true, want false for an empty file")
+	}
+	ch.Duration = 4
+	if !ch.ShouldSwitchFile() {
+		t.Fatal("ShouldSwitchFile() = false, want true past the chunk boundary")
+	}
+}
+
+func TestShortBroadcast(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	ch.Sequence = 1 // NextFile counts the file being written
+	ch.Duration = 8
+
+	// A split while the stream goes on keeps the file
+	if ch.shortBroadcast(10) {
+		t.Fatal("shortBroadcast(10) = true, want false while the stream goes on")
+	}
+	ch.streamEnding = true
+	if ch.shortBroadcast(0) {
+		t.Fatal("shortBroadcast(0) = true, want false when disabled")
+	}
+	if !ch.shortBroadcast(10) {
+		t.Fatal("shortBroadcast(10) = false, want true for an 8s broadcast")
+	}
+	if ch.shortBroadcast(5) {
+		t.Fatal("shortBroadcast(5) = true, want false for an 8s broadcast")
+	}
+	// The last part of a split broadcast is kept
+	ch.Sequence = 2
+	if ch.shortBroadcast(10) {
+		t.Fatal("shortBroadcast(10) = true, want false for the second file")
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name string, modTime time.Time) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0666); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Chtimes() error = %v", err)
+		}
+		return path
+	}
+	old := time.Now().Add(-time.Hour)
+	ts := write("alice_1.ts", old)
+	write("alice_1"+recordingMarkerExt, old)
+	video := write("alice_2.video.mp4", old)
+	write("alice_2.audio.mp4", old)
+	write("alice_3.mkv", old)
+	write("done/alice_4.ts", old)
+	write("done/alice_4"+recordingMarkerExt, old)
+	write("alice_5.ts", time.Now().Add(time.Minute)) // written by this run
+	write("alice_5"+recordingMarkerExt, time.Now().Add(time.Minute))
+	write("alice_6.mp4", old)       // finalized, without a marker
+	write("alice_7.video.mp4", old) // kept video-only after the audio track went missing
+
+	got, err := FindOrphans(dir, []string{filepath.Join(dir, "done")}, time.Now())
+	if err != nil {
+		t.Fatalf("FindOrphans() error = %v", err)
+	}
+	if want := []string{ts, video}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("FindOrphans() = %v, want %v", got, want)
+	}
+}
+
+func TestRecordingMarkerIsRemovedOnceFinalized(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ch := New(&entity.ChannelConfig{Username: "alice", Pattern: filepath.Join(dir, "recording")})
+	ch.CurrentFilename = filepath.Join(dir, "recording")
+	if err := ch.CreateNewFile(ch.CurrentFilename); err != nil {
+		t.Fatalf("CreateNewFile() error = %v", err)
+	}
+	marker := recordingMarker(ch.CurrentFilename)
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("marker while recording: %v", err)
+	}
+	if err := ch.Cleanup(); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("marker after Cleanup: err = %v, want it removed", err)
+	}
+}
+
+func TestFindSelfTestOutput(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if _, err := findSelfTestOutput(dir); err == nil || !strings.Contains(err.Error(), "no recording") {
+		t.Fatalf("findSelfTestOutput() error = %v, want no recording", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "self-test_0.ts"), []byte("data"), 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := findSelfTestOutput(dir); err == nil || !strings.Contains(err.Error(), "compression failed") {
+		t.Fatalf("findSelfTestOutput() error = %v, want compression failed", err)
+	}
+	mkv := filepath.Join(dir, "self-test_0.mkv")
+	if err := os.WriteFile(mkv, []byte("data"), 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if got, err := findSelfTestOutput(dir); err != nil || got != mkv {
+		t.Fatalf("findSelfTestOutput() = %q, %v, want %q", got, err, mkv)
+	}
+}
+
+func TestWholeFileBufferFallsBackToStreaming(t *testing.T) {
+	t.Parallel()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "alice_0.ts"))
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	defer file.Close()
+	size := func() int64 {
+		info, err := file.Stat()
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		return info.Size()
+	}
+
+	var overflows int
+	buf := &wholeFileBuffer{limit: 8, onOverflow: func() { overflows++ }}
+	for _, segment := range []string{"aaa", "bbb"} {
+		if _, err := buf.Write(file, []byte(segment)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if size() != 0 {
+		t.Fatalf("file size = %d before the flush, want 0", size())
+	}
+
+	// Exceeding the limit writes the buffer out, later segments go to the file directly
+	for _, segment := range []string{"ccc", "ddd"} {
+		if _, err := buf.Write(file, []byte(segment)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := buf.Flush(file); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	b, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(b) != "aaabbbcccddd" || overflows != 1 {
+		t.Fatalf("file = %q with %d overflow(s), want %q with 1", b, overflows, "aaabbbcccddd")
+	}
+}
+
+// Not parallel, it sets server.Config for the requests.
+func TestConfirmResolutionWaitsForRampUp(t *testing.T) {
+	previous := server.Config
+	server.Config = &entity.Config{}
+	t.Cleanup(func() { server.Config = previous })
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		variant := "#EXT-X-STREAM-INF:BANDWIDTH=400000,RESOLUTION=426x240\nlow.m3u8\n"
+		if requests.Add(1) > 2 {
+			variant += "#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720\nhigh.m3u8\n"
+		}
+		_, _ = w.Write([]byte("#EXTM3U\n" + variant))
+	}))
+	t.Cleanup(srv.Close)
+
+	ch := New(&entity.ChannelConfig{Username: "alice", Resolution: 1080})
+	stream := &chaturbate.Stream{HLSSource: srv.URL + "/master.m3u8"}
+	playlist, err := stream.GetPlaylist(context.Background(), 1080, chaturbate.FramerateAny, 0)
+	if err != nil {
+		t.Fatalf("GetPlaylist() error = %v", err)
+	}
+
+	// The second poll ramps up to 720p, which restarts the window
+	start := time.Now()
+	window := 300 * time.Millisecond
+	got, err := ch.confirmResolution(context.Background(), stream, playlist, window, 0)
+	if err != nil {
+		t.Fatalf("confirmResolution() error = %v", err)
+	}
+	if got.Resolution != 720 || time.Since(start) < window+window/3 {
+		t.Fatalf("confirmResolution() = %dp after %s, want 720p after the window restarted", got.Resolution, time.Since(start))
+	}
+
+	// A stream below the minimum isn't confirmed
+	if _, err := ch.confirmResolution(context.Background(), stream, playlist, window, 1080); !errors.Is(err, internal.ErrResolutionTooLow) {
+		t.Fatalf("confirmResolution() error = %v, want %v", err, internal.ErrResolutionTooLow)
+	}
+}
+
+func TestSFTPBatch(t *testing.T) {
+	t.Parallel()
+
+	for _, dest := range []string{"host", "user@:/videos", ":/videos"} {
+		if _, _, err := internal.ParseSFTPDestination(dest); err == nil {
+			t.Fatalf("ParseSFTPDestination(%q) error = nil, want an error", dest)
+		}
+	}
+	host, dir, err := internal.ParseSFTPDestination("user@nas:/videos/dvr")
+	if err != nil || host != "user@nas" || dir != "/videos/dvr" {
+		t.Fatalf("ParseSFTPDestination() = %q, %q, %v", host, dir, err)
+	}
+
+	got := sftpBatch(dir+"/alice", []string{"/tmp/alice_2024 \"1\".mkv"})
+	want := `-mkdir "/videos"
+-mkdir "/videos/dvr"
+-mkdir "/videos/dvr/alice"
+put "/tmp/alice_2024 \"1\".mkv" "/videos/dvr/alice/alice_2024 \"1\".mkv.part"
+-rm "/videos/dvr/alice/alice_2024 \"1\".mkv"
+rename "/videos/dvr/alice/alice_2024 \"1\".mkv.part" "/videos/dvr/alice/alice_2024 \"1\".mkv"
+`
+	if got != want {
+		t.Fatalf("sftpBatch() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHandleSubtitleSegmentRetimesCues(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	ch.CurrentFilename = filepath.Join(t.TempDir(), "alice_0")
+
+	// The segments are 4s long, the first has no cue so the first cue is placed 4s into the file
+	segments := []string{
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n",
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\nNOTE a comment\n\n1\n00:00:04.500 --> 00:00:09.000 align:center\nHello\nthere\n",
+		"WEBVTT\r\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\r\n\r\n00:00:04.500 --> 00:00:09.000 align:center\r\nHello\r\nthere\r\n\r\n00:09.000 --> 00:10.000\r\nBye\r\n",
+	}
+	for _, segment := range segments {
+		if err := ch.HandleSubtitleSegment([]byte(segment), 4); err != nil {
+			t.Fatalf("HandleSubtitleSegment() error = %v", err)
+		}
+	}
+	path := ch.CurrentFilename + ".vtt"
+	ch.closeSubtitles()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	want := "WEBVTT\n\n00:00:04.000 --> 00:00:08.500 align:center\nHello\nthere\n\n00:00:08.500 --> 00:00:09.500\nBye\n\n"
+	if string(b) != want {
+		t.Fatalf("sidecar =\n%q\nwant\n%q", b, want)
+	}
+}
+
+func TestContinueStreamResumesSameSource(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	prev := &chaturbate.Playlist{PlaylistURL: "https://edge1.example.com/live/alice/chunklist.m3u8?token=a", LastSeq: 41, AudioLastSeq: 40}
+	prev.OnDiscontinuity = ch.HandleDiscontinuity
+
+	next := &chaturbate.Playlist{PlaylistURL: "https://edge1.example.com/live/alice/chunklist.m3u8?token=b", LastSeq: -1, AudioLastSeq: -1}
+	if err := ch.continueStream(prev, next); err != nil {
+		t.Fatalf("continueStream() error = %v", err)
+	}
+	if next.LastSeq != 41 || next.AudioLastSeq != 40 || next.OnDiscontinuity == nil {
+		t.Fatalf("same source: LastSeq = %d, AudioLastSeq = %d, want 41, 40 and the handlers", next.LastSeq, next.AudioLastSeq)
+	}
+
+	// Another edge numbers the segments on its own
+	other := &chaturbate.Playlist{PlaylistURL: "https://edge2.example.com/live/alice/chunklist.m3u8", LastSeq: -1, AudioLastSeq: -1}
+	if err := ch.continueStream(next, other); err != nil {
+		t.Fatalf("continueStream() error = %v", err)
+	}
+	if other.LastSeq != -1 || other.AudioLastSeq != -1 {
+		t.Fatalf("other source: LastSeq = %d, AudioLastSeq = %d, want -1", other.LastSeq, other.AudioLastSeq)
+	}
+}
+
+// Not parallel, it sets server.Config for --timestamps.
+func TestTimestampArgsOnlyForTS(t *testing.T) {
+	previous := server.Config
+	server.Config = &entity.Config{Timestamps: entity.TimestampsRegenerate}
+	t.Cleanup(func() { server.Config = previous })
+
+	if got := strings.Join(timestampInputArgs("/videos/alice_0.ts"), " "); got != "-fflags +genpts" {
+		t.Fatalf("timestampInputArgs(.ts) = %q, want %q", got, "-fflags +genpts")
+	}
+	if got := strings.Join(timestampOutputArgs("/videos/alice_0.ts"), " "); got != "-avoid_negative_ts make_zero" {
+		t.Fatalf("timestampOutputArgs(.ts) = %q, want %q", got, "-avoid_negative_ts make_zero")
+	}
+	// fMP4 recordings carry the timestamps of their fragments
+	if args := timestampInputArgs("/videos/alice_0.mp4"); args != nil {
+		t.Fatalf("timestampInputArgs(.mp4) = %q, want none", args)
+	}
+
+	server.Config.Timestamps = entity.TimestampsKeep
+	if args := timestampInputArgs("/videos/alice_0.ts"); args != nil {
+		t.Fatalf("timestampInputArgs() with keep = %q, want none", args)
+	}
+}
+
+func TestPatternTimestampIsISO8601(t *testing.T) {
+	t.Parallel()
+
+	ch := &Channel{Config: &entity.ChannelConfig{Username: "alice"}, StreamedAt: 1704203100}
+	p := ch.pattern()
+	got, err := time.Parse("20060102T150405-0700", p.ISO8601)
+	if err != nil {
+		t.Fatalf("ISO8601 = %q: %v", p.ISO8601, err)
+	}
+	if got.Unix() != ch.StreamedAt {
+		t.Fatalf("ISO8601 = %q, want unix %d", p.ISO8601, ch.StreamedAt)
+	}
+	if !strings.HasSuffix(p.ISO8601, p.Timezone) {
+		t.Fatalf("ISO8601 = %q, want the offset %q", p.ISO8601, p.Timezone)
+	}
+}
+
+func TestVariantChannelRecordsToOwnFile(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice", Resolution: 1080, Resolutions: []int{480}, Pattern: "{{.Username}}_{{.Year}}"})
+	ch.StreamedAt = 1704203100
+	variant := ch.variantChannel(480)
+	if variant.Config.Resolution != 480 || len(variant.Config.Resolutions) != 0 {
+		t.Fatalf("variant config = %dp %v, want 480p without resolutions", variant.Config.Resolution, variant.Config.Resolutions)
+	}
+	if ch.Config.Resolution != 1080 {
+		t.Fatalf("main resolution = %dp, want 1080p", ch.Config.Resolution)
+	}
+
+	main, err := ch.GenerateFilename()
+	if err != nil {
+		t.Fatalf("GenerateFilename() error = %v", err)
+	}
+	got, err := variant.GenerateFilename()
+	if err != nil {
+		t.Fatalf("variant GenerateFilename() error = %v", err)
+	}
+	if got != main+"_480p" {
+		t.Fatalf("variant filename = %q, want %q", got, main+"_480p")
+	}
+}
+
+// Not parallel, it sets server.Config and PATH.
+func TestCodecAvailableTimesOut(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as ffmpeg")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\nexec /bin/sleep 10\n"), 0755); err != nil {
+		t.Fatalf("write fake ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", dir)
+
+	previous := server.Config
+	server.Config = &entity.Config{EncoderDetectTimeout: 1}
+	t.Cleanup(func() { server.Config = previous })
+
+	start := time.Now()
+	if codecAvailable("h264_nvenc") {
+		t.Fatal("codecAvailable() = true for a hanging probe, want false")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Fatalf("codecAvailable() took %s, want about the 1s timeout", elapsed)
+	}
+}
+
+// Not parallel, it sets server.Config for the dormant interval.
+func TestMarkRegionLockedAfterConsecutiveChecks(t *testing.T) {
+	previous := server.Config
+	server.Config = &entity.Config{DormantInterval: 60}
+	t.Cleanup(func() { server.Config = previous })
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	for i := 1; i < regionLockAfter; i++ {
+		ch.markRegionLocked()
+		if ch.IsRegionLocked {
+			t.Fatalf("region-locked after %d check(s), want %d", i, regionLockAfter)
+		}
+	}
+	ch.RoomStatus = chaturbate.StatusPublic
+	ch.markRegionLocked()
+	if !ch.IsRegionLocked || ch.RoomStatus != chaturbate.StatusRegionLocked {
+		t.Fatalf("IsRegionLocked = %v, RoomStatus = %q, want locked", ch.IsRegionLocked, ch.RoomStatus)
+	}
+
+	// An offline check in between replaces the status, the next locked check restores it
+	ch.RoomStatus = chaturbate.StatusOffline
+	ch.markRegionLocked()
+	if ch.RoomStatus != chaturbate.StatusRegionLocked {
+		t.Fatalf("RoomStatus = %q, want %q", ch.RoomStatus, chaturbate.StatusRegionLocked)
+	}
+
+	ch.markOnline()
+	if ch.IsRegionLocked || ch.lockedChecks != 0 {
+		t.Fatalf("after markOnline IsRegionLocked = %v, lockedChecks = %d, want reset", ch.IsRegionLocked, ch.lockedChecks)
+	}
+}
+
+func TestFFmpegWarningsSummary(t *testing.T) {
+	t.Parallel()
+
+	output := []byte(strings.Join([]string{
+		"Input #0, mpegts, from 'alice.ts':",
+		"[h264 @ 0x1] error while decoding MB 12 34, bytestream -5",
+		"[h264 @ 0x1] concealing 120 DC, 120 AC, 120 MV errors in P frame",
+		"[mpegts @ 0x2] Packet corrupt (stream = 0, dts = 900000).",
+		"    Last message repeated 2 times",
+		"[matroska @ 0x3] Application provided invalid, non monotonically increasing dts to muxer in stream 1: 100 >= 90",
+		"[h264 @ 0x1] error while decoding MB 1 2, bytestream -3",
+		"video:1024kB audio:128kB subtitle:0kB other streams:0kB global headers:0kB muxing overhead: 0.5%",
+	}, "\n"))
+	want := "2 decode error(s), 3 corrupt packet(s), 1 non-monotonic timestamp(s), 1 concealed error(s)"
+	if got := ffmpegWarnings(output); got != want {
+		t.Fatalf("ffmpegWarnings() = %q, want %q", got, want)
+	}
+	if got := ffmpegWarnings([]byte("video:1024kB audio:128kB")); got != "" {
+		t.Fatalf("ffmpegWarnings() of a clean run = %q, want empty", got)
+	}
+}
+
+// Not parallel, it sets server.Config for --split-on-resolution-change.
+func TestContinuousKeepsFileAcrossQualityChange(t *testing.T) {
+	previous := server.Config
+	server.Config = &entity.Config{Continuous: true}
+	t.Cleanup(func() { server.Config = previous })
+
+	ch := New(&entity.ChannelConfig{Username: "alice", Pattern: filepath.Join(t.TempDir(), "alice")})
+	ch.CurrentFilename = "alice_0"
+	ch.Duration = 10
+	ch.HasSeparateAudio = true
+	ch.InitSegment, ch.AudioInitSegment = []byte("video init"), []byte("audio init")
+	t.Cleanup(func() { _ = ch.Cleanup() })
+
+	if err := ch.HandleDiscontinuity(42); err != nil || ch.CurrentFilename != "alice_0" || ch.switchRequested {
+		t.Fatalf("HandleDiscontinuity() = %v, file %q, switchRequested %v, want the same file", err, ch.CurrentFilename, ch.switchRequested)
+	}
+	if err := ch.HandleVariantSwitch(480, 30, true); err != nil || ch.CurrentFilename != "alice_0" {
+		t.Fatalf("HandleVariantSwitch() = %v, file %q, want the same file", err, ch.CurrentFilename)
+	}
+	if string(ch.InitSegment) != "video init" {
+		t.Fatalf("InitSegment = %q, want it kept to compare the new one", ch.InitSegment)
+	}
+
+	// The same init segment continues, another one can't be decoded by the current file
+	if err := ch.HandleInitSegment([]byte("video init")); err != nil || ch.switchRequested {
+		t.Fatalf("HandleInitSegment(same) = %v, switchRequested %v, want none", err, ch.switchRequested)
+	}
+	if err := ch.HandleAudioInitSegment([]byte("other audio init")); err != nil || ch.CurrentFilename == "alice_0" {
+		t.Fatalf("HandleAudioInitSegment(other) = %v, file %q, want a new file", err, ch.CurrentFilename)
+	}
+
+	// Splitting on quality changes keeps the audio file as it was before the option
+	server.Config = &entity.Config{Continuous: false}
+	ch.Duration = 10
+	file := ch.CurrentFilename
+	if err := ch.HandleAudioInitSegment([]byte("third audio init")); err != nil || ch.CurrentFilename != file {
+		t.Fatalf("HandleAudioInitSegment(other) without continuous = %v, file %q, want %q", err, ch.CurrentFilename, file)
+	}
+}
+
+func TestCheckScheduleSkipsOutsideMinutes(t *testing.T) {
+	t.Parallel()
+
+	ch := &Channel{Config: &entity.ChannelConfig{Username: "alice", Schedule: "0 18-23 * * FRI,SAT"}}
+	sched := ch.parseSchedule()
+	if sched == nil {
+		t.Fatal("parseSchedule() = nil, want the schedule")
+	}
+
+	// Thursday 2024-01-04 12:30, the next check is Friday 18:00
+	thursday := time.Date(2024, 1, 4, 12, 30, 0, 0, time.UTC)
+	if err := ch.checkSchedule(sched, thursday); !errors.Is(err, internal.ErrOutsideSchedule) {
+		t.Fatalf("checkSchedule(thursday) = %v, want ErrOutsideSchedule", err)
+	}
+	want := time.Date(2024, 1, 5, 18, 0, 0, 0, time.UTC)
+	if !ch.nextCheck.Equal(want) {
+		t.Fatalf("nextCheck = %v, want %v", ch.nextCheck, want)
+	}
+	if info := ch.ExportInfo(); info.NextCheck != formatTimestamp(want) {
+		t.Fatalf("ExportInfo().NextCheck = %q, want %q", info.NextCheck, formatTimestamp(want))
+	}
+
+	if err := ch.checkSchedule(sched, time.Date(2024, 1, 5, 18, 0, 0, 0, time.UTC)); err != nil || !ch.nextCheck.IsZero() {
+		t.Fatalf("checkSchedule(friday 18:00) = %v, nextCheck %v, want a check", err, ch.nextCheck)
+	}
+	if err := ch.checkSchedule(nil, thursday); err != nil {
+		t.Fatalf("checkSchedule(no schedule) = %v, want a check", err)
+	}
+}
+
+func TestHandleSegmentSplitsOnContentDuration(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ch := New(&entity.ChannelConfig{
+		Username:    "alice",
+		Pattern:     filepath.Join(dir, "content{{if .Sequence}}_{{.Sequence}}{{end}}"),
+		MaxDuration: 1, // minute
+	})
+	ch.StreamedAt = 1
+
+	if err := ch.NextFile(); err != nil {
+		t.Fatalf("NextFile() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ch.Cleanup() })
+	firstName := ch.File.Name()
+
+	// 29 segments of 2.04s are 59.16s of content, written in no time at all
+	for i := 0; i < 29; i++ {
+		if err := ch.HandleSegment([]byte("segment"), 2.04); err != nil {
+			t.Fatalf("HandleSegment(%d) error = %v", i, err)
+		}
+	}
+	if ch.File.Name() != firstName {
+		t.Fatalf("file rotated after %.2fs of content, want after 60s", ch.Duration)
+	}
+
+	if err := ch.HandleSegment([]byte("segment"), 2.04); err != nil {
+		t.Fatalf("HandleSegment() error = %v", err)
+	}
+	if ch.File.Name() == firstName {
+		t.Fatalf("file not rotated after 61.2s of content (still %q)", firstName)
+	}
+	if ch.Duration != 0 {
+		t.Fatalf("Duration = %v after the rotation, want 0", ch.Duration)
+	}
+}
+
+// Not parallel, it sets server.Config for --trim-start.
+func TestTrimStartDropsSegmentsWithinIt(t *testing.T) {
+	previous := server.Config
+	server.Config = &entity.Config{TrimStart: 5}
+	t.Cleanup(func() { server.Config = previous })
+
+	dir := t.TempDir()
+	ch := New(&entity.ChannelConfig{Username: "alice", Pattern: filepath.Join(dir, "trim")})
+	ch.StreamedAt = 1
+	ch.armTrimStart(false)
+	if err := ch.NextFile(); err != nil {
+		t.Fatalf("NextFile() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ch.Cleanup() })
+
+	// 0-2s and 2-4s end within 5s, 4-6s is the first one kept
+	for _, segment := range []string{"a", "b", "c", "d"} {
+		if err := ch.HandleSegment([]byte(segment), 2); err != nil {
+			t.Fatalf("HandleSegment(%s) error = %v", segment, err)
+		}
+	}
+	if ch.Duration != 4 || ch.Filesize != 2 {
+		t.Fatalf("Duration = %v, Filesize = %d, want the last 2 segments", ch.Duration, ch.Filesize)
+	}
+
+	// A reconnected stream isn't trimmed again, neither is a restart within the same broadcast
+	for _, resumed := range []bool{true, false} {
+		ch.armTrimStart(resumed)
+		if trimSegment(&ch.trimVideo, 2) || trimSegment(&ch.trimAudio, 2) {
+			t.Fatalf("trimSegment() = true after a restart (resumed %t), want nothing dropped", resumed)
+		}
+	}
+	// The next broadcast is trimmed once the last one ended
+	ch.broadcastEnded()
+	ch.armTrimStart(false)
+	if !trimSegment(&ch.trimVideo, 2) {
+		t.Fatal("trimSegment() = false after the broadcast ended, want the start of the next one dropped")
+	}
+	ch.broadcastEnded()
+	ch.armTrimStart(true)
+	if trimSegment(&ch.trimVideo, 2) {
+		t.Fatal("trimSegment() = true for a resumed stream, want nothing dropped")
+	}
+
+	remaining := 5.0
+	if trimSegment(&remaining, 0) || remaining != 0 {
+		t.Fatalf("trimSegment(no duration) dropped it or kept trimming, remaining %v", remaining)
+	}
+}
+
+func TestGrabPosterKeepsTheMostDetailedFrame(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as ffmpeg")
+	}
+	bin := t.TempDir()
+	// The fake ffmpeg "decodes" the segment by copying it to the output, the last argument
+	script := "#!/bin/sh\nfor last; do :; done\nexec /bin/cat > \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("write fake ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", bin)
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	path := filepath.Join(t.TempDir(), "alice_0.poster.jpg")
+
+	for _, tt := range []struct {
+		frame        string
+		wantReplaced bool
+		want         string
+	}{
+		{"dark", true, "dark"},
+		{"detailed frame", true, "detailed frame"},
+		{"blurry", false, "detailed frame"},
+	} {
+		replaced, err := ch.grabPoster(path, []byte(tt.frame))
+		if err != nil {
+			t.Fatalf("grabPoster(%q) error = %v", tt.frame, err)
+		}
+		if b, _ := os.ReadFile(path); replaced != tt.wantReplaced || string(b) != tt.want {
+			t.Fatalf("grabPoster(%q) = %v, poster %q, want %v, %q", tt.frame, replaced, b, tt.wantReplaced, tt.want)
+		}
+	}
+	if _, err := os.Stat(strings.TrimSuffix(path, ".jpg") + ".part.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("the grabbed frame is left behind, stat error = %v", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "alice_0.mp4")
+	ch.movePoster(strings.TrimSuffix(path, ".poster.jpg")+".mp4", dest)
+	if _, err := os.Stat(posterPath(dest)); err != nil {
+		t.Fatalf("poster not moved along with the recording: %v", err)
+	}
+}
+
+// Not parallel, it sets server.Config for --compress-min-duration and --compress-min-size.
+func TestCompressWorthwhileChecksThresholds(t *testing.T) {
+	previous := server.Config
+	server.Config = &entity.Config{CompressMinDuration: 60, CompressMinSize: 1}
+	t.Cleanup(func() { server.Config = previous })
+
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.ts")
+	large := filepath.Join(dir, "large.ts")
+	if err := os.WriteFile(small, make([]byte, 1024), 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := os.WriteFile(large, make([]byte, 2*1024*1024), 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	for _, tc := range []struct {
+		path     string
+		duration float64
+		want     bool
+	}{
+		{large, 120, true},
+		{large, 30, false},  // too short
+		{small, 120, false}, // too small
+		{large, 0, true},    // unknown duration, e.g. a recovered file
+	} {
+		if got := ch.compressWorthwhile(tc.path, tc.duration); got != tc.want {
+			t.Errorf("compressWorthwhile(%s, %v) = %v, want %v", filepath.Base(tc.path), tc.duration, got, tc.want)
+		}
+	}
+}
+
+// Not parallel, it sets server.Config for the files of a daily window.
+func TestOutsideWindowFinalizesAndStartsFiles(t *testing.T) {
+	previous := server.Config
+	server.Config = &entity.Config{}
+	t.Cleanup(func() { server.Config = previous })
+
+	dir := t.TempDir()
+	ch := New(&entity.ChannelConfig{Username: "alice", Pattern: filepath.Join(dir, "window"), Window: "10:00-11:00 UTC"})
+	ch.window = ch.parseWindow()
+	if err := ch.NextFile(); err != nil {
+		t.Fatalf("NextFile() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ch.Cleanup() })
+
+	at := func(hour, minute int) time.Time { return time.Date(2024, 1, 5, hour, minute, 0, 0, time.UTC) }
+	if outside, err := ch.outsideWindow(at(9, 59)); !outside || err != nil {
+		t.Fatalf("outsideWindow(09:59) = %v, %v, want the segment dropped", outside, err)
+	}
+	if err := ch.HandleAudioSegment([]byte("audio"), 2); err != nil || ch.Filesize != 0 {
+		t.Fatalf("HandleAudioSegment() outside the window = %v, filesize %d, want it dropped", err, ch.Filesize)
+	}
+	if outside, err := ch.outsideWindow(at(10, 0)); outside || err != nil {
+		t.Fatalf("outsideWindow(10:00) = %v, %v, want the segment written", outside, err)
+	}
+
+	// The recorded file is finalized when the window ends
+	ch.Duration = 2
+	if outside, err := ch.outsideWindow(at(11, 0)); !outside || err != nil || ch.Duration != 0 {
+		t.Fatalf("outsideWindow(11:00) = %v, %v, duration %v, want the file finalized", outside, err, ch.Duration)
+	}
+	if !ch.ExportInfo().OutsideWindow {
+		t.Fatal("ExportInfo().OutsideWindow = false outside the window")
+	}
+}
+
+func TestMonitorExitClearsIsMonitoring(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// As startMonitor registers it, the monitoring exits right away on the canceled context
+	done := make(chan struct{})
+	ch.isMonitoring.Store(true)
+	ch.monitorDone = done
+	ch.monitors.Add(1)
+	ch.Monitor(ctx, done)
+
+	select {
+	case <-done:
+	default:
+		t.Fatal("Monitor() returned without closing done")
+	}
+	if ch.isMonitoring.Load() {
+		t.Fatal("isMonitoring = true after Monitor exited, Resume would never start it again")
+	}
+	ch.monitors.Wait()
+}
+
+func TestStopMonitorWaitsForPreviousMonitor(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&entity.ChannelConfig{Username: "alice"})
+	done := make(chan struct{})
+	var exited atomic.Bool
+	ch.monitorDone = done
+	// The previous Monitor finalizes its file after the cancel, then exits
+	ch.CancelFunc = func() {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			exited.Store(true)
+			close(done)
+		}()
+	}
+
+	ch.controlMu.Lock()
+	ch.stopMonitor()
+	ch.controlMu.Unlock()
+	if !exited.Load() {
+		t.Fatal("stopMonitor() returned before the previous Monitor exited")
+	}
+}
+
+func TestApplyRuntimeKeepsChannelSettings(t *testing.T) {
+	t.Parallel()
+
+	prev := &entity.RuntimeConfig{MaxDuration: 60, MaxFilesize: 0, Compress: false}
+	next := &entity.RuntimeConfig{MaxDuration: 30, MaxFilesize: 2048, Compress: true}
+
+	defaults := New(&entity.ChannelConfig{Username: "alice", MaxDuration: 60})
+	if !defaults.ApplyRuntime(prev, next) {
+		t.Fatal("ApplyRuntime() = false, want the defaults applied")
+	}
+	if maxDuration, maxFilesize, compress := defaults.limits(); maxDuration != 30 || maxFilesize != 2048 || !compress {
+		t.Fatalf("limits() = %d, %d, %t, want the new defaults", maxDuration, maxFilesize, compress)
+	}
+
+	// The values set for the channel are kept
+	custom := New(&entity.ChannelConfig{Username: "bob", MaxDuration: 120, MaxFilesize: 500, Compress: true})
+	if custom.ApplyRuntime(prev, next) {
+		t.Fatal("ApplyRuntime() = true, want the values of the channel kept")
+	}
+	if conf := custom.ConfigCopy(); conf.MaxDuration != 120 || conf.MaxFilesize != 500 || !conf.Compress {
+		t.Fatalf("config = %+v, want it unchanged", conf)
+	}
+
+	// The new limit splits the current file
+	defaults.Duration = 31 * 60
+	if !defaults.ShouldSwitchFile() {
+		t.Fatal("ShouldSwitchFile() = false, want a split by the new max duration")
+	}
+}
+
+func TestCleanupWaitsForPosterGrab(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ch := New(&entity.ChannelConfig{Username: "alice", Pattern: filepath.Join(dir, "recording")})
+	ch.StreamedAt = 1
+	if err := ch.NextFile(); err != nil {
+		t.Fatalf("NextFile() error = %v", err)
+	}
+
+	// A grab still running when the file is finalized
+	ch.poster.grabs.Add(1)
+	cleaned := make(chan error, 1)
+	go func() { cleaned <- ch.Cleanup() }()
+
+	select {
+	case err := <-cleaned:
+		t.Fatalf("Cleanup() = %v before the poster grab finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ch.poster.grabs.Done()
+	select {
+	case err := <-cleaned:
+		if err != nil {
+			t.Fatalf("Cleanup() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cleanup() didn't return after the poster grab finished")
+	}
+}
+
+func TestTwoPassArgsPerCodec(t *testing.T) {
+	t.Parallel()
+
+	x264 := videoEncoder{"CPU", "libx264", []string{"-preset", "medium"}}
+	tests := []struct {
+		name      string
+		pass      int
+		extraArgs []string
+		want      string // the arguments following the encoder arguments
+	}{
+		{"libx264 first pass", 1, nil, "-pass 1 -passlogfile /tmp/a:b -an -f null " + os.DevNull},
+		{"libx264 second pass", 2, []string{"-tune", "film"}, "-pass 2 -passlogfile /tmp/a:b -b:v 2500k /out.mkv"},
+		{"libx265 first pass", 1, []string{"-c:v", "libx265"}, `-c:v libx265 -x265-params pass=1:stats=/tmp/a\:b -an -f null ` + os.DevNull},
+		{"libx265 second pass", 2, []string{"-c:v", "libx265"}, `-x265-params pass=2:stats=/tmp/a\:b -b:v 2500k /out.mkv`},
+	}
+	for _, tt := range tests {
+		args := twoPassArgs("/in.mp4", "/out.mkv", "/tmp/a:b", x264, tt.pass, tt.extraArgs, []string{"-b:v", "2500k"})
+		got := strings.Join(args, " ")
+		if _, after, ok := strings.Cut(got, "-c:v libx264 -preset medium "); !ok || after != tt.want {
+			t.Errorf("%s: twoPassArgs() = %q, want ... %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampJumpDetectsUntaggedJumps(t *testing.T) {
+	t.Parallel()
+
+	// A PSI packet without a PES start code, then a PES packet with its PTS after an adaptation field
+	segment := func(pts int64) []byte {
+		psi := make([]byte, 188)
+		psi[0], psi[1], psi[3] = 0x47, 0x40, 0x10
+		pes := make([]byte, 188)
+		pes[0], pes[1], pes[2], pes[3], pes[4] = 0x47, 0x41, 0x00, 0x30, 1
+		copy(pes[6:], []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+			byte(0x21 | pts>>29&0x0e), byte(pts >> 22), byte(pts>>14 | 1), byte(pts >> 7), byte(pts<<1 | 1)})
+		return append(psi, pes...)
+	}
+	if pts, ok := firstPTS(segment(ptsWrap - 1)); !ok || pts != ptsWrap-1 {
+		t.Fatalf("firstPTS() = %d, %v, want %d", pts, ok, int64(ptsWrap-1))
+	}
+	if _, ok := firstPTS([]byte("not a segment")); ok {
+		t.Fatal("firstPTS() of garbage = true, want false")
+	}
+
+	ch := &Channel{}
+	for i, step := range []struct {
+		pts  int64
+		want bool
+	}{
+		{pts: 900000}, // the first segment of the file has nothing to continue
+		{pts: 900000 + 180000},
+		{pts: 900000 + 2*180000 + 45000}, // within the tolerance
+		{pts: 5000, want: true},
+		{pts: 5000 + 180000},
+		{pts: ptsWrap - 90000, want: true},
+		{pts: 90000}, // wrapped around
+	} {
+		if got := ch.timestampJump(segment(step.pts), 2); got != step.want {
+			t.Errorf("segment %d: timestampJump() = %v, want %v", i, got, step.want)
+		}
+		ch.Duration += 2
+	}
+}
+
+func TestQueuedPipeWritesInOrderAndReportsStall(t *testing.T) {
+	t.Parallel()
+
+	pr, pw := io.Pipe()
+	p := newQueuedPipe(pw, 50*time.Millisecond)
+	read := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(pr)
+		read <- string(b)
+	}()
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := p.Write([]byte(s)); err != nil {
+			t.Fatalf("Write(%q) error = %v", s, err)
+		}
+	}
+	p.Close()
+	if got := <-read; got != "abc" {
+		t.Fatalf("read %q, want %q", got, "abc")
+	}
+
+	// Nothing reads, the queue fills up and the next write gives up instead of blocking
+	pr, pw = io.Pipe()
+	p = newQueuedPipe(pw, 50*time.Millisecond)
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		_, err = p.Write([]byte("segment"))
+	}
+	if !errors.Is(err, errPipeStalled) {
+		t.Fatalf("Write() to a stalled pipe error = %v, want %v", err, errPipeStalled)
+	}
+	if _, err := p.Write([]byte("segment")); !errors.Is(err, errPipeStalled) {
+		t.Fatalf("Write() after the stall error = %v, want %v", err, errPipeStalled)
+	}
+	// Killing ffmpeg closes the read end, which fails the blocked write
+	_ = pr.Close()
+	p.Close()
+}
+
+func TestTailBufferKeepsTheEnd(t *testing.T) {
+	t.Parallel()
+
+	tail := &tailBuffer{max: 8}
+	for _, s := range []string{"ffmpeg: ", "error ", "writing", "!"} {
+		if n, err := tail.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if got := tail.String(); got != "writing!" {
+		t.Fatalf("String() = %q, want %q", got, "writing!")
+	}
+}
+
+func TestLiveMuxerCloseKillsStalledProcess(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sleep")
+	}
+
+	// A process that never reads its stdin, like a hung ffmpeg
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe() error = %v", err)
+	}
+	m := &liveMuxer{cmd: exec.Command("sleep", "60"), stderr: &tailBuffer{max: 100}, done: make(chan struct{})}
+	m.cmd.Stdin = r
+	if err := m.cmd.Start(); err != nil {
+		t.Skipf("start sleep: %v", err)
+	}
+	r.Close()
+	m.video = newQueuedPipe(w, 50*time.Millisecond)
+	go func() {
+		m.err = m.cmd.Wait()
+		close(m.done)
+	}()
+
+	chunk := make([]byte, 64*1024)
+	for i := 0; i < 1000 && !m.stalled(); i++ {
+		_, _ = m.video.Write(chunk)
+	}
+	if !m.stalled() {
+		t.Fatal("stalled() = false after filling the pipe, want true")
+	}
+	start := time.Now()
+	if err := m.Close(); err == nil {
+		t.Fatal("Close() error = nil, want the killed process")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Close() took %s, want the stalled process killed right away", elapsed)
+	}
+}
+
+func TestAudioCodecArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		codec, bitrate string
+		want           string
+	}{
+		{"aac", "", "-c:a aac -b:a 128k"},
+		{"aac", "192k", "-c:a aac -b:a 192k"},
+		{"aac_he", "64k", "-c:a libfdk_aac -profile:a aac_he -b:a 64k"},
+		{"opus", "96k", "-c:a libopus -b:a 96k -af aformat=channel_layouts=7.1|5.1|stereo|mono"},
+		{"unknown", "", "-c:a aac -b:a 128k"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(audioCodecArgs(tt.codec, tt.bitrate), " "); got != tt.want {
+			t.Errorf("audioCodecArgs(%q, %q) = %q, want %q", tt.codec, tt.bitrate, got, tt.want)
+		}
+	}
+}
+
+func TestCompressArgs(t *testing.T) {
+	t.Parallel()
+
+	nvenc := videoEncoder{"NVENC", "h264_nvenc", []string{"-cq", "30"}}
+	tests := []struct {
+		name                  string
+		inputArgs, outputArgs []string
+		want                  string
+	}{
+		{"plain", nil, nil, "-y -nostats -progress pipe:1 -i /in.ts -c:v h264_nvenc -cq 30 /out.mkv"},
+		{"hardware decoding", []string{"-hwaccel", "cuda"}, nil, "-y -nostats -progress pipe:1 -hwaccel cuda -i /in.ts -c:v h264_nvenc -cq 30 /out.mkv"},
+		{"opus", nil, audioCodecArgs("opus", "96k"), "-y -nostats -progress pipe:1 -i /in.ts -c:v h264_nvenc -cq 30 -c:a libopus -b:a 96k -af aformat=channel_layouts=7.1|5.1|stereo|mono /out.mkv"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(compressArgs("/in.ts", "/out.mkv", nvenc, tt.inputArgs, tt.outputArgs), " "); got != tt.want {
+			t.Errorf("%s: compressArgs() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestThumbnailQualityArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		format  string
+		quality int
+		want    string
+	}{
+		{"webp", 80, "-c:v libwebp -quality 80"},
+		{"webp", 1, "-c:v libwebp -quality 1"},
+		{"jpg", 100, "-q:v 2"},
+		{"jpg", 50, "-q:v 17"},
+		{"jpg", 1, "-q:v 31"},
+		{"png", 80, ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(thumbnailQualityArgs(tt.format, tt.quality), " "); got != tt.want {
+			t.Errorf("thumbnailQualityArgs(%q, %d) = %q, want %q", tt.format, tt.quality, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMinResolution(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		resolution, minResolution int
+		wantErr                   bool
+	}{
+		{resolution: 240, minResolution: 0},
+		{resolution: 720, minResolution: 720},
+		{resolution: 1080, minResolution: 720},
+		{resolution: 480, minResolution: 720, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := checkMinResolution(&chaturbate.Playlist{Resolution: tt.resolution}, tt.minResolution)
+		if errors.Is(err, internal.ErrResolutionTooLow) != tt.wantErr || (err != nil && !tt.wantErr) {
+			t.Errorf("checkMinResolution(%dp, %dp) = %v, want error %v", tt.resolution, tt.minResolution, err, tt.wantErr)
+		}
+	}
+}
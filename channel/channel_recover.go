@@ -0,0 +1,161 @@
+package channel
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// recordingMarkerExt is the extension of the marker created next to a file while it's recorded and removed once
+// it's finalized, so `--recover` tells an unfinished recording from a finished one left in the pattern directory.
+const recordingMarkerExt = ".recording"
+
+// recordingMarker returns the marker path of the file recorded as filename (without its extension).
+func recordingMarker(filename string) string {
+	return filename + recordingMarkerExt
+}
+
+// markRecording creates the marker of filename, a failure only means a crash leaves the file for a manual recovery.
+func (ch *Channel) markRecording(filename string) {
+	if err := os.WriteFile(recordingMarker(filename), nil, 0666); err != nil {
+		ch.Error("recover: cannot create the recording marker: %s", err.Error())
+	}
+}
+
+// recordingBase returns the path of a recording without its extension, as the marker is named after it.
+func recordingBase(path string) string {
+	for _, ext := range []string{".video.mp4", ".audio.mp4", ".mp4", ".ts"} {
+		if base, ok := strings.CutSuffix(path, ext); ok {
+			return base
+		}
+	}
+	return path
+}
+
+// FindOrphans lists the recordings in dir and its subdirectories that were last written before `before`
+// and never finalized, i.e. with a recording marker left or separate tracks that were never muxed.
+// The directories in skip (e.g. the output directory) aren't scanned.
+// Separate tracks are listed by their `.video.mp4` file, `.mkv` files are already finalized and left out.
+func FindOrphans(dir string, skip []string, before time.Time) ([]string, error) {
+	skipped := map[string]bool{}
+	for _, s := range skip {
+		if s == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(s); err == nil {
+			skipped[abs] = true
+		}
+	}
+
+	var orphans []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && os.IsNotExist(err) {
+				return filepath.SkipDir // nothing recorded yet
+			}
+			return err
+		}
+		if d.IsDir() {
+			if abs, err := filepath.Abs(path); err == nil && skipped[abs] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext != ".ts" && ext != ".mp4" {
+			return nil
+		}
+		// The audio track is recovered along with the video one
+		if base, ok := strings.CutSuffix(path, ".audio.mp4"); ok {
+			if _, err := os.Stat(base + ".video.mp4"); err == nil {
+				return nil
+			}
+		}
+		if !unfinished(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() == 0 || !info.ModTime().Before(before) {
+			return nil
+		}
+		orphans = append(orphans, path)
+		return nil
+	})
+	return orphans, err
+}
+
+// unfinished reports whether the recording at path was never finalized: it has a marker,
+// or it's a video track with its audio one still next to it, which Cleanup would have muxed.
+func unfinished(path string) bool {
+	base := recordingBase(path)
+	if _, err := os.Stat(recordingMarker(base)); err == nil {
+		return true
+	}
+	if strings.HasSuffix(path, ".video.mp4") {
+		if _, err := os.Stat(base + ".audio.mp4"); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Recover finalizes a recording left behind by a previous run (`--recover`) like Cleanup would have:
+// separate tracks are muxed, then the file is compressed or moved to the output directory.
+// A single file without compression or an output directory is already final and left alone.
+// It returns once the file is finalized, i.e. after its compression, which waits for a `--compress-concurrency` slot.
+func (ch *Channel) Recover(path string) error {
+	marker := recordingMarker(recordingBase(path))
+	_, _, compress := ch.limits()
+	if base, ok := strings.CutSuffix(path, ".video.mp4"); ok {
+		audioPath := base + ".audio.mp4"
+		if _, err := os.Stat(audioPath); err == nil {
+			output, err := ch.recoverTracks(path, audioPath, uniqueDestPath(base+".mp4"))
+			if err != nil {
+				return err
+			}
+			path = output
+		}
+	} else if !compress && ch.outputDir() == "" {
+		_ = os.Remove(marker)
+		return nil
+	}
+	_ = os.Remove(marker)
+
+	ch.Info("recover: finalizing %s", filepath.Base(path))
+	// The duration of an orphan isn't known, only its size is checked
+	if compress && ch.compressWorthwhile(path, 0) {
+		<-ch.CompressFile(path)
+	} else {
+		ch.MoveToOutputDir(path, 0)
+	}
+	return nil
+}
+
+// recoverTracks muxes the separate tracks into output, then removes them. They're kept if the output looks corrupt.
+func (ch *Channel) recoverTracks(videoPath, audioPath, output string) (string, error) {
+	videoInfo, err := os.Stat(videoPath)
+	if err != nil {
+		return "", fmt.Errorf("stat video: %w", err)
+	}
+	audioInfo, err := os.Stat(audioPath)
+	if err != nil {
+		return "", fmt.Errorf("stat audio: %w", err)
+	}
+
+	ch.Info("recover: muxing %s and %s", filepath.Base(videoPath), filepath.Base(audioPath))
+	if err := ch.MuxAV(videoPath, audioPath, output); err != nil {
+		ch.Info("recover: ffmpeg mux failed, trying native fallback: %s", err.Error())
+		if nativeErr := ch.MuxAVNative(videoPath, audioPath, output); nativeErr != nil {
+			return "", fmt.Errorf("mux audio/video: %w", nativeErr)
+		}
+	}
+	if ok, reason := muxOutputLooksValid(output, videoInfo, audioInfo); !ok {
+		_ = os.Remove(output)
+		return "", fmt.Errorf("mux output looks corrupt (%s), keeping %s and %s", reason, filepath.Base(videoPath), filepath.Base(audioPath))
+	}
+	_ = os.Remove(videoPath)
+	_ = os.Remove(audioPath)
+	return output, nil
+}
@@ -0,0 +1,78 @@
+package channel
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+var (
+	s3Client     *internal.S3
+	s3ClientErr  error
+	s3ClientOnce sync.Once
+)
+
+// s3Enabled reports whether `--s3-bucket` is set.
+func (ch *Channel) s3Enabled() bool {
+	return server.Config != nil && server.Config.S3Bucket != ""
+}
+
+// s3Prefix renders `--s3-prefix` with the pattern of the current file, empty if it fails.
+func (ch *Channel) s3Prefix() string {
+	if !ch.s3Enabled() {
+		return ""
+	}
+	prefix, err := internal.RenderS3Prefix(server.Config.S3Prefix, ch.pattern())
+	if err != nil {
+		ch.Error("s3: prefix: %s", err.Error())
+	}
+	return prefix
+}
+
+// UploadS3 uploads the files of a completed recording to `--s3-bucket` under the key prefix,
+// retrying `--s3-retries` times. It reports whether the upload succeeded, errors are logged.
+func (ch *Channel) UploadS3(files []string, prefix string) bool {
+	s3ClientOnce.Do(func() {
+		c := server.Config
+		s3Client, s3ClientErr = internal.NewS3(c.S3Endpoint, c.S3Region, c.S3Bucket, c.S3AccessKey, c.S3SecretKey)
+	})
+	if s3ClientErr != nil {
+		ch.Error("s3: %s", s3ClientErr.Error())
+		return false
+	}
+
+	name := filepath.Base(files[0])
+	ch.Info("s3: uploading %s to %s/%s", name, server.Config.S3Bucket, prefix)
+	uploaded := make(map[string]bool, len(files))
+	err := retry.Do(
+		func() error {
+			for _, file := range files {
+				if uploaded[file] {
+					continue
+				}
+				if err := s3Client.Upload(uploadCtx, prefix+filepath.Base(file), file); err != nil {
+					return err
+				}
+				uploaded[file] = true
+			}
+			return nil
+		},
+		retry.Context(uploadCtx),
+		retry.Attempts(uint(server.Config.S3Retries+1)),
+		retry.Delay(uploadRetryDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			ch.Error("s3: upload of %s failed (attempt %d), retrying - %s", name, n+1, err.Error())
+		}),
+	)
+	if err != nil {
+		ch.Error("s3: failed to upload %s, keeping it locally - %s", name, err.Error())
+		return false
+	}
+	ch.Info("s3: uploaded %s", name)
+	return true
+}
@@ -0,0 +1,32 @@
+package channel
+
+import (
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/internal"
+)
+
+// parseSchedule returns the parsed cron schedule of the channel, or nil if it's checked all the time.
+// A schedule that doesn't parse, e.g. edited by hand in channels.json, is logged and ignored.
+func (ch *Channel) parseSchedule() *internal.Cron {
+	if ch.Config.Schedule == "" {
+		return nil
+	}
+	sched, err := internal.ParseCron(ch.Config.Schedule)
+	if err != nil {
+		ch.Error("schedule: %s, checking all the time", err.Error())
+		return nil
+	}
+	return sched
+}
+
+// checkSchedule returns internal.ErrOutsideSchedule and sets nextCheck if the minute of now isn't in the schedule.
+// A recording that's started keeps going until the stream ends, the schedule only gates the checks.
+func (ch *Channel) checkSchedule(sched *internal.Cron, now time.Time) error {
+	if sched == nil || sched.Match(now) {
+		ch.nextCheck = time.Time{}
+		return nil
+	}
+	ch.nextCheck = sched.Next(now)
+	return internal.ErrOutsideSchedule
+}
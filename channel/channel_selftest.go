@@ -0,0 +1,179 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/chaturbate"
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+const (
+	selfTestSegments = 3               // segments the self-test records before it stops
+	selfTestTimeout  = 2 * time.Minute // the recording stops then with what it has, e.g. a short VOD playlist
+)
+
+// SelfTest records a few segments of hlsURL, compresses the recording and checks that the output decodes (`--self-test`),
+// exercising the whole pipeline like a real recording. Without hlsURL a test stream generated with ffmpeg is served locally.
+// Everything is written to a temporary directory that's removed afterwards.
+// It replaces server.Config with a copy without the options that move or discard the recording, so it's meant to run alone.
+func SelfTest(ctx context.Context, hlsURL string) error {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return errors.New("ffmpeg not found in PATH")
+	}
+	dir, err := os.MkdirTemp("", "chaturbate-dvr-self-test-")
+	if err != nil {
+		return fmt.Errorf("mkdir temp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := *server.Config
+	conf.OutputDir, conf.MinDuration, conf.ChunkDuration, conf.TrimStart = "", 0, 0, 0
+	conf.LiveMux, conf.OutputPipe, conf.NoBackfill = false, "", false
+	conf.ThumbnailFormat, conf.Checksum, conf.SFTP, conf.S3Bucket = "", "", "", ""
+	conf.OnExisting = entity.OnExistingRename
+	server.Config = &conf
+
+	if hlsURL == "" {
+		fixtureURL, stop, err := serveSelfTestStream(ctx, filepath.Join(dir, "fixture"))
+		if err != nil {
+			return fmt.Errorf("test stream: %w", err)
+		}
+		defer stop()
+		hlsURL = fixtureURL
+	}
+
+	ch := New(&entity.ChannelConfig{
+		Username:   "self-test",
+		Resolution: 4320, // the best variant
+		Framerate:  chaturbate.FramerateAny,
+		Pattern:    filepath.Join(dir, "recordings", "{{.Username}}_{{.Sequence}}"),
+		Compress:   true,
+	})
+
+	ch.Info("self-test: fetching %s", hlsURL)
+	playlist, err := chaturbate.FetchPlaylist(ctx, hlsURL, ch.Config.Resolution, ch.Config.Framerate, ch.Config.MaxBitrate)
+	if err != nil {
+		return fmt.Errorf("fetch playlist: %w", err)
+	}
+	ch.StreamedAt = time.Now().Unix()
+	ch.HasSeparateAudio = playlist.AudioPlaylistURL != ""
+	if err := ch.NextFile(); err != nil {
+		return fmt.Errorf("next file: %w", err)
+	}
+
+	// Stop after selfTestSegments segments, a short test stream may end before
+	recordCtx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	var segments int
+	handler := func(b []byte, duration float64) error {
+		if err := ch.HandleSegment(b, duration); err != nil {
+			return err
+		}
+		if segments++; segments >= selfTestSegments {
+			cancel()
+		}
+		return nil
+	}
+	err = playlist.WatchAVSegments(recordCtx, handler, ch.HandleInitSegment, ch.HandleAudioSegment, ch.HandleAudioInitSegment, ch.OnPollComplete)
+	if err != nil && recordCtx.Err() == nil && !errors.Is(err, internal.ErrStreamEnded) {
+		return fmt.Errorf("watch segments: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if segments == 0 {
+		return errors.New("no segment was recorded")
+	}
+	ch.Info("self-test: recorded %d segment(s) of %s", segments, internal.FormatDuration(ch.Duration))
+
+	if err := ch.Cleanup(); err != nil {
+		return fmt.Errorf("cleanup: %w", err)
+	}
+	WaitCompressions()
+
+	output, err := findSelfTestOutput(filepath.Join(dir, "recordings"))
+	if err != nil {
+		return err
+	}
+	// Decode the whole file, a broken recording or encoder fails here
+	if out, err := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-i", output, "-f", "null", "-").CombinedOutput(); err != nil {
+		ch.logFFmpegOutput("self-test", out)
+		return fmt.Errorf("decode %s: %w", filepath.Base(output), err)
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		return fmt.Errorf("stat output: %w", err)
+	}
+	ch.Info("self-test: %s decodes fine (%s), the recording pipeline works", filepath.Base(output), internal.FormatFilesize(int(info.Size())))
+	return nil
+}
+
+// findSelfTestOutput returns the compressed recording in dir, CompressFile keeps the source if it failed.
+func findSelfTestOutput(dir string) (string, error) {
+	var outputs, sources []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".mkv":
+			outputs = append(outputs, path)
+		case ".ts", ".mp4":
+			sources = append(sources, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("walk dir: %w", err)
+	}
+	if len(outputs) == 0 {
+		if len(sources) > 0 {
+			return "", fmt.Errorf("compression failed, %s was kept, see the log above", filepath.Base(sources[0]))
+		}
+		return "", errors.New("no recording was written")
+	}
+	return outputs[0], nil
+}
+
+// serveSelfTestStream generates a short HLS stream with ffmpeg into dir and serves it on localhost,
+// it returns the URL of the master playlist and a function stopping the server.
+func serveSelfTestStream(ctx context.Context, dir string) (string, func(), error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", nil, fmt.Errorf("mkdir all: %w", err)
+	}
+	args := []string{
+		"-v", "error",
+		"-f", "lavfi", "-i", "testsrc2=size=640x360:rate=30",
+		"-f", "lavfi", "-i", "sine=frequency=440",
+		"-t", "6", "-c:v", "libx264", "-preset", "ultrafast", "-pix_fmt", "yuv420p", "-g", "30", "-c:a", "aac",
+		"-f", "hls", "-hls_time", "1", "-hls_list_size", "0", "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "segment_%03d.ts"),
+		filepath.Join(dir, "media.m3u8"),
+	}
+	if out, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+		return "", nil, fmt.Errorf("ffmpeg: %w: %s", err, out)
+	}
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\nmedia.m3u8\n"
+	if err := os.WriteFile(filepath.Join(dir, "master.m3u8"), []byte(master), 0666); err != nil {
+		return "", nil, fmt.Errorf("write master playlist: %w", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("listen: %w", err)
+	}
+	srv := &http.Server{Handler: http.FileServer(http.Dir(dir))}
+	go srv.Serve(ln)
+	return "http://" + ln.Addr().String() + "/master.m3u8", func() { _ = srv.Close() }, nil
+}
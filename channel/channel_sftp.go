@@ -0,0 +1,101 @@
+package channel
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// sftpEnabled reports whether `--sftp` is set.
+func (ch *Channel) sftpEnabled() bool {
+	return server.Config != nil && server.Config.SFTP != ""
+}
+
+// UploadSFTP uploads the files of a completed recording to `--sftp` with the OpenSSH sftp client,
+// retrying `--sftp-retries` times. It reports whether the upload succeeded, errors are logged.
+func (ch *Channel) UploadSFTP(files []string) bool {
+	host, dir, err := internal.ParseSFTPDestination(server.Config.SFTP)
+	if err != nil {
+		ch.Error("sftp: %s", err.Error())
+		return false
+	}
+	if server.Config.PerModelFolder {
+		dir = path.Join(dir, ch.Config.Username)
+	}
+
+	name := filepath.Base(files[0])
+	ch.Info("sftp: uploading %s to %s:%s", name, host, dir)
+	err = retry.Do(
+		func() error {
+			return runSFTP(host, sftpBatch(dir, files), server.Config.SFTPPort, server.Config.SFTPKey)
+		},
+		retry.Context(uploadCtx),
+		retry.Attempts(uint(server.Config.SFTPRetries+1)),
+		retry.Delay(uploadRetryDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			ch.Error("sftp: upload of %s failed (attempt %d), retrying - %s", name, n+1, err.Error())
+		}),
+	)
+	if err != nil {
+		ch.Error("sftp: failed to upload %s, keeping it locally - %s", name, err.Error())
+		return false
+	}
+	ch.Info("sftp: uploaded %s", name)
+	return true
+}
+
+// sftpBatch returns the sftp batch commands uploading the files into dir. The directories are created first,
+// `-` ignores the error if they exist. Each file is uploaded under a temporary name and renamed once complete,
+// so a partial upload never looks like a finished recording.
+func sftpBatch(dir string, files []string) string {
+	var b strings.Builder
+	var parent string
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" || part == "." {
+			if parent == "" && strings.HasPrefix(dir, "/") {
+				parent = "/"
+			}
+			continue
+		}
+		parent = path.Join(parent, part)
+		fmt.Fprintf(&b, "-mkdir %s\n", sftpQuote(parent))
+	}
+	for _, file := range files {
+		remote := path.Join(dir, filepath.Base(file))
+		fmt.Fprintf(&b, "put %s %s\n", sftpQuote(file), sftpQuote(remote+".part"))
+		fmt.Fprintf(&b, "-rm %s\n", sftpQuote(remote))
+		fmt.Fprintf(&b, "rename %s %s\n", sftpQuote(remote+".part"), sftpQuote(remote))
+	}
+	return b.String()
+}
+
+// sftpQuote quotes a path for an sftp batch command.
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// runSFTP runs the batch commands on host. BatchMode makes a missing key or an unknown host key fail instead of prompting.
+func runSFTP(host, batch string, port int, key string) error {
+	args := []string{"-b", "-", "-o", "BatchMode=yes", "-P", strconv.Itoa(port)}
+	if key != "" {
+		args = append(args, "-i", key)
+	}
+	cmd := exec.Command("sftp", append(args, host)...)
+	cmd.Stdin = strings.NewReader(batch)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package channel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// subtitles writes the WebVTT segments of the subtitle rendition to a `.vtt` sidecar of the current file (`--subtitles`).
+// The cues are timed from the start of the file: the first cue is placed by the durations of the subtitle segments
+// before it, so they're accurate to about the offset of that cue within its segment.
+type subtitles struct {
+	file    *os.File
+	elapsed float64         // seconds of subtitle segments written for the current file
+	anchor  float64         // stream time of the start of the file
+	started bool            // the anchor is set
+	written map[string]bool // a cue spanning segments is repeated in each of them
+	cues    int
+}
+
+// subtitlesEnabled reports whether `--subtitles` is set.
+func (ch *Channel) subtitlesEnabled() bool {
+	return server.Config != nil && server.Config.Subtitles
+}
+
+// subtitlePath returns the sidecar of a recording, e.g. `video.mkv` → `video.vtt`.
+func subtitlePath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".vtt"
+}
+
+// HandleSubtitleSegment appends the cues of a WebVTT segment to the sidecar of the current file, it's created
+// with the first segment. Errors are logged and never stop the recording.
+func (ch *Channel) HandleSubtitleSegment(b []byte, duration float64) error {
+	if ch.CurrentFilename == "" || ch.pipe != nil {
+		return nil
+	}
+	s := &ch.subtitles
+	if s.file == nil {
+		path := ch.CurrentFilename + ".vtt"
+		file, err := os.Create(path)
+		if err != nil {
+			ch.Error("subtitles: %s", err.Error())
+			return nil
+		}
+		ch.applyPermissions(path, false)
+		if _, err := file.WriteString("WEBVTT\n\n"); err != nil {
+			ch.Error("subtitles: %s", err.Error())
+		}
+		s.file, s.written = file, map[string]bool{}
+	}
+
+	cues, offset, err := parseWebVTT(b)
+	if err != nil {
+		ch.Error("subtitles: %s", err.Error())
+	}
+	w := bufio.NewWriter(s.file)
+	for _, cue := range cues {
+		start, end := cue.start+offset, cue.end+offset
+		if !s.started {
+			s.anchor, s.started = start-s.elapsed, true
+		}
+		key := fmt.Sprintf("%.3f %.3f %s", start, end, cue.text)
+		if s.written[key] {
+			continue
+		}
+		s.written[key] = true
+		s.cues++
+		fmt.Fprintf(w, "%s --> %s%s\n%s\n\n", formatVTTTime(start-s.anchor), formatVTTTime(end-s.anchor), cue.settings, cue.text)
+	}
+	if err := w.Flush(); err != nil {
+		ch.Error("subtitles: %s", err.Error())
+	}
+	s.elapsed += duration
+	return nil
+}
+
+// closeSubtitles closes the sidecar of the current file, it's removed if it has no cues.
+func (ch *Channel) closeSubtitles() {
+	s := &ch.subtitles
+	if s.file != nil {
+		name := s.file.Name()
+		if err := s.file.Close(); err != nil {
+			ch.Error("subtitles: %s", err.Error())
+		}
+		if s.cues == 0 {
+			_ = os.Remove(name)
+		} else {
+			ch.Info("subtitles: saved %d cue(s) to %s", s.cues, filepath.Base(name))
+		}
+	}
+	ch.subtitles = subtitles{}
+}
+
+// moveSubtitles moves the sidecar of srcPath next to destPath, if there's one.
+func (ch *Channel) moveSubtitles(srcPath, destPath string) {
+	src, dest := subtitlePath(srcPath), subtitlePath(destPath)
+	if src == dest {
+		return
+	}
+	if _, err := os.Stat(src); err != nil {
+		return
+	}
+	if err := moveFile(src, dest); err != nil {
+		ch.Error("subtitles: move %s: %s", filepath.Base(src), err.Error())
+		return
+	}
+	ch.applyPermissions(dest, false)
+}
+
+// vttCue is a cue of a WebVTT segment, the times are in seconds.
+type vttCue struct {
+	start, end float64
+	settings   string // e.g. " align:center", with the leading space
+	text       string
+}
+
+// parseWebVTT returns the cues of a WebVTT segment and the offset of its times to the stream time from
+// `X-TIMESTAMP-MAP`, 0 without one. The cues that could be parsed are returned along with an error.
+func parseWebVTT(b []byte) ([]vttCue, float64, error) {
+	blocks := strings.Split(strings.ReplaceAll(strings.ReplaceAll(string(b), "\r\n", "\n"), "\r", "\n"), "\n\n")
+	if !strings.HasPrefix(strings.TrimPrefix(blocks[0], "\uFEFF"), "WEBVTT") {
+		return nil, 0, errors.New("not a WebVTT segment")
+	}
+
+	var offset float64
+	for _, line := range strings.Split(blocks[0], "\n") {
+		if v, ok := strings.CutPrefix(line, "X-TIMESTAMP-MAP="); ok {
+			offset = parseTimestampMap(v)
+		}
+	}
+
+	var cues []vttCue
+	var errs []error
+	for _, block := range blocks[1:] {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		// The cue identifier is optional, NOTE, STYLE and REGION blocks have no timings
+		if len(lines) > 1 && !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+		if !strings.Contains(lines[0], "-->") {
+			continue
+		}
+		from, rest, _ := strings.Cut(lines[0], "-->")
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			errs = append(errs, fmt.Errorf("invalid cue timing %q", lines[0]))
+			continue
+		}
+		start, err1 := parseVTTTime(strings.TrimSpace(from))
+		end, err2 := parseVTTTime(fields[0])
+		if err := errors.Join(err1, err2); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var settings string
+		if len(fields) > 1 {
+			settings = " " + strings.Join(fields[1:], " ")
+		}
+		cues = append(cues, vttCue{start: start, end: end, settings: settings, text: strings.Join(lines[1:], "\n")})
+	}
+	return cues, offset, errors.Join(errs...)
+}
+
+// parseTimestampMap returns the offset of `X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000`, the MPEG-TS time
+// in seconds minus the local time.
+func parseTimestampMap(v string) float64 {
+	var mpegts, local float64
+	for _, part := range strings.Split(v, ",") {
+		key, value, _ := strings.Cut(part, ":")
+		switch key {
+		case "MPEGTS":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				mpegts = float64(n) / 90000
+			}
+		case "LOCAL":
+			local, _ = parseVTTTime(value)
+		}
+	}
+	return mpegts - local
+}
+
+// parseVTTTime parses a WebVTT timestamp, `hh:mm:ss.ttt` or `mm:ss.ttt`, into seconds.
+func parseVTTTime(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var seconds float64
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// formatVTTTime formats seconds as a WebVTT timestamp, negative times are clamped to 0.
+func formatVTTTime(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	if ms < 0 {
+		ms = 0
+	}
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
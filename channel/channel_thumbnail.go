@@ -0,0 +1,49 @@
+package channel
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// thumbnailEnabled reports whether `--thumbnail-format` is set.
+func (ch *Channel) thumbnailEnabled() bool {
+	return server.Config != nil && server.Config.ThumbnailFormat != ""
+}
+
+// GenerateThumbnail saves a representative frame of the recording next to it,
+// e.g. `video.mkv` → `video.webp`. Audio-only recordings are skipped, errors are non-fatal.
+func (ch *Channel) GenerateThumbnail(videoPath string) {
+	if strings.Contains(filepath.Base(videoPath), ".audio.") {
+		return
+	}
+	format := server.Config.ThumbnailFormat
+	thumbPath := strings.TrimSuffix(videoPath, filepath.Ext(videoPath)) + "." + format
+
+	args := []string{"-y", "-hide_banner", "-loglevel", "error", "-i", videoPath, "-vf", "thumbnail,scale=640:-2", "-frames:v", "1"}
+	args = append(args, thumbnailQualityArgs(format, server.Config.ThumbnailQuality)...)
+	args = append(args, thumbPath)
+
+	if output, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+		ch.Error("thumbnail: failed %s - %s", filepath.Base(videoPath), err.Error())
+		ch.logFFmpegOutput("thumbnail", output)
+		return
+	}
+	ch.applyPermissions(thumbPath, false)
+	ch.Info("thumbnail: saved %s", filepath.Base(thumbPath))
+}
+
+// thumbnailQualityArgs maps the 1-100 quality to the ffmpeg arguments of the format.
+func thumbnailQualityArgs(format string, quality int) []string {
+	switch format {
+	case "webp":
+		return []string{"-c:v", "libwebp", "-quality", strconv.Itoa(quality)}
+	case "jpg":
+		// The mjpeg qscale goes from 2 (best) to 31 (worst)
+		return []string{"-q:v", strconv.Itoa(31 - (quality-1)*29/99)}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package channel
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// regenerateTimestamps reports whether the timestamps of the recording are regenerated (`--timestamps regenerate`).
+// Only `.ts` recordings are concatenated from segments as-is, so only they carry the timestamp jumps of the CDN.
+func regenerateTimestamps(path string) bool {
+	return server.Config != nil && server.Config.Timestamps == entity.TimestampsRegenerate && strings.EqualFold(filepath.Ext(path), ".ts")
+}
+
+// timestampInputArgs returns the ffmpeg input options generating the missing timestamps of path, none unless regenerateTimestamps.
+// They don't remove the jumps, the recording is split at them instead, see timestampJump.
+func timestampInputArgs(path string) []string {
+	if !regenerateTimestamps(path) {
+		return nil
+	}
+	return []string{"-fflags", "+genpts"}
+}
+
+// timestampOutputArgs returns the ffmpeg output options shifting the regenerated timestamps of path to start at zero,
+// none unless regenerateTimestamps.
+func timestampOutputArgs(path string) []string {
+	if !regenerateTimestamps(path) {
+		return nil
+	}
+	return []string{"-avoid_negative_ts", "make_zero"}
+}
+
+// timestampJumpTolerance is how far the first timestamp of a segment may be off the end of the previous segment,
+// the first packet is audio or video and the reordered video frames start a bit later.
+const timestampJumpTolerance = time.Second
+
+// ptsWrap is where the 33-bit MPEG-TS timestamps wrap around, about 26.5 hours at 90 kHz.
+const ptsWrap = 1 << 33
+
+// timestampJump reports whether the `.ts` segment doesn't continue the timestamps of the segments written before,
+// the CDN restarted or shifted them without tagging a discontinuity. ffmpeg can't stitch such a jump, so the recording
+// is split at it and every file gets monotonic timestamps. It remembers where the next segment should start.
+func (ch *Channel) timestampJump(b []byte, duration float64) bool {
+	pts, ok := firstPTS(b)
+	expected, known := ch.nextPTS, ch.nextPTSKnown && ch.Duration > 0
+	ch.nextPTS, ch.nextPTSKnown = (pts+int64(duration*90000))%ptsWrap, ok
+	if !ok || !known {
+		return false
+	}
+	diff := (pts - expected + ptsWrap) % ptsWrap
+	if diff > ptsWrap/2 {
+		diff = ptsWrap - diff
+	}
+	return diff > int64(timestampJumpTolerance.Seconds()*90000)
+}
+
+// firstPTS returns the timestamp of the first PES packet of an MPEG-TS segment in 90 kHz units, false if it has none.
+func firstPTS(b []byte) (int64, bool) {
+	for i := 0; i+188 <= len(b); i += 188 {
+		pkt := b[i : i+188]
+		// A packet starting a PES packet, with a payload
+		if pkt[0] != 0x47 || pkt[1]&0x40 == 0 || pkt[3]&0x10 == 0 {
+			continue
+		}
+		payload := pkt[4:]
+		if pkt[3]&0x20 != 0 {
+			if int(payload[0])+1 >= len(payload) {
+				continue
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		// The PSI tables have no start code, the PTS follows the optional header flags
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 || payload[7]&0x80 == 0 {
+			continue
+		}
+		p := payload[9:14]
+		return int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1), true
+	}
+	return 0, false
+}
+
+// RemuxFile copies the streams of an uncompressed `.ts` recording into a new `.ts` with timestamps starting at zero
+// in the background, so players show the right duration and can seek. The original is kept if ffmpeg fails.
+func (ch *Channel) RemuxFile(srcPath string) {
+	// Read before Cleanup resets it
+	duration := ch.Duration
+
+	compressions.Add(1)
+	go func() {
+		defer compressions.Done()
+
+		ext := filepath.Ext(srcPath)
+		tmpPath := strings.TrimSuffix(srcPath, ext) + ".remux" + ext
+		args := append([]string{"-y", "-hide_banner", "-loglevel", "error"}, timestampInputArgs(srcPath)...)
+		args = append(args, "-i", srcPath, "-map", "0", "-c", "copy")
+		args = append(args, timestampOutputArgs(srcPath)...)
+		args = append(args, "-f", "mpegts", tmpPath)
+
+		if output, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+			ch.Error("remux: failed to regenerate the timestamps of %s, keeping it as recorded - %s", filepath.Base(srcPath), err.Error())
+			ch.logFFmpegOutput("remux", output)
+			_ = os.Remove(tmpPath)
+		} else if err := os.Rename(tmpPath, srcPath); err != nil {
+			ch.Error("remux: failed to replace %s - %s", filepath.Base(srcPath), err.Error())
+			_ = os.Remove(tmpPath)
+		} else {
+			ch.Info("remux: regenerated the timestamps of %s", filepath.Base(srcPath))
+		}
+		ch.MoveToOutputDir(srcPath, duration)
+	}()
+}
@@ -0,0 +1,41 @@
+package channel
+
+import (
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// armTrimStart sets the seconds `--trim-start` drops from the start of the broadcast of the stream about to be
+// recorded, or none if it isn't one: the stream was reconnected into (resumed), or the broadcast recorded last
+// wasn't seen ending, e.g. the recording restarted after a playlist error.
+func (ch *Channel) armTrimStart(resumed bool) {
+	broadcastStart := !resumed && !ch.inBroadcast
+	ch.inBroadcast = true
+	ch.trimVideo, ch.trimAudio = 0, 0
+	if !broadcastStart || server.Config == nil || server.Config.TrimStart <= 0 {
+		return
+	}
+	ch.trimVideo = float64(server.Config.TrimStart)
+	ch.trimAudio = ch.trimVideo
+	ch.Info("trim-start: dropping the segments within the first %ds", server.Config.TrimStart)
+}
+
+// broadcastEnded marks the broadcast recorded last as ended, the channel was seen offline or its playlist ended.
+// The next stream recorded is the start of a new broadcast, see armTrimStart.
+func (ch *Channel) broadcastEnded() {
+	ch.inBroadcast = false
+}
+
+// trimSegment reports whether the segment of duration is dropped, it's dropped if it ends within the seconds
+// remaining to trim of its track. The first segment ending after them stops the trim, so it's accurate to
+// the segment boundaries and never drops more than `--trim-start`. A segment without a duration stops it too.
+func trimSegment(remaining *float64, duration float64) bool {
+	if *remaining <= 0 {
+		return false
+	}
+	if duration <= 0 || duration > *remaining {
+		*remaining = 0
+		return false
+	}
+	*remaining -= duration
+	return true
+}
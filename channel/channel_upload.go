@@ -0,0 +1,74 @@
+package channel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// uploadRetryDelay is the delay before the first retry of a failed upload, it doubles on each retry.
+const uploadRetryDelay = 30 * time.Second
+
+// The uploads run in the background, tracked by uploads. They stop once uploadCtx is canceled, see CancelUploads.
+var (
+	uploads                  sync.WaitGroup
+	uploadCtx, cancelUploads = context.WithCancel(context.Background())
+)
+
+// WaitUploads waits for the running uploads to finish, the shutdown waits for them.
+func WaitUploads() {
+	uploads.Wait()
+}
+
+// CancelUploads stops the running uploads and the ones started afterwards, e.g. when the shutdown timed out.
+// Their local files are kept, and a multipart upload to S3 is aborted on a best effort basis.
+func CancelUploads() {
+	cancelUploads()
+}
+
+// uploadEnabled reports whether completed recordings are uploaded with `--sftp` or `--s3-bucket`.
+func (ch *Channel) uploadEnabled() bool {
+	return ch.sftpEnabled() || ch.s3Enabled()
+}
+
+// Upload uploads a completed recording with its thumbnail and checksum to the enabled destinations.
+// The local files are removed with `--sftp-delete` or `--s3-delete` once every upload succeeded, otherwise they're kept.
+func (ch *Channel) Upload(path, s3Prefix string) {
+	files := uploadFiles(path)
+	ok := true
+	if ch.sftpEnabled() {
+		ok = ch.UploadSFTP(files) && ok
+	}
+	if ch.s3Enabled() {
+		ok = ch.UploadS3(files, s3Prefix) && ok
+	}
+	if !ok || !(server.Config.SFTPDelete || server.Config.S3Delete) {
+		return
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			ch.Error("upload: failed to remove %s - %s", filepath.Base(file), err.Error())
+		}
+	}
+	ch.Info("upload: removed the local copy of %s", filepath.Base(path))
+}
+
+// uploadFiles returns the recording followed by its thumbnail, checksum, subtitles and poster that exist.
+func uploadFiles(path string) []string {
+	files := []string{path}
+	sidecars := []string{path + ".sha256", subtitlePath(path), posterPath(path)}
+	if server.Config.ThumbnailFormat != "" {
+		sidecars = append(sidecars, strings.TrimSuffix(path, filepath.Ext(path))+"."+server.Config.ThumbnailFormat)
+	}
+	for _, sidecar := range sidecars {
+		if _, err := os.Stat(sidecar); err == nil && sidecar != path {
+			files = append(files, sidecar)
+		}
+	}
+	return files
+}
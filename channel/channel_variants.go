@@ -0,0 +1,103 @@
+package channel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/teacat/chaturbate-dvr/chaturbate"
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// startVariants records the resolutions of `--resolutions` alongside the main playlist, each by a channel of its own
+// picking its variant from the same master playlist and writing files ending with e.g. `_480p`. A resolution picking
+// a variant that's recorded already is skipped. The returned func stops them and waits until their files are finalized.
+func (ch *Channel) startVariants(ctx context.Context, main *chaturbate.Playlist) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+
+	recording := map[string]bool{main.PlaylistURL: true}
+	for _, resolution := range ch.Config.Resolutions {
+		playlist, err := chaturbate.FetchPlaylist(ctx, main.RootURL, resolution, ch.Config.Framerate, ch.Config.MaxBitrate)
+		if err != nil {
+			ch.Error("resolutions: %dp: %s", resolution, err.Error())
+			continue
+		}
+		if recording[playlist.PlaylistURL] {
+			ch.Info("resolutions: %dp picks the %dp variant, which is recorded already", resolution, playlist.Resolution)
+			continue
+		}
+		recording[playlist.PlaylistURL] = true
+
+		variant := ch.variantChannel(playlist.Resolution)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			variant.recordVariant(ctx, playlist)
+		}()
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// variantChannel returns the channel recording the resolution alongside ch, it shares the logs of ch.
+func (ch *Channel) variantChannel(resolution int) *Channel {
+	conf := *ch.Config
+	conf.Resolution, conf.Resolutions = resolution, nil
+	return &Channel{
+		LogCh:           ch.LogCh,
+		UpdateCh:        ch.UpdateCh,
+		Config:          &conf,
+		CancelFunc:      func() {},
+		PauseCancelFunc: func() {},
+		StreamedAt:      ch.StreamedAt,
+		EdgeRegion:      ch.EdgeRegion,
+		RoomTitle:       ch.RoomTitle,
+		Gender:          ch.Gender,
+		Tags:            ch.Tags,
+		variant:         resolution,
+		trimVideo:       ch.trimVideo,
+		trimAudio:       ch.trimAudio,
+		window:          ch.window,
+	}
+}
+
+// recordVariant records the playlist until ctx is done or the stream ends, without the offline grace, notifications
+// and subtitles of the main recording.
+func (ch *Channel) recordVariant(ctx context.Context, playlist *chaturbate.Playlist) {
+	ch.HasSeparateAudio = playlist.AudioPlaylistURL != ""
+	ch.skipBackfill(ctx, playlist)
+	if err := ch.NextFile(); err != nil {
+		ch.Error("next file: %s", err.Error())
+		return
+	}
+	defer func() {
+		if err := ch.endStream(); err != nil {
+			ch.Error("cleanup on record stream exit: %s", err.Error())
+		}
+	}()
+
+	playlist.OnDiscontinuity = ch.HandleDiscontinuity
+	playlist.OnSequenceReset = ch.HandleSequenceReset
+	playlist.OnSegmentBreaker = ch.handleSegmentBreaker
+	if server.Config == nil || server.Config.OnVariant404 != entity.OnVariant404Stop {
+		playlist.OnVariantSwitch = ch.HandleVariantSwitch
+	}
+
+	ch.Info("recording %dp, framerate %dfps alongside the main recording", playlist.Resolution, playlist.Framerate)
+	err := playlist.WatchAVSegments(ctx, ch.HandleSegment, ch.HandleInitSegment, ch.HandleAudioSegment, ch.HandleAudioInitSegment, ch.OnPollComplete)
+	if err != nil && ctx.Err() == nil {
+		ch.Info("stopped: %s", err.Error())
+	}
+}
+
+// logPrefix tags the messages of a recording of `--resolutions` with its resolution, it's empty for the main one.
+func (ch *Channel) logPrefix() string {
+	if ch.variant == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[%dp] ", ch.variant)
+}
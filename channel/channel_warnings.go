@@ -0,0 +1,78 @@
+package channel
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// ffmpegWarningPatterns are the lowercase warnings of a successful ffmpeg run hinting at a degraded output,
+// in the order they're summarized.
+var ffmpegWarningPatterns = []struct {
+	pattern string
+	name    string
+}{
+	{"error while decoding", "decode error(s)"},
+	{"corrupt", "corrupt packet(s)"},
+	{"non monotonically increasing dts", "non-monotonic timestamp(s)"},
+	{"concealing", "concealed error(s)"},
+}
+
+// repeatedRegexp matches the line ffmpeg prints instead of repeating the last message.
+var repeatedRegexp = regexp.MustCompile(`last message repeated (\d+) times`)
+
+// ffmpegWarnings summarizes the lines of the ffmpeg output matching ffmpegWarningPatterns,
+// e.g. "12 decode error(s), 3 corrupt packet(s)", it's empty if there are none.
+func ffmpegWarnings(output []byte) string {
+	counts := make([]int, len(ffmpegWarningPatterns))
+	last := -1
+	for _, line := range strings.Split(string(output), "\n") {
+		lower := strings.ToLower(line)
+		if m := repeatedRegexp.FindStringSubmatch(lower); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil && last >= 0 {
+				counts[last] += n
+			}
+			continue
+		}
+		last = -1
+		for i, w := range ffmpegWarningPatterns {
+			if strings.Contains(lower, w.pattern) {
+				counts[i]++
+				last = i
+				break
+			}
+		}
+	}
+
+	var parts []string
+	for i, n := range counts {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, ffmpegWarningPatterns[i].name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reportFFmpegWarnings logs the summary of the ffmpeg warnings of a compressed recording, and marks it degraded
+// in the recordings index with `--on-ffmpeg-warnings flag`. Nothing is reported with `ignore` or no warnings.
+func (ch *Channel) reportFFmpegWarnings(path, summary string) {
+	action := entity.FFmpegWarningsLog
+	if server.Config != nil && server.Config.FFmpegWarnings != "" {
+		action = server.Config.FFmpegWarnings
+	}
+	if summary == "" || action == entity.FFmpegWarningsIgnore {
+		return
+	}
+	ch.Error("compress: %s may be degraded, ffmpeg warned about %s", filepath.Base(path), summary)
+
+	if action == entity.FFmpegWarningsFlag && server.Recordings != nil {
+		if err := server.Recordings.SetDegraded(path, summary); err != nil {
+			ch.Error("index: failed to flag %s - %s", filepath.Base(path), err.Error())
+		}
+	}
+}
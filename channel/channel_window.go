@@ -0,0 +1,54 @@
+package channel
+
+import (
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/internal"
+)
+
+// parseWindow returns the parsed daily window of the channel, or nil if it's recorded all day.
+// A window that doesn't parse, e.g. edited by hand in channels.json, is logged and ignored.
+func (ch *Channel) parseWindow() *internal.Window {
+	if ch.Config.Window == "" {
+		return nil
+	}
+	window, err := internal.ParseWindow(ch.Config.Window)
+	if err != nil {
+		ch.Error("%s, recording all day", err.Error())
+		return nil
+	}
+	return window
+}
+
+// outsideWindow reports whether the segment received at now is dropped because it's outside the daily window.
+// Leaving the window finalizes the file, entering it starts a new one named after that time.
+func (ch *Channel) outsideWindow(now time.Time) (bool, error) {
+	if ch.window == nil {
+		return false, nil
+	}
+	outside := !ch.window.Contains(now)
+	switch {
+	case outside && !ch.skippingWindow:
+		ch.skippingWindow = true
+		ch.Update()
+		if ch.Duration == 0 {
+			ch.Info("window: outside %s, waiting for it", ch.Config.Window)
+			return true, nil
+		}
+		ch.Info("window: %s ended, finalizing the file and skipping the segments until it starts again", ch.Config.Window)
+		// Finalized after the poll with separate audio, so its audio segments are dropped along
+		if ch.HasSeparateAudio {
+			ch.switchRequested = true
+			return true, nil
+		}
+		return true, ch.NextFile()
+	case !outside && ch.skippingWindow:
+		ch.skippingWindow = false
+		ch.Update()
+		if err := ch.NextFile(); err != nil {
+			return false, err
+		}
+		ch.Info("window: %s started, new file created: %s", ch.Config.Window, ch.OutputName())
+	}
+	return outside, nil
+}
@@ -6,15 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/avast/retry-go/v4"
 	"github.com/grafov/m3u8"
 	"github.com/samber/lo"
+	"github.com/teacat/chaturbate-dvr/entity"
 	"github.com/teacat/chaturbate-dvr/internal"
 	"github.com/teacat/chaturbate-dvr/server"
 )
@@ -25,8 +29,16 @@ const (
 	StatusPrivate = "private"
 	StatusAway    = "away"
 	StatusOffline = "offline"
+	// StatusPassword is a show only viewers knowing its password may watch, see Client.RoomPassword.
+	StatusPassword = "password protected"
+
+	// StatusRegionLocked is never returned by the API, it's set once every edge keeps refusing the stream.
+	StatusRegionLocked = "region-locked"
 )
 
+// FramerateAny requests whatever framerate the chosen resolution offers, preferring the highest.
+const FramerateAny = 0
+
 // edgeRegionRegexp extracts edge region from URL like "edge14-sin.live.mmcdn.com"
 var edgeRegionRegexp = regexp.MustCompile(`edge\d+-([a-z]+)`)
 
@@ -37,12 +49,35 @@ var edgeRegions = []string{"lax", "fra", "ams", "sin", "hnd"}
 type APIResponse struct {
 	HLSSource  string `json:"hls_source"`
 	RoomStatus string `json:"room_status"`
+
+	// Room metadata, these are optional and empty if the API doesn't return them.
+	RoomTitle         string `json:"room_title"`
+	BroadcasterGender string `json:"broadcaster_gender"`
+	NumViewers        int    `json:"num_viewers"`
+}
+
+// hashtagRegexp matches the hashtags broadcasters put in the room title.
+var hashtagRegexp = regexp.MustCompile(`#([\p{L}\p{N}_-]+)`)
+
+// Tags returns the hashtags of the room title in lowercase, without duplicates.
+func (r *APIResponse) Tags() []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, m := range hashtagRegexp.FindAllStringSubmatch(r.RoomTitle, -1) {
+		tag := strings.ToLower(m[1])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
 }
 
 // Client represents an API client for interacting with Chaturbate.
 type Client struct {
 	Req            *internal.Req
 	LastRoomStatus string // cached from the most recent API call
+	RoomPassword   string // unlocks a password protected room, empty if it's not known
 }
 
 // NewClient initializes and returns a new Client instance.
@@ -54,23 +89,163 @@ func NewClient() *Client {
 
 // GetStream fetches the stream information for a given username.
 // The room status is cached in Client.LastRoomStatus.
+// A password protected room is unlocked with Client.RoomPassword first, which keeps it unlocked for the session.
 func (c *Client) GetStream(ctx context.Context, username string) (*Stream, error) {
 	stream, roomStatus, err := FetchStream(ctx, c.Req, username)
+	if errors.Is(err, internal.ErrRoomPassword) && c.RoomPassword != "" {
+		if err := unlockRoom(ctx, c.Req, username, c.RoomPassword); err != nil {
+			c.LastRoomStatus = roomStatus
+			return nil, err
+		}
+		stream, roomStatus, err = FetchStream(ctx, c.Req, username)
+		// Still locked, so the password was accepted by the form but not by the room
+		if errors.Is(err, internal.ErrRoomPassword) {
+			err = internal.ErrWrongRoomPassword
+		}
+	}
 	c.LastRoomStatus = roomStatus
 	return stream, err
 }
 
+// RoomPasswordEndpoint is where the password of a room is posted to, relative to the domain.
+const RoomPasswordEndpoint = "roomlogin/{username}/"
+
+// unlockRoom posts the password of the password protected room of username, the client keeps the session it unlocks.
+func unlockRoom(ctx context.Context, client *internal.Req, username, password string) error {
+	endpoint := server.Config.Domain + strings.ReplaceAll(RoomPasswordEndpoint, "{username}", url.PathEscape(username))
+	body, err := client.PostForm(ctx, endpoint, url.Values{"password": {password}})
+	if errors.Is(err, internal.ErrCloudflareBlocked) {
+		return err
+	}
+	if err != nil || strings.Contains(strings.ToLower(body), "incorrect password") {
+		return internal.ErrWrongRoomPassword
+	}
+	return nil
+}
+
+// isPasswordProtected reports whether the room status is StatusPassword, some endpoints shorten it to "password".
+func isPasswordProtected(roomStatus string) bool {
+	return strings.HasPrefix(roomStatus, "password")
+}
+
 // GetRoomStatus returns the room status string (public, private, away, offline, etc.)
 func (c *Client) GetRoomStatus(ctx context.Context, username string) (string, error) {
-	resp, err := fetchAPIResponse(ctx, c.Req, username)
+	resp, err := fetchAPIResponse(ctx, c.Req, apiEndpointURLs(server.Config.Domain, server.Config.APIEndpoints, username)[0])
 	if err != nil {
 		return "", err
 	}
 	return resp.RoomStatus, nil
 }
 
-func fetchAPIResponse(ctx context.Context, client *internal.Req, username string) (*APIResponse, error) {
-	apiURL := fmt.Sprintf("%sapi/chatvideocontext/%s/", server.Config.Domain, username)
+// DefaultAPIEndpoint is the primary API endpoint, relative to the domain.
+const DefaultAPIEndpoint = "api/chatvideocontext/{username}/"
+
+// apiEndpointURLs returns the URLs of the API endpoints for the username, the first one is the primary.
+// An endpoint is either a full URL or a path relative to the domain, with "{username}" replaced.
+func apiEndpointURLs(domain string, endpoints []string, username string) []string {
+	if len(endpoints) == 0 {
+		endpoints = []string{DefaultAPIEndpoint}
+	}
+	urls := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		endpoint = strings.ReplaceAll(endpoint, "{username}", url.PathEscape(username))
+		if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+			endpoint = domain + strings.TrimPrefix(endpoint, "/")
+		}
+		urls[i] = endpoint
+	}
+	return urls
+}
+
+// DefaultFollowedEndpoint lists the followed channels that are online, relative to the domain.
+// It needs the cookies of a logged-in session.
+const DefaultFollowedEndpoint = "api/ts/roomlist/room-list/?follow=true&limit=90"
+
+// followedPages bounds the pages GetFollowed fetches, in case the endpoint keeps returning the same page.
+const followedPages = 20
+
+// GetFollowed returns the usernames of the followed channels that are online from endpoint (`--auto-follow`),
+// a full URL or a path relative to the domain. The pages are fetched with an increasing `offset` until the list is complete.
+func (c *Client) GetFollowed(ctx context.Context, endpoint string) ([]string, error) {
+	base := apiEndpointURLs(server.Config.Domain, []string{endpoint}, "")[0]
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+
+	var usernames []string
+	for page := 0; page < followedPages; page++ {
+		body, err := c.Req.Get(ctx, fmt.Sprintf("%s%soffset=%d", base, separator, len(usernames)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get followed channels: %w", err)
+		}
+		rooms, total, err := parseFollowed([]byte(body))
+		if err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, rooms...)
+		if len(rooms) == 0 || len(usernames) >= total {
+			break
+		}
+	}
+	return lo.Uniq(usernames), nil
+}
+
+// parseFollowed returns the usernames of a page of the followed channels and the total count.
+// A page that isn't the expected JSON is most likely the login page, the cookies are missing or expired.
+func parseFollowed(body []byte) ([]string, int, error) {
+	var resp struct {
+		Rooms []struct {
+			Username string `json:"username"`
+		} `json:"rooms"`
+		TotalCount *int `json:"total_count"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.TotalCount == nil {
+		return nil, 0, errors.New("unexpected followed channels response, are the `--cookies` of a logged-in session set?")
+	}
+	var usernames []string
+	for _, room := range resp.Rooms {
+		if room.Username != "" {
+			usernames = append(usernames, room.Username)
+		}
+	}
+	return usernames, *resp.TotalCount, nil
+}
+
+// apiFields are the fields of the API response the recording depends on.
+var apiFields = []string{"hls_source", "room_status"}
+
+// CheckAPI fetches the API response of the username from endpoint, the primary one if it's empty, and returns
+// the expected fields it lacks or that aren't strings, so a site change is noticed before recordings fail (`--version-check`).
+func CheckAPI(ctx context.Context, username, endpoint string) ([]string, error) {
+	endpoints := server.Config.APIEndpoints
+	if endpoint != "" {
+		endpoints = []string{endpoint}
+	}
+	body, err := internal.NewReq().Get(ctx, apiEndpointURLs(server.Config.Domain, endpoints, username)[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API response: %w", err)
+	}
+	return missingAPIFields([]byte(body))
+}
+
+// missingAPIFields returns the apiFields the JSON object lacks or that aren't strings, null counts as an empty string.
+func missingAPIFields(body []byte) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("API response is not a JSON object: %w", err)
+	}
+	var missing []string
+	for _, name := range apiFields {
+		var v string
+		if raw, ok := fields[name]; !ok || json.Unmarshal(raw, &v) != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+func fetchAPIResponse(ctx context.Context, client *internal.Req, apiURL string) (*APIResponse, error) {
 	body, err := client.Get(ctx, apiURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get API response: %w", err)
@@ -87,7 +262,7 @@ func fetchAPIResponse(ctx context.Context, client *internal.Req, username string
 // FetchStream retrieves the streaming data using the Chaturbate API.
 // Returns the stream, the room status string, and any error.
 func FetchStream(ctx context.Context, client *internal.Req, username string) (*Stream, string, error) {
-	resp, err := fetchAPIResponse(ctx, client, username)
+	resp, err := fetchStreamResponse(ctx, client, apiEndpointURLs(server.Config.Domain, server.Config.APIEndpoints, username))
 	if err != nil {
 		return nil, "", err
 	}
@@ -95,10 +270,17 @@ func FetchStream(ctx context.Context, client *internal.Req, username string) (*S
 	// Handle room status
 	switch resp.RoomStatus {
 	case StatusPrivate:
-		return nil, resp.RoomStatus, internal.ErrPrivateStream
+		// The stream of a private show is only given to a viewer in it
+		if !recordPrivate() || resp.HLSSource == "" {
+			return nil, resp.RoomStatus, internal.ErrPrivateStream
+		}
 	case StatusAway, StatusOffline:
 		return nil, resp.RoomStatus, internal.ErrChannelOffline
 	}
+	// The HLS source is only there once the session unlocked the room
+	if isPasswordProtected(resp.RoomStatus) && resp.HLSSource == "" {
+		return nil, resp.RoomStatus, internal.ErrRoomPassword
+	}
 
 	if resp.HLSSource == "" {
 		return nil, resp.RoomStatus, internal.ErrChannelOffline
@@ -110,10 +292,36 @@ func FetchStream(ctx context.Context, client *internal.Req, username string) (*S
 		return nil, resp.RoomStatus, err
 	}
 
-	return &Stream{HLSSource: workingURL}, resp.RoomStatus, nil
+	return &Stream{HLSSource: workingURL, EdgeRegion: edgeRegion(workingURL), Room: resp}, resp.RoomStatus, nil
+}
+
+// recordPrivate reports whether a private show is recorded when its stream is given with `--record-private`.
+func recordPrivate() bool {
+	return server.Config != nil && server.Config.RecordPrivate
+}
+
+// fetchStreamResponse fetches the primary endpoint of apiURLs, then tries the alternate ones in turn
+// while the room is public but the response has no HLS source. The errors of the alternates are ignored.
+func fetchStreamResponse(ctx context.Context, client *internal.Req, apiURLs []string) (*APIResponse, error) {
+	resp, err := fetchAPIResponse(ctx, client, apiURLs[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, apiURL := range apiURLs[1:] {
+		if resp.RoomStatus != StatusPublic || resp.HLSSource != "" {
+			break
+		}
+		if alt, err := fetchAPIResponse(ctx, client, apiURL); err == nil && alt.HLSSource != "" {
+			return alt, nil
+		}
+	}
+	return resp, nil
 }
 
 // findWorkingEdgeURL validates the HLS URL and tries alternative edge regions if geo-blocked.
+// It returns ErrRegionLocked if every edge refused the stream with 403, which is how a broadcaster
+// unavailable in this country looks, and ErrGeoBlocked if some failed otherwise and may work later.
+// The working URL is reused for the same stream for edgeCacheTTL, or until its playlist or a segment fails on the edge.
 func findWorkingEdgeURL(ctx context.Context, client *internal.Req, hlsSource string) (string, error) {
 	// LL-HLS URLs use token-based sessions; HEAD requests consume the token
 	// and cause subsequent GET requests to fail with "session_duplicated".
@@ -121,20 +329,25 @@ func findWorkingEdgeURL(ctx context.Context, client *internal.Req, hlsSource str
 	if strings.Contains(hlsSource, "llhls.m3u8") {
 		return hlsSource, nil
 	}
+	// The stream was found on a working edge a moment ago, e.g. before a reconnect
+	if cached, ok := cachedEdge(hlsSource); ok {
+		return cached, nil
+	}
 
-	// 1. Validate original URL
-	statusCode, err := client.Head(ctx, hlsSource)
-	if err == nil && statusCode == 200 {
-		return hlsSource, nil
+	// 1. Validate original URL, an edge redirecting to a working location is used at that location
+	statusCode, finalURL, err := client.Head(ctx, hlsSource)
+	if err == nil && edgeStatusOK(statusCode) {
+		cacheEdge(hlsSource, finalURL)
+		return finalURL, nil
 	}
+	forbidden := err == nil && statusCode == http.StatusForbidden
 
 	// 2. Extract current region from URL
-	matches := edgeRegionRegexp.FindStringSubmatch(hlsSource)
-	if len(matches) < 2 {
+	currentRegion := edgeRegion(hlsSource)
+	if currentRegion == "" {
 		// URL doesn't match edge pattern, return original
 		return hlsSource, nil
 	}
-	currentRegion := matches[1]
 
 	// 3. Try alternative edge regions: lax, fra, ams, sin, hnd
 	for _, region := range edgeRegions {
@@ -143,27 +356,148 @@ func findWorkingEdgeURL(ctx context.Context, client *internal.Req, hlsSource str
 		}
 		altURL := strings.Replace(hlsSource, "-"+currentRegion+".", "-"+region+".", 1)
 
-		statusCode, err := client.Head(ctx, altURL)
-		if err == nil && statusCode == 200 {
-			return altURL, nil
+		statusCode, finalURL, err := client.Head(ctx, altURL)
+		if err == nil && edgeStatusOK(statusCode) {
+			cacheEdge(hlsSource, finalURL)
+			return finalURL, nil
 		}
+		forbidden = forbidden && err == nil && statusCode == http.StatusForbidden
 	}
 
+	if forbidden {
+		return "", internal.ErrRegionLocked
+	}
 	return "", internal.ErrGeoBlocked
 }
 
+// edgeCacheTTL is how long the working URL found for a stream is reused.
+const edgeCacheTTL = 2 * time.Minute
+
+// workingEdges caches the working URL of a stream by the host and path of its HLS source, see findWorkingEdgeURL.
+// Whether an edge works depends on the broadcaster (e.g. a region lock), so the streams are cached each on their own.
+var workingEdges = struct {
+	sync.Mutex
+	streams map[string]workingEdge
+}{streams: map[string]workingEdge{}}
+
+// workingEdge is the working URL of a stream after the redirects and when it was found.
+type workingEdge struct {
+	url string
+	at  time.Time
+}
+
+// edgeCacheKey returns the host and path of hlsSource, ok is false if it's not on an edge host.
+func edgeCacheKey(hlsSource string) (string, bool) {
+	u, err := url.Parse(hlsSource)
+	if err != nil || edgeRegion(u.Host) == "" {
+		return "", false
+	}
+	return u.Host + u.Path, true
+}
+
+// cachedEdge returns the working URL cached for the stream of hlsSource, ok is false if there's none within edgeCacheTTL.
+func cachedEdge(hlsSource string) (string, bool) {
+	key, ok := edgeCacheKey(hlsSource)
+	if !ok {
+		return "", false
+	}
+	workingEdges.Lock()
+	defer workingEdges.Unlock()
+	edge, ok := workingEdges.streams[key]
+	if !ok || time.Since(edge.at) >= edgeCacheTTL {
+		return "", false
+	}
+	return edge.url, true
+}
+
+// cacheEdge stores workingURL as the working URL of the stream of hlsSource, only the streams on edge hosts are cached.
+func cacheEdge(hlsSource, workingURL string) {
+	key, ok := edgeCacheKey(hlsSource)
+	if !ok {
+		return
+	}
+	workingEdges.Lock()
+	defer workingEdges.Unlock()
+	workingEdges.streams[key] = workingEdge{url: workingURL, at: time.Now()}
+}
+
+// forgetEdge drops the cached streams working on the host of rawURL, e.g. after a playlist or a segment failed on it.
+func forgetEdge(rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	workingEdges.Lock()
+	defer workingEdges.Unlock()
+	for key, edge := range workingEdges.streams {
+		if working, err := url.Parse(edge.url); err == nil && working.Host == u.Host {
+			delete(workingEdges.streams, key)
+		}
+	}
+}
+
+// edgeStatusOK reports whether the status of an edge's response means it works, see `--edge-ok-status`.
+func edgeStatusOK(statusCode int) bool {
+	if server.Config == nil || len(server.Config.EdgeOKStatuses) == 0 {
+		return statusCode == http.StatusOK
+	}
+	code := strconv.Itoa(statusCode)
+	for _, status := range server.Config.EdgeOKStatuses {
+		if status == code || (strings.HasSuffix(status, "xx") && status[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// edgeRegion returns the edge region of an HLS URL, e.g. "sin" for "edge14-sin.live.mmcdn.com", empty if there's none.
+func edgeRegion(hlsSource string) string {
+	matches := edgeRegionRegexp.FindStringSubmatch(hlsSource)
+	if len(matches) < 2 {
+		return ""
+	}
+	return matches[1]
+}
+
 // Stream represents an HLS stream source.
 type Stream struct {
-	HLSSource string
+	HLSSource  string
+	EdgeRegion string       // edge region of HLSSource, empty if the URL has none
+	Room       *APIResponse // room metadata at the time the stream was fetched
 }
 
 // GetPlaylist retrieves the playlist corresponding to the given resolution and framerate.
-func (s *Stream) GetPlaylist(ctx context.Context, resolution, framerate int) (*Playlist, error) {
-	return FetchPlaylist(ctx, s.HLSSource, resolution, framerate)
+// A master playlist without variants is fetched again `--variant-retries` times,
+// the variants are often listed a moment later when a stream just started or glitched.
+func (s *Stream) GetPlaylist(ctx context.Context, resolution, framerate, maxBitrate int) (*Playlist, error) {
+	var retries int
+	var delay time.Duration
+	if server.Config != nil {
+		retries = server.Config.VariantRetries
+		delay = time.Duration(server.Config.VariantRetryDelay) * time.Second
+	}
+	return fetchPlaylistWithRetry(ctx, s.HLSSource, resolution, framerate, maxBitrate, retries, delay)
+}
+
+// fetchPlaylistWithRetry calls FetchPlaylist, then again up to retries times while there are no variants.
+func fetchPlaylistWithRetry(ctx context.Context, hlsSource string, resolution, framerate, maxBitrate, retries int, delay time.Duration) (*Playlist, error) {
+	return retry.DoWithData(
+		func() (*Playlist, error) {
+			return FetchPlaylist(ctx, hlsSource, resolution, framerate, maxBitrate)
+		},
+		retry.Context(ctx),
+		retry.Attempts(uint(retries+1)),
+		retry.Delay(delay),
+		retry.DelayType(retry.FixedDelay),
+		retry.RetryIf(func(err error) bool {
+			return errors.Is(err, internal.ErrNoVariants)
+		}),
+		retry.LastErrorOnly(true),
+	)
 }
 
 // FetchPlaylist fetches and decodes the HLS playlist file.
-func FetchPlaylist(ctx context.Context, hlsSource string, resolution, framerate int) (*Playlist, error) {
+func FetchPlaylist(ctx context.Context, hlsSource string, resolution, framerate, maxBitrate int) (*Playlist, error) {
 	if hlsSource == "" {
 		return nil, errors.New("HLS source is empty")
 	}
@@ -173,11 +507,11 @@ func FetchPlaylist(ctx context.Context, hlsSource string, resolution, framerate
 		return nil, fmt.Errorf("failed to fetch HLS source: %w", err)
 	}
 
-	return ParsePlaylist(resp, hlsSource, resolution, framerate)
+	return ParsePlaylist(resp, hlsSource, resolution, framerate, maxBitrate)
 }
 
 // ParsePlaylist decodes the M3U8 playlist and extracts the variant streams.
-func ParsePlaylist(resp, hlsSource string, resolution, framerate int) (*Playlist, error) {
+func ParsePlaylist(resp, hlsSource string, resolution, framerate, maxBitrate int) (*Playlist, error) {
 	p, _, err := m3u8.DecodeFrom(strings.NewReader(resp), true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode m3u8 playlist: %w", err)
@@ -185,10 +519,14 @@ func ParsePlaylist(resp, hlsSource string, resolution, framerate int) (*Playlist
 
 	masterPlaylist, ok := p.(*m3u8.MasterPlaylist)
 	if !ok {
+		// An empty master playlist has nothing to tell it apart, it's decoded as an empty media playlist
+		if media, ok := p.(*m3u8.MediaPlaylist); ok && media.Count() == 0 {
+			return nil, internal.ErrNoVariants
+		}
 		return nil, errors.New("invalid master playlist format")
 	}
 
-	return PickPlaylist(masterPlaylist, hlsSource, resolution, framerate)
+	return PickPlaylist(masterPlaylist, hlsSource, resolution, framerate, maxBitrate)
 }
 
 // Playlist represents an HLS playlist containing variant streams.
@@ -196,8 +534,59 @@ type Playlist struct {
 	PlaylistURL      string
 	AudioPlaylistURL string
 	RootURL          string
-	Resolution       int
-	Framerate        int
+
+	// SubtitlePlaylistURL is the WebVTT playlist of the subtitle rendition, empty if the stream has none.
+	SubtitlePlaylistURL string
+	Resolution          int
+	Framerate           int
+	MaxBitrate          int // kbps the variants are capped at, kept for switchVariant, 0 = no cap
+
+	// LastSeq and AudioLastSeq hold the sequence number of the last processed
+	// segment of each media playlist. PickPlaylist initializes them to -1,
+	// callers may preset them to resume a reconnect without duplicating segments.
+	LastSeq         int
+	AudioLastSeq    int
+	SubtitleLastSeq int
+
+	// OnDiscontinuity is called before the first video segment following an
+	// EXT-X-DISCONTINUITY tag (ad insertion, encoder restart), optional.
+	OnDiscontinuity DiscontinuityHandler
+
+	// OnSegmentFetched is called after each video and audio segment download, optional.
+	OnSegmentFetched SegmentFetchHandler
+
+	// OnSequenceReset is called when the video sequence numbers restarted below LastSeq
+	// (the stream restarted on the same playlist), before its segments are processed, optional.
+	OnSequenceReset SequenceResetHandler
+
+	// OnVariantSwitch is called after the video playlist kept returning 404 and was replaced by another
+	// variant of the master playlist (see switchVariant). Without it a 404 ends the stream, optional.
+	OnVariantSwitch VariantSwitchHandler
+
+	// OnSubtitleSegment is called with each WebVTT segment of SubtitlePlaylistURL and its duration, optional.
+	// The subtitles are only fetched with it, and their errors are ignored so they never stop the recording.
+	OnSubtitleSegment WatchHandler
+
+	// ShouldDowngrade is called after each poll, when it returns true the video steps down to the highest variant
+	// of the master playlist below its resolution and OnVariantDowngrade is called (`--adaptive`), optional.
+	ShouldDowngrade func() bool
+
+	// OnVariantDowngrade is called after the video stepped down to a lower variant, see ShouldDowngrade.
+	OnVariantDowngrade VariantSwitchHandler
+
+	// OnSegmentBreaker is called when the segment fetches are paused after too many of them failed,
+	// and when they work again after the pause (see recordSegmentFetch), optional.
+	OnSegmentBreaker SegmentBreakerHandler
+
+	variantNotFound int            // polls in a row the video playlist returned 404 while the master playlist still listed it
+	endlist         bool           // the video playlist ended with EXT-X-ENDLIST and all of its segments were processed
+	breaker         segmentBreaker // the recent segment fetches, to pause them when too many failed
+	lowestVariant   bool           // the master playlist has no variant below the video to step down to
+
+	// lastEnds is where the last processed segment of each media playlist ends by its EXT-X-PROGRAM-DATE-TIME,
+	// reanchors the playlists of another variant whose cursor is moved on their next poll (see useVariant).
+	lastEnds  map[string]time.Time
+	reanchors map[string]time.Time
 }
 
 // Resolution represents a video resolution and its corresponding framerate.
@@ -207,12 +596,13 @@ type Resolution struct {
 	Alternatives []*m3u8.Alternative
 }
 
-// PickPlaylist selects the best matching variant stream based on resolution and framerate.
-func PickPlaylist(masterPlaylist *m3u8.MasterPlaylist, baseURL string, resolution, framerate int) (*Playlist, error) {
+// PickPlaylist selects the best matching variant stream based on resolution and framerate,
+// among the variants within maxBitrate in kbps (see capBitrate).
+func PickPlaylist(masterPlaylist *m3u8.MasterPlaylist, baseURL string, resolution, framerate, maxBitrate int) (*Playlist, error) {
 	resolutions := map[int]*Resolution{}
 
 	// Extract available resolutions and framerates from the master playlist
-	for _, v := range masterPlaylist.Variants {
+	for _, v := range capBitrate(masterPlaylist.Variants, maxBitrate) {
 		parts := strings.Split(v.Resolution, "x")
 		if len(parts) != 2 {
 			continue
@@ -231,6 +621,15 @@ func PickPlaylist(masterPlaylist *m3u8.MasterPlaylist, baseURL string, resolutio
 		resolutions[width].Framerate[framerateVal] = v.URI
 	}
 
+	if len(resolutions) == 0 {
+		return nil, internal.ErrNoVariants
+	}
+	if server.Config != nil {
+		if err := filterResolutions(resolutions, server.Config.AllowedResolutions, server.Config.BlockedResolutions); err != nil {
+			return nil, err
+		}
+	}
+
 	// Find exact match for requested resolution
 	variant, exists := resolutions[resolution]
 	if !exists {
@@ -249,18 +648,11 @@ func PickPlaylist(masterPlaylist *m3u8.MasterPlaylist, baseURL string, resolutio
 
 	var (
 		finalResolution = variant.Width
-		finalFramerate  = framerate
-		audioPlaylist   string
+		// Select the desired framerate, or fallback to the closest available one
+		finalFramerate = pickFramerate(variant.Framerate, framerate)
+		playlistURL    = variant.Framerate[finalFramerate]
+		audioPlaylist  string
 	)
-	// Select the desired framerate, or fallback to the first available framerate
-	playlistURL, exists := variant.Framerate[framerate]
-	if !exists {
-		for fr, url := range variant.Framerate {
-			playlistURL = url
-			finalFramerate = fr
-			break
-		}
-	}
 
 	for _, alt := range variant.Alternatives {
 		if alt == nil || alt.Type != "AUDIO" || alt.URI == "" {
@@ -273,14 +665,96 @@ func PickPlaylist(masterPlaylist *m3u8.MasterPlaylist, baseURL string, resolutio
 	}
 
 	return &Playlist{
-		PlaylistURL:      resolveURL(baseURL, playlistURL),
-		AudioPlaylistURL: audioPlaylist,
-		RootURL:          baseURL,
-		Resolution:       finalResolution,
-		Framerate:        finalFramerate,
+		PlaylistURL:         resolveURL(baseURL, playlistURL),
+		AudioPlaylistURL:    audioPlaylist,
+		SubtitlePlaylistURL: pickSubtitles(masterPlaylist, baseURL),
+		RootURL:             baseURL,
+		Resolution:          finalResolution,
+		Framerate:           finalFramerate,
+		MaxBitrate:          maxBitrate,
+		LastSeq:             -1,
+		AudioLastSeq:        -1,
+		SubtitleLastSeq:     -1,
 	}, nil
 }
 
+// capBitrate returns the variants whose BANDWIDTH is at most maxBitrate in kbps, a hard ceiling for the picked variant
+// (`--max-bitrate`). If none is, the variants with the lowest bandwidth are returned instead. 0 returns all of them,
+// a variant without BANDWIDTH is always within the cap.
+func capBitrate(variants []*m3u8.Variant, maxBitrate int) []*m3u8.Variant {
+	if maxBitrate <= 0 || len(variants) == 0 {
+		return variants
+	}
+	limit := uint32(maxBitrate) * 1000
+	capped := lo.Filter(variants, func(v *m3u8.Variant, _ int) bool {
+		return v.Bandwidth <= limit
+	})
+	if len(capped) > 0 {
+		return capped
+	}
+	lowest := lo.MinBy(variants, func(a, b *m3u8.Variant) bool {
+		return a.Bandwidth < b.Bandwidth
+	}).Bandwidth
+	return lo.Filter(variants, func(v *m3u8.Variant, _ int) bool {
+		return v.Bandwidth == lowest
+	})
+}
+
+// filterResolutions removes the resolutions not in allowed (`--allowed-resolutions`, empty allows all) or in blocked
+// (`--blocked-resolutions`), so the fallback only picks among the rest. It returns ErrNoAllowedVariant if none is left.
+func filterResolutions(resolutions map[int]*Resolution, allowed, blocked []int) error {
+	available := lo.Keys(resolutions)
+	for width := range resolutions {
+		if (len(allowed) > 0 && !lo.Contains(allowed, width)) || lo.Contains(blocked, width) {
+			delete(resolutions, width)
+		}
+	}
+	if len(resolutions) == 0 {
+		slices.Sort(available)
+		return fmt.Errorf("%w: stream has %s", internal.ErrNoAllowedVariant, strings.Join(lo.Map(available, func(width, _ int) string {
+			return strconv.Itoa(width) + "p"
+		}), ", "))
+	}
+	return nil
+}
+
+// pickSubtitles returns the URL of the default subtitle rendition of the master playlist, or the first one,
+// empty if there's none. The decoder attaches the renditions to the variant listed after them, so all variants are searched.
+func pickSubtitles(masterPlaylist *m3u8.MasterPlaylist, baseURL string) string {
+	var subtitles string
+	for _, v := range masterPlaylist.Variants {
+		for _, alt := range v.Alternatives {
+			if alt == nil || alt.Type != "SUBTITLES" || alt.URI == "" {
+				continue
+			}
+			if alt.Default {
+				return resolveURL(baseURL, alt.URI)
+			}
+			if subtitles == "" {
+				subtitles = resolveURL(baseURL, alt.URI)
+			}
+		}
+	}
+	return subtitles
+}
+
+// pickFramerate picks the framerate to record from the available ones.
+// `FramerateAny` (0) picks the highest framerate, otherwise the requested one is used if available,
+// then the highest framerate below it, then the lowest framerate above it.
+func pickFramerate(available map[int]string, framerate int) int {
+	if _, ok := available[framerate]; ok && framerate != FramerateAny {
+		return framerate
+	}
+	frs := lo.Keys(available)
+	if framerate == FramerateAny {
+		return lo.Max(frs)
+	}
+	if lower := lo.Filter(frs, func(fr, _ int) bool { return fr < framerate }); len(lower) > 0 {
+		return lo.Max(lower)
+	}
+	return lo.Min(frs)
+}
+
 // resolveURL resolves a potentially relative or absolute URI against a base URL.
 func resolveURL(baseURL, ref string) string {
 	base, err := url.Parse(baseURL)
@@ -300,6 +774,23 @@ type WatchHandler func(b []byte, duration float64) error
 // InitHandler is called once when an init segment (fMP4 moov atom) is detected.
 type InitHandler func(initData []byte) error
 
+// DiscontinuityHandler is called with the sequence number of a segment that follows a discontinuity.
+type DiscontinuityHandler func(seq int) error
+
+// SequenceResetHandler is called with the last processed sequence number and the new first one.
+type SequenceResetHandler func(lastSeq, seq int) error
+
+// VariantSwitchHandler is called with the resolution and framerate of the variant that replaced the previous one,
+// and whether it has a separate audio playlist.
+type VariantSwitchHandler func(resolution, framerate int, separateAudio bool) error
+
+// SegmentFetchHandler is called with how long a segment took to download and its duration in seconds.
+type SegmentFetchHandler func(fetch time.Duration, duration float64)
+
+// SegmentBreakerHandler is called with paused true, how many of the recent segment fetches failed and how long
+// the fetches pause for when they're paused, and with paused false when a fetch after the pause worked.
+type SegmentBreakerHandler func(paused bool, failed, total int, cooldown time.Duration)
+
 // PollCompleteHandler is called once per poll cycle after both video and
 // audio playlists have been processed. Used to coordinate side effects that
 // must not interleave with segment processing (e.g. file rotation).
@@ -308,31 +799,45 @@ type PollCompleteHandler func() error
 // WatchAVSegments continuously fetches and processes video segments, and optional separate audio segments.
 func (p *Playlist) WatchAVSegments(ctx context.Context, handler WatchHandler, initHandler InitHandler, audioHandler WatchHandler, audioInitHandler InitHandler, pollComplete PollCompleteHandler) error {
 	var (
-		client           = internal.NewReq()
-		lastSeq          = -1
-		initWritten      = false
-		audioLastSeq     = -1
-		audioInitWritten = false
+		client          = internal.NewReq()
+		initURL         string
+		audioInitURL    string
+		subtitleInitURL string
 	)
 
 	for {
-		pollInterval, err := p.processMediaPlaylist(ctx, client, p.PlaylistURL, handler, initHandler, &lastSeq, &initWritten)
+		if err := p.waitBreaker(ctx); err != nil {
+			return err
+		}
+		pollInterval, err := p.processMediaPlaylist(ctx, client, p.PlaylistURL, handler, initHandler, &p.LastSeq, &initURL)
 		if err != nil {
 			return fmt.Errorf("video: %w", err)
 		}
 		if p.AudioPlaylistURL != "" {
-			audioInterval, err := p.processMediaPlaylist(ctx, client, p.AudioPlaylistURL, audioHandler, audioInitHandler, &audioLastSeq, &audioInitWritten)
+			audioInterval, err := p.processMediaPlaylist(ctx, client, p.AudioPlaylistURL, audioHandler, audioInitHandler, &p.AudioLastSeq, &audioInitURL)
 			if err != nil {
 				return fmt.Errorf("audio: %w", err)
 			}
 			pollInterval = pickPollInterval(pollInterval, audioInterval)
 		}
+		if p.SubtitlePlaylistURL != "" && p.OnSubtitleSegment != nil {
+			_, _ = p.processMediaPlaylist(ctx, client, p.SubtitlePlaylistURL, p.OnSubtitleSegment, nil, &p.SubtitleLastSeq, &subtitleInitURL)
+		}
 
 		if pollComplete != nil {
 			if err := pollComplete(); err != nil {
 				return fmt.Errorf("poll complete: %w", err)
 			}
 		}
+		// Ended after the last audio and subtitle segments of the poll are processed too
+		if p.endlist {
+			return fmt.Errorf("video: %w", internal.ErrStreamEndlist)
+		}
+		if !p.lowestVariant && p.ShouldDowngrade != nil && p.OnVariantDowngrade != nil && p.ShouldDowngrade() {
+			if err := p.downgradeVariant(ctx, client); err != nil {
+				return fmt.Errorf("video: %w", err)
+			}
+		}
 
 		// Use the playlist's target duration as the polling interval (minimum 2s)
 		// with random jitter to avoid synchronized requests across channels.
@@ -365,11 +870,128 @@ func pickPollInterval(current, candidate time.Duration) time.Duration {
 	return current
 }
 
-func (p *Playlist) processMediaPlaylist(ctx context.Context, client *internal.Req, playlistURL string, handler WatchHandler, initHandler InitHandler, lastSeq *int, initWritten *bool) (time.Duration, error) {
-	resp, err := client.Get(ctx, playlistURL)
+// segmentBreaker is the state of the circuit breaker of the segment fetches of a playlist.
+type segmentBreaker struct {
+	failed      []bool    // the outcome of the recent video and audio segment fetches, true if it failed
+	pausedUntil time.Time // the fetches pause until then, zero if they aren't paused
+	probing     bool      // the pause is over, the next fetch decides whether to pause again
+}
+
+// recordSegmentFetch counts the outcome of a video or audio segment fetch. The fetches are paused for
+// `--segment-error-cooldown` seconds once `--segment-error-rate` percent of the last `--segment-error-window`
+// failed, so a failing edge isn't hammered with retries. The first fetch after the pause is a probe,
+// the fetches pause again if it fails too.
+func (p *Playlist) recordSegmentFetch(failed bool) {
+	conf := server.Config
+	if conf == nil || conf.SegmentErrorRate <= 0 || conf.SegmentErrorWindow <= 0 {
+		return
+	}
+	b := &p.breaker
+	cooldown := time.Duration(conf.SegmentErrorCooldown) * time.Second
+
+	if b.probing {
+		b.probing = false
+		if failed {
+			b.pausedUntil = time.Now().Add(cooldown)
+			if p.OnSegmentBreaker != nil {
+				p.OnSegmentBreaker(true, 1, 1, cooldown)
+			}
+		} else if p.OnSegmentBreaker != nil {
+			p.OnSegmentBreaker(false, 0, 0, 0)
+		}
+		return
+	}
+
+	b.failed = append(b.failed, failed)
+	if len(b.failed) > conf.SegmentErrorWindow {
+		b.failed = b.failed[len(b.failed)-conf.SegmentErrorWindow:]
+	}
+	if len(b.failed) < conf.SegmentErrorWindow {
+		return
+	}
+	var n int
+	for _, f := range b.failed {
+		if f {
+			n++
+		}
+	}
+	if n*100 < conf.SegmentErrorRate*len(b.failed) {
+		return
+	}
+	total := len(b.failed)
+	b.failed = b.failed[:0]
+	b.pausedUntil = time.Now().Add(cooldown)
+	if p.OnSegmentBreaker != nil {
+		p.OnSegmentBreaker(true, n, total, cooldown)
+	}
+}
+
+// waitBreaker waits until the pause of the segment fetches is over, if they're paused.
+func (p *Playlist) waitBreaker(ctx context.Context) error {
+	b := &p.breaker
+	if b.pausedUntil.IsZero() {
+		return nil
+	}
+	timer := time.NewTimer(time.Until(b.pausedUntil))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	b.pausedUntil, b.probing = time.Time{}, true
+	return nil
+}
+
+// segmentSeq returns the sequence number from the segment URI, or the position from `EXT-X-MEDIA-SEQUENCE`
+// if the URI has no number instead of skipping the segment.
+func segmentSeq(v *m3u8.MediaSegment) int {
+	if seq := internal.SegmentSeq(v.URI); seq != -1 {
+		return seq
+	}
+	return int(v.SeqId)
+}
+
+// sequenceRange returns the first and last sequence number of the playlist, ok is false if it has no segments.
+func sequenceRange(playlist *m3u8.MediaPlaylist) (first, last int, ok bool) {
+	for _, v := range playlist.Segments {
+		if v == nil {
+			continue
+		}
+		seq := segmentSeq(v)
+		if !ok {
+			first = seq
+		}
+		last, ok = seq, true
+	}
+	return first, last, ok
+}
+
+// sequenceReset reports whether the sequence numbers restarted, i.e. the whole playlist window is
+// more than its own length behind lastSeq. A lagging edge serving a slightly stale playlist stays within it.
+func sequenceReset(lastSeq, first, last int) bool {
+	return lastSeq >= 0 && last+(last-first+1) < lastSeq
+}
+
+func (p *Playlist) processMediaPlaylist(ctx context.Context, client *internal.Req, playlistURL string, handler WatchHandler, initHandler InitHandler, lastSeq *int, initURL *string) (time.Duration, error) {
+	resp, err := client.GetPlaylist(ctx, playlistURL)
+	// The edge may be failing the stream, the next stream found probes the edges again
+	if err != nil && ctx.Err() == nil {
+		forgetEdge(playlistURL)
+	}
+	if errors.Is(err, internal.ErrNotFound) {
+		if playlistURL == p.PlaylistURL && p.OnVariantSwitch != nil {
+			return 0, p.switchVariant(ctx, client)
+		}
+		// The playlist is removed once the broadcast ends
+		return 0, internal.ErrStreamEnded
+	}
 	if err != nil {
 		return 0, fmt.Errorf("get playlist: %w", err)
 	}
+	if playlistURL == p.PlaylistURL {
+		p.variantNotFound = 0
+	}
 	pl, _, err := m3u8.DecodeFrom(strings.NewReader(resp), true)
 	if err != nil {
 		return 0, fmt.Errorf("decode from: %w", err)
@@ -379,41 +1001,60 @@ func (p *Playlist) processMediaPlaylist(ctx context.Context, client *internal.Re
 		return 0, fmt.Errorf("cast to media playlist")
 	}
 
-	if !*initWritten && playlist.Map != nil && playlist.Map.URI != "" {
-		initURL := resolveURL(playlistURL, playlist.Map.URI)
-		initData, initErr := retry.DoWithData(
-			func() ([]byte, error) {
-				return client.GetBytes(ctx, initURL)
-			},
-			retry.Context(ctx),
-			retry.Attempts(3),
-			retry.Delay(600*time.Millisecond),
-			retry.DelayType(retry.FixedDelay),
-		)
-		if initErr != nil {
-			return 0, fmt.Errorf("fetch init segment: %w", initErr)
-		}
-		if initHandler != nil {
-			if err := initHandler(initData); err != nil {
-				return 0, fmt.Errorf("handler init: %w", err)
+	// A stream restarted on the same playlist (e.g. an encoder restart or a reconnect into a reused source)
+	// numbers its segments from the start again, which would all be skipped as already processed.
+	if end, ok := p.reanchors[playlistURL]; ok {
+		delete(p.reanchors, playlistURL)
+		*lastSeq = anchorSequence(playlist, end)
+	}
+	if first, last, ok := sequenceRange(playlist); ok && sequenceReset(*lastSeq, first, last) {
+		previous := *lastSeq
+		*lastSeq = first - 1
+		if playlistURL == p.PlaylistURL && p.OnSequenceReset != nil {
+			if err := p.OnSequenceReset(previous, first); err != nil {
+				return 0, fmt.Errorf("handler sequence reset: %w", err)
 			}
 		}
-		*initWritten = true
 	}
 
-	for _, v := range playlist.Segments {
+	// An `EXT-X-MAP` applies to every following segment until the next one,
+	// the decoder only attaches it to the segment right after the tag.
+	initMap := playlist.Map
+	dates := segmentDates(playlist)
+
+	for i, v := range playlist.Segments {
 		if v == nil {
 			continue
 		}
-		seq := internal.SegmentSeq(v.URI)
-		if seq == -1 || seq <= *lastSeq {
+		if v.Map != nil {
+			initMap = v.Map
+		}
+		seq := segmentSeq(v)
+		if seq <= *lastSeq {
 			continue
 		}
 
+		// Fetch the init segment when it's first seen or changed (e.g. after a discontinuity).
+		if initMap != nil && initMap.URI != "" {
+			if u := resolveURL(playlistURL, initMap.URI); u != *initURL {
+				if err := fetchInitSegment(ctx, client, u, initHandler); err != nil {
+					return 0, err
+				}
+				*initURL = u
+			}
+		}
+
+		if v.Discontinuity && playlistURL == p.PlaylistURL && p.OnDiscontinuity != nil {
+			if err := p.OnDiscontinuity(seq); err != nil {
+				return 0, fmt.Errorf("handler discontinuity: %w", err)
+			}
+		}
+
 		segmentURL := resolveURL(playlistURL, v.URI)
+		fetchStart := time.Now()
 		resp, err := retry.DoWithData(
 			func() ([]byte, error) {
-				return client.GetBytes(ctx, segmentURL)
+				return client.GetSegment(ctx, segmentURL)
 			},
 			retry.Context(ctx),
 			retry.Attempts(3),
@@ -421,15 +1062,303 @@ func (p *Playlist) processMediaPlaylist(ctx context.Context, client *internal.Re
 			retry.DelayType(retry.FixedDelay),
 		)
 		if err != nil {
+			// The edge may be failing, the next stream on its host probes the edges again
+			if ctx.Err() == nil {
+				forgetEdge(segmentURL)
+				if playlistURL != p.SubtitlePlaylistURL {
+					p.recordSegmentFetch(true)
+				}
+			}
 			break
 		}
+		if playlistURL != p.SubtitlePlaylistURL {
+			p.recordSegmentFetch(false)
+		}
+		if p.OnSegmentFetched != nil && playlistURL != p.SubtitlePlaylistURL {
+			p.OnSegmentFetched(time.Since(fetchStart), v.Duration)
+		}
 		if handler != nil {
 			if err := handler(resp, v.Duration); err != nil {
 				return 0, fmt.Errorf("handler: %w", err)
 			}
 		}
 		*lastSeq = seq
+		if !dates[i].IsZero() {
+			p.setLastEnd(playlistURL, dates[i].Add(segmentDuration(v)))
+		}
+	}
+
+	// The stream ended for good, unless a segment failed and is retried on the next poll
+	if playlist.Closed && playlistURL == p.PlaylistURL && endlistStops() {
+		if _, last, ok := sequenceRange(playlist); !ok || *lastSeq >= last {
+			p.endlist = true
+		}
 	}
 
 	return time.Duration(playlist.TargetDuration) * time.Second, nil
 }
+
+// endlistStops reports whether a playlist ending with `EXT-X-ENDLIST` ends the stream, see `--on-endlist`.
+func endlistStops() bool {
+	return server.Config == nil || server.Config.OnEndlist != entity.OnEndlistIgnore
+}
+
+// SkipBackfill moves LastSeq, AudioLastSeq and SubtitleLastSeq to the last segment their media playlists list now,
+// so only the segments published afterwards are processed. The subtitles are optional and their errors ignored.
+func (p *Playlist) SkipBackfill(ctx context.Context) error {
+	client := internal.NewReq()
+	seq, err := lastSequence(ctx, client, p.PlaylistURL)
+	if err != nil {
+		return fmt.Errorf("video: %w", err)
+	}
+	p.LastSeq = max(p.LastSeq, seq)
+	if p.AudioPlaylistURL != "" {
+		seq, err := lastSequence(ctx, client, p.AudioPlaylistURL)
+		if err != nil {
+			return fmt.Errorf("audio: %w", err)
+		}
+		p.AudioLastSeq = max(p.AudioLastSeq, seq)
+	}
+	if p.SubtitlePlaylistURL != "" {
+		if seq, err := lastSequence(ctx, client, p.SubtitlePlaylistURL); err == nil {
+			p.SubtitleLastSeq = max(p.SubtitleLastSeq, seq)
+		}
+	}
+	return nil
+}
+
+// lastSequence returns the sequence number of the last segment of the media playlist, -1 if it has none.
+func lastSequence(ctx context.Context, client *internal.Req, playlistURL string) (int, error) {
+	resp, err := client.GetPlaylist(ctx, playlistURL)
+	if err != nil {
+		return 0, fmt.Errorf("get playlist: %w", err)
+	}
+	pl, _, err := m3u8.DecodeFrom(strings.NewReader(resp), true)
+	if err != nil {
+		return 0, fmt.Errorf("decode from: %w", err)
+	}
+	playlist, ok := pl.(*m3u8.MediaPlaylist)
+	if !ok {
+		return 0, fmt.Errorf("cast to media playlist")
+	}
+	if _, last, ok := sequenceRange(playlist); ok {
+		return last, nil
+	}
+	return -1, nil
+}
+
+// variantNotFoundLimit is how many polls in a row the video playlist may return 404
+// while the master playlist still lists it before another variant is picked.
+const variantNotFoundLimit = 3
+
+// switchVariant replaces the video playlist that returned 404 with another variant of the master playlist
+// at the same or the nearest resolution, e.g. after the encoder ladder was reshuffled. A variant the master
+// playlist still lists is retried on the next polls first. The stream ended if the master playlist is gone
+// or has no other variant.
+func (p *Playlist) switchVariant(ctx context.Context, client *internal.Req) error {
+	resp, err := client.GetPlaylist(ctx, p.RootURL)
+	if errors.Is(err, internal.ErrNotFound) {
+		return internal.ErrStreamEnded
+	}
+	if err != nil {
+		return fmt.Errorf("get master playlist: %w", err)
+	}
+	pl, _, err := m3u8.DecodeFrom(strings.NewReader(resp), true)
+	master, ok := pl.(*m3u8.MasterPlaylist)
+	if err != nil || !ok {
+		return internal.ErrStreamEnded
+	}
+
+	var others []*m3u8.Variant
+	for _, v := range master.Variants {
+		if v != nil && resolveURL(p.RootURL, v.URI) != p.PlaylistURL {
+			others = append(others, v)
+		}
+	}
+	if len(others) < len(master.Variants) {
+		if p.variantNotFound++; p.variantNotFound < variantNotFoundLimit {
+			return nil
+		}
+	}
+	if len(others) == 0 {
+		return internal.ErrStreamEnded
+	}
+
+	others = capBitrate(others, p.MaxBitrate)
+	next, err := PickPlaylist(&m3u8.MasterPlaylist{Variants: others}, p.RootURL, nearestResolution(others, p.Resolution), p.Framerate, p.MaxBitrate)
+	if err != nil {
+		return fmt.Errorf("pick playlist: %w", err)
+	}
+	p.useVariant(next)
+	p.variantNotFound = 0
+	if err := p.OnVariantSwitch(next.Resolution, next.Framerate, next.AudioPlaylistURL != ""); err != nil {
+		return fmt.Errorf("handler variant switch: %w", err)
+	}
+	return nil
+}
+
+// downgradeVariant replaces the video playlist with the highest variant of the master playlist below its resolution,
+// the recording continues where the old variant stopped like with switchVariant. A master playlist that can't be
+// fetched is retried the next time a step down is wanted, only the error of OnVariantDowngrade is returned.
+func (p *Playlist) downgradeVariant(ctx context.Context, client *internal.Req) error {
+	resp, err := client.GetPlaylist(ctx, p.RootURL)
+	if err != nil {
+		return nil
+	}
+	pl, _, err := m3u8.DecodeFrom(strings.NewReader(resp), true)
+	master, ok := pl.(*m3u8.MasterPlaylist)
+	if err != nil || !ok {
+		return nil
+	}
+
+	// Without an exact match PickPlaylist picks the highest resolution below the requested one
+	next, err := PickPlaylist(master, p.RootURL, p.Resolution-1, p.Framerate, p.MaxBitrate)
+	if err != nil || next.Resolution >= p.Resolution {
+		p.lowestVariant = true
+		return nil
+	}
+	p.useVariant(next)
+	if err := p.OnVariantDowngrade(next.Resolution, next.Framerate, next.AudioPlaylistURL != ""); err != nil {
+		return fmt.Errorf("handler variant downgrade: %w", err)
+	}
+	return nil
+}
+
+// useVariant moves the playlist to the media playlists of another variant of the master playlist. The sequence numbers
+// of the variants aren't related, so the cursor of each playlist that changed is re-anchored on its next poll.
+func (p *Playlist) useVariant(next *Playlist) {
+	p.reanchor(p.PlaylistURL, next.PlaylistURL)
+	p.reanchor(p.AudioPlaylistURL, next.AudioPlaylistURL)
+	p.reanchor(p.SubtitlePlaylistURL, next.SubtitlePlaylistURL)
+	p.PlaylistURL, p.AudioPlaylistURL, p.SubtitlePlaylistURL = next.PlaylistURL, next.AudioPlaylistURL, next.SubtitlePlaylistURL
+	p.Resolution, p.Framerate = next.Resolution, next.Framerate
+}
+
+// reanchor moves the cursor of the media playlist from to the playlist to on its next poll, after the segments
+// that end by where the last processed segment of from ended (see anchorSequence).
+func (p *Playlist) reanchor(from, to string) {
+	if from == to || to == "" {
+		return
+	}
+	if p.reanchors == nil {
+		p.reanchors = map[string]time.Time{}
+	}
+	// A playlist replaced before its first poll passes its own anchor on
+	end, ok := p.reanchors[from]
+	if !ok {
+		end = p.lastEnds[from]
+	}
+	p.reanchors[to] = end
+	delete(p.reanchors, from)
+	delete(p.lastEnds, from)
+}
+
+// setLastEnd stores where the last processed segment of the media playlist ends, see reanchor.
+func (p *Playlist) setLastEnd(playlistURL string, end time.Time) {
+	if p.lastEnds == nil {
+		p.lastEnds = map[string]time.Time{}
+	}
+	p.lastEnds[playlistURL] = end
+}
+
+// anchorSequence returns the sequence number to continue after in the playlist of another variant: the last segment
+// covered by end, the EXT-X-PROGRAM-DATE-TIME where the last processed segment of the old variant ended. A segment is
+// covered when at least half of it is. Without the date-times it's the live edge, since a gap in the recording
+// is better than segments recorded twice.
+func anchorSequence(playlist *m3u8.MediaPlaylist, end time.Time) int {
+	first, last, ok := sequenceRange(playlist)
+	if !ok {
+		return -1
+	}
+	if end.IsZero() {
+		return last
+	}
+	seq := first - 1
+	for i, date := range segmentDates(playlist) {
+		v := playlist.Segments[i]
+		if v == nil {
+			continue
+		}
+		if date.IsZero() {
+			return last
+		}
+		if !date.Add(segmentDuration(v) / 2).After(end) {
+			seq = segmentSeq(v)
+		}
+	}
+	return seq
+}
+
+// segmentDates returns when each segment of the playlist starts by EXT-X-PROGRAM-DATE-TIME, zero if it's unknown.
+// The tag may only be set on some segments, the ones after it start where the one before ended.
+func segmentDates(playlist *m3u8.MediaPlaylist) []time.Time {
+	dates := make([]time.Time, len(playlist.Segments))
+	var next time.Time
+	for i, v := range playlist.Segments {
+		if v == nil {
+			continue
+		}
+		if !v.ProgramDateTime.IsZero() {
+			next = v.ProgramDateTime
+		}
+		if next.IsZero() {
+			continue
+		}
+		dates[i] = next
+		next = next.Add(segmentDuration(v))
+	}
+	return dates
+}
+
+// segmentDuration returns the duration of the segment by its EXTINF.
+func segmentDuration(v *m3u8.MediaSegment) time.Duration {
+	return time.Duration(v.Duration * float64(time.Second))
+}
+
+// nearestResolution returns resolution if a variant is at or below it, PickPlaylist picks the closest one then,
+// otherwise the lowest resolution above it.
+func nearestResolution(variants []*m3u8.Variant, resolution int) int {
+	above := 0
+	for _, v := range variants {
+		parts := strings.Split(v.Resolution, "x")
+		if len(parts) != 2 {
+			continue
+		}
+		height, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		if height <= resolution {
+			return resolution
+		}
+		if above == 0 || height < above {
+			above = height
+		}
+	}
+	if above == 0 {
+		return resolution
+	}
+	return above
+}
+
+// fetchInitSegment downloads the fMP4 init segment and passes it to the handler.
+func fetchInitSegment(ctx context.Context, client *internal.Req, initURL string, initHandler InitHandler) error {
+	initData, err := retry.DoWithData(
+		func() ([]byte, error) {
+			return client.GetSegment(ctx, initURL)
+		},
+		retry.Context(ctx),
+		retry.Attempts(3),
+		retry.Delay(600*time.Millisecond),
+		retry.DelayType(retry.FixedDelay),
+	)
+	if err != nil {
+		return fmt.Errorf("fetch init segment: %w", err)
+	}
+	if initHandler != nil {
+		if err := initHandler(initData); err != nil {
+			return fmt.Errorf("handler init: %w", err)
+		}
+	}
+	return nil
+}
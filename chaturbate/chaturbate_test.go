@@ -2,13 +2,17 @@ package chaturbate
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/grafov/m3u8"
+	"github.com/samber/lo"
 	"github.com/teacat/chaturbate-dvr/entity"
 	"github.com/teacat/chaturbate-dvr/internal"
 	"github.com/teacat/chaturbate-dvr/server"
@@ -33,7 +37,7 @@ func TestPickPlaylistIncludesDefaultAudioRendition(t *testing.T) {
 		},
 	}
 
-	playlist, err := PickPlaylist(master, "https://example.com/master.m3u8", 1080, 60)
+	playlist, err := PickPlaylist(master, "https://example.com/master.m3u8", 1080, 60, 0)
 	if err != nil {
 		t.Fatalf("PickPlaylist() error = %v", err)
 	}
@@ -45,6 +49,71 @@ func TestPickPlaylistIncludesDefaultAudioRendition(t *testing.T) {
 	}
 }
 
+func TestPickPlaylistResolvesVariantURIs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		master  string
+		uri     string
+		wantURL string
+	}{
+		{"relative", "https://edge1-lax.live.mmcdn.com/live-hls/amlst:alice/playlist.m3u8", "chunklist_720.m3u8", "https://edge1-lax.live.mmcdn.com/live-hls/amlst:alice/chunklist_720.m3u8"},
+		{"relative to a parent", "https://example.com/hls/alice/master.m3u8", "../720p/index.m3u8", "https://example.com/hls/720p/index.m3u8"},
+		{"root-relative", "https://example.com/hls/alice/master.m3u8", "/v1/720p.m3u8?token=abc", "https://example.com/v1/720p.m3u8?token=abc"},
+		{"absolute", "https://example.com/hls/alice/playlist.m3u8", "https://cdn.example.net/alice/720p.m3u8", "https://cdn.example.net/alice/720p.m3u8"},
+		{"master with a query", "https://example.com/hls/alice/llhls.m3u8?session=1", "720p.m3u8?session=1", "https://example.com/hls/alice/720p.m3u8?session=1"},
+	}
+	for _, tt := range tests {
+		master := &m3u8.MasterPlaylist{
+			Variants: []*m3u8.Variant{
+				{URI: tt.uri, VariantParams: m3u8.VariantParams{Resolution: "1280x720", FrameRate: 30}},
+			},
+		}
+		playlist, err := PickPlaylist(master, tt.master, 720, 30, 0)
+		if err != nil {
+			t.Fatalf("%s: PickPlaylist() error = %v", tt.name, err)
+		}
+		if playlist.PlaylistURL != tt.wantURL {
+			t.Errorf("%s: PlaylistURL = %q, want %q", tt.name, playlist.PlaylistURL, tt.wantURL)
+		}
+	}
+}
+
+func TestPickPlaylistIncludesSubtitleRendition(t *testing.T) {
+	t.Parallel()
+
+	master := &m3u8.MasterPlaylist{
+		Variants: []*m3u8.Variant{
+			{URI: "video-720.m3u8", VariantParams: m3u8.VariantParams{Resolution: "1280x720"}},
+			{
+				URI: "video-1080.m3u8",
+				VariantParams: m3u8.VariantParams{
+					Resolution: "1920x1080",
+					Alternatives: []*m3u8.Alternative{
+						{Type: "SUBTITLES", GroupId: "subs", URI: "subs-es.m3u8", Name: "Spanish"},
+						{Type: "SUBTITLES", GroupId: "subs", URI: "subs-en.m3u8", Name: "English", Default: true},
+					},
+				},
+			},
+		},
+	}
+
+	// The renditions are attached to the 1080p variant but apply to the 720p one too
+	playlist, err := PickPlaylist(master, "https://example.com/master.m3u8", 720, 30, 0)
+	if err != nil {
+		t.Fatalf("PickPlaylist() error = %v", err)
+	}
+	if got, want := playlist.SubtitlePlaylistURL, "https://example.com/subs-en.m3u8"; got != want {
+		t.Fatalf("SubtitlePlaylistURL = %q, want %q", got, want)
+	}
+
+	master.Variants[1].Alternatives = nil
+	if playlist, err = PickPlaylist(master, "https://example.com/master.m3u8", 720, 30, 0); err != nil || playlist.SubtitlePlaylistURL != "" {
+		t.Fatalf("PickPlaylist() = %q, %v, want no subtitles", playlist.SubtitlePlaylistURL, err)
+	}
+}
+
 // TestProcessMediaPlaylistKeepsLastSeqOnFetchFailure guards against silent
 // segment drop: if a segment fetch fails, lastSeq must not advance past the
 // failed segment, so the next playlist poll can retry it (or at minimum not
@@ -106,8 +175,8 @@ func TestProcessMediaPlaylistKeepsLastSeqOnFetchFailure(t *testing.T) {
 	}
 
 	lastSeq := -1
-	initWritten := false
-	_, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, nil, &lastSeq, &initWritten)
+	initURL := ""
+	_, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, nil, &lastSeq, &initURL)
 	if err != nil {
 		t.Fatalf("processMediaPlaylist() error = %v", err)
 	}
@@ -119,3 +188,1036 @@ func TestProcessMediaPlaylistKeepsLastSeqOnFetchFailure(t *testing.T) {
 		t.Fatalf("lastSeq = %d, want 100 (must not advance past failed segment 101)", lastSeq)
 	}
 }
+
+// TestProcessMediaPlaylistResolvesSegmentURIs verifies that relative, root-relative, absolute and
+// query string segment URIs are fetched from where they point to, not appended to the root URL.
+func TestProcessMediaPlaylistResolvesSegmentURIs(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	var playlistBody string
+	var fetched []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hls/alice/chunklist.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(playlistBody))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.RequestURI())
+		_, _ = w.Write([]byte("data"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	playlistBody = strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-MEDIA-SEQUENCE:100",
+		"#EXTINF:2.000,",
+		"seg_100.ts",
+		"#EXTINF:2.000,",
+		"/segments/alice/seg_101.ts",
+		"#EXTINF:2.000,",
+		srv.URL + "/cdn/alice/seg_102.ts",
+		"#EXTINF:2.000,",
+		"../bob/seg_103.ts?token=abc",
+		"",
+	}, "\n")
+
+	pl := &Playlist{PlaylistURL: srv.URL + "/hls/alice/chunklist.m3u8", RootURL: srv.URL + "/hls/alice/playlist.m3u8", LastSeq: -1}
+	handlerCalls := 0
+	handler := func(_ []byte, _ float64) error {
+		handlerCalls++
+		return nil
+	}
+	initURL := ""
+	if _, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, nil, &pl.LastSeq, &initURL); err != nil {
+		t.Fatalf("processMediaPlaylist() error = %v", err)
+	}
+
+	want := []string{"/hls/alice/seg_100.ts", "/segments/alice/seg_101.ts", "/cdn/alice/seg_102.ts", "/hls/bob/seg_103.ts?token=abc"}
+	if strings.Join(fetched, " ") != strings.Join(want, " ") {
+		t.Fatalf("fetched = %v, want %v", fetched, want)
+	}
+	if handlerCalls != len(want) || pl.LastSeq != 103 {
+		t.Fatalf("handler called %d times, LastSeq = %d, want every segment written", handlerCalls, pl.LastSeq)
+	}
+}
+
+// TestProcessMediaPlaylistResumesFromLastSeq verifies that a reconnect which
+// presets lastSeq only downloads segments newer than the ones already written.
+func TestProcessMediaPlaylistResumesFromLastSeq(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	playlistBody := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-MEDIA-SEQUENCE:100",
+		"#EXTINF:2.000,",
+		"seg_1_100_video_abc.m4s",
+		"#EXTINF:2.000,",
+		"seg_2_101_video_abc.m4s",
+		"#EXTINF:2.000,",
+		"seg_3_102_video_abc.m4s",
+		"",
+	}, "\n")
+
+	var fetched []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(playlistBody))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		_, _ = w.Write([]byte("data"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	pl := &Playlist{PlaylistURL: srv.URL + "/playlist.m3u8", LastSeq: 101}
+	initURL := ""
+	if _, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, nil, nil, &pl.LastSeq, &initURL); err != nil {
+		t.Fatalf("processMediaPlaylist() error = %v", err)
+	}
+
+	if len(fetched) != 1 || fetched[0] != "/seg_3_102_video_abc.m4s" {
+		t.Fatalf("fetched = %v, want only segment 102", fetched)
+	}
+	if pl.LastSeq != 102 {
+		t.Fatalf("LastSeq = %d, want 102", pl.LastSeq)
+	}
+}
+
+// A stream restarted on the same playlist numbers its segments from the start again,
+// they're recorded instead of being skipped as older than lastSeq.
+func TestProcessMediaPlaylistDetectsSequenceReset(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	playlistBody := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-MEDIA-SEQUENCE:3",
+		"#EXTINF:2.000,",
+		"media_w1_3.ts",
+		"#EXTINF:2.000,",
+		"media_w1_4.ts",
+		"",
+	}, "\n")
+
+	var events []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(playlistBody))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	pl := &Playlist{PlaylistURL: srv.URL + "/playlist.m3u8", LastSeq: 1200}
+	pl.OnSequenceReset = func(lastSeq, seq int) error {
+		events = append(events, fmt.Sprintf("reset %d->%d", lastSeq, seq))
+		return nil
+	}
+	handler := func(b []byte, _ float64) error {
+		events = append(events, string(b))
+		return nil
+	}
+
+	initURL := ""
+	if _, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, nil, &pl.LastSeq, &initURL); err != nil {
+		t.Fatalf("processMediaPlaylist() error = %v", err)
+	}
+	want := []string{"reset 1200->3", "/media_w1_3.ts", "/media_w1_4.ts"}
+	if strings.Join(events, ",") != strings.Join(want, ",") || pl.LastSeq != 4 {
+		t.Fatalf("events = %v, LastSeq = %d, want %v and 4", events, pl.LastSeq, want)
+	}
+
+	// A slightly stale playlist from a lagging edge is not a reset
+	if sequenceReset(6, 3, 4) {
+		t.Fatal("sequenceReset(6, 3, 4) = true, want false")
+	}
+}
+
+func TestProcessMediaPlaylistReportsDiscontinuity(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	playlistBody := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-MEDIA-SEQUENCE:100",
+		"#EXTINF:2.000,",
+		"media_w1_100.ts",
+		"#EXT-X-DISCONTINUITY",
+		"#EXTINF:2.000,",
+		"media_w1_101.ts",
+		"",
+	}, "\n")
+
+	var events []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(playlistBody))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	pl := &Playlist{PlaylistURL: srv.URL + "/playlist.m3u8", LastSeq: -1}
+	pl.OnDiscontinuity = func(_ int) error {
+		events = append(events, "discontinuity")
+		return nil
+	}
+	handler := func(b []byte, _ float64) error {
+		events = append(events, string(b))
+		return nil
+	}
+
+	initURL := ""
+	if _, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, nil, &pl.LastSeq, &initURL); err != nil {
+		t.Fatalf("processMediaPlaylist() error = %v", err)
+	}
+
+	want := []string{"/media_w1_100.ts", "discontinuity", "/media_w1_101.ts"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+}
+
+func TestProcessMediaPlaylistFetchesInitSegments(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	playlistBody := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-MEDIA-SEQUENCE:100",
+		`#EXT-X-MAP:URI="init_1.mp4"`,
+		"#EXTINF:2.000,",
+		"seg_1_100_video_1_llhls.m4s",
+		"#EXTINF:2.000,",
+		"seg_1_101_video_1_llhls.m4s",
+		"#EXT-X-DISCONTINUITY",
+		`#EXT-X-MAP:URI="init_2.mp4"`,
+		"#EXTINF:2.000,",
+		"seg_1_102_video_1_llhls.m4s",
+		"#EXTINF:2.000,",
+		"seg_1_103_video_1_llhls.m4s",
+		"",
+	}, "\n")
+
+	var events []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(playlistBody))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	pl := &Playlist{PlaylistURL: srv.URL + "/playlist.m3u8", LastSeq: -1}
+	pl.OnDiscontinuity = func(_ int) error {
+		events = append(events, "discontinuity")
+		return nil
+	}
+	handler := func(b []byte, _ float64) error {
+		events = append(events, string(b))
+		return nil
+	}
+	initHandler := func(b []byte) error {
+		events = append(events, "init "+string(b))
+		return nil
+	}
+
+	initURL := ""
+	if _, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, initHandler, &pl.LastSeq, &initURL); err != nil {
+		t.Fatalf("processMediaPlaylist() error = %v", err)
+	}
+	want := []string{
+		"init /init_1.mp4",
+		"/seg_1_100_video_1_llhls.m4s",
+		"/seg_1_101_video_1_llhls.m4s",
+		"init /init_2.mp4",
+		"discontinuity",
+		"/seg_1_102_video_1_llhls.m4s",
+		"/seg_1_103_video_1_llhls.m4s",
+	}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+
+	// A reconnect starts without a known init segment and must fetch the current one,
+	// even when resuming past the segments that introduced it.
+	events = nil
+	pl.LastSeq = 102
+	initURL = ""
+	if _, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, initHandler, &pl.LastSeq, &initURL); err != nil {
+		t.Fatalf("processMediaPlaylist() error = %v", err)
+	}
+	want = []string{"init /init_2.mp4", "/seg_1_103_video_1_llhls.m4s"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("events after reconnect = %v, want %v", events, want)
+	}
+}
+
+func TestProcessMediaPlaylistFallsBackToMediaSequence(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	playlistBody := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:2",
+		"#EXT-X-MEDIA-SEQUENCE:500",
+		"#EXTINF:2.000,",
+		"segment.ts?part=a",
+		"#EXTINF:2.000,",
+		"segment.ts?part=b",
+		"",
+	}, "\n")
+
+	var got []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(playlistBody))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Query().Get("part")))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	pl := &Playlist{PlaylistURL: srv.URL + "/playlist.m3u8", LastSeq: -1}
+	handler := func(b []byte, _ float64) error {
+		got = append(got, string(b))
+		return nil
+	}
+
+	initURL := ""
+	if _, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, nil, &pl.LastSeq, &initURL); err != nil {
+		t.Fatalf("processMediaPlaylist() error = %v", err)
+	}
+	if strings.Join(got, ",") != "a,b" {
+		t.Fatalf("segments = %v, want [a b]", got)
+	}
+	if pl.LastSeq != 501 {
+		t.Fatalf("LastSeq = %d, want 501", pl.LastSeq)
+	}
+}
+
+func TestPickPlaylistFramerate(t *testing.T) {
+	t.Parallel()
+
+	master := &m3u8.MasterPlaylist{
+		Variants: []*m3u8.Variant{
+			{URI: "1080p30.m3u8", VariantParams: m3u8.VariantParams{Resolution: "1920x1080", FrameRate: 30}},
+			{URI: "1080p60.m3u8", VariantParams: m3u8.VariantParams{Resolution: "1920x1080", FrameRate: 60}},
+			{URI: "720p30.m3u8", VariantParams: m3u8.VariantParams{Resolution: "1280x720", FrameRate: 30}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		resolution int
+		framerate  int
+		wantURL    string
+		wantFPS    int
+	}{
+		{"exact", 1080, 30, "https://example.com/1080p30.m3u8", 30},
+		{"any prefers highest", 1080, FramerateAny, "https://example.com/1080p60.m3u8", 60},
+		{"any with single framerate", 720, FramerateAny, "https://example.com/720p30.m3u8", 30},
+		{"fallback below requested", 720, 60, "https://example.com/720p30.m3u8", 30},
+		{"fallback above requested", 1080, 24, "https://example.com/1080p30.m3u8", 30},
+	}
+	for _, tt := range tests {
+		playlist, err := PickPlaylist(master, "https://example.com/playlist.m3u8", tt.resolution, tt.framerate, 0)
+		if err != nil {
+			t.Fatalf("%s: PickPlaylist() error = %v", tt.name, err)
+		}
+		if playlist.PlaylistURL != tt.wantURL || playlist.Framerate != tt.wantFPS {
+			t.Fatalf("%s: got (%q, %d), want (%q, %d)", tt.name, playlist.PlaylistURL, playlist.Framerate, tt.wantURL, tt.wantFPS)
+		}
+	}
+}
+
+func TestPickPlaylistMaxBitrate(t *testing.T) {
+	t.Parallel()
+
+	master := &m3u8.MasterPlaylist{
+		Variants: []*m3u8.Variant{
+			{URI: "1080p.m3u8", VariantParams: m3u8.VariantParams{Resolution: "1920x1080", Bandwidth: 6000000}},
+			{URI: "720p.m3u8", VariantParams: m3u8.VariantParams{Resolution: "1280x720", Bandwidth: 3500000}},
+			{URI: "480p.m3u8", VariantParams: m3u8.VariantParams{Resolution: "854x480", Bandwidth: 1500000}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		maxBitrate int
+		wantURL    string
+	}{
+		{"no cap", 0, "https://example.com/1080p.m3u8"},
+		{"capped below the requested resolution", 4000, "https://example.com/720p.m3u8"},
+		{"exactly at the cap", 1500, "https://example.com/480p.m3u8"},
+		{"all above the cap picks the lowest", 1000, "https://example.com/480p.m3u8"},
+	}
+	for _, tt := range tests {
+		playlist, err := PickPlaylist(master, "https://example.com/playlist.m3u8", 1080, 30, tt.maxBitrate)
+		if err != nil {
+			t.Fatalf("%s: PickPlaylist() error = %v", tt.name, err)
+		}
+		if playlist.PlaylistURL != tt.wantURL || playlist.MaxBitrate != tt.maxBitrate {
+			t.Fatalf("%s: got %q capped at %d, want %q", tt.name, playlist.PlaylistURL, playlist.MaxBitrate, tt.wantURL)
+		}
+	}
+}
+
+func TestFilterResolutions(t *testing.T) {
+	t.Parallel()
+
+	newResolutions := func() map[int]*Resolution {
+		resolutions := map[int]*Resolution{}
+		for _, width := range []int{240, 480, 720, 1080, 1440} {
+			resolutions[width] = &Resolution{Width: width}
+		}
+		return resolutions
+	}
+
+	resolutions := newResolutions()
+	if err := filterResolutions(resolutions, []int{480, 720, 1080}, []int{1080}); err != nil {
+		t.Fatalf("filterResolutions() error = %v", err)
+	}
+	if got := lo.Keys(resolutions); len(got) != 2 || resolutions[480] == nil || resolutions[720] == nil {
+		t.Fatalf("filterResolutions() kept %v, want 480 and 720", got)
+	}
+
+	err := filterResolutions(newResolutions(), []int{360}, nil)
+	if !errors.Is(err, internal.ErrNoAllowedVariant) || !strings.Contains(err.Error(), "240p, 480p, 720p, 1080p, 1440p") {
+		t.Fatalf("filterResolutions() error = %v, want ErrNoAllowedVariant listing the resolutions", err)
+	}
+}
+
+func TestGetFollowedPages(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("offset") {
+		case "0":
+			fmt.Fprint(w, `{"rooms":[{"username":"alice"},{"username":"bob"}],"total_count":3}`)
+		case "2":
+			fmt.Fprint(w, `{"rooms":[{"username":"carol"}],"total_count":3}`)
+		default:
+			t.Errorf("unexpected offset %q", r.URL.Query().Get("offset"))
+		}
+	}))
+	defer srv.Close()
+
+	usernames, err := NewClient().GetFollowed(context.Background(), srv.URL+"/api/ts/roomlist/room-list/?follow=true")
+	if err != nil {
+		t.Fatalf("GetFollowed() error = %v", err)
+	}
+	if got := strings.Join(usernames, ","); got != "alice,bob,carol" {
+		t.Fatalf("GetFollowed() = %q, want %q", got, "alice,bob,carol")
+	}
+
+	// Without a logged-in session the login page is returned
+	if _, _, err := parseFollowed([]byte("<html>")); err == nil {
+		t.Fatal("parseFollowed(login page) error = nil, want an error")
+	}
+}
+
+func TestAPIResponseTags(t *testing.T) {
+	t.Parallel()
+
+	resp := &APIResponse{RoomTitle: "Goal: dance #Lovense #new-model, #lovense #18"}
+	if got, want := strings.Join(resp.Tags(), ","), "lovense,new-model,18"; got != want {
+		t.Fatalf("Tags() = %q, want %q", got, want)
+	}
+	if tags := (&APIResponse{}).Tags(); len(tags) != 0 {
+		t.Fatalf("Tags() = %v, want none", tags)
+	}
+}
+
+func TestEdgeRegion(t *testing.T) {
+	t.Parallel()
+
+	for url, want := range map[string]string{
+		"https://edge14-sin.live.mmcdn.com/live-hls/amlst:user/playlist.m3u8": "sin",
+		"https://edge3-lax.live.mmcdn.com/live-edge/playlist.m3u8":            "lax",
+		"https://cdn.example.com/playlist.m3u8":                               "",
+	} {
+		if got := edgeRegion(url); got != want {
+			t.Errorf("edgeRegion(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestFetchStreamResponseFallsBackToAlternateEndpoint(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/primary/alice/", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"room_status":"public","hls_source":""}`))
+	})
+	mux.HandleFunc("/broken/alice/", func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/alternate/alice/", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"room_status":"public","hls_source":"https://edge1-lax.live.mmcdn.com/playlist.m3u8"}`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	urls := apiEndpointURLs(srv.URL+"/", []string{"primary/{username}/", "/broken/{username}/", srv.URL + "/alternate/{username}/"}, "alice")
+	if urls[1] != srv.URL+"/broken/alice/" || urls[2] != srv.URL+"/alternate/alice/" {
+		t.Fatalf("apiEndpointURLs() = %v", urls)
+	}
+
+	resp, err := fetchStreamResponse(context.Background(), internal.NewReq(), urls)
+	if err != nil {
+		t.Fatalf("fetchStreamResponse() error = %v", err)
+	}
+	if resp.HLSSource != "https://edge1-lax.live.mmcdn.com/playlist.m3u8" {
+		t.Fatalf("HLSSource = %q, want the alternate one", resp.HLSSource)
+	}
+
+	// Only the primary is used when the room isn't public
+	mux.HandleFunc("/private/alice/", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"room_status":"private","hls_source":""}`))
+	})
+	resp, err = fetchStreamResponse(context.Background(), internal.NewReq(), apiEndpointURLs(srv.URL+"/", []string{"private/{username}/", "alternate/{username}/"}, "alice"))
+	if err != nil || resp.RoomStatus != StatusPrivate || resp.HLSSource != "" {
+		t.Fatalf("fetchStreamResponse() = %+v, %v, want the private primary response", resp, err)
+	}
+}
+
+func TestProcessMediaPlaylistReportsStreamEnded(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	for _, status := range []int{http.StatusNotFound, http.StatusGone} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "gone", status)
+		}))
+		t.Cleanup(srv.Close)
+
+		pl := &Playlist{PlaylistURL: srv.URL + "/playlist.m3u8", LastSeq: -1}
+		initURL := ""
+		_, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, nil, nil, &pl.LastSeq, &initURL)
+		if !errors.Is(err, internal.ErrStreamEnded) {
+			t.Fatalf("status %d: error = %v, want %v", status, err, internal.ErrStreamEnded)
+		}
+	}
+}
+
+func TestProcessMediaPlaylistSwitchesVariantOn404(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	master := "#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720\na.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1900000,RESOLUTION=1280x720\nb.m3u8\n"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		if master == "" {
+			http.NotFound(w, nil)
+			return
+		}
+		_, _ = w.Write([]byte(master))
+	})
+	mux.HandleFunc("/a.m3u8", http.NotFound)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	var switches []string
+	pl := &Playlist{PlaylistURL: srv.URL + "/a.m3u8", RootURL: srv.URL + "/master.m3u8", Resolution: 720, Framerate: 30, LastSeq: -1}
+	pl.OnVariantSwitch = func(resolution, framerate int, _ bool) error {
+		switches = append(switches, fmt.Sprintf("%dp%d %s", resolution, framerate, strings.TrimPrefix(pl.PlaylistURL, srv.URL)))
+		return nil
+	}
+	poll := func() error {
+		initURL := ""
+		_, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, nil, nil, &pl.LastSeq, &initURL)
+		return err
+	}
+
+	// The master playlist still lists the variant, a 404 is retried before switching
+	for i := 1; i <= variantNotFoundLimit; i++ {
+		if err := poll(); err != nil {
+			t.Fatalf("poll %d: error = %v", i, err)
+		}
+		if (i < variantNotFoundLimit) != (len(switches) == 0) {
+			t.Fatalf("poll %d: switches = %v", i, switches)
+		}
+	}
+	if strings.Join(switches, ",") != "720p30 /b.m3u8" {
+		t.Fatalf("switches = %v, want [720p30 /b.m3u8]", switches)
+	}
+
+	// A variant gone from the master playlist is replaced right away, at the nearest resolution above if none is below
+	master = "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=4000000,RESOLUTION=1920x1080\nc.m3u8\n"
+	pl.PlaylistURL = srv.URL + "/a.m3u8"
+	if err := poll(); err != nil || switches[len(switches)-1] != "1080p30 /c.m3u8" {
+		t.Fatalf("error = %v, switches = %v, want 1080p30 /c.m3u8", err, switches)
+	}
+
+	// The stream ended once the master playlist is gone too
+	master = ""
+	pl.PlaylistURL = srv.URL + "/a.m3u8"
+	if err := poll(); !errors.Is(err, internal.ErrStreamEnded) {
+		t.Fatalf("error = %v, want %v", err, internal.ErrStreamEnded)
+	}
+}
+
+func TestMissingAPIFields(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"hls_source": "https://edge1-sin.live.mmcdn.com/live.m3u8", "room_status": "public"}`, ""},
+		{`{"hls_source": null, "room_status": "offline", "room_title": "hi"}`, ""},
+		{`{"hls_url": "https://edge1-sin.live.mmcdn.com/live.m3u8", "room_status": "public"}`, "hls_source"},
+		{`{"hls_source": "", "room_status": {"code": 1}}`, "room_status"},
+		{`{}`, "hls_source,room_status"},
+	}
+	for _, tt := range tests {
+		missing, err := missingAPIFields([]byte(tt.body))
+		if err != nil || strings.Join(missing, ",") != tt.want {
+			t.Errorf("missingAPIFields(%s) = %v, %v, want %q", tt.body, missing, err, tt.want)
+		}
+	}
+	if _, err := missingAPIFields([]byte("<html>Just a moment...</html>")); err == nil {
+		t.Errorf("missingAPIFields(html) error = nil, want an error")
+	}
+}
+
+func TestFetchPlaylistRetriesWithoutVariants(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	// The master playlist lists no variants for the first `empty` requests
+	var requests, empty atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) <= empty.Load() {
+			_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-VERSION:3\n"))
+			return
+		}
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000,RESOLUTION=1280x720\n720p.m3u8\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	empty.Store(2)
+	playlist, err := fetchPlaylistWithRetry(context.Background(), srv.URL+"/playlist.m3u8", 1080, 30, 0, 3, time.Millisecond)
+	if err != nil {
+		t.Fatalf("fetchPlaylistWithRetry() error = %v", err)
+	}
+	if requests.Load() != 3 || playlist.Resolution != 720 {
+		t.Fatalf("requests = %d, resolution = %d, want 3 requests and 720p", requests.Load(), playlist.Resolution)
+	}
+
+	// Giving up after the retries reports the missing variants
+	requests.Store(0)
+	empty.Store(10)
+	_, err = fetchPlaylistWithRetry(context.Background(), srv.URL+"/playlist.m3u8", 1080, 30, 0, 2, time.Millisecond)
+	if !errors.Is(err, internal.ErrNoVariants) || requests.Load() != 3 {
+		t.Fatalf("fetchPlaylistWithRetry() error = %v after %d requests, want %v after 3", err, requests.Load(), internal.ErrNoVariants)
+	}
+
+	// A variant list without a usable resolution is not retried
+	requests.Store(0)
+	empty.Store(0)
+	_, err = fetchPlaylistWithRetry(context.Background(), srv.URL+"/playlist.m3u8", 480, 30, 0, 3, time.Millisecond)
+	if err == nil || errors.Is(err, internal.ErrNoVariants) || requests.Load() != 1 {
+		t.Fatalf("fetchPlaylistWithRetry() error = %v after %d requests, want resolution not found after 1", err, requests.Load())
+	}
+}
+
+func TestGetStreamUnlocksPasswordRoom(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/chatvideocontext/alice/", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("room_unlocked"); err == nil {
+			_, _ = w.Write([]byte(`{"room_status":"password protected","hls_source":"https://edge1-lax.live.mmcdn.com/llhls.m3u8"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"room_status":"password protected","hls_source":""}`))
+	})
+	mux.HandleFunc("/roomlogin/alice/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.FormValue("password") != "secret" {
+			http.Error(w, "incorrect password", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "room_unlocked", Value: "1", Path: "/"})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	previous := server.Config
+	server.Config = &entity.Config{Domain: srv.URL + "/"}
+	t.Cleanup(func() { server.Config = previous })
+
+	client := NewClient()
+	if _, err := client.GetStream(context.Background(), "alice"); !errors.Is(err, internal.ErrRoomPassword) {
+		t.Fatalf("GetStream() without a password error = %v, want ErrRoomPassword", err)
+	}
+
+	client.RoomPassword = "wrong"
+	if _, err := client.GetStream(context.Background(), "alice"); !errors.Is(err, internal.ErrWrongRoomPassword) {
+		t.Fatalf("GetStream() with a wrong password error = %v, want ErrWrongRoomPassword", err)
+	}
+	if client.LastRoomStatus != StatusPassword {
+		t.Fatalf("LastRoomStatus = %q, want %q", client.LastRoomStatus, StatusPassword)
+	}
+
+	client.RoomPassword = "secret"
+	stream, err := client.GetStream(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("GetStream() with the password error = %v", err)
+	}
+	if stream.HLSSource != "https://edge1-lax.live.mmcdn.com/llhls.m3u8" {
+		t.Fatalf("HLSSource = %q, want the unlocked one", stream.HLSSource)
+	}
+}
+
+func TestFindWorkingEdgeURLFollowsRedirectsAndAcceptedStatuses(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/moved/playlist.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/live/playlist.m3u8", http.StatusFound)
+	})
+	mux.HandleFunc("/live/playlist.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/partial/playlist.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	previous := server.Config
+	server.Config = &entity.Config{}
+	t.Cleanup(func() { server.Config = previous })
+
+	got, err := findWorkingEdgeURL(context.Background(), internal.NewReq(), srv.URL+"/moved/playlist.m3u8")
+	if err != nil || got != srv.URL+"/live/playlist.m3u8" {
+		t.Fatalf("findWorkingEdgeURL(redirect) = %q, %v, want the redirect destination", got, err)
+	}
+
+	// Only 200 works by default, the URL isn't an edge so there's no other region to try
+	if _, err := findWorkingEdgeURL(context.Background(), internal.NewReq(), srv.URL+"/partial/playlist.m3u8"); err != nil {
+		t.Fatalf("findWorkingEdgeURL(206) error = %v, want the original URL of a non-edge host", err)
+	}
+	if edgeStatusOK(http.StatusPartialContent) {
+		t.Fatal("edgeStatusOK(206) = true by default, want only 200")
+	}
+	server.Config.EdgeOKStatuses = []string{"2xx"}
+	if !edgeStatusOK(http.StatusPartialContent) || edgeStatusOK(http.StatusNotFound) {
+		t.Fatal("edgeStatusOK() with 2xx accepted doesn't accept 206 only")
+	}
+	server.Config.EdgeOKStatuses = []string{"200", "206"}
+	if !edgeStatusOK(http.StatusPartialContent) || edgeStatusOK(http.StatusNoContent) {
+		t.Fatal("edgeStatusOK() with 200,206 accepted doesn't accept 206 only")
+	}
+}
+
+func TestFetchStreamRecordsPrivateShowOnlyWhenEnabled(t *testing.T) {
+	hlsSource := `"https://edge1-lax.live.mmcdn.com/llhls.m3u8"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"room_status":"private","hls_source":` + hlsSource + `}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	previous := server.Config
+	server.Config = &entity.Config{Domain: srv.URL + "/"}
+	t.Cleanup(func() { server.Config = previous })
+
+	if _, _, err := FetchStream(context.Background(), internal.NewReq(), "alice"); !errors.Is(err, internal.ErrPrivateStream) {
+		t.Fatalf("FetchStream() error = %v, want ErrPrivateStream by default", err)
+	}
+
+	server.Config.RecordPrivate = true
+	stream, status, err := FetchStream(context.Background(), internal.NewReq(), "alice")
+	if err != nil || status != StatusPrivate || stream.HLSSource != "https://edge1-lax.live.mmcdn.com/llhls.m3u8" {
+		t.Fatalf("FetchStream() with --record-private = %v, %q, %v, want the stream of the show", stream, status, err)
+	}
+
+	// A private show the session isn't in has no stream
+	hlsSource = `""`
+	if _, _, err := FetchStream(context.Background(), internal.NewReq(), "alice"); !errors.Is(err, internal.ErrPrivateStream) {
+		t.Fatalf("FetchStream() without a stream error = %v, want ErrPrivateStream", err)
+	}
+}
+
+func TestWatchAVSegmentsEndsOnEndlistAfterLastSegments(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:2.000,\nvideo_1.ts\n#EXTINF:2.000,\nvideo_2.ts\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/audio.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:2.000,\naudio_1.aac\n#EXTINF:2.000,\naudio_2.aac\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("data"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	pl := &Playlist{PlaylistURL: srv.URL + "/video.m3u8", AudioPlaylistURL: srv.URL + "/audio.m3u8", LastSeq: -1, AudioLastSeq: -1}
+	var video, audio int
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := pl.WatchAVSegments(ctx,
+		func([]byte, float64) error { video++; return nil }, nil,
+		func([]byte, float64) error { audio++; return nil }, nil, nil)
+	if !errors.Is(err, internal.ErrStreamEndlist) || !errors.Is(err, internal.ErrStreamEnded) {
+		t.Fatalf("WatchAVSegments() error = %v, want ErrStreamEndlist", err)
+	}
+	if video != 2 || audio != 2 {
+		t.Fatalf("handled %d video and %d audio segment(s), want all 2 of each before ending", video, audio)
+	}
+}
+
+func TestSkipBackfillStartsAfterListedSegments(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:2.000,\nvideo_5.ts\n#EXTINF:2.000,\nvideo_6.ts\n#EXTINF:2.000,\nvideo_7.ts\n"))
+	})
+	mux.HandleFunc("/audio.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:40\n#EXTINF:2.000,\naudio_40.aac\n#EXTINF:2.000,\naudio_41.aac\n"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	pl := &Playlist{PlaylistURL: srv.URL + "/video.m3u8", AudioPlaylistURL: srv.URL + "/audio.m3u8", LastSeq: -1, AudioLastSeq: -1}
+	if err := pl.SkipBackfill(context.Background()); err != nil {
+		t.Fatalf("SkipBackfill() error = %v", err)
+	}
+	if pl.LastSeq != 7 || pl.AudioLastSeq != 41 {
+		t.Fatalf("LastSeq, AudioLastSeq = %d, %d, want 7, 41", pl.LastSeq, pl.AudioLastSeq)
+	}
+
+	pl.AudioPlaylistURL = srv.URL + "/gone.m3u8"
+	if err := pl.SkipBackfill(context.Background()); err == nil {
+		t.Fatal("SkipBackfill() with a missing audio playlist, want an error")
+	}
+}
+
+func TestFindWorkingEdgeURLReusesCachedEdgeUntilForgotten(t *testing.T) {
+	t.Parallel()
+
+	// The working URL after the redirects is cached
+	working := "https://edge92-fra.live.mmcdn.com/v2/amlst:alice/playlist.m3u8?session=1"
+	cacheEdge("https://edge92-sin.live.mmcdn.com/live-hls/amlst:alice/playlist.m3u8", working)
+
+	// No request is made, the hosts don't resolve
+	got, err := findWorkingEdgeURL(context.Background(), internal.NewReq(), "https://edge92-sin.live.mmcdn.com/live-hls/amlst:alice/playlist.m3u8?t=2")
+	if err != nil || got != working {
+		t.Fatalf("findWorkingEdgeURL() = %q, %v, want the cached %q", got, err, working)
+	}
+
+	// Another broadcaster on the same edge host is validated on its own, it may be region locked
+	if cached, ok := cachedEdge("https://edge92-sin.live.mmcdn.com/live-hls/amlst:bob/playlist.m3u8"); ok {
+		t.Fatalf("cachedEdge() = %q for another broadcaster, want none", cached)
+	}
+
+	forgetEdge("https://edge92-fra.live.mmcdn.com/v2/amlst:alice/media_12.ts")
+	if cached, ok := cachedEdge("https://edge92-sin.live.mmcdn.com/live-hls/amlst:alice/playlist.m3u8"); ok {
+		t.Fatalf("cachedEdge() = %q after a segment failed on the edge, want none", cached)
+	}
+
+	// Only the edge hosts are cached
+	cacheEdge("https://example.com/playlist.m3u8", "https://example.com/playlist.m3u8")
+	if cached, ok := cachedEdge("https://example.com/playlist.m3u8"); ok {
+		t.Fatalf("cachedEdge() = %q for a host that isn't an edge, want none", cached)
+	}
+}
+
+func TestSegmentBreakerPausesAndProbes(t *testing.T) {
+	previous := server.Config
+	server.Config = &entity.Config{SegmentErrorRate: 50, SegmentErrorWindow: 4, SegmentErrorCooldown: 0}
+	t.Cleanup(func() { server.Config = previous })
+
+	type call struct {
+		paused        bool
+		failed, total int
+	}
+	var calls []call
+	pl := &Playlist{OnSegmentBreaker: func(paused bool, failed, total int, _ time.Duration) {
+		calls = append(calls, call{paused, failed, total})
+	}}
+
+	// 1 of the last 4 failed is below the rate, 2 reach it
+	for _, failed := range []bool{true, false, false, false, false, true, true} {
+		pl.recordSegmentFetch(failed)
+	}
+	if len(calls) != 1 || calls[0] != (call{true, 2, 4}) {
+		t.Fatalf("breaker calls = %v, want a pause after 2 of the last 4 fetches failed", calls)
+	}
+	if err := pl.waitBreaker(context.Background()); err != nil || !pl.breaker.probing {
+		t.Fatalf("waitBreaker() = %v, probing %t, want the next fetch to probe", err, pl.breaker.probing)
+	}
+
+	// A failed probe pauses again, a working one resumes
+	pl.recordSegmentFetch(true)
+	if len(calls) != 2 || !calls[1].paused {
+		t.Fatalf("breaker calls = %v, want a pause after the probe failed", calls)
+	}
+	_ = pl.waitBreaker(context.Background())
+	pl.recordSegmentFetch(false)
+	if len(calls) != 3 || calls[2].paused {
+		t.Fatalf("breaker calls = %v, want a resume after the probe worked", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pl.breaker.pausedUntil = time.Now().Add(time.Hour)
+	if err := pl.waitBreaker(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("waitBreaker() with a canceled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestDowngradeVariantStepsDownToLowerResolution(t *testing.T) {
+	if server.Config == nil {
+		server.Config = &entity.Config{}
+	}
+
+	master := "#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=4000000,RESOLUTION=1920x1080\n1080p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720\n720p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=854x480\n480p.m3u8\n"
+	// The variants number their segments differently, the 480p one lists the same times as 100-103
+	media := map[string]string{
+		"/1080p.m3u8": datedPlaylist(40, 2),
+		"/480p.m3u8":  datedPlaylist(100, 4),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/master.m3u8":
+			_, _ = w.Write([]byte(master))
+		case media[r.URL.Path] != "":
+			_, _ = w.Write([]byte(media[r.URL.Path]))
+		default:
+			_, _ = w.Write([]byte("segment"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	var downgrades []string
+	pl := &Playlist{PlaylistURL: srv.URL + "/1080p.m3u8", RootURL: srv.URL + "/master.m3u8", Resolution: 1080, Framerate: 30, LastSeq: -1}
+	pl.OnVariantDowngrade = func(resolution, framerate int, _ bool) error {
+		downgrades = append(downgrades, fmt.Sprintf("%dp%d %s", resolution, framerate, strings.TrimPrefix(pl.PlaylistURL, srv.URL)))
+		return nil
+	}
+	var segments []string
+	poll := func() {
+		t.Helper()
+		initURL := ""
+		handler := func(_ []byte, _ float64) error {
+			segments = append(segments, fmt.Sprintf("%dp", pl.Resolution))
+			return nil
+		}
+		if _, err := pl.processMediaPlaylist(context.Background(), internal.NewReq(), pl.PlaylistURL, handler, nil, &pl.LastSeq, &initURL); err != nil {
+			t.Fatalf("processMediaPlaylist() error = %v", err)
+		}
+	}
+
+	poll()
+	if pl.LastSeq != 41 {
+		t.Fatalf("LastSeq = %d, want 41", pl.LastSeq)
+	}
+	for range 3 {
+		if err := pl.downgradeVariant(context.Background(), internal.NewReq()); err != nil {
+			t.Fatalf("downgradeVariant() error = %v", err)
+		}
+	}
+	if strings.Join(downgrades, ",") != "720p30 /720p.m3u8,480p30 /480p.m3u8" || !pl.lowestVariant {
+		t.Fatalf("downgrades = %v, lowestVariant = %t, want 720p then 480p", downgrades, pl.lowestVariant)
+	}
+
+	// The 480p playlist continues after the segments of the same times as the processed 1080p ones
+	poll()
+	if pl.LastSeq != 103 || strings.Join(segments, ",") != "1080p,1080p,480p,480p" {
+		t.Fatalf("LastSeq = %d, segments = %v, want 480p 102 and 103 after 1080p 40 and 41", pl.LastSeq, segments)
+	}
+}
+
+func TestAnchorSequence(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)
+	decode := func(s string) *m3u8.MediaPlaylist {
+		t.Helper()
+		pl, _, err := m3u8.DecodeFrom(strings.NewReader(s), true)
+		if err != nil {
+			t.Fatalf("DecodeFrom() error = %v", err)
+		}
+		return pl.(*m3u8.MediaPlaylist)
+	}
+	dated := decode(datedPlaylist(100, 4))
+	undated := decode("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:100\n#EXTINF:2.000,\na.ts\n#EXTINF:2.000,\nb.ts\n")
+
+	tests := []struct {
+		name     string
+		playlist *m3u8.MediaPlaylist
+		end      time.Time
+		want     int
+	}{
+		{"covered segments", dated, start.Add(4 * time.Second), 101},
+		{"half of a segment is covered", dated, start.Add(5 * time.Second), 102},
+		{"less than half is covered", dated, start.Add(4*time.Second + 900*time.Millisecond), 101},
+		{"ended before the playlist", dated, start.Add(-time.Minute), 99},
+		{"ended after the playlist", dated, start.Add(time.Minute), 103},
+		{"unknown end", dated, time.Time{}, 103},
+		{"no date-times", undated, start, 101},
+	}
+	for _, tt := range tests {
+		if got := anchorSequence(tt.playlist, tt.end); got != tt.want {
+			t.Errorf("%s: anchorSequence() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// datedPlaylist returns a media playlist of n 2 second segments from first, the first one
+// dated 2024-01-02 15:04:00 UTC by EXT-X-PROGRAM-DATE-TIME.
+func datedPlaylist(first, n int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	b.WriteString("#EXT-X-PROGRAM-DATE-TIME:2024-01-02T15:04:00.000Z\n")
+	for i := range n {
+		fmt.Fprintf(&b, "#EXTINF:2.000,\n%d.ts\n", first+i)
+	}
+	return b.String()
+}
@@ -1,12 +1,25 @@
 package config
 
 import (
+	"fmt"
+	"io"
+	"net/http"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/notify"
 	"github.com/urfave/cli/v2"
 )
 
+// bitrateRegexp matches ffmpeg bitrates such as "2500k" or "3M".
+var bitrateRegexp = regexp.MustCompile(`^\d+[kKmM]?$`)
+
 // HasFFmpeg checks if ffmpeg is installed and available in PATH.
 func HasFFmpeg() bool {
 	_, err := exec.LookPath("ffmpeg")
@@ -21,23 +34,683 @@ func New(c *cli.Context) (*entity.Config, error) {
 		compress = true
 	}
 
+	framerate, err := parseFramerate(c.String("framerate"))
+	if err != nil {
+		return nil, fmt.Errorf("framerate: %w", err)
+	}
+
+	audioCodec := strings.ToLower(c.String("audio-codec"))
+	if audioCodec != "aac" && audioCodec != "aac_he" && audioCodec != "opus" {
+		return nil, fmt.Errorf("audio-codec: unsupported codec %q", audioCodec)
+	}
+
+	fileMode, err := parseMode(c.String("file-mode"))
+	if err != nil {
+		return nil, fmt.Errorf("file-mode: %w", err)
+	}
+	dirMode, err := parseMode(c.String("dir-mode"))
+	if err != nil {
+		return nil, fmt.Errorf("dir-mode: %w", err)
+	}
+	onExisting := strings.ToLower(c.String("on-existing"))
+	switch onExisting {
+	case entity.OnExistingAppend, entity.OnExistingOverwrite, entity.OnExistingRename, entity.OnExistingSkip:
+	default:
+		return nil, fmt.Errorf("on-existing: unsupported value %q", onExisting)
+	}
+
+	onShort := strings.ToLower(c.String("on-short"))
+	switch onShort {
+	case entity.OnShortDiscard, entity.OnShortKeep:
+	default:
+		return nil, fmt.Errorf("on-short: unsupported value %q", onShort)
+	}
+	onVariant404 := strings.ToLower(c.String("on-variant-404"))
+	switch onVariant404 {
+	case entity.OnVariant404Switch, entity.OnVariant404Stop:
+	default:
+		return nil, fmt.Errorf("on-variant-404: unsupported value %q", onVariant404)
+	}
+	onEndlist := strings.ToLower(c.String("on-endlist"))
+	switch onEndlist {
+	case entity.OnEndlistStop, entity.OnEndlistIgnore:
+	default:
+		return nil, fmt.Errorf("on-endlist: unsupported value %q", onEndlist)
+	}
+	timestamps := strings.ToLower(c.String("timestamps"))
+	switch timestamps {
+	case entity.TimestampsKeep:
+	case entity.TimestampsRegenerate:
+		if !HasFFmpeg() {
+			return nil, fmt.Errorf("timestamps: regenerate requires ffmpeg in PATH")
+		}
+	default:
+		return nil, fmt.Errorf("timestamps: unsupported value %q", timestamps)
+	}
+	ffmpegWarnings := strings.ToLower(c.String("on-ffmpeg-warnings"))
+	switch ffmpegWarnings {
+	case entity.FFmpegWarningsLog, entity.FFmpegWarningsFlag, entity.FFmpegWarningsIgnore:
+	default:
+		return nil, fmt.Errorf("on-ffmpeg-warnings: unsupported value %q", ffmpegWarnings)
+	}
+	if c.Int("min-duration") < 0 {
+		return nil, fmt.Errorf("min-duration: must not be negative, got %d", c.Int("min-duration"))
+	}
+	if c.Int("trim-start") < 0 {
+		return nil, fmt.Errorf("trim-start: must not be negative, got %d", c.Int("trim-start"))
+	}
+
+	thumbnailFormat := strings.ToLower(c.String("thumbnail-format"))
+	switch thumbnailFormat {
+	case "", "jpg", "webp", "png":
+	default:
+		return nil, fmt.Errorf("thumbnail-format: unsupported format %q", thumbnailFormat)
+	}
+	if thumbnailFormat != "" && !HasFFmpeg() {
+		return nil, fmt.Errorf("thumbnail-format: ffmpeg not found in PATH")
+	}
+	if c.Bool("poster") && !HasFFmpeg() {
+		return nil, fmt.Errorf("poster: ffmpeg not found in PATH")
+	}
+	thumbnailQuality := c.Int("thumbnail-quality")
+	if thumbnailQuality < 1 || thumbnailQuality > 100 {
+		return nil, fmt.Errorf("thumbnail-quality: must be between 1 and 100, got %d", thumbnailQuality)
+	}
+
+	encoder := strings.ToLower(c.String("encoder"))
+	switch encoder {
+	case "", "nvenc", "amf", "qsv", "videotoolbox", "cpu":
+	default:
+		return nil, fmt.Errorf("encoder: unsupported encoder %q", encoder)
+	}
+	if c.Int("encoder-detect-timeout") < 0 {
+		return nil, fmt.Errorf("encoder-detect-timeout: must not be negative, got %d", c.Int("encoder-detect-timeout"))
+	}
+	if encoder != "" && !HasFFmpeg() {
+		return nil, fmt.Errorf("encoder: ffmpeg not found in PATH")
+	}
+
+	targetBitrate := c.String("target-bitrate")
+	if c.Bool("two-pass") {
+		if !bitrateRegexp.MatchString(targetBitrate) {
+			return nil, fmt.Errorf("two-pass: --target-bitrate must be a bitrate such as 2500k, got %q", targetBitrate)
+		}
+		if encoder != "" && encoder != "cpu" {
+			return nil, fmt.Errorf("two-pass: only supported with the cpu encoder, got %q", encoder)
+		}
+	}
+
+	ipFamily := strings.ToLower(c.String("ip-family"))
+	switch ipFamily {
+	case "", "ipv4", "ipv6":
+	default:
+		return nil, fmt.Errorf("ip-family: unsupported value %q", ipFamily)
+	}
+
+	if c.Int("sequence-padding") < 0 || c.Int("sequence-padding") > 10 {
+		return nil, fmt.Errorf("sequence-padding: must be between 0 and 10, got %d", c.Int("sequence-padding"))
+	}
+
+	location, err := time.LoadLocation(c.String("timezone"))
+	if err != nil {
+		return nil, fmt.Errorf("timezone: unknown timezone %q", c.String("timezone"))
+	}
+
+	if c.Int("chunk-duration") < 0 || c.Int("chunk-duration") > 1440 {
+		return nil, fmt.Errorf("chunk-duration: must be between 0 and 1440 minutes, got %d", c.Int("chunk-duration"))
+	}
+
+	if c.Int("max-idle-conns") < 0 || c.Int("max-idle-conns-per-host") < 1 || c.Int("idle-conn-timeout") < 0 {
+		return nil, fmt.Errorf("max-idle-conns: connection pool settings must not be negative, and at least 1 per host")
+	}
+
+	if c.Int("resolution-confirm") < 0 {
+		return nil, fmt.Errorf("resolution-confirm: must not be negative, got %d", c.Int("resolution-confirm"))
+	}
+
+	if c.Int("max-concurrent-recordings") < 0 {
+		return nil, fmt.Errorf("max-concurrent-recordings: must not be negative, got %d", c.Int("max-concurrent-recordings"))
+	}
+
+	if c.Int("global-segment-concurrency") < 0 {
+		return nil, fmt.Errorf("global-segment-concurrency: must not be negative, got %d", c.Int("global-segment-concurrency"))
+	}
+	if c.Int("segment-error-rate") < 0 || c.Int("segment-error-rate") > 100 {
+		return nil, fmt.Errorf("segment-error-rate: must be between 0 and 100, got %d", c.Int("segment-error-rate"))
+	}
+	if c.Int("segment-error-rate") > 0 && c.Int("segment-error-window") <= 0 {
+		return nil, fmt.Errorf("segment-error-window: must be positive, got %d", c.Int("segment-error-window"))
+	}
+	if c.Int("segment-error-cooldown") < 0 {
+		return nil, fmt.Errorf("segment-error-cooldown: must not be negative, got %d", c.Int("segment-error-cooldown"))
+	}
+	if c.Int("compress-min-duration") < 0 || c.Int("compress-min-size") < 0 {
+		return nil, fmt.Errorf("compress-min-duration, compress-min-size: must not be negative")
+	}
+	if c.Int("recover-concurrency") < 0 {
+		return nil, fmt.Errorf("recover-concurrency: must not be negative, got %d", c.Int("recover-concurrency"))
+	}
+	if c.Int("compress-concurrency") < 0 {
+		return nil, fmt.Errorf("compress-concurrency: must not be negative, got %d", c.Int("compress-concurrency"))
+	}
+
+	if c.Int("max-bitrate") < 0 {
+		return nil, fmt.Errorf("max-bitrate: must not be negative, got %d", c.Int("max-bitrate"))
+	}
+	if c.Int("offline-grace") < 0 {
+		return nil, fmt.Errorf("offline-grace: must not be negative, got %d", c.Int("offline-grace"))
+	}
+	if c.Int("max-checks-per-minute") < 0 {
+		return nil, fmt.Errorf("max-checks-per-minute: must not be negative, got %d", c.Int("max-checks-per-minute"))
+	}
+	if c.Int("offline-grace-interval") < 1 {
+		return nil, fmt.Errorf("offline-grace-interval: must be at least 1 second, got %d", c.Int("offline-grace-interval"))
+	}
+	if c.Int("dormant-interval") < 1 {
+		return nil, fmt.Errorf("dormant-interval: must be at least 1 minute, got %d", c.Int("dormant-interval"))
+	}
+	if c.Bool("auto-follow") {
+		if c.String("username") != "" {
+			return nil, fmt.Errorf("auto-follow: only works in the Web UI mode, without --username")
+		}
+		if c.String("cookies") == "" {
+			return nil, fmt.Errorf("auto-follow: requires the --cookies of a logged-in session")
+		}
+		if c.Int("auto-follow-interval") < 1 {
+			return nil, fmt.Errorf("auto-follow-interval: must be at least 1 minute, got %d", c.Int("auto-follow-interval"))
+		}
+	}
+	if c.Bool("record-private") && c.String("cookies") == "" {
+		return nil, fmt.Errorf("record-private: requires the --cookies of a session in the show")
+	}
+	if c.Int("variant-retries") < 0 || c.Int("variant-retry-delay") < 0 {
+		return nil, fmt.Errorf("variant-retries: attempts and delay must not be negative")
+	}
+
+	apiEndpoints := c.StringSlice("api-endpoint")
+	for _, endpoint := range apiEndpoints {
+		if !strings.Contains(endpoint, "{username}") {
+			return nil, fmt.Errorf("api-endpoint: %q has no {username} placeholder", endpoint)
+		}
+	}
+
+	edgeOKStatuses, err := ParseStatuses(c.String("edge-ok-status"))
+	if err != nil {
+		return nil, fmt.Errorf("edge-ok-status: %w", err)
+	}
+
+	versionCheckChannel := c.String("version-check-channel")
+	if versionCheckChannel == "" {
+		versionCheckChannel = c.String("username")
+	}
+	if c.Bool("version-check") && versionCheckChannel == "" {
+		return nil, fmt.Errorf("version-check: set --version-check-channel to the channel to probe")
+	}
+	if endpoint := c.String("version-check-endpoint"); endpoint != "" && !strings.Contains(endpoint, "{username}") {
+		return nil, fmt.Errorf("version-check-endpoint: %q has no {username} placeholder", endpoint)
+	}
+
+	allowedResolutions, err := ParseResolutions(c.String("allowed-resolutions"))
+	if err != nil {
+		return nil, fmt.Errorf("allowed-resolutions: %w", err)
+	}
+	blockedResolutions, err := ParseResolutions(c.String("blocked-resolutions"))
+	if err != nil {
+		return nil, fmt.Errorf("blocked-resolutions: %w", err)
+	}
+
+	if schedule := c.String("schedule"); schedule != "" {
+		if _, err := internal.ParseCron(schedule); err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+	}
+	if window := c.String("window"); window != "" {
+		if _, err := internal.ParseWindow(window); err != nil {
+			return nil, err
+		}
+	}
+
+	resolutions, err := ParseResolutions(c.String("resolutions"))
+	if err != nil {
+		return nil, fmt.Errorf("resolutions: %w", err)
+	}
+	if len(resolutions) > 0 && c.String("output-pipe") != "" {
+		return nil, fmt.Errorf("resolutions: not supported with --output-pipe, the pipe takes a single stream")
+	}
+
+	gpuDevices, err := parseDevices(c.String("gpu-device"))
+	if err != nil {
+		return nil, fmt.Errorf("gpu-device: %w", err)
+	}
+
+	checksum := strings.ToLower(c.String("checksum"))
+	if checksum != "" && checksum != "sha256" {
+		return nil, fmt.Errorf("checksum: unsupported algorithm %q", checksum)
+	}
+
+	headers, err := parseHeaders(c.StringSlice("header"))
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+
+	ffmpegExtraArgs, err := splitArgs(c.String("ffmpeg-extra-args"))
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg-extra-args: %w", err)
+	}
+	// The pass log is only written by libx264 (`-pass`) and libx265 (`-x265-params pass=N`)
+	if codec := internal.VideoCodecArg(ffmpegExtraArgs, "libx264"); c.Bool("two-pass") && codec != "libx264" && codec != "libx265" {
+		return nil, fmt.Errorf("two-pass: only supported with libx264 or libx265, --ffmpeg-extra-args selects %q", codec)
+	}
+
+	for _, name := range []string{"webhook-template", "discord-template", "telegram-template"} {
+		if err := validateNotifyTemplate(c.String(name)); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if c.Int("buffer-max-size") < 1 {
+		return nil, fmt.Errorf("buffer-max-size: must be at least 1 MB, got %d", c.Int("buffer-max-size"))
+	}
+
+	if sftp := c.String("sftp"); sftp != "" {
+		if _, _, err := internal.ParseSFTPDestination(sftp); err != nil {
+			return nil, fmt.Errorf("sftp: %w", err)
+		}
+		if _, err := exec.LookPath("sftp"); err != nil {
+			return nil, fmt.Errorf("sftp: the OpenSSH sftp client was not found in PATH")
+		}
+	}
+	if c.Int("sftp-retries") < 0 {
+		return nil, fmt.Errorf("sftp-retries: must not be negative, got %d", c.Int("sftp-retries"))
+	}
+	if c.String("s3-bucket") != "" {
+		if c.String("s3-access-key") == "" || c.String("s3-secret-key") == "" {
+			return nil, fmt.Errorf("s3-bucket: --s3-access-key and --s3-secret-key are required")
+		}
+		if _, err := internal.NewS3(c.String("s3-endpoint"), c.String("s3-region"), c.String("s3-bucket"), "", ""); err != nil {
+			return nil, fmt.Errorf("s3-endpoint: %w", err)
+		}
+		if _, err := internal.RenderS3Prefix(c.String("s3-prefix"), &internal.Pattern{}); err != nil {
+			return nil, fmt.Errorf("s3-prefix: %w", err)
+		}
+	}
+	if c.Int("s3-retries") < 0 {
+		return nil, fmt.Errorf("s3-retries: must not be negative, got %d", c.Int("s3-retries"))
+	}
+
+	if c.Bool("live-mux") && !HasFFmpeg() {
+		return nil, fmt.Errorf("live-mux: ffmpeg not found in PATH")
+	}
+
+	if c.String("output-pipe") != "" && c.String("username") == "" {
+		return nil, fmt.Errorf("output-pipe: only supported when recording a single channel with --username")
+	}
+
+	chown := c.String("chown") != ""
+	uid, gid, err := parseOwner(c.String("chown"))
+	if err != nil {
+		return nil, fmt.Errorf("chown: %w", err)
+	}
+
 	return &entity.Config{
 		Version:        c.App.Version,
 		Username:       c.String("username"),
 		AdminUsername:  c.String("admin-username"),
 		AdminPassword:  c.String("admin-password"),
-		Framerate:      c.Int("framerate"),
+		APIToken:       c.String("api-token"),
+		Framerate:      framerate,
 		Resolution:     c.Int("resolution"),
 		Pattern:        c.String("pattern"),
 		MaxDuration:    c.Int("max-duration"),
 		MaxFilesize:    c.Int("max-filesize"),
+		MaxBitrate:     c.Int("max-bitrate"),
+		Resolutions:    resolutions,
+		Schedule:       c.String("schedule"),
+		Window:         strings.TrimSpace(c.String("window")),
 		Compress:       compress,
+		AudioCodec:     audioCodec,
+		AudioBitrate:   c.String("audio-bitrate"),
 		Port:           c.String("port"),
 		Interval:       c.Int("interval"),
+		RequestTimeout: c.Int("request-timeout"),
+		SegmentTimeout: c.Int("segment-timeout"),
 		Cookies:        c.String("cookies"),
+		RecordPrivate:  c.Bool("record-private"),
 		UserAgent:      c.String("user-agent"),
 		Domain:         c.String("domain"),
 		OutputDir:      c.String("output-dir"),
+		OutputDirRoots: parseDirs(c.String("output-dir-roots")),
 		PerModelFolder: c.Bool("per-model-folder"),
+		FileMode:       fileMode,
+		DirMode:        dirMode,
+		Chown:          chown,
+		ChownUID:       uid,
+		ChownGID:       gid,
+
+		StartupConcurrency:       c.Int("startup-concurrency"),
+		MaxRecordings:            c.Int("max-concurrent-recordings"),
+		GlobalSegmentConcurrency: c.Int("global-segment-concurrency"),
+		SegmentErrorRate:         c.Int("segment-error-rate"),
+		SegmentErrorWindow:       c.Int("segment-error-window"),
+		SegmentErrorCooldown:     c.Int("segment-error-cooldown"),
+		Priority:                 c.Int("priority"),
+		IntervalJitter:           c.Int("interval-jitter"),
+		MaxChecksPerMinute:       c.Int("max-checks-per-minute"),
+		VariantRetries:           c.Int("variant-retries"),
+		VariantRetryDelay:        c.Int("variant-retry-delay"),
+
+		Headers:        headers,
+		OnExisting:     onExisting,
+		APIEndpoints:   apiEndpoints,
+		EdgeOKStatuses: edgeOKStatuses,
+
+		VersionCheck:         c.Bool("version-check"),
+		VersionCheckChannel:  versionCheckChannel,
+		VersionCheckEndpoint: c.String("version-check-endpoint"),
+
+		MinDuration: c.Int("min-duration"),
+		TrimStart:   c.Int("trim-start"),
+		NoBackfill:  c.Bool("no-backfill"),
+		OnShort:     onShort,
+
+		OnVariant404: onVariant404,
+		OnEndlist:    onEndlist,
+		Adaptive:     c.Bool("adaptive"),
+		Continuous:   !c.Bool("split-on-resolution-change"),
+		Subtitles:    c.Bool("subtitles"),
+
+		MinResolution:      c.Int("min-resolution"),
+		AllowedResolutions: allowedResolutions,
+		BlockedResolutions: blockedResolutions,
+		ResolutionConfirm:  c.Int("resolution-confirm"),
+		IdleSplit:          c.Int("idle-split"),
+		ChunkDuration:      c.Int("chunk-duration"),
+
+		SequencePadding: c.Int("sequence-padding"),
+		SequenceStart:   c.Int("sequence-start"),
+
+		Timezone: c.String("timezone"),
+		Location: location,
+
+		InsecureSkipVerify: c.Bool("insecure-skip-verify"),
+		IPFamily:           ipFamily,
+
+		MaxIdleConns:        c.Int("max-idle-conns"),
+		MaxIdleConnsPerHost: c.Int("max-idle-conns-per-host"),
+		IdleConnTimeout:     c.Int("idle-conn-timeout"),
+
+		ThumbnailFormat:  thumbnailFormat,
+		ThumbnailQuality: thumbnailQuality,
+		Poster:           c.Bool("poster"),
+		Checksum:         checksum,
+
+		DormantAfter:    c.Int("dormant-after"),
+		DormantInterval: c.Int("dormant-interval"),
+
+		OfflineGrace:         c.Int("offline-grace"),
+		OfflineGraceInterval: c.Int("offline-grace-interval"),
+
+		AutoFollow:         c.Bool("auto-follow"),
+		AutoFollowInterval: c.Int("auto-follow-interval"),
+		AutoFollowRemove:   c.Bool("auto-follow-remove"),
+		AutoFollowEndpoint: c.String("auto-follow-endpoint"),
+
+		Encoder:              encoder,
+		EncoderDetectTimeout: c.Int("encoder-detect-timeout"),
+		GPUDevices:           gpuDevices,
+		HWDecode:             c.Bool("hw-decode"),
+
+		TwoPass:             c.Bool("two-pass"),
+		TargetBitrate:       targetBitrate,
+		TempDir:             c.String("temp-dir"),
+		CompressConcurrency: c.Int("compress-concurrency"),
+		CompressMinDuration: c.Int("compress-min-duration"),
+		CompressMinSize:     c.Int("compress-min-size"),
+		RecoverConcurrency:  c.Int("recover-concurrency"),
+		FFmpegExtraArgs:     ffmpegExtraArgs,
+		FFmpegLogSize:       c.Int("ffmpeg-log-size"),
+		Timestamps:          timestamps,
+		FFmpegWarnings:      ffmpegWarnings,
+
+		WebhookURL:       c.String("webhook-url"),
+		WebhookTemplate:  c.String("webhook-template"),
+		DiscordWebhook:   c.String("discord-webhook"),
+		DiscordTemplate:  c.String("discord-template"),
+		TelegramToken:    c.String("telegram-token"),
+		TelegramChatID:   c.String("telegram-chat-id"),
+		TelegramTemplate: c.String("telegram-template"),
+
+		SFTP:        c.String("sftp"),
+		SFTPPort:    c.Int("sftp-port"),
+		SFTPKey:     c.String("sftp-key"),
+		SFTPDelete:  c.Bool("sftp-delete"),
+		SFTPRetries: c.Int("sftp-retries"),
+
+		S3Bucket:    c.String("s3-bucket"),
+		S3Endpoint:  c.String("s3-endpoint"),
+		S3Region:    c.String("s3-region"),
+		S3AccessKey: c.String("s3-access-key"),
+		S3SecretKey: c.String("s3-secret-key"),
+		S3Prefix:    c.String("s3-prefix"),
+		S3Delete:    c.Bool("s3-delete"),
+		S3Retries:   c.Int("s3-retries"),
+
+		BufferWholeFile: c.Bool("buffer-whole-file"),
+		BufferMaxSize:   c.Int("buffer-max-size"),
+
+		LiveMux:    c.Bool("live-mux"),
+		OutputPipe: c.String("output-pipe"),
 	}, nil
 }
+
+// ValidateRuntime checks the settings changed while running, see entity.RuntimeConfig.
+func ValidateRuntime(r *entity.RuntimeConfig) error {
+	if r.Interval < 1 {
+		return fmt.Errorf("interval: must be at least 1 minute, got %d", r.Interval)
+	}
+	if r.MaxDuration < 0 || r.MaxFilesize < 0 {
+		return fmt.Errorf("max-duration, max-filesize: must not be negative")
+	}
+	if r.Compress && !HasFFmpeg() {
+		return fmt.Errorf("compress: ffmpeg not found in PATH")
+	}
+	return nil
+}
+
+// ParseStatuses parses a comma-separated list of HTTP status codes (e.g. "200") and classes (e.g. "2xx").
+// Redirects (3xx) are refused, the client follows them and only sees the status of the final response.
+func ParseStatuses(s string) ([]string, error) {
+	var statuses []string
+	for _, part := range strings.Split(s, ",") {
+		status := strings.ToLower(strings.TrimSpace(part))
+		if status == "" {
+			continue
+		}
+		if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+			return nil, fmt.Errorf("invalid status %q, want a code such as 200 or a class such as 2xx", part)
+		}
+		if status[1:] != "xx" {
+			if _, err := strconv.Atoi(status[1:]); err != nil {
+				return nil, fmt.Errorf("invalid status %q, want a code such as 200 or a class such as 2xx", part)
+			}
+		}
+		if status[0] == '3' {
+			return nil, fmt.Errorf("invalid status %q, redirects are followed so a 3xx is never seen", part)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// parseFramerate parses the framerate flag, "any" is stored as 0.
+func parseFramerate(s string) (int, error) {
+	if strings.EqualFold(s, "any") {
+		return 0, nil
+	}
+	framerate, err := strconv.Atoi(s)
+	if err != nil || framerate < 0 {
+		return 0, fmt.Errorf("invalid framerate %q", s)
+	}
+	return framerate, nil
+}
+
+// parseDirs parses a comma-separated list of directories, empty means none.
+func parseDirs(s string) []string {
+	var dirs []string
+	for _, dir := range strings.Split(s, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+	return dirs
+}
+
+// parseMode parses an octal permission string such as "0644", empty means default.
+func parseMode(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid octal mode %q", s)
+	}
+	return uint32(mode), nil
+}
+
+// parseOwner parses a "uid:gid" string, empty means keeping the current owner.
+func parseOwner(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected uid:gid, got %q", s)
+	}
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid uid %q", parts[0])
+	}
+	gid, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gid %q", parts[1])
+	}
+	return uid, gid, nil
+}
+
+// parseDevices parses a comma-separated list of device indexes such as "0,1", empty means none.
+func parseDevices(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var devices []int
+	for _, v := range strings.Split(s, ",") {
+		device, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || device < 0 {
+			return nil, fmt.Errorf("invalid device index %q", v)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// ParseResolutions parses a comma-separated list of resolutions such as "720,1080p", empty means none.
+func ParseResolutions(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var resolutions []int
+	for _, v := range strings.Split(s, ",") {
+		resolution, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "p"))
+		if err != nil || resolution <= 0 {
+			return nil, fmt.Errorf("invalid resolution %q", v)
+		}
+		resolutions = append(resolutions, resolution)
+	}
+	return resolutions, nil
+}
+
+// splitArgs splits a command line into arguments at whitespace, quotes group an argument with spaces
+// (e.g. `-vf "scale=-2:720, fps=30"`) and aren't part of it. A backslash escapes a whitespace or a quote outside
+// of quotes and a double quote inside double ones, any other backslash is kept so Windows paths work as is.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		inQuote rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+			if !escapable(r, inQuote) {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(r)
+		case r == '\\' && inQuote != '\'':
+			escaped, inArg = true, true
+		case inQuote != 0 && r == inQuote:
+			inQuote = 0
+		case inQuote != 0:
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			inQuote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inQuote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", inQuote, s)
+	}
+	if escaped {
+		arg.WriteRune('\\')
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// escapable reports whether a backslash escapes r, inQuote is the quote it's in (0 if none).
+func escapable(r, inQuote rune) bool {
+	if inQuote == '"' {
+		return r == '"'
+	}
+	return r == ' ' || r == '\t' || r == '\n' || r == '"' || r == '\''
+}
+
+// validateNotifyTemplate parses a notification template and renders it with sample data, so a typo in a field fails on startup.
+func validateNotifyTemplate(text string) error {
+	tmpl, err := notify.ParseTemplate("template", text)
+	if err != nil {
+		return err
+	}
+	for _, event := range []notify.Event{notify.EventStarted, notify.EventFinished} {
+		if err := tmpl.Execute(io.Discard, notify.Data{Event: event}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseHeaders parses "Key: Value" pairs into a map keyed by the canonical header name.
+func parseHeaders(values []string) (map[string]string, error) {
+	headers := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected Key: Value, got %q", v)
+		}
+		headers[http.CanonicalHeaderKey(key)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestSplitArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in   string
+		want []string
+		err  string // part of the error, empty if it's valid
+	}{
+		{in: "", want: nil},
+		{in: "  -threads   4\t-an\n", want: []string{"-threads", "4", "-an"}},
+		{in: `-vf "scale=-2:720, fps=30"`, want: []string{"-vf", "scale=-2:720, fps=30"}},
+		{in: `-metadata 'title=a "b" c'`, want: []string{"-metadata", `title=a "b" c`}},
+		{in: `-metadata title=""`, want: []string{"-metadata", "title="}},
+		{in: `pre"quoted part"post`, want: []string{"prequoted partpost"}},
+		{in: `a\ b \"c\' d`, want: []string{"a b", `"c'`, "d"}},
+		{in: `"say \"hi\""`, want: []string{`say "hi"`}},
+		{in: `'it\'s'`, err: "unterminated ' quote"},
+		{in: `"a\b" 'c\d'`, want: []string{`a\b`, `c\d`}},
+		{in: `C:\videos\logo.png \\nas\share trailing\`, want: []string{`C:\videos\logo.png`, `\\nas\share`, `trailing\`}},
+		{in: `-vf "scale=-2:720`, err: `unterminated " quote`},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("splitArgs(%q) error = %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("splitArgs(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in      string
+		want    uint32
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0644", want: 0644},
+		{in: "755", want: 0755},
+		{in: "0777", want: 0777},
+		{in: "1777", wantErr: true},
+		{in: "0648", wantErr: true},
+		{in: "rw-r--r--", wantErr: true},
+		{in: "-644", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseMode(%q) = %o, %v, want %o, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in       string
+		uid, gid int
+		err      string // part of the error, empty if it's valid
+	}{
+		{in: "", uid: 0, gid: 0},
+		{in: "1000:1000", uid: 1000, gid: 1000},
+		{in: "0:100", uid: 0, gid: 100},
+		{in: "1000", err: "expected uid:gid"},
+		{in: "alice:1000", err: "invalid uid"},
+		{in: "1000:", err: "invalid gid"},
+		{in: "1000:100:1", err: "invalid gid"},
+	}
+	for _, tt := range tests {
+		uid, gid, err := parseOwner(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseOwner(%q) error = %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || uid != tt.uid || gid != tt.gid {
+			t.Errorf("parseOwner(%q) = %d, %d, %v, want %d, %d", tt.in, uid, gid, err, tt.uid, tt.gid)
+		}
+	}
+}
+
+func TestNewRejectsDormantIntervalBelowOneMinute(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		interval string
+		err      string // part of the error, empty if it's valid
+	}{
+		{interval: "60"},
+		{interval: "1"},
+		{interval: "0", err: "dormant-interval: must be at least 1 minute"},
+		{interval: "-5", err: "dormant-interval: must be at least 1 minute"},
+	} {
+		_, err := New(newTestContext(t, map[string]string{"dormant-interval": tt.interval}))
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("New() with --dormant-interval %s error = %v, want %q", tt.interval, err, tt.err)
+		}
+	}
+}
+
+// newTestContext returns a CLI context with the defaults New requires, overridden by values.
+func newTestContext(t *testing.T, values map[string]string) *cli.Context {
+	t.Helper()
+
+	defaults := map[string]string{
+		"framerate":               "30",
+		"audio-codec":             "aac",
+		"on-existing":             "append",
+		"on-short":                "discard",
+		"on-variant-404":          "switch",
+		"on-endlist":              "stop",
+		"timestamps":              "keep",
+		"on-ffmpeg-warnings":      "log",
+		"thumbnail-quality":       "80",
+		"timezone":                "UTC",
+		"max-idle-conns-per-host": "2",
+		"offline-grace-interval":  "30",
+		"dormant-interval":        "60",
+		"edge-ok-status":          "200",
+		"buffer-max-size":         "64",
+		"pattern":                 "{{.Username}}",
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for name, value := range defaults {
+		if v, ok := values[name]; ok {
+			value = v
+		}
+		set.String(name, value, "")
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
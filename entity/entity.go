@@ -1,8 +1,11 @@
 package entity
 
 import (
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Event represents the type of event for the channel.
@@ -13,40 +16,156 @@ const (
 	EventLog    Event = "log"
 )
 
+// What to do when the output file of a new recording already exists.
+const (
+	OnExistingAppend    = "append"
+	OnExistingOverwrite = "overwrite"
+	OnExistingRename    = "rename"
+	OnExistingSkip      = "skip"
+)
+
+// What to do with a broadcast shorter than `--min-duration`.
+const (
+	OnShortDiscard = "discard"
+	OnShortKeep    = "keep"
+)
+
+// What to do when the video playlist of the recorded variant keeps returning 404.
+const (
+	OnVariant404Switch = "switch" // pick another variant of the master playlist
+	OnVariant404Stop   = "stop"   // end the recording like the stream went offline
+)
+
+// What to do when the video playlist ends with `EXT-X-ENDLIST`.
+const (
+	OnEndlistStop   = "stop"   // finalize the recording once the last segments are written
+	OnEndlistIgnore = "ignore" // keep polling until the playlist is gone
+)
+
+// How ffmpeg handles the timestamps of `.ts` recordings.
+const (
+	TimestampsKeep       = "keep"       // as the CDN sent them
+	TimestampsRegenerate = "regenerate" // split at timestamp jumps, monotonic timestamps starting at zero
+)
+
+// What to do when ffmpeg compressed a recording but warned about decode errors or broken timestamps.
+const (
+	FFmpegWarningsLog    = "log"    // log a summary of the warnings
+	FFmpegWarningsFlag   = "flag"   // log it and mark the recording degraded in the recordings index
+	FFmpegWarningsIgnore = "ignore" // say nothing
+)
+
 // ChannelConfig represents the configuration for a channel.
 type ChannelConfig struct {
-	IsPaused    bool   `json:"is_paused"`
-	Username    string `json:"username"`
-	Framerate   int    `json:"framerate"`
-	Resolution  int    `json:"resolution"`
-	Pattern     string `json:"pattern"`
-	MaxDuration int    `json:"max_duration"`
-	MaxFilesize int    `json:"max_filesize"`
-	Compress    bool   `json:"compress"`
-	CreatedAt   int64  `json:"created_at"`
+	IsPaused     bool   `json:"is_paused"`
+	Username     string `json:"username"`
+	Framerate    int    `json:"framerate"`
+	Resolution   int    `json:"resolution"`
+	Pattern      string `json:"pattern"`
+	MaxDuration  int    `json:"max_duration"`
+	MaxFilesize  int    `json:"max_filesize"`
+	MaxBitrate   int    `json:"max_bitrate"`   // kbps, variants above it aren't picked, 0 = no cap
+	Resolutions  []int  `json:"resolutions"`   // also recorded at the same time, each to its own file
+	Schedule     string `json:"schedule"`      // cron expression of the minutes the channel is checked, empty = always
+	Window       string `json:"window"`        // daily window the stream is recorded in, e.g. "20:00-21:00", empty = all day
+	RoomPassword string `json:"room_password"` // unlocks a password protected show, empty if it's not known
+	Compress     bool   `json:"compress"`
+	CreatedAt    int64  `json:"created_at"`
+
+	OutputDir  string `json:"output_dir"`  // overrides the global `--output-dir`
+	Priority   int    `json:"priority"`    // higher goes first when checks, recordings, segment downloads or compressions wait for a slot
+	AutoFollow bool   `json:"auto_follow"` // added by `--auto-follow`, removed by it with `--auto-follow-remove`
 }
 
 func (c *ChannelConfig) Sanitize() {
 	c.Username = regexp.MustCompile(`[^a-zA-Z0-9_-]`).ReplaceAllString(c.Username, "")
 	c.Username = strings.TrimSpace(c.Username)
+	if c.OutputDir = strings.TrimSpace(c.OutputDir); c.OutputDir != "" {
+		c.OutputDir = filepath.Clean(c.OutputDir)
+	}
 }
 
 // ChannelInfo represents the information about a channel,
 // mostly used for the template rendering.
 type ChannelInfo struct {
-	IsOnline     bool
-	IsPaused     bool
-	RoomStatus   string // public, private, group, away, offline, hidden
-	Username     string
-	Duration     string
-	Filesize     string
-	Filename     string
-	StreamedAt   string
-	MaxDuration  string
-	MaxFilesize  string
-	CreatedAt    int64
-	Logs         []string
-	GlobalConfig *Config // for nested template to access $.Config
+	IsOnline       bool     `json:"is_online"`
+	IsPaused       bool     `json:"is_paused"`
+	IsDormant      bool     `json:"is_dormant"`       // offline for too long, checked less often
+	IsRegionLocked bool     `json:"is_region_locked"` // every edge keeps refusing the stream, checked less often
+	IsQueued       bool     `json:"is_queued"`        // online, waiting for a slot of `--max-concurrent-recordings`
+	RoomStatus     string   `json:"room_status"`      // public, private, group, away, offline, hidden, region-locked
+	EdgeRegion     string   `json:"edge_region"`      // CDN edge region of the stream, e.g. "sin", empty if unknown
+	Username       string   `json:"username"`
+	Duration       string   `json:"duration"`
+	Filesize       string   `json:"filesize"`
+	Bitrate        string   `json:"bitrate"`       // rolling average of the recent segments
+	Lifetime       string   `json:"lifetime"`      // totals of the completed recordings, e.g. "12 recording(s), 8.40 GB, 20.5 hour(s)"
+	FetchAvg       string   `json:"fetch_avg"`     // average segment download time, e.g. "0.42s"
+	FetchMax       string   `json:"fetch_max"`     // slowest segment download time
+	FetchPercent   int      `json:"fetch_percent"` // download time in % of the segment duration, falling behind from 100
+	Compressing    string   `json:"compressing"`   // compression progress, e.g. "42%", empty when idle
+	Filename       string   `json:"filename"`
+	RoomTitle      string   `json:"room_title"`
+	Gender         string   `json:"gender"`
+	Tags           []string `json:"tags"`
+	StreamedAt     string   `json:"streamed_at"`
+	Poster         string   `json:"poster"`     // URL of the poster of the file being recorded with `--poster`, empty if none yet
+	PosterPath     string   `json:"-"`          // file of Poster
+	Schedule       string   `json:"schedule"`   // cron expression, empty if it's always checked
+	NextCheck      string   `json:"next_check"` // next minute the schedule matches while outside of it, e.g. "2024-01-05T18:00:00+09:00"
+	Window         string   `json:"window"`     // daily window, empty if it's recorded all day
+	OutsideWindow  bool     `json:"outside_window"`
+	MaxDuration    string   `json:"max_duration"`
+	MaxFilesize    string   `json:"max_filesize"`
+	CreatedAt      int64    `json:"created_at"`
+	Logs           []string `json:"logs"`
+	GlobalConfig   *Config  `json:"-"` // for nested template to access $.Config
+}
+
+// Recording represents a completed recording in the recordings directory.
+type Recording struct {
+	Channel    string `json:"channel"`   // empty if it can't be inferred
+	Filename   string `json:"filename"`  // path relative to the recordings directory
+	URL        string `json:"url"`       // download URL
+	Thumbnail  string `json:"thumbnail"` // thumbnail URL, empty if there's none
+	Size       string `json:"size"`
+	SizeBytes  int64  `json:"size_bytes"`
+	ModifiedAt string `json:"modified_at"`
+	ModTime    int64  `json:"mod_time"`
+
+	// Probed with ffprobe only when the API needs them, empty if unknown.
+	Duration        string  `json:"duration,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+
+	Degraded string `json:"degraded,omitempty"` // summary of the ffmpeg warnings with `--on-ffmpeg-warnings flag`
+}
+
+// Metrics is the summary of the channels and the recordings returned by `/api/v1/metrics`.
+type Metrics struct {
+	Version         string `json:"version"`
+	Channels        int    `json:"channels"`
+	Recording       int    `json:"recording"` // online and not paused
+	Paused          int    `json:"paused"`
+	Dormant         int    `json:"dormant"`
+	Queued          int    `json:"queued"`      // waiting for a slot of `--max-concurrent-recordings`
+	Compressing     int    `json:"compressing"` // channels with a compression running
+	Recordings      int    `json:"recordings"`  // completed recordings
+	RecordingsBytes int64  `json:"recordings_bytes"`
+
+	Lifetime RecordingTotals `json:"lifetime"` // including the recordings removed since
+}
+
+// RecordingTotals are the lifetime totals of completed recordings, they're kept when the files are removed.
+type RecordingTotals struct {
+	Recordings int     `json:"recordings"`
+	Bytes      int64   `json:"bytes"`
+	Duration   float64 `json:"duration"` // seconds
+}
+
+// Stats are the lifetime totals of all the recordings and of each channel returned by `/api/v1/stats`.
+type Stats struct {
+	Total    RecordingTotals            `json:"total"`
+	Channels map[string]RecordingTotals `json:"channels"`
 }
 
 // Config holds the configuration for the application.
@@ -55,18 +174,296 @@ type Config struct {
 	Username      string
 	AdminUsername string
 	AdminPassword string
+	APIToken      string // bearer token of the API, see `--api-token`
 	Framerate     int
 	Resolution    int
 	Pattern       string
 	MaxDuration   int
 	MaxFilesize   int
+	MaxBitrate    int    // kbps, the default of new channels
+	Resolutions   []int  // recorded alongside Resolution, the default of new channels
+	Schedule      string // cron expression, the default of new channels
+	Window        string // daily window, the default of new channels
 	Compress      bool
+	AudioCodec    string
+	AudioBitrate  string
 	Port          string
 	Interval      int
 	Cookies       string
+	RecordPrivate bool // record a private show whose stream the API gives, the session of Cookies is in it
 	UserAgent     string
 	Domain        string
 
 	OutputDir      string
+	OutputDirRoots []string // the per-channel output directories must be inside one of them, see OutputDirAllowed
 	PerModelFolder bool
+
+	FileMode uint32 // 0 = default (0777 minus umask)
+	DirMode  uint32 // 0 = default (0777 minus umask)
+	Chown    bool   // change ownership to ChownUID:ChownGID
+	ChownUID int
+	ChownGID int
+
+	// RequestTimeout and SegmentTimeout are in seconds, 0 uses the defaults.
+	RequestTimeout int
+	SegmentTimeout int
+
+	StartupConcurrency       int // max channels checking their stream at once, 0 = unlimited
+	MaxRecordings            int // max channels recording at once, the others are queued, 0 = unlimited
+	GlobalSegmentConcurrency int // max segment downloads in flight across all channels, 0 = unlimited
+	SegmentErrorRate         int // percent of the recent segment fetches failing that pauses the fetches of a channel, 0 = never
+	SegmentErrorWindow       int // number of recent segment fetches the error rate is measured over
+	SegmentErrorCooldown     int // seconds the segment fetches pause for before probing them again
+	Priority                 int // default priority of new channels
+	VariantRetries           int // extra fetches of a master playlist without variants
+	VariantRetryDelay        int // seconds between them
+	IntervalJitter           int // randomize the check interval by ±N percent
+	MaxChecksPerMinute       int // checks of all channels per minute the interval is raised to stay under, 0 = no limit
+	IntervalFloor            int // minutes, the interval MaxChecksPerMinute allows for the channels, see CheckInterval
+
+	Headers        map[string]string // extra request headers from `--header`
+	APIEndpoints   []string          // primary API endpoint first, then the alternates tried without an HLS source
+	EdgeOKStatuses []string          // status codes such as "200" or classes such as "2xx" of a working edge, empty = 200
+
+	// VersionCheck probes the API response of VersionCheckChannel on startup, the endpoint is empty for the primary one.
+	VersionCheck         bool
+	VersionCheckChannel  string
+	VersionCheckEndpoint string
+
+	MinResolution      int   // streams below this resolution aren't recorded, 0 = any
+	AllowedResolutions []int // the only resolutions PickPlaylist picks, empty = all
+	BlockedResolutions []int // resolutions PickPlaylist never picks
+	ResolutionConfirm  int   // seconds the resolution must stay the same before recording, 0 = start right away
+	IdleSplit          int   // seconds without new segments before the file is finalized, 0 = never
+	ChunkDuration      int   // minutes, a new file starts on every wall-clock multiple, 0 = never
+
+	SequencePadding int // zero-pad {{.Sequence}} to this many digits, 0 = no padding
+	SequenceStart   int // number printed for the first file of a stream
+
+	Timezone string         // `--timezone` as given, e.g. "Local" or "Europe/Berlin"
+	Location *time.Location `json:"-"` // loaded from Timezone, see In and FormatTime
+
+	InsecureSkipVerify bool   // skip TLS certificate verification of outbound requests
+	IPFamily           string // "ipv4" or "ipv6" to dial first, empty uses the system preference
+
+	// Connection pool of the shared HTTP transport, see internal.NewReq.
+	MaxIdleConns        int // across all hosts, 0 = unlimited
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     int // seconds, 0 = never closed
+
+	DormantAfter    int // consecutive offline checks before a channel goes dormant, 0 = never
+	DormantInterval int // check interval in minutes for dormant channels
+
+	OfflineGrace         int // checks a stream that went offline gets to come back before its file is finalized, 0 = none
+	OfflineGraceInterval int // seconds between the OfflineGrace checks
+
+	AutoFollow         bool   // add the followed channels that are online
+	AutoFollowInterval int    // minutes between the syncs of the followed channels
+	AutoFollowRemove   bool   // remove the channels added by AutoFollow once they're off the list
+	AutoFollowEndpoint string // full URL or a path relative to the domain
+
+	OnExisting string // append, overwrite, rename or skip when the output file exists
+
+	MinDuration int    // seconds, a shorter broadcast is handled by OnShort, 0 = keep all
+	TrimStart   int    // seconds, the first segments of a broadcast within it are dropped, 0 = keep all
+	NoBackfill  bool   // skip the segments a playlist lists when a recording starts
+	OnShort     string // discard or keep (uncompressed) a broadcast shorter than MinDuration
+
+	OnVariant404 string // switch or stop when the video playlist keeps returning 404
+	OnEndlist    string // stop or ignore when the video playlist ends with EXT-X-ENDLIST
+	Adaptive     bool   // step down to a lower variant when the segment downloads can't keep up
+	Continuous   bool   // keep writing the same file across quality changes, `--split-on-resolution-change=false`
+	Subtitles    bool   // record the subtitle rendition to a `.vtt` sidecar
+
+	ThumbnailFormat  string // jpg, webp or png, empty disables thumbnails
+	ThumbnailQuality int    // 1-100
+	Poster           bool   // grab a `.poster.jpg` of each file while it's recorded
+	Checksum         string // sha256 writes a checksum next to each recording, empty disables it
+
+	Encoder              string // nvenc, amf, qsv, videotoolbox or cpu, empty auto-detects
+	EncoderDetectTimeout int    // seconds each encoder probe may take, 0 = no limit
+	GPUDevices           []int  // NVENC devices compressions are spread across, empty lets the driver choose
+	HWDecode             bool   // decode on the hardware of the GPU encoder too
+
+	TwoPass             bool     // two-pass libx264 encoding to TargetBitrate
+	TargetBitrate       string   // e.g. "2500k"
+	TempDir             string   // compression output is written here, then moved into place
+	CompressConcurrency int      // max compressions at once, 0 = unlimited
+	CompressMinDuration int      // seconds, shorter recordings aren't compressed, 0 = compress all
+	CompressMinSize     int      // MB, smaller recordings aren't compressed, 0 = compress all
+	RecoverConcurrency  int      // max recordings `--recover` finalizes at once, 0 = unlimited
+	FFmpegExtraArgs     []string // `--ffmpeg-extra-args`, inserted right before the output file of the compression
+	FFmpegLogSize       int      // characters of ffmpeg output logged on failure when no known error is found
+	Timestamps          string   // keep or regenerate the timestamps of `.ts` recordings when compressing, or remuxing them uncompressed
+	FFmpegWarnings      string   // log, flag or ignore the warnings of a successful compression
+
+	// Notifications when a recording starts or finishes, the templates are empty for the default message.
+	WebhookURL       string
+	WebhookTemplate  string
+	DiscordWebhook   string
+	DiscordTemplate  string
+	TelegramToken    string
+	TelegramChatID   string
+	TelegramTemplate string
+
+	SFTP        string // user@host:/path completed recordings are uploaded to, empty disables it
+	SFTPPort    int
+	SFTPKey     string // private key file, empty uses the default ssh keys
+	SFTPDelete  bool   // remove the local files once uploaded
+	SFTPRetries int
+
+	S3Bucket    string // completed recordings are uploaded to this bucket, empty disables it
+	S3Endpoint  string // an S3-compatible server, empty for AWS S3
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Prefix    string // key prefix template with the fields of the filename pattern
+	S3Delete    bool   // remove the local files once uploaded and verified
+	S3Retries   int
+
+	BufferWholeFile bool // keep each file in memory and write it when it's closed
+	BufferMaxSize   int  // MB, a larger file is written segment by segment
+
+	LiveMux    bool   // pipe segments into ffmpeg while recording
+	OutputPipe string // "-" for stdout or a named pipe, only in single channel mode
+}
+
+// RuntimeConfig is the subset of Config that can be changed while running, from the settings or `/api/config`.
+// The interval applies from the next check of each channel. The splitting and compression are the defaults of the
+// channels added afterwards, and apply to the channels that were left at the previous defaults too.
+// The other options are set with the flags and require a restart.
+type RuntimeConfig struct {
+	Interval    int    `json:"interval"`     // minutes between the checks of an offline channel
+	MaxDuration int    `json:"max_duration"` // minutes
+	MaxFilesize int    `json:"max_filesize"` // MB
+	Compress    bool   `json:"compress"`
+	Cookies     string `json:"cookies"`
+	UserAgent   string `json:"user_agent"`
+}
+
+// runtimeMu guards the fields of RuntimeConfig and IntervalFloor of Config, which are changed while the channels
+// read them. They're read with Runtime and CheckInterval, and changed with SetRuntime and SetIntervalFloor.
+var runtimeMu sync.RWMutex
+
+// Runtime returns a copy of the settings that can be changed while running.
+func (c *Config) Runtime() *RuntimeConfig {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return &RuntimeConfig{
+		Interval:    c.Interval,
+		MaxDuration: c.MaxDuration,
+		MaxFilesize: c.MaxFilesize,
+		Compress:    c.Compress,
+		Cookies:     c.Cookies,
+		UserAgent:   c.UserAgent,
+	}
+}
+
+// CheckInterval returns the minutes between the checks of an offline channel, the interval raised
+// to IntervalFloor if it's below.
+func (c *Config) CheckInterval() int {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return max(c.Interval, c.IntervalFloor)
+}
+
+// SetIntervalFloor sets IntervalFloor, it reports whether it changed.
+func (c *Config) SetIntervalFloor(floor int) bool {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	changed := c.IntervalFloor != floor
+	c.IntervalFloor = floor
+	return changed
+}
+
+// redacted replaces the secrets in Redacted.
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the config with the passwords, tokens, keys, cookies and header values replaced,
+// e.g. to print it. The webhook URLs are secrets too, anyone with one can post to it.
+func (c *Config) Redacted() *Config {
+	r := c.Copy()
+	for _, secret := range []*string{
+		&r.AdminPassword, &r.APIToken, &r.Cookies, &r.TelegramToken,
+		&r.S3AccessKey, &r.S3SecretKey, &r.WebhookURL, &r.DiscordWebhook,
+	} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	if c.Headers != nil {
+		r.Headers = make(map[string]string, len(c.Headers))
+		for k := range c.Headers {
+			r.Headers[k] = redacted
+		}
+	}
+	return r
+}
+
+// Copy returns a copy of the config that's safe to read while SetRuntime changes the config, e.g. to render it.
+// It's nil if the config is.
+func (c *Config) Copy() *Config {
+	if c == nil {
+		return nil
+	}
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	r := *c
+	return &r
+}
+
+// In returns t in the `--timezone` location, or in the local time zone without a config or a location.
+func (c *Config) In(t time.Time) time.Time {
+	if c == nil || c.Location == nil {
+		return t.In(time.Local)
+	}
+	return t.In(c.Location)
+}
+
+// OutputDirAllowed reports whether a per-channel output directory is inside one of `--output-dir-roots`, or inside
+// `--output-dir` (the working directory without it) if none are set. Relative paths are relative to the working directory.
+func (c *Config) OutputDirAllowed(dir string) bool {
+	roots := []string{"."}
+	if c != nil && len(c.OutputDirRoots) > 0 {
+		roots = c.OutputDirRoots
+	} else if c != nil && c.OutputDir != "" {
+		roots = []string{c.OutputDir}
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Now returns the current time in the `--timezone` location, the wall clock of the patterns, schedules and windows.
+func (c *Config) Now() time.Time {
+	return c.In(time.Now())
+}
+
+// FormatTime formats t in ISO 8601 (RFC 3339) with the UTC offset of `--timezone`, every timestamp shown is formatted with it.
+func (c *Config) FormatTime(t time.Time) string {
+	return c.In(t).Format(time.RFC3339)
+}
+
+// SetRuntime applies the settings changed while running, they're reverted on restart.
+func (c *Config) SetRuntime(r *RuntimeConfig) {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	c.Interval = r.Interval
+	c.MaxDuration = r.MaxDuration
+	c.MaxFilesize = r.MaxFilesize
+	c.Compress = r.Compress
+	c.Cookies = r.Cookies
+	c.UserAgent = r.UserAgent
 }
@@ -0,0 +1,179 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Entry is a completed recording in the index.
+type Entry struct {
+	Path     string  `json:"path"`               // absolute path of the file
+	Channel  string  `json:"channel"`            // empty if it's unknown
+	Size     int64   `json:"size"`               // bytes
+	ModTime  int64   `json:"mod_time"`           // unix seconds
+	Duration float64 `json:"duration"`           // seconds, 0 if it's unknown
+	Degraded string  `json:"degraded,omitempty"` // summary of the ffmpeg warnings, see SetDegraded
+}
+
+// Index keeps the completed recordings in a JSON file, so they're listed without scanning the directories.
+// It's updated whenever a recording completes and can be rebuilt from the files if lost.
+type Index struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*Entry
+}
+
+// Open loads the index from the JSON file, the index is empty if the file doesn't exist yet.
+// exists reports whether it did, the index should be rebuilt otherwise.
+func Open(path string) (idx *Index, exists bool, err error) {
+	idx = &Index{path: path, entries: map[string]*Entry{}}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return idx, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("read file: %w", err)
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, false, fmt.Errorf("unmarshal: %w", err)
+	}
+	for _, e := range entries {
+		idx.entries[e.Path] = e
+	}
+	return idx, true, nil
+}
+
+// Add adds or updates the recording at path, with its size and modification time from the file.
+func (idx *Index) Add(path, channel string, duration float64) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("abs: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.entries[path] = &Entry{
+		Path:     path,
+		Channel:  channel,
+		Size:     info.Size(),
+		ModTime:  info.ModTime().Unix(),
+		Duration: duration,
+	}
+	return idx.save()
+}
+
+// SetDegraded marks the indexed recording at path as degraded with a summary of why, e.g. "3 decode errors".
+func (idx *Index) SetDegraded(path, summary string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("abs: %w", err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[path]
+	if !ok {
+		return fmt.Errorf("%s is not indexed", path)
+	}
+	e.Degraded = summary
+	return idx.save()
+}
+
+// Entries returns the recordings that still exist, the removed ones are dropped from the index
+// and the size and modification time are refreshed if the file changed.
+func (idx *Index) Entries() ([]Entry, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var changed bool
+	entries := make([]Entry, 0, len(idx.entries))
+	for path, e := range idx.entries {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(idx.entries, path)
+			changed = true
+			continue
+		}
+		if info.Size() != e.Size || info.ModTime().Unix() != e.ModTime {
+			e.Size, e.ModTime = info.Size(), info.ModTime().Unix()
+			changed = true
+		}
+		entries = append(entries, *e)
+	}
+	if changed {
+		if err := idx.save(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Rebuild replaces the index with the scanned recordings. The channel, duration and degradation already known
+// for an unchanged file are kept, and the indexed files outside of the scan are kept while they exist.
+func (idx *Index) Rebuild(scanned []*Entry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entries := map[string]*Entry{}
+	for _, e := range scanned {
+		if known, ok := idx.entries[e.Path]; ok && known.Size == e.Size && known.ModTime == e.ModTime {
+			if e.Channel == "" {
+				e.Channel = known.Channel
+			}
+			e.Duration = known.Duration
+			e.Degraded = known.Degraded
+		}
+		entries[e.Path] = e
+	}
+	for path, e := range idx.entries {
+		if _, ok := entries[path]; ok {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			entries[path] = e
+		}
+	}
+	idx.entries = entries
+	return idx.save()
+}
+
+// save writes the index, sorted by path so it diffs well. The caller holds the lock.
+func (idx *Index) save() error {
+	entries := make([]*Entry, 0, len(idx.entries))
+	for _, e := range idx.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	return writeJSON(idx.path, entries)
+}
+
+// writeJSON writes v as indented JSON to path, creating its directory.
+func writeJSON(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("mkdir all: %w", err)
+	}
+	// Write to a temporary file first so a crash never leaves a truncated file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0666); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
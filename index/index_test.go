@@ -0,0 +1,109 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexAddReopenAndRebuild(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "conf", "recordings.json")
+	idx, exists, err := Open(indexPath)
+	if err != nil || exists {
+		t.Fatalf("Open() = %v, %v, want a new index", exists, err)
+	}
+
+	kept := filepath.Join(dir, "alice_1.mkv")
+	removed := filepath.Join(dir, "alice_2.mkv")
+	for _, path := range []string{kept, removed} {
+		if err := os.WriteFile(path, []byte("video"), 0666); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if err := idx.Add(path, "alice", 90); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	idx, exists, err = Open(indexPath)
+	if err != nil || !exists {
+		t.Fatalf("Open() = %v, %v, want the saved index", exists, err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	entries, err := idx.Entries()
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != kept || entries[0].Channel != "alice" || entries[0].Duration != 90 || entries[0].Size != 5 {
+		t.Fatalf("Entries() = %+v, want only %s", entries, kept)
+	}
+
+	// A rebuild keeps the duration of the unchanged file and adds the new ones
+	added := filepath.Join(dir, "bob_1.mkv")
+	if err := os.WriteFile(added, []byte("video"), 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	scanned := []*Entry{
+		{Path: kept, Size: entries[0].Size, ModTime: entries[0].ModTime},
+		{Path: added, Channel: "bob", Size: 5},
+	}
+	if err := idx.SetDegraded(kept, "2 decode errors"); err != nil {
+		t.Fatalf("SetDegraded() error = %v", err)
+	}
+	if err := idx.SetDegraded(added, "1 decode error"); err == nil {
+		t.Fatal("SetDegraded() of a file that isn't indexed, want an error")
+	}
+	if err := idx.Rebuild(scanned); err != nil {
+		t.Fatalf("Rebuild() error = %v", err)
+	}
+	if e := idx.entries[kept]; e.Channel != "alice" || e.Duration != 90 || e.Degraded != "2 decode errors" {
+		t.Fatalf("rebuilt entry = %+v, want the known channel, duration and degradation", e)
+	}
+	if _, ok := idx.entries[added]; !ok || len(idx.entries) != 2 {
+		t.Fatalf("rebuilt entries = %v, want %s added", idx.entries, added)
+	}
+}
+
+func TestTotalsCountRemovedRecordingsAcrossReopens(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	totalsPath := filepath.Join(dir, "conf", "totals.json")
+	totals, exists, err := OpenTotals(totalsPath)
+	if err != nil || exists {
+		t.Fatalf("OpenTotals() = %v, %v, want new totals", exists, err)
+	}
+	if err := totals.Seed([]Entry{{Path: "/old.mkv", Channel: "alice", Size: 100, Duration: 60}, {Path: "/unknown.mkv", Size: 10}}); err != nil {
+		t.Fatalf("Seed() error = %v", err)
+	}
+
+	path := filepath.Join(dir, "alice_1.mkv")
+	if err := os.WriteFile(path, []byte("video"), 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := totals.Add(path, "alice", 30); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	totals, exists, err = OpenTotals(totalsPath)
+	if err != nil || !exists {
+		t.Fatalf("OpenTotals() = %v, %v, want the saved totals", exists, err)
+	}
+	stats := totals.Stats()
+	if stats.Total.Recordings != 3 || stats.Total.Bytes != 115 || stats.Total.Duration != 90 {
+		t.Fatalf("Total = %+v, want 3 recordings, 115 bytes and 90 seconds", stats.Total)
+	}
+	if alice := totals.Channel("alice"); alice.Recordings != 2 || alice.Bytes != 105 || alice.Duration != 90 {
+		t.Fatalf("Channel(alice) = %+v, want 2 recordings, 105 bytes and 90 seconds", alice)
+	}
+	if len(stats.Channels) != 1 {
+		t.Fatalf("Channels = %v, want only alice, the unknown channel only counts in the total", stats.Channels)
+	}
+}
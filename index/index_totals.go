@@ -0,0 +1,96 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/teacat/chaturbate-dvr/entity"
+)
+
+// Totals keeps the lifetime totals of the completed recordings in a JSON file. Unlike the Index,
+// a recording is counted once when it completes and stays counted after its file is removed.
+type Totals struct {
+	mu    sync.Mutex
+	path  string
+	stats entity.Stats
+}
+
+// OpenTotals loads the totals from the JSON file, they're zero if the file doesn't exist yet.
+// exists reports whether it did, the totals should be seeded otherwise.
+func OpenTotals(path string) (t *Totals, exists bool, err error) {
+	t = &Totals{path: path}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, fmt.Errorf("read file: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &t.stats); err != nil {
+			return nil, false, fmt.Errorf("unmarshal: %w", err)
+		}
+		exists = true
+	}
+	if t.stats.Channels == nil {
+		t.stats.Channels = map[string]entity.RecordingTotals{}
+	}
+	return t, exists, nil
+}
+
+// Add counts the completed recording at path of the channel, with its size from the file and the duration in seconds.
+func (t *Totals) Add(path, channel string, duration float64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(channel, info.Size(), duration)
+	return writeJSON(t.path, t.stats)
+}
+
+// Seed counts the indexed recordings, so the totals of a new file start from what's recorded already.
+func (t *Totals) Seed(entries []Entry) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range entries {
+		t.add(e.Channel, e.Size, e.Duration)
+	}
+	return writeJSON(t.path, t.stats)
+}
+
+// add counts a recording, an unknown channel only counts in the total. The caller holds the lock.
+func (t *Totals) add(channel string, size int64, duration float64) {
+	t.stats.Total = addTotals(t.stats.Total, size, duration)
+	if channel != "" {
+		t.stats.Channels[channel] = addTotals(t.stats.Channels[channel], size, duration)
+	}
+}
+
+// addTotals returns the totals with a recording of size bytes and duration seconds.
+func addTotals(totals entity.RecordingTotals, size int64, duration float64) entity.RecordingTotals {
+	totals.Recordings++
+	totals.Bytes += size
+	totals.Duration += duration
+	return totals
+}
+
+// Stats returns a copy of the totals of all the recordings and of each channel.
+func (t *Totals) Stats() entity.Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	channels := make(map[string]entity.RecordingTotals, len(t.stats.Channels))
+	for name, totals := range t.stats.Channels {
+		channels[name] = totals
+	}
+	return entity.Stats{Total: t.stats.Total, Channels: channels}
+}
+
+// Channel returns the totals of the recordings of the channel, zero if it has none.
+func (t *Totals) Channel(channel string) entity.RecordingTotals {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats.Channels[channel]
+}
@@ -2,10 +2,62 @@ package internal
 
 import (
 	"fmt"
+	"io"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/server"
 )
 
+// ConfDir is the directory of the channels, the recordings index and the totals, it's never scanned or served.
+const ConfDir = "./conf"
+
+// Pattern holds the date/time and sequence information for the filename pattern
+type Pattern struct {
+	Username string
+	Year     string
+	Month    string
+	Day      string
+	Hour     string
+	Minute   string
+	Second   string
+	Timezone string // UTC offset, e.g. "+0900"
+	ISO8601  string // basic format, safe in filenames, e.g. "20240102T134500+0900"
+	Sequence SequenceNumber
+}
+
+// SequenceNumber is the sequence of the file in the stream, starting at 0. It's printed offset by
+// `--sequence-start` and zero-padded to `--sequence-padding` digits, `{{if .Sequence}}` still hides the first file.
+type SequenceNumber int
+
+func (s SequenceNumber) String() string {
+	if server.Config == nil {
+		return formatSequence(int(s), 0, 0)
+	}
+	return formatSequence(int(s), server.Config.SequencePadding, server.Config.SequenceStart)
+}
+
+// formatSequence formats the sequence offset by start and zero-padded to padding digits.
+func formatSequence(seq, padding, start int) string {
+	return fmt.Sprintf("%0*d", padding, seq+start)
+}
+
+// PatternDir returns the static directory of a filename pattern, which the recordings are written under,
+// e.g. "videos" for "videos/{{.Username}}/{{.Year}}". It's empty if the pattern starts with a template
+// or has no directory, the recordings aren't under a directory of their own then.
+func PatternDir(pattern string) string {
+	prefix, _, _ := strings.Cut(pattern, "{{")
+	if dir := filepath.Dir(prefix); dir != "." {
+		return dir
+	}
+	return ""
+}
+
 // FormatDuration converts a float64 duration (in seconds) to h:m:s format.
 func FormatDuration(duration float64) string {
 	if duration == 0 {
@@ -19,7 +71,7 @@ func FormatDuration(duration float64) string {
 	return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
 }
 
-// FormatFilesize converts an int filesize in bytes to a human-readable string (KB, MB, GB).
+// FormatFilesize converts an int filesize in bytes to a human-readable string (KB, MB, GB, TB).
 func FormatFilesize(filesize int) string {
 	if filesize == 0 {
 		return ""
@@ -28,8 +80,11 @@ func FormatFilesize(filesize int) string {
 		KB = 1024
 		MB = KB * 1024
 		GB = MB * 1024
+		TB = GB * 1024
 	)
 	switch {
+	case filesize >= TB:
+		return fmt.Sprintf("%.2f TB", float64(filesize)/float64(TB))
 	case filesize >= GB:
 		return fmt.Sprintf("%.2f GB", float64(filesize)/float64(GB))
 	case filesize >= MB:
@@ -41,15 +96,43 @@ func FormatFilesize(filesize int) string {
 	}
 }
 
+// FormatTotals converts the lifetime totals of recordings to a human-readable string, empty if there's none.
+func FormatTotals(t entity.RecordingTotals) string {
+	if t.Recordings == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d recording(s), %s, %.1f hour(s)", t.Recordings, FormatFilesize(int(t.Bytes)), t.Duration/3600)
+}
+
+// FormatBitrate converts a bitrate in bits per second to a human-readable string (Kbps, Mbps).
+func FormatBitrate(bps float64) string {
+	switch {
+	case bps <= 0:
+		return ""
+	case bps >= 1000*1000:
+		return fmt.Sprintf("%.2f Mbps", bps/1000/1000)
+	default:
+		return fmt.Sprintf("%.0f Kbps", bps/1000)
+	}
+}
+
 var (
 	// Old format: media_w1920_12345.ts
 	segmentSeqTSRegexp = regexp.MustCompile(`_(\d+)\.ts$`)
 	// New LL-HLS format: seg_4_6543_video_11903984827994253865_llhls.m4s?session=xxx
 	segmentSeqM4SRegexp = regexp.MustCompile(`seg_\d+_(\d+)_`)
+	// Other encoders: 12345.ts, segment-12345.m4s, chunk12345.aac
+	segmentSeqTrailingRegexp = regexp.MustCompile(`(\d+)\.[A-Za-z0-9]+$`)
 )
 
-// SegmentSeq extracts the segment sequence number from a filename.
+// SegmentSeq extracts the segment sequence number from a segment URI, or -1 if there's none.
 func SegmentSeq(filename string) int {
+	// Query strings and fragments carry tokens, not the sequence, and directories may contain numbers too
+	if i := strings.IndexAny(filename, "?#"); i != -1 {
+		filename = filename[:i]
+	}
+	filename = path.Base(filename)
+
 	// Old format: xxx_12345.ts
 	if match := segmentSeqTSRegexp.FindStringSubmatch(filename); len(match) > 1 {
 		if number, err := strconv.Atoi(match[1]); err == nil {
@@ -62,5 +145,80 @@ func SegmentSeq(filename string) int {
 			return number
 		}
 	}
+	// Any other format: the number right before the extension
+	if match := segmentSeqTrailingRegexp.FindStringSubmatch(filename); len(match) > 1 {
+		if number, err := strconv.Atoi(match[1]); err == nil {
+			return number
+		}
+	}
 	return -1
 }
+
+// IntervalFloor returns the minutes between the checks of each of the channels so they're checked at most
+// maxChecks times a minute together, 0 if there's no limit.
+func IntervalFloor(channels, maxChecks int) int {
+	if maxChecks <= 0 || channels <= 0 {
+		return 0
+	}
+	return (channels + maxChecks - 1) / maxChecks
+}
+
+// IsFMP4 reports whether b starts with an ISO BMFF box, as fMP4/CMAF segments do.
+// MPEG-TS segments start with the 0x47 sync byte instead.
+func IsFMP4(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	switch string(b[4:8]) {
+	case "ftyp", "styp", "moov", "moof", "sidx", "emsg", "prft":
+		return true
+	}
+	return false
+}
+
+// TimestampWriter prefixes each write with the current time in ISO 8601 (RFC 3339) with the UTC offset, it's
+// the output of the standard logger, which writes each line at once.
+type TimestampWriter struct {
+	w   io.Writer
+	loc *time.Location
+}
+
+// NewTimestampWriter returns a TimestampWriter writing to w, with the time in loc (`--timezone`).
+func NewTimestampWriter(w io.Writer, loc *time.Location) *TimestampWriter {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &TimestampWriter{w: w, loc: loc}
+}
+
+func (t *TimestampWriter) Write(p []byte) (int, error) {
+	if _, err := fmt.Fprintf(t.w, "%s %s", time.Now().In(t.loc).Format(time.RFC3339), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ParseSFTPDestination splits an `--sftp` destination in the `user@host:/path` form into the host and the remote directory.
+func ParseSFTPDestination(dest string) (host, dir string, err error) {
+	host, dir, ok := strings.Cut(dest, ":")
+	if !ok || host == "" || strings.HasSuffix(host, "@") {
+		return "", "", fmt.Errorf("expected user@host:/path, got %q", dest)
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return host, dir, nil
+}
+
+// VideoCodecArg returns the video codec ffmpeg arguments select with `-c:v`, `-codec:v` or `-vcodec`,
+// the last one wins like in ffmpeg. It's fallback if they select none.
+func VideoCodecArg(args []string, fallback string) string {
+	codec := fallback
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-c:v", "-codec:v", "-vcodec":
+			codec = args[i+1]
+		}
+	}
+	return codec
+}
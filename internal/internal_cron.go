@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression of 5 fields: minute, hour, day of month, month and day of week.
+// Each field is a set of values as a bitmask.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// Like cron, a day matches either field when both the day of month and the day of week are restricted,
+	// a field listing every value (`*`, `1-31`, `0-6`, ...) is not.
+	domAny, dowAny bool
+}
+
+// cronField is the range and the names of the values of a cron field.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string // names of the values from min, e.g. "JAN" for 1
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}},
+}
+
+// cronSearchLimit bounds how far Next looks for a matching minute.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// ParseCron parses a cron expression such as "*/5 18-23 * * FRI,SAT". A field is `*`, a value, a range `a-b`,
+// any of them with a step `/n`, or a comma-separated list of those. Months and days of week may be given by
+// their first 3 letters, Sunday is 0 or 7. An expression that never matches (e.g. "0 0 30 2 *") is an error.
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron: want %d fields (minute hour day-of-month month day-of-week), got %d", len(cronFields), len(fields))
+	}
+
+	var masks [5]uint64
+	for i, field := range fields {
+		mask, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron: %s: %w", cronFields[i].name, err)
+		}
+		masks[i] = mask
+	}
+	// Sunday is both 0 and 7
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+
+	c := &Cron{
+		minute: masks[0],
+		hour:   masks[1],
+		dom:    masks[2],
+		month:  masks[3],
+		dow:    masks[4],
+		domAny: masks[2] == cronFields[2].full(),
+		dowAny: masks[4]&0x7f == 0x7f,
+	}
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron: %q never matches", expr)
+	}
+	return c, nil
+}
+
+// parseCronField parses a field of a cron expression into a bitmask of its values.
+func parseCronField(s string, f cronField) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		var from, to int
+		switch {
+		case rng == "*":
+			from, to = f.min, f.max
+		case strings.Contains(rng, "-"):
+			a, b, _ := strings.Cut(rng, "-")
+			var err error
+			if from, err = f.value(a); err != nil {
+				return 0, err
+			}
+			if to, err = f.value(b); err != nil {
+				return 0, err
+			}
+			if from > to {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			v, err := f.value(rng)
+			if err != nil {
+				return 0, err
+			}
+			// `a/n` steps from a to the end of the field
+			from, to = v, v
+			if hasStep {
+				to = f.max
+			}
+		}
+		for v := from; v <= to; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// full returns the mask of every value of the field.
+func (f cronField) full() uint64 {
+	return (1<<(f.max+1) - 1) &^ (1<<f.min - 1)
+}
+
+// value parses a number or a name of the field.
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q, want %d-%d", s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Match reports whether the minute of t matches the expression, in the location of t.
+func (c *Cron) Match(t time.Time) bool {
+	return c.minute&(1<<t.Minute()) != 0 &&
+		c.hour&(1<<t.Hour()) != 0 &&
+		c.month&(1<<int(t.Month())) != 0 &&
+		c.matchDay(t)
+}
+
+// matchDay reports whether the day of t matches the day of month and the day of week fields.
+func (c *Cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first matching minute at or after t, or the zero time if there's none within 5 years.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location())
+	limit := t.Add(cronSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			// Skip to the next set minute of the hour, or the next hour
+			next := c.minute >> (t.Minute() + 1) << (t.Minute() + 1)
+			if next == 0 {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			} else {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), bits.TrailingZeros64(next), 0, 0, t.Location())
+			}
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
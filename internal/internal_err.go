@@ -1,6 +1,9 @@
 package internal
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrChannelExists     = errors.New("channel exists")
@@ -12,4 +15,20 @@ var (
 	ErrPaused            = errors.New("channel paused")
 	ErrStopped           = errors.New("channel stopped")
 	ErrGeoBlocked        = errors.New("stream not accessible (may be geo-blocked)")
+	ErrRegionLocked      = errors.New("stream refused by every edge (broadcaster may not be available in this region)")
+	ErrOutsideSchedule   = errors.New("outside the schedule")
+	ErrRoomPassword      = errors.New("room is password protected; set its room password")
+	ErrWrongRoomPassword = errors.New("room password was refused")
+	ErrFileExists        = errors.New("output file already exists")
+	ErrResolutionTooLow  = errors.New("resolution too low")
+	ErrNoAllowedVariant  = errors.New("no variant at an allowed resolution")
+	ErrNotFound          = errors.New("not found")
+	ErrStreamEnded       = errors.New("stream ended")
+	ErrStreamEndlist     = fmt.Errorf("%w (endlist)", ErrStreamEnded) // the playlist ended with EXT-X-ENDLIST, no offline grace
+	ErrChannelRecording  = errors.New("channel is already recording")
+	ErrNoVariants        = errors.New("master playlist has no variants yet")
+	ErrInvalidQuery      = errors.New("invalid query parameter")
+	ErrInvalidSettings   = errors.New("invalid settings")
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrNoRecordingsDir   = errors.New("no recordings directory, set --output-dir or start --pattern with a directory")
 )
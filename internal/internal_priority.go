@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// PrioritySlots bounds how many callers hold a slot at once. When all slots are taken
+// the waiters get the next free slot by highest priority first, in arrival order for
+// the same priority, so equal priorities keep the FIFO behavior.
+type PrioritySlots struct {
+	mu      sync.Mutex
+	free    int
+	waiters []*slotWaiter
+}
+
+type slotWaiter struct {
+	priority int
+	ready    chan struct{}
+}
+
+// NewPrioritySlots returns n free slots.
+func NewPrioritySlots(n int) *PrioritySlots {
+	return &PrioritySlots{free: n}
+}
+
+// Acquire waits for a free slot, it returns the context error if ctx is done first.
+func (s *PrioritySlots) Acquire(ctx context.Context, priority int) error {
+	s.mu.Lock()
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	w := &slotWaiter{priority: priority, ready: make(chan struct{})}
+	i := sort.Search(len(s.waiters), func(i int) bool { return s.waiters[i].priority < priority })
+	s.waiters = slices.Insert(s.waiters, i, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if i := slices.Index(s.waiters, w); i >= 0 {
+			s.waiters = slices.Delete(s.waiters, i, i+1)
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+		s.mu.Unlock()
+		// The slot was handed over at the same time, pass it on
+		s.Release()
+		return ctx.Err()
+	}
+}
+
+// TryAcquire takes a free slot without waiting, it reports whether there was one.
+func (s *PrioritySlots) TryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		return true
+	}
+	return false
+}
+
+// Release hands the slot to the first waiter, or frees it.
+func (s *PrioritySlots) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiters) == 0 {
+		s.free++
+		return
+	}
+	w := s.waiters[0]
+	s.waiters = s.waiters[1:]
+	close(w.ready)
+}
+
+// waiting returns the number of callers waiting for a slot.
+func (s *PrioritySlots) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying the channel priority, the slots acquired deeper down
+// with PriorityFrom (e.g. the segment downloads) go by it.
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityFrom returns the priority carried by ctx, 0 if it has none.
+func PriorityFrom(ctx context.Context) int {
+	priority, _ := ctx.Value(priorityKey{}).(int)
+	return priority
+}
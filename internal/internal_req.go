@@ -5,40 +5,102 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/teacat/chaturbate-dvr/entity"
 	"github.com/teacat/chaturbate-dvr/server"
 )
 
 // Req represents an HTTP client with customized settings.
 type Req struct {
-	client *http.Client
+	client       *http.Client
+	segmentSlots *PrioritySlots // shared by all clients, nil if the segment downloads are unlimited
 }
 
+// sharedTransport is the transport of all clients, so the channels on the same edge reuse its connections
+// instead of a TLS handshake for every client. segmentSlots bounds the segment downloads in flight across
+// all channels (`--global-segment-concurrency`).
+var (
+	sharedTransport     *http.Transport
+	segmentSlots        *PrioritySlots
+	sharedTransportOnce sync.Once
+)
+
 // NewReq creates a new HTTP client with specific transport configurations.
 func NewReq() *Req {
+	sharedTransportOnce.Do(func() {
+		sharedTransport = CreateTransport()
+		if server.Config != nil && server.Config.GlobalSegmentConcurrency > 0 {
+			segmentSlots = NewPrioritySlots(server.Config.GlobalSegmentConcurrency)
+		}
+	})
 	return &Req{
 		client: &http.Client{
-			Transport: CreateTransport(),
+			Transport: sharedTransport,
 		},
+		segmentSlots: segmentSlots,
 	}
 }
 
 // CreateTransport initializes a custom HTTP transport.
 func CreateTransport() *http.Transport {
+	return newTransport(server.Config)
+}
+
+// newTransport initializes a custom HTTP transport with the settings of conf, the defaults if it's nil.
+func newTransport(conf *entity.Config) *http.Transport {
 	// The DefaultTransport allows user changes the proxy settings via environment variables
 	// such as HTTP_PROXY, HTTPS_PROXY.
 	defaultTransport := http.DefaultTransport.(*http.Transport)
 
+	// Certificates are verified unless `--insecure-skip-verify` is set, e.g. for a MITM proxy with a self-signed certificate.
 	newTransport := defaultTransport.Clone()
 	newTransport.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: true,
+		InsecureSkipVerify: conf != nil && conf.InsecureSkipVerify,
+	}
+	if conf == nil {
+		return newTransport
+	}
+	if conf.IPFamily != "" {
+		newTransport.DialContext = preferFamilyDialer(conf.IPFamily)
+	}
+	// The flags always set MaxIdleConnsPerHost, a config without it keeps the defaults
+	if conf.MaxIdleConnsPerHost > 0 {
+		newTransport.MaxIdleConns = conf.MaxIdleConns
+		newTransport.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+		newTransport.IdleConnTimeout = time.Duration(conf.IdleConnTimeout) * time.Second
 	}
 	return newTransport
 }
 
+// preferFamilyDialer returns a dialer trying the address family ("ipv4" or "ipv6") first,
+// then falling back to any family so hosts without an address of the preferred one stay reachable.
+func preferFamilyDialer(family string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	preferred := "tcp4"
+	if family == "ipv6" {
+		preferred = "tcp6"
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			conn, err := dialer.DialContext(ctx, preferred, addr)
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
 // Get sends an HTTP GET request and returns the response as a string.
 func (h *Req) Get(ctx context.Context, url string) (string, error) {
 	resp, err := h.GetBytes(ctx, url)
@@ -50,62 +112,211 @@ func (h *Req) Get(ctx context.Context, url string) (string, error) {
 
 // GetBytes sends an HTTP GET request and returns the response as a byte slice.
 func (h *Req) GetBytes(ctx context.Context, url string) ([]byte, error) {
-	req, cancel, err := CreateRequest(ctx, url)
+	b, _, err := h.getBytes(ctx, url, RequestTimeout())
+	return b, err
+}
+
+// GetPlaylist is like Get for HLS playlists, a 404 or 410 returns ErrNotFound since the playlists
+// are removed once the broadcast ends. Other requests keep the body of such responses.
+func (h *Req) GetPlaylist(ctx context.Context, url string) (string, error) {
+	b, status, err := h.getBytes(ctx, url, RequestTimeout())
+	if err != nil {
+		return "", fmt.Errorf("get bytes: %w", err)
+	}
+	if status == http.StatusNotFound || status == http.StatusGone {
+		return "", fmt.Errorf("status %d: %w", status, ErrNotFound)
+	}
+	return string(b), nil
+}
+
+// GetSegment is like GetBytes but uses the segment timeout,
+// so large media segments are not limited by the shorter request timeout.
+//
+// If the transfer breaks and the server advertises `Accept-Ranges: bytes`,
+// the download resumes from the last received byte instead of starting over.
+// With `--global-segment-concurrency` it waits for a free download slot first, by the priority of ctx (see WithPriority),
+// the segment timeout starts after.
+func (h *Req) GetSegment(ctx context.Context, url string) ([]byte, error) {
+	if h.segmentSlots != nil {
+		if err := h.segmentSlots.Acquire(ctx, PriorityFrom(ctx)); err != nil {
+			return nil, err
+		}
+		defer h.segmentSlots.Release()
+	}
+
+	var buf []byte
+	for resumes := 0; ; resumes++ {
+		b, resumable, err := h.getSegmentFrom(ctx, url, len(buf))
+		buf = append(buf, b...)
+		if err == nil {
+			return buf, nil
+		}
+		if !resumable || len(b) == 0 || resumes >= maxSegmentResumes || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// maxSegmentResumes is how many times a broken segment download is resumed.
+const maxSegmentResumes = 3
+
+// getSegmentFrom downloads the segment starting at offset, it returns the bytes received
+// before an error and whether the server supports resuming with a range request.
+func (h *Req) getSegmentFrom(ctx context.Context, url string, offset int) ([]byte, bool, error) {
+	req, cancel, err := CreateRequest(ctx, url, SegmentTimeout())
+	if err != nil {
+		return nil, false, fmt.Errorf("new request: %w", err)
+	}
+	defer cancel()
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("client do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		return nil, false, fmt.Errorf("forbidden: %w", ErrPrivateStream)
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		return nil, false, fmt.Errorf("resume segment: unexpected status %d", resp.StatusCode)
+	}
+	resumable := resp.Header.Get("Accept-Ranges") == "bytes" || resp.StatusCode == http.StatusPartialContent
+
+	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
+		return b, resumable, fmt.Errorf("read body: %w", err)
+	}
+
+	if offset == 0 {
+		// Check for Cloudflare protection
+		if strings.Contains(string(b), "<title>Just a moment...</title>") {
+			return nil, false, ErrCloudflareBlocked
+		}
+		// Check for Age Verification
+		if strings.Contains(string(b), "Verify your age") {
+			return nil, false, ErrAgeVerification
+		}
+	}
+	return b, resumable, nil
+}
+
+func (h *Req) getBytes(ctx context.Context, url string, timeout time.Duration) ([]byte, int, error) {
+	req, cancel, err := CreateRequest(ctx, url, timeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("new request: %w", err)
 	}
 	defer cancel()
 
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("client do: %w", err)
+		return nil, 0, fmt.Errorf("client do: %w", err)
 	}
 	defer resp.Body.Close()
 
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("read body: %w", err)
+		return nil, resp.StatusCode, fmt.Errorf("read body: %w", err)
 	}
 
 	// Check for Cloudflare protection
 	if strings.Contains(string(b), "<title>Just a moment...</title>") {
-		return nil, ErrCloudflareBlocked
+		return nil, resp.StatusCode, ErrCloudflareBlocked
 	}
 	// Check for Age Verification
 	if strings.Contains(string(b), "Verify your age") {
-		return nil, ErrAgeVerification
+		return nil, resp.StatusCode, ErrAgeVerification
 	}
 
 	if resp.StatusCode == http.StatusForbidden {
-		return nil, fmt.Errorf("forbidden: %w", ErrPrivateStream)
+		return nil, resp.StatusCode, fmt.Errorf("forbidden: %w", ErrPrivateStream)
 	}
+	return b, resp.StatusCode, nil
+}
 
-	return b, err
+// PostForm posts the form to rawURL and returns the body, with the `csrftoken` of `--cookies` as the CSRF header.
+// The client keeps the cookies the response sets from then on, e.g. the session a room password unlocks.
+func (h *Req) PostForm(ctx context.Context, rawURL string, form url.Values) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", rawURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("new request: %w", err)
+	}
+	SetRequestHeaders(req)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", rawURL)
+	if token := ParseCookies(server.Config.Runtime().Cookies)["csrftoken"]; token != "" {
+		req.Header.Set("X-CSRFToken", token)
+	}
+
+	if h.client.Jar == nil {
+		if h.client.Jar, err = cookiejar.New(nil); err != nil {
+			return "", fmt.Errorf("cookie jar: %w", err)
+		}
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("client do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read body: %w", err)
+	}
+	if strings.Contains(string(b), "<title>Just a moment...</title>") {
+		return "", ErrCloudflareBlocked
+	}
+	if resp.StatusCode >= 400 {
+		return string(b), fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return string(b), nil
 }
 
-// Head sends an HTTP HEAD request and returns the status code.
-func (h *Req) Head(ctx context.Context, url string) (int, error) {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+// Head sends an HTTP HEAD request and returns the status code and the URL it ended at after the redirects.
+func (h *Req) Head(ctx context.Context, url string) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout())
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	SetRequestHeaders(req)
 
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode, nil
+	return resp.StatusCode, resp.Request.URL.String(), nil
+}
+
+// RequestTimeout returns the timeout for API, playlist and HEAD requests.
+func RequestTimeout() time.Duration {
+	if server.Config != nil && server.Config.RequestTimeout > 0 {
+		return time.Duration(server.Config.RequestTimeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// SegmentTimeout returns the timeout for segment downloads, defaults to RequestTimeout.
+func SegmentTimeout() time.Duration {
+	if server.Config != nil && server.Config.SegmentTimeout > 0 {
+		return time.Duration(server.Config.SegmentTimeout) * time.Second
+	}
+	return RequestTimeout()
 }
 
 // CreateRequest constructs an HTTP GET request with necessary headers.
-func CreateRequest(ctx context.Context, url string) (*http.Request, context.CancelFunc, error) {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second) // timed out after 10 seconds
+func CreateRequest(ctx context.Context, url string, timeout time.Duration) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -119,15 +330,20 @@ func CreateRequest(ctx context.Context, url string) (*http.Request, context.Canc
 func SetRequestHeaders(req *http.Request) {
 	req.Header.Set("X-Requested-With", "XMLHttpRequest") // So Cloudflare would likely accept the request, and no Age Verification
 
-	if server.Config.UserAgent != "" {
-		req.Header.Set("User-Agent", server.Config.UserAgent)
+	settings := server.Config.Runtime()
+	if settings.UserAgent != "" {
+		req.Header.Set("User-Agent", settings.UserAgent)
 	}
-	if server.Config.Cookies != "" {
-		cookies := ParseCookies(server.Config.Cookies)
+	if settings.Cookies != "" {
+		cookies := ParseCookies(settings.Cookies)
 		for name, value := range cookies {
 			req.AddCookie(&http.Cookie{Name: name, Value: value})
 		}
 	}
+	// Custom headers go last so they can override the ones above
+	for key, value := range server.Config.Headers {
+		req.Header.Set(key, value)
+	}
 }
 
 // ParseCookies converts a cookie string into a map.
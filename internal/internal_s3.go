@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+)
+
+const (
+	s3MinPartSize = 16 * 1024 * 1024 // the part size of a multipart upload unless a file needs larger parts
+	s3MaxParts    = 10000            // the S3 limit of parts in an upload
+	s3PartRetries = 3                // attempts of each part before the upload fails
+
+	// A request times out after s3RequestTimeout, plus a second for every s3MinThroughput bytes of its body,
+	// so a stalled connection fails the request instead of hanging the upload.
+	s3RequestTimeout = time.Minute
+	s3MinThroughput  = 64 * 1024
+)
+
+// emptySHA256 is the payload hash of a request without a body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 uploads files to an S3-compatible bucket, e.g. AWS S3 or MinIO, signing the requests with AWS Signature Version 4.
+type S3 struct {
+	Endpoint  *url.URL // e.g. https://minio.example.com:9000, path-style. Nil uses AWS S3 with virtual-hosted buckets
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PartSize  int64 // files larger than this are uploaded in parts, s3MinPartSize if 0
+
+	client  *http.Client
+	now     func() time.Time
+	timeout time.Duration // s3RequestTimeout, see requestContext
+}
+
+// NewS3 returns an S3 client, the endpoint is empty for AWS S3.
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) (*S3, error) {
+	s := &S3{
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		client:    &http.Client{Transport: CreateTransport()},
+		now:       time.Now,
+		timeout:   s3RequestTimeout,
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q, expected e.g. https://minio.example.com:9000", endpoint)
+		}
+		s.Endpoint = u
+	}
+	return s, nil
+}
+
+// Upload uploads the file at path as key, in parts if it's larger than the part size.
+// Each request carries the MD5 of its body for the server to verify, and the size of the object is checked afterwards.
+// Each request times out on its own (see requestContext), and canceling ctx stops the upload and aborts its parts.
+func (s *S3) Upload(ctx context.Context, key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = s3MinPartSize
+	}
+	if info.Size() <= partSize {
+		if _, err := s.putPart(ctx, key, nil, io.NewSectionReader(file, 0, info.Size())); err != nil {
+			return fmt.Errorf("put object: %w", err)
+		}
+	} else {
+		// Grow the parts so the largest recordings still fit in s3MaxParts
+		if needed := (info.Size() + s3MaxParts - 1) / s3MaxParts; partSize < needed {
+			partSize = needed
+		}
+		if err := s.multipartUpload(ctx, key, file, info.Size(), partSize); err != nil {
+			return err
+		}
+	}
+
+	size, err := s.head(ctx, key)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	if size != info.Size() {
+		return fmt.Errorf("verify: uploaded %d bytes, the file has %d", size, info.Size())
+	}
+	return nil
+}
+
+// multipartUpload uploads the file in parts of partSize, a failed part is retried and a failed upload is aborted
+// so the bucket doesn't keep its parts.
+func (s *S3) multipartUpload(ctx context.Context, key string, file *os.File, size, partSize int64) error {
+	body, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &created); err != nil || created.UploadID == "" {
+		return fmt.Errorf("create multipart upload: unexpected response %q", truncate(string(body), 200))
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {created.UploadID}}
+		etag, err := retry.DoWithData(
+			func() (string, error) {
+				return s.putPart(ctx, key, query, io.NewSectionReader(file, offset, min(partSize, size-offset)))
+			},
+			retry.Context(ctx),
+			retry.Attempts(s3PartRetries),
+			retry.Delay(2*time.Second),
+			retry.LastErrorOnly(true),
+		)
+		if err != nil {
+			s.abort(key, created.UploadID)
+			return fmt.Errorf("upload part %d: %w", number, err)
+		}
+		complete.Parts = append(complete.Parts, part{number, etag})
+	}
+
+	payload, err := xml.Marshal(complete)
+	if err != nil {
+		s.abort(key, created.UploadID)
+		return fmt.Errorf("marshal: %w", err)
+	}
+	// The completion can fail with a 200 response, the error is in the body then
+	body, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {created.UploadID}}, nil, payload)
+	if err == nil && bytes.Contains(body, []byte("<Error>")) {
+		err = fmt.Errorf("unexpected response %q", truncate(string(body), 200))
+	}
+	if err != nil {
+		s.abort(key, created.UploadID)
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+// abort aborts a multipart upload, it's best effort and runs even if ctx is canceled.
+func (s *S3) abort(key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, _ = s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+}
+
+// requestContext returns the context of a request with a body of size bytes, see s3RequestTimeout.
+func (s *S3) requestContext(ctx context.Context, size int64) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.timeout+time.Duration(size/s3MinThroughput)*time.Second)
+}
+
+// putPart uploads r as the object, or a part of it with the query of the part, and returns the ETag.
+func (s *S3) putPart(ctx context.Context, key string, query url.Values, r *io.SectionReader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", fmt.Errorf("read: %w", err)
+	}
+	header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(hash.Sum(nil))}}
+
+	ctx, cancel := s.requestContext(ctx, r.Size())
+	defer cancel()
+	req, err := s.newRequest(ctx, http.MethodPut, key, query, header, io.NewSectionReader(r, 0, r.Size()), r.Size(), "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.send(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// head returns the size of the object.
+func (s *S3) head(ctx context.Context, key string) (int64, error) {
+	ctx, cancel := s.requestContext(ctx, 0)
+	defer cancel()
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.send(req)
+	if err != nil {
+		return 0, err
+	}
+	return resp.ContentLength, nil
+}
+
+// do sends a request with a small payload, e.g. the XML of a multipart upload, and returns the response body.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, payload []byte) ([]byte, error) {
+	sum := sha256.Sum256(payload)
+	ctx, cancel := s.requestContext(ctx, int64(len(payload)))
+	defer cancel()
+	req, err := s.newRequest(ctx, method, key, query, header, bytes.NewReader(payload), int64(len(payload)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client do: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, s3Error(resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// send sends a request and discards the response body, a response other than 2xx is an error.
+func (s *S3) send(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client do: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, s3Error(resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+// s3Error returns the error of an S3 response, with the code and message of its XML body if there's one.
+func s3Error(status int, body []byte) error {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("unexpected status %d: %s: %s", status, e.Code, e.Message)
+	}
+	return fmt.Errorf("unexpected status %d", status)
+}
+
+// newRequest creates a signed request of the object key.
+func (s *S3) newRequest(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Request, error) {
+	u := s.objectURL(key)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, payloadHash)
+	return req, nil
+}
+
+// objectURL returns the URL of the object key, path-style with an endpoint, virtual-hosted on AWS S3.
+// The path is sent escaped the way it's signed.
+func (s *S3) objectURL(key string) *url.URL {
+	u := &url.URL{Scheme: "https", Host: s.Bucket + ".s3." + s.Region + ".amazonaws.com", Path: "/" + key}
+	if s.Endpoint != nil {
+		u = &url.URL{Scheme: s.Endpoint.Scheme, Host: s.Endpoint.Host, Path: strings.TrimSuffix(s.Endpoint.Path, "/") + "/" + s.Bucket + "/" + key}
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return u
+}
+
+// sign adds the AWS Signature Version 4 of the request, all of its headers are signed.
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	for _, v := range []string{s.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes a path for the canonical request, everything but the unreserved characters and slashes.
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery returns the query sorted by name, with the spaces escaped as %20.
+func s3CanonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// truncate shortens s to n bytes for a log message.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// RenderS3Prefix renders an `--s3-prefix` template with data, the fields of the filename pattern,
+// e.g. "{{.Username}}/{{.Year}}/".
+func RenderS3Prefix(text string, data any) (string, error) {
+	tpl, err := template.New("s3-prefix").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(b.String(), "/"), nil
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily window of the wall clock such as 20:00-21:00, it spans midnight if it ends before it starts.
+type Window struct {
+	start, end int            // minutes of the day
+	loc        *time.Location // nil for the time zone of the checked time, `--timezone`
+}
+
+// ParseWindow parses a daily window such as "20:00-21:00", optionally followed by the time zone it's in,
+// e.g. "20:00-21:00 Europe/Berlin", otherwise it's in the local time zone (`--timezone`). "23:00-01:00" spans midnight.
+func ParseWindow(s string) (*Window, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("window: want HH:MM-HH:MM and an optional time zone, got %q", s)
+	}
+	from, to, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return nil, fmt.Errorf("window: want HH:MM-HH:MM, got %q", fields[0])
+	}
+
+	w := &Window{}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return nil, fmt.Errorf("window: start: %w", err)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return nil, fmt.Errorf("window: end: %w", err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("window: %q is empty", fields[0])
+	}
+	if len(fields) == 2 {
+		if w.loc, err = time.LoadLocation(fields[1]); err != nil {
+			return nil, fmt.Errorf("window: time zone: %w", err)
+		}
+	}
+	return w, nil
+}
+
+// parseClock parses a time of the day such as "20:00" into minutes.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t is within the window, the start is included and the end isn't.
+func (w *Window) Contains(t time.Time) bool {
+	if w.loc != nil {
+		t = t.In(w.loc)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
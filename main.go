@@ -1,12 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata" // --timezone works without the zoneinfo of the system, e.g. on Windows
 
+	"github.com/teacat/chaturbate-dvr/channel"
+	"github.com/teacat/chaturbate-dvr/chaturbate"
 	"github.com/teacat/chaturbate-dvr/config"
 	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/index"
+	"github.com/teacat/chaturbate-dvr/internal"
 	"github.com/teacat/chaturbate-dvr/manager"
 	"github.com/teacat/chaturbate-dvr/router"
 	"github.com/teacat/chaturbate-dvr/server"
@@ -51,24 +64,64 @@ func main() {
 				Usage: "Password for web authentication (optional)",
 				Value: "",
 			},
-			&cli.IntFlag{
+			&cli.StringFlag{
+				Name:  "api-token",
+				Usage: "Bearer token for the API, sent as 'Authorization: Bearer <token>' instead of the admin credentials (optional)",
+				Value: "",
+			},
+			&cli.StringFlag{
 				Name:  "framerate",
-				Usage: "Desired framerate (FPS)",
-				Value: 30,
+				Usage: "Desired framerate (FPS), 'any' (or '0') to take the highest framerate of the chosen resolution",
+				Value: "30",
 			},
 			&cli.IntFlag{
 				Name:  "resolution",
 				Usage: "Desired resolution (e.g., 1080 for 1080p)",
 				Value: 1080,
 			},
+			&cli.IntFlag{
+				Name:  "min-resolution",
+				Usage: "Don't record streams below this resolution and check again later ('0' to disable)",
+				Value: 0,
+			},
+			&cli.StringFlag{
+				Name:  "allowed-resolutions",
+				Usage: "Comma-separated resolutions the stream may be recorded at (e.g. 480,720,1080), the others are never picked and a stream with none of them is checked again later",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "blocked-resolutions",
+				Usage: "Comma-separated resolutions the stream is never recorded at (e.g. 1440,2160)",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "resolution-confirm",
+				Usage: "Seconds the stream must stay at the same resolution, at least --min-resolution, before recording starts; a stream ramping up from a low variant is recorded once it settles ('0' to disable)",
+				Value: 0,
+			},
 			&cli.StringFlag{
 				Name:  "pattern",
 				Usage: "Template for naming recorded videos",
 				Value: "videos/{{.Username}}_{{.Year}}-{{.Month}}-{{.Day}}_{{.Hour}}-{{.Minute}}-{{.Second}}{{if .Sequence}}_{{.Sequence}}{{end}}",
 			},
+			&cli.IntFlag{
+				Name:  "sequence-padding",
+				Usage: "Zero-pad {{.Sequence}} in the pattern to N digits so split files sort correctly, e.g. 3 for _001 ('0' to disable)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "sequence-start",
+				Usage: "Number {{.Sequence}} starts from for the first file of a stream",
+				Value: 0,
+			},
+			&cli.StringFlag{
+				Name:  "timezone",
+				Usage: "Timezone of the pattern fields, the log lines and the recording timestamps, an IANA name such as 'Europe/Berlin', 'UTC' or 'Local'",
+				Value: "Local",
+			},
 			&cli.IntFlag{
 				Name:  "max-duration",
-				Usage: "Split video into segments every N minutes ('0' to disable)",
+				Usage: "Split video into segments every N minutes of recorded content ('0' to disable)",
 				Value: 0,
 			},
 			&cli.IntFlag{
@@ -76,6 +129,60 @@ func main() {
 				Usage: "Split video into segments every N MB ('0' to disable)",
 				Value: 0,
 			},
+			&cli.IntFlag{
+				Name:  "max-bitrate",
+				Usage: "Never pick a variant above N kbps, the lowest one is picked if all are; the default for new channels in the Web UI ('0' to disable)",
+				Value: 0,
+			},
+			&cli.StringFlag{
+				Name:  "room-password",
+				Usage: "Password of the password protected shows of the channel of --username (experimental, the room login is unverified)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "schedule",
+				Usage: "Cron expression of the minutes a channel is checked, e.g. '*/5 18-23 * * FRI,SAT' (in --timezone); the default for new channels in the Web UI",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "window",
+				Usage: "Daily window the stream is recorded in, e.g. '20:00-21:00' (in --timezone) or '20:00-21:00 Europe/Berlin'; a file starts and ends at its boundaries; the default for new channels in the Web UI",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "resolutions",
+				Usage: "Also record these resolutions of the same broadcast, each to its own file ending with e.g. _480p, such as '480' or '720,480'; the default for new channels in the Web UI",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "idle-split",
+				Usage: "Finalize the current file when no new segments arrive for N seconds, the stream continues in a new file ('0' to disable)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "chunk-duration",
+				Usage: "Start a new file on every wall-clock multiple of N minutes, e.g. 30 for :00 and :30, whichever split comes first ('0' to disable)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "min-duration",
+				Usage: "Broadcasts that end before N seconds are handled by --on-short, e.g. to drop a few seconds long captures ('0' to disable)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "trim-start",
+				Usage: "Drop the segments within the first N seconds of a broadcast, e.g. its buffering and low resolution start ('0' to disable)",
+				Value: 0,
+			},
+			&cli.BoolFlag{
+				Name:  "no-backfill",
+				Usage: "Start recording from the segments published after the stream is found, instead of the past ones its playlist still lists",
+			},
+			&cli.StringFlag{
+				Name:  "on-short",
+				Usage: "What to do with a broadcast shorter than --min-duration: discard, keep (uncompressed)",
+				Value: "discard",
+			},
 			&cli.StringFlag{
 				Name:    "port",
 				Aliases: []string{"p"},
@@ -87,38 +194,511 @@ func main() {
 				Usage: "Check if the channel is online every N minutes",
 				Value: 1,
 			},
+			&cli.IntFlag{
+				Name:  "max-checks-per-minute",
+				Usage: "Raise --interval so all channels together are checked at most N times a minute, guarding against API bans ('0' to disable)",
+				Value: 60,
+			},
+			&cli.IntFlag{
+				Name:  "interval-jitter",
+				Usage: "Randomize the check interval by up to ±N percent to spread out API requests ('0' to disable)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "dormant-after",
+				Usage: "Mark a channel dormant after N consecutive offline checks and check it every --dormant-interval instead ('0' to disable)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "dormant-interval",
+				Usage: "Check dormant and region-locked channels every N minutes",
+				Value: 60,
+			},
+			&cli.IntFlag{
+				Name:  "offline-grace",
+				Usage: "Keep the file open when a recording stream goes offline and check it N more times before finalizing it, a stream back by then continues in the same file ('0' to disable)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "offline-grace-interval",
+				Usage: "Seconds between the --offline-grace checks",
+				Value: 10,
+			},
+			&cli.BoolFlag{
+				Name:  "auto-follow",
+				Usage: "Add the followed channels that are online with the defaults of new channels, requires the --cookies of a logged-in session (Web UI mode only)",
+			},
+			&cli.IntFlag{
+				Name:  "auto-follow-interval",
+				Usage: "Minutes between the --auto-follow syncs",
+				Value: 5,
+			},
+			&cli.BoolFlag{
+				Name:  "auto-follow-remove",
+				Usage: "Remove the channels --auto-follow added once they're no longer followed or online, unless they're recording",
+			},
+			&cli.StringFlag{
+				Name:  "auto-follow-endpoint",
+				Usage: "Endpoint listing the followed channels that are online, a full URL or a path relative to --domain",
+				Value: chaturbate.DefaultFollowedEndpoint,
+			},
+			&cli.IntFlag{
+				Name:  "request-timeout",
+				Usage: "Timeout in seconds for API, playlist and edge check requests",
+				Value: 10,
+			},
+			&cli.IntFlag{
+				Name:  "segment-timeout",
+				Usage: "Timeout in seconds for segment downloads ('0' to use --request-timeout)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "variant-retries",
+				Usage: "Fetch the master playlist again N times when it lists no variants yet ('0' to disable)",
+				Value: 3,
+			},
+			&cli.IntFlag{
+				Name:  "variant-retry-delay",
+				Usage: "Seconds between the --variant-retries fetches",
+				Value: 2,
+			},
+			&cli.BoolFlag{
+				Name:  "split-on-resolution-change",
+				Usage: "Start a new file when the stream changes quality (a discontinuity, restart or variant switch), '--split-on-resolution-change=false' keeps one file as long as the init segment allows it",
+				Value: true,
+			},
+			&cli.StringFlag{
+				Name:  "on-variant-404",
+				Usage: "What to do when the playlist of the recorded variant keeps returning 404 while the stream is online: switch (to another variant at the same or nearest resolution, in a new file), stop",
+				Value: "switch",
+			},
+			&cli.StringFlag{
+				Name:  "on-endlist",
+				Usage: "What to do when the playlist ends with EXT-X-ENDLIST: stop (finalize the recording after its last segments, without --offline-grace), ignore (keep polling until the playlist is gone)",
+				Value: "stop",
+			},
+			&cli.BoolFlag{
+				Name:  "adaptive",
+				Usage: "Step down to the next lower variant when the segment downloads can't keep up with the recorded one",
+			},
+			&cli.BoolFlag{
+				Name:  "subtitles",
+				Usage: "Record the subtitles of the stream to a .vtt file next to the recording, if it has any",
+			},
+			&cli.IntFlag{
+				Name:  "startup-concurrency",
+				Usage: "Max channels checking their stream at the same time, on startup and on each re-check ('0' for unlimited)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "max-concurrent-recordings",
+				Usage: "Max channels recording at the same time, the others are queued by priority until one ends ('0' for unlimited)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "global-segment-concurrency",
+				Usage: "Max segment downloads in flight across all channels, the others wait for a free slot by channel priority ('0' for unlimited)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "segment-error-rate",
+				Usage: "Pause the segment fetches of a channel when this percent of the recent ones failed, the segments published during the pause are lost ('0' to disable)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "segment-error-window",
+				Usage: "Number of recent segment fetches the error rate is measured over",
+				Value: 20,
+			},
+			&cli.IntFlag{
+				Name:  "segment-error-cooldown",
+				Usage: "Seconds the segment fetches pause for before probing whether they work again",
+				Value: 30,
+			},
+			&cli.IntFlag{
+				Name:  "priority",
+				Usage: "Priority of the channel, or the default for new channels in the Web UI; higher goes first when checks, recordings, segment downloads or compressions wait for a slot",
+				Value: 0,
+			},
 			&cli.StringFlag{
 				Name:  "cookies",
 				Usage: "Cookies to use in the request (format: key=value; key2=value2)",
 				Value: "",
 			},
+			&cli.BoolFlag{
+				Name:  "record-private",
+				Usage: "Record a private show when the API still gives its stream, i.e. the --cookies are of a session in the show",
+			},
 			&cli.StringFlag{
 				Name:  "user-agent",
 				Usage: "Custom User-Agent for the request",
 				Value: "",
 			},
+			&cli.StringSliceFlag{
+				Name:  "header",
+				Usage: "Extra HTTP header for all requests in 'Key: Value' format, can be repeated",
+			},
 			&cli.StringFlag{
 				Name:  "domain",
 				Usage: "Chaturbate domain to use",
 				Value: "https://chaturbate.com/",
 			},
+			&cli.BoolFlag{
+				Name:  "insecure-skip-verify",
+				Usage: "Skip TLS certificate verification of outbound requests, e.g. behind a proxy with a self-signed certificate (insecure)",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:  "ip-family",
+				Usage: "Address family to connect with first: ipv4 or ipv6, falls back to the other one (default: system preference)",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "max-idle-conns",
+				Usage: "Max idle connections kept open for reuse across all hosts ('0' for unlimited)",
+				Value: 100,
+			},
+			&cli.IntFlag{
+				Name:  "max-idle-conns-per-host",
+				Usage: "Max idle connections kept open for reuse per host, e.g. an edge server shared by many channels",
+				Value: 16,
+			},
+			&cli.IntFlag{
+				Name:  "idle-conn-timeout",
+				Usage: "Seconds an idle connection is kept open for reuse ('0' to never close it)",
+				Value: 90,
+			},
+			&cli.StringSliceFlag{
+				Name:  "api-endpoint",
+				Usage: "API endpoint with a {username} placeholder, relative to --domain or a full URL, can be repeated to add alternates tried when the room is public without a stream; only the primary is set by default, so there's no fallback without an extra one",
+				Value: cli.NewStringSlice(chaturbate.DefaultAPIEndpoint),
+			},
+			&cli.StringFlag{
+				Name:  "edge-ok-status",
+				Usage: "Comma-separated status codes or classes (e.g. 200,206 or 2xx) a stream edge must respond with to be used, after following its redirects (so no 3xx)",
+				Value: "200",
+			},
 			&cli.BoolFlag{
 				Name:  "compress",
 				Usage: "Compress recorded files (.ts or .mp4) to .mkv using ffmpeg after recording (auto-enabled if ffmpeg is installed)",
 				Value: false,
 			},
+			&cli.IntFlag{
+				Name:  "compress-min-duration",
+				Usage: "Only compress recordings at least N seconds long, the shorter ones are kept as recorded ('0' to compress all)",
+				Value: 0,
+			},
+			&cli.IntFlag{
+				Name:  "compress-min-size",
+				Usage: "Only compress recordings of at least N MB, the smaller ones are kept as recorded ('0' to compress all)",
+				Value: 0,
+			},
+			&cli.StringFlag{
+				Name:  "audio-codec",
+				Usage: "Audio codec used when compressing: aac, aac_he (HE-AAC, requires ffmpeg with libfdk_aac), opus",
+				Value: "aac",
+			},
+			&cli.StringFlag{
+				Name:  "audio-bitrate",
+				Usage: "Audio bitrate used when compressing (e.g., 128k)",
+				Value: "128k",
+			},
+			&cli.StringFlag{
+				Name:  "encoder",
+				Usage: "Force the video encoder for compression: nvenc, amf, qsv, videotoolbox or cpu (default: auto-detect)",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "encoder-detect-timeout",
+				Usage: "Seconds an encoder probe may take before it's skipped for the next encoder ('0' to disable)",
+				Value: 10,
+			},
+			&cli.StringFlag{
+				Name:  "gpu-device",
+				Usage: "NVENC GPU index for compression, or a comma-separated list (e.g. 0,1) to spread compressions across them",
+				Value: "",
+			},
+			&cli.BoolFlag{
+				Name:  "hw-decode",
+				Usage: "Decode on the same hardware as the GPU encoder too (cuda, qsv, d3d11va, videotoolbox), falls back to software decoding if it fails",
+				Value: false,
+			},
+			&cli.BoolFlag{
+				Name:  "two-pass",
+				Usage: "Compress in two passes to --target-bitrate with libx264, or libx265 with --ffmpeg-extra-args \"-c:v libx265\", slower but hits the target file size",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:  "target-bitrate",
+				Usage: "Video bitrate for --two-pass (e.g. 2500k)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "temp-dir",
+				Usage: "Directory the compression writes to before moving the finished .mkv into place (default: next to the recording)",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "compress-concurrency",
+				Usage: "Max compressions running at the same time, the others wait by channel priority ('0' for unlimited)",
+				Value: 0,
+			},
+			&cli.StringFlag{
+				Name:  "ffmpeg-extra-args",
+				Usage: "Extra ffmpeg arguments for compression, inserted right before the output file so they override the defaults (e.g. \"-threads 4 -vf scale=-2:720\")",
+			},
+			&cli.IntFlag{
+				Name:  "ffmpeg-log-size",
+				Usage: "Characters of ffmpeg output to log when it fails without a recognized error",
+				Value: 500,
+			},
+			&cli.StringFlag{
+				Name:  "timestamps",
+				Usage: "Timestamps of .ts recordings: keep (as the CDN sent them), regenerate (split at timestamp jumps, each file monotonic from zero with ffmpeg when compressing, uncompressed recordings are remuxed)",
+				Value: "keep",
+			},
+			&cli.StringFlag{
+				Name:  "on-ffmpeg-warnings",
+				Usage: "What to do when a compression succeeds but ffmpeg warned about decode errors, corrupt packets or broken timestamps: log (a summary), flag (log it and mark the recording degraded in the recordings list), ignore",
+				Value: "log",
+			},
+			&cli.BoolFlag{
+				Name:  "validate-state",
+				Usage: "Check the channels file and the recordings index, report their problems and exit",
+			},
+			&cli.BoolFlag{
+				Name:  "repair",
+				Usage: "With --validate-state, drop the invalid channels and remove a corrupt recordings index to be rebuilt, backing up the original files",
+			},
+			&cli.BoolFlag{
+				Name:  "print-config",
+				Usage: "Print the resolved settings as JSON, with the defaults and auto-enabled options applied, and exit",
+			},
+			&cli.BoolFlag{
+				Name:  "show-secrets",
+				Usage: "With --print-config, print the passwords, tokens, keys, cookies and headers instead of redacting them",
+			},
+			&cli.BoolFlag{
+				Name:  "list-encoders",
+				Usage: "Print the video encoders available for compression on this machine and exit",
+				Value: false,
+			},
+			&cli.BoolFlag{
+				Name:  "buffer-whole-file",
+				Usage: "Keep each file in memory and write it at once when it's split or finished, fewer and larger writes for a NAS (a crash loses the buffered file)",
+				Value: false,
+			},
+			&cli.IntFlag{
+				Name:  "buffer-max-size",
+				Usage: "MB of a file --buffer-whole-file keeps in memory, a larger file is written segment by segment",
+				Value: 512,
+			},
+			&cli.BoolFlag{
+				Name:  "live-mux",
+				Usage: "Mux segments into .mkv with ffmpeg while recording, --compress is not applied (requires ffmpeg, separate audio needs Linux/macOS)",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:  "thumbnail-format",
+				Usage: "Save a thumbnail next to each recording: jpg, webp, png (empty to disable)",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "thumbnail-quality",
+				Usage: "Thumbnail quality from 1 to 100, ignored for png",
+				Value: 80,
+			},
+			&cli.BoolFlag{
+				Name:  "poster",
+				Usage: "Grab a poster frame of each file while it's recorded, saved as {name}.poster.jpg and shown in the Web UI (requires ffmpeg)",
+			},
+			&cli.StringFlag{
+				Name:  "checksum",
+				Usage: "Write a checksum of each completed recording next to it: sha256 (empty = disabled)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "on-existing",
+				Usage: "What to do when the output file already exists: append, overwrite, rename (adds a numeric suffix up to _1000), skip (stops monitoring the channel)",
+				Value: "append",
+			},
+			&cli.StringFlag{
+				Name:  "output-pipe",
+				Usage: "Write the recording to stdout ('-') or an existing named pipe instead of files, requires --username",
+				Value: "",
+			},
 			&cli.StringFlag{
 				Name:    "output-dir",
 				Usage:   "Directory to move completed recordings to (empty = keep in place)",
 				EnvVars: []string{"OUTPUT_DIR"},
 				Value:   "",
 			},
+			&cli.StringFlag{
+				Name:  "output-dir-roots",
+				Usage: "Comma-separated directories a per-channel output directory must be inside of (empty = --output-dir, or the working directory without it)",
+				Value: "",
+			},
 			&cli.BoolFlag{
 				Name:    "per-model-folder",
 				Usage:   "Create a subdirectory per model inside --output-dir",
 				EnvVars: []string{"PER_MODEL_FOLDER"},
 				Value:   false,
 			},
+			&cli.StringFlag{
+				Name:  "file-mode",
+				Usage: "Permission bits for recorded files in octal, e.g. 0644 (empty = 0777 minus umask)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "dir-mode",
+				Usage: "Permission bits for created directories in octal, e.g. 0755 (empty = 0777 minus umask)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "chown",
+				Usage: "Change ownership of recorded files and directories to uid:gid (Unix only, optional)",
+				Value: "",
+			},
+			&cli.BoolFlag{
+				Name:  "service",
+				Usage: "Run headless under a service manager (systemd, NSSM): no logo or interactive output, logs without timestamps",
+				Value: false,
+			},
+			&cli.BoolFlag{
+				Name:  "recover",
+				Usage: "On startup, finalize the recordings a crash left behind in the --pattern directories (mux, compress and move them like a finished recording)",
+				Value: false,
+			},
+			&cli.IntFlag{
+				Name:  "recover-concurrency",
+				Usage: "Max recordings --recover finalizes at the same time, their compressions also wait for --compress-concurrency ('0' for unlimited)",
+				Value: 1,
+			},
+			&cli.StringFlag{
+				Name:  "webhook-url",
+				Usage: "POST a JSON notification with the message and the recording fields to this URL when a recording starts or finishes",
+			},
+			&cli.StringFlag{
+				Name:  "webhook-template",
+				Usage: "Go template of the --webhook-url message (default: a built-in message, see the README)",
+			},
+			&cli.StringFlag{
+				Name:  "discord-webhook",
+				Usage: "Discord webhook URL to notify when a recording starts or finishes",
+			},
+			&cli.StringFlag{
+				Name:  "discord-template",
+				Usage: "Go template of the Discord message (default: a built-in message, see the README)",
+			},
+			&cli.StringFlag{
+				Name:  "telegram-token",
+				Usage: "Telegram bot token to notify --telegram-chat-id when a recording starts or finishes",
+			},
+			&cli.StringFlag{
+				Name:  "telegram-chat-id",
+				Usage: "Telegram chat the bot sends the notifications to",
+			},
+			&cli.StringFlag{
+				Name:  "telegram-template",
+				Usage: "Go template of the Telegram message (default: a built-in message, see the README)",
+			},
+			&cli.StringFlag{
+				Name:  "sftp",
+				Usage: "Upload completed recordings to user@host:/path with the OpenSSH sftp client, key authentication only (empty = disabled)",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "sftp-port",
+				Usage: "SSH port of the --sftp server",
+				Value: 22,
+			},
+			&cli.StringFlag{
+				Name:  "sftp-key",
+				Usage: "Private key file for --sftp (empty = the default ssh keys and agent)",
+				Value: "",
+			},
+			&cli.BoolFlag{
+				Name:  "sftp-delete",
+				Usage: "Delete the local recording once it was uploaded to every destination",
+				Value: false,
+			},
+			&cli.IntFlag{
+				Name:  "sftp-retries",
+				Usage: "Times a failed --sftp upload is retried, with a growing delay starting at 30 seconds",
+				Value: 3,
+			},
+			&cli.StringFlag{
+				Name:  "s3-bucket",
+				Usage: "Upload completed recordings to this S3 bucket (empty = disabled)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "s3-endpoint",
+				Usage: "Endpoint of an S3-compatible server such as MinIO, e.g. https://minio.example.com:9000 (empty = AWS S3)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "s3-region",
+				Usage: "Region of the --s3-bucket",
+				Value: "us-east-1",
+			},
+			&cli.StringFlag{
+				Name:    "s3-access-key",
+				Usage:   "Access key ID for --s3-bucket",
+				EnvVars: []string{"AWS_ACCESS_KEY_ID"},
+				Value:   "",
+			},
+			&cli.StringFlag{
+				Name:    "s3-secret-key",
+				Usage:   "Secret access key for --s3-bucket",
+				EnvVars: []string{"AWS_SECRET_ACCESS_KEY"},
+				Value:   "",
+			},
+			&cli.StringFlag{
+				Name:  "s3-prefix",
+				Usage: "Key prefix of the uploads, with the fields of --pattern",
+				Value: "{{.Username}}/",
+			},
+			&cli.BoolFlag{
+				Name:  "s3-delete",
+				Usage: "Delete the local recording once it was uploaded to every destination and verified",
+				Value: false,
+			},
+			&cli.IntFlag{
+				Name:  "s3-retries",
+				Usage: "Times a failed --s3-bucket upload is retried, with a growing delay starting at 30 seconds",
+				Value: 3,
+			},
+			&cli.BoolFlag{
+				Name:  "self-test",
+				Usage: "Record a few segments of a generated test stream, compress them, check that the output plays and exit (requires ffmpeg)",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:  "self-test-url",
+				Usage: "HLS URL --self-test records instead of the generated test stream",
+				Value: "",
+			},
+			&cli.BoolFlag{
+				Name:  "version-check",
+				Usage: "On startup, check that the API response of --version-check-channel still has the fields the recording depends on and warn if the site changed",
+				Value: false,
+			},
+			&cli.StringFlag{
+				Name:  "version-check-channel",
+				Usage: "Channel the --version-check probes, it doesn't need to be online (default: --username)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "version-check-endpoint",
+				Usage: "API endpoint the --version-check probes, in the --api-endpoint format (default: the primary --api-endpoint)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "pid-file",
+				Usage: "Write the process ID to this file, removed on exit (optional)",
+				Value: "",
+			},
 		},
 		Action: start,
 	}
@@ -128,43 +708,195 @@ func main() {
 }
 
 func start(c *cli.Context) error {
-	fmt.Println(logo)
+	if c.Bool("validate-state") {
+		return manager.ValidateState(os.Stdout, c.Bool("repair"))
+	}
+	if c.Bool("list-encoders") {
+		if !config.HasFFmpeg() {
+			return fmt.Errorf("list encoders: ffmpeg not found in PATH")
+		}
+		channel.PrintEncoders(os.Stdout)
+		return nil
+	}
+
+	// Keep stdout clean for the recording, and the service logs free of interactive output
+	service := c.Bool("service")
+	if c.String("output-pipe") != "-" && !service && !c.Bool("print-config") {
+		fmt.Println(logo)
+	}
+	if service {
+		// Service managers timestamp the logs already
+		log.SetFlags(0)
+	}
 
 	var err error
 	server.Config, err = config.New(c)
 	if err != nil {
 		return fmt.Errorf("new config: %w", err)
 	}
-	server.Manager, err = manager.New()
+	if c.Bool("print-config") {
+		conf := server.Config
+		if !c.Bool("show-secrets") {
+			conf = conf.Redacted()
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(conf)
+	}
+	if !service {
+		log.SetFlags(0)
+		log.SetOutput(internal.NewTimestampWriter(os.Stderr, server.Config.Location))
+	}
+
+	// Files written before now are from a previous run, see `--recover`
+	startedAt := time.Now()
+	if server.Config.InsecureSkipVerify {
+		log.Printf("WARNING: TLS certificate verification is disabled by --insecure-skip-verify, outbound requests can be intercepted")
+	}
+	if server.Config.Compress && server.Config.AudioCodec == "aac_he" && !channel.HEAACAvailable() {
+		log.Printf("WARNING: --audio-codec aac_he requires ffmpeg built with libfdk_aac, compressing with aac instead")
+	}
+	if server.Config.Encoder != "" {
+		if err := channel.ValidateEncoder(server.Config.Encoder); err != nil {
+			return fmt.Errorf("encoder: %w", err)
+		}
+	}
+	if len(server.Config.GPUDevices) > 0 {
+		if err := channel.ValidateGPUDevices(server.Config.GPUDevices); err != nil {
+			return fmt.Errorf("gpu-device: %w", err)
+		}
+	}
+	mgr, err := manager.New()
 	if err != nil {
 		return fmt.Errorf("new manager: %w", err)
 	}
+	server.Manager = mgr
+
+	if c.Bool("self-test") {
+		if err := channel.SelfTest(c.Context, c.String("self-test-url")); err != nil {
+			return fmt.Errorf("self-test: %w", err)
+		}
+		return nil
+	}
+
+	if server.Config.VersionCheck {
+		go checkAPI(c.Context, server.Config.VersionCheckChannel, server.Config.VersionCheckEndpoint)
+	}
+
+	if path := c.String("pid-file"); path != "" {
+		if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			return fmt.Errorf("pid file: %w", err)
+		}
+		defer os.Remove(path)
+	}
+
+	// SIGINT/SIGTERM stop the channels so the current recordings are finalized, a second signal kills right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errCh := make(chan error, 1)
 
 	// init web interface if username is not provided
 	if server.Config.Username == "" {
-		fmt.Printf("👋 Visit http://localhost:%s to use the Web UI\n\n\n", c.String("port"))
+		if !service {
+			fmt.Printf("👋 Visit http://localhost:%s to use the Web UI\n\n\n", c.String("port"))
+		}
 
+		var indexExists bool
+		if server.Recordings, indexExists, err = index.Open(manager.RecordingsPath); err != nil {
+			return fmt.Errorf("open recordings index: %w", err)
+		}
 		if err := server.Manager.LoadConfig(); err != nil {
 			return fmt.Errorf("load config: %w", err)
 		}
+		// The index is rebuilt from the files if it's lost, with the channels loaded to infer their recordings
+		if !indexExists {
+			if err := router.RebuildIndex(); err != nil && !errors.Is(err, internal.ErrNoRecordingsDir) {
+				return fmt.Errorf("rebuild recordings index: %w", err)
+			}
+		}
+		var totalsExist bool
+		if server.Totals, totalsExist, err = index.OpenTotals(manager.TotalsPath); err != nil {
+			return fmt.Errorf("open recording totals: %w", err)
+		}
+		// The totals start from the indexed recordings, the ones removed before can't be counted
+		if !totalsExist {
+			entries, err := server.Recordings.Entries()
+			if err == nil {
+				err = server.Totals.Seed(entries)
+			}
+			if err != nil {
+				return fmt.Errorf("seed recording totals: %w", err)
+			}
+		}
+		if c.Bool("recover") {
+			go mgr.Recover(startedAt)
+		}
+		if server.Config.AutoFollow {
+			go mgr.AutoFollow(ctx)
+		}
 
-		return router.SetupRouter().Run(":" + c.String("port"))
+		go func() {
+			errCh <- router.SetupRouter().Run(":" + c.String("port"))
+		}()
+		return waitForShutdown(ctx, stop, mgr, errCh)
 	}
 
 	// else create a channel with the provided username
 	if err := server.Manager.CreateChannel(&entity.ChannelConfig{
-		IsPaused:    false,
-		Username:    c.String("username"),
-		Framerate:   c.Int("framerate"),
-		Resolution:  c.Int("resolution"),
-		Pattern:     c.String("pattern"),
-		MaxDuration: c.Int("max-duration"),
-		MaxFilesize: c.Int("max-filesize"),
-		Compress:    c.Bool("compress"),
+		IsPaused:     false,
+		Username:     c.String("username"),
+		Framerate:    server.Config.Framerate,
+		Resolution:   c.Int("resolution"),
+		Pattern:      c.String("pattern"),
+		MaxDuration:  c.Int("max-duration"),
+		MaxFilesize:  c.Int("max-filesize"),
+		MaxBitrate:   server.Config.MaxBitrate,
+		Resolutions:  server.Config.Resolutions,
+		Schedule:     server.Config.Schedule,
+		Window:       server.Config.Window,
+		RoomPassword: c.String("room-password"),
+		Compress:     c.Bool("compress"),
+		Priority:     server.Config.Priority,
 	}, false); err != nil {
 		return fmt.Errorf("create channel: %w", err)
 	}
+	if c.Bool("recover") {
+		go mgr.Recover(startedAt)
+	}
 
-	// block forever
-	select {}
+	return waitForShutdown(ctx, stop, mgr, errCh)
+}
+
+// shutdownTimeout is how long the channels get to finish their recordings, compressions and uploads on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// waitForShutdown blocks until a signal cancels ctx or the web server fails, then shuts the channels down.
+func waitForShutdown(ctx context.Context, stop context.CancelFunc, mgr *manager.Manager, errCh <-chan error) error {
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Printf("shutting down, finishing recordings (up to %s)", shutdownTimeout)
+	case err = <-errCh:
+	}
+	stop()
+
+	mgr.Shutdown(shutdownTimeout)
+	return err
+}
+
+// checkAPI warns loudly when the API response of the channel lacks the fields the recording depends on (`--version-check`).
+func checkAPI(ctx context.Context, username, endpoint string) {
+	missing, err := chaturbate.CheckAPI(ctx, username, endpoint)
+	if err != nil {
+		log.Printf("WARNING: version check: %s", err.Error())
+		return
+	}
+	if len(missing) > 0 {
+		log.Printf("WARNING: ****************************************************************")
+		log.Printf("WARNING: version check: the API response of %s has no %s,", username, strings.Join(missing, ", "))
+		log.Printf("WARNING: the site likely changed and recordings may fail, check for an update")
+		log.Printf("WARNING: ****************************************************************")
+		return
+	}
+	log.Printf("version check: the API response of %s has the expected fields", username)
 }
@@ -5,16 +5,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/r3labs/sse/v2"
 	"github.com/teacat/chaturbate-dvr/channel"
 	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
 	"github.com/teacat/chaturbate-dvr/router/view"
+	"github.com/teacat/chaturbate-dvr/server"
 )
 
 // Manager is responsible for managing channels and their states.
@@ -42,7 +47,7 @@ func (m *Manager) SaveConfig() error {
 	var config []*entity.ChannelConfig
 
 	m.Channels.Range(func(key, value any) bool {
-		config = append(config, value.(*channel.Channel).Config)
+		config = append(config, value.(*channel.Channel).ConfigCopy())
 		return true
 	})
 
@@ -50,10 +55,10 @@ func (m *Manager) SaveConfig() error {
 	if err != nil {
 		return fmt.Errorf("marshal: %w", err)
 	}
-	if err := os.MkdirAll("./conf", 0777); err != nil {
+	if err := os.MkdirAll(internal.ConfDir, 0777); err != nil {
 		return fmt.Errorf("mkdir all conf: %w", err)
 	}
-	if err := os.WriteFile("./conf/channels.json", b, 0777); err != nil {
+	if err := writeChannelsFile(ChannelsPath, b); err != nil {
 		return fmt.Errorf("write file: %w", err)
 	}
 	return nil
@@ -61,7 +66,7 @@ func (m *Manager) SaveConfig() error {
 
 // LoadConfig loads the channels from JSON and starts them.
 func (m *Manager) LoadConfig() error {
-	b, err := os.ReadFile("./conf/channels.json")
+	b, err := os.ReadFile(ChannelsPath)
 	if os.IsNotExist(err) {
 		return nil
 	}
@@ -69,9 +74,21 @@ func (m *Manager) LoadConfig() error {
 		return fmt.Errorf("read file: %w", err)
 	}
 
-	var config []*entity.ChannelConfig
-	if err := json.Unmarshal(b, &config); err != nil {
-		return fmt.Errorf("unmarshal: %w", err)
+	// An invalid channel is skipped rather than failing the others, `--validate-state --repair` drops it
+	config, problems, err := decodeChannels(b)
+	if err != nil {
+		return fmt.Errorf("%w, see --validate-state", err)
+	}
+	for _, problem := range problems {
+		log.Printf("WARNING: %s: skipped %s, see --validate-state", ChannelsPath, problem)
+	}
+	// The next save drops the skipped channels, they're kept in a backup to fix and restore
+	if len(problems) > 0 {
+		backup, err := backupFile(ChannelsPath, b)
+		if err != nil {
+			return fmt.Errorf("%s has invalid channels the next save would drop: %w", ChannelsPath, err)
+		}
+		log.Printf("WARNING: %s: the original is backed up to %s, the skipped channels are dropped when the channels are saved", ChannelsPath, backup)
 	}
 
 	pausedSeq := 0
@@ -82,31 +99,83 @@ func (m *Manager) LoadConfig() error {
 
 		if ch.Config.IsPaused {
 			ch.Info("channel was paused, waiting for resume")
-			ctx, cancel := context.WithCancel(context.Background())
-			ch.PauseCancelFunc = cancel
-			go ch.CheckOnlineWhilePaused(ctx, pausedSeq)
+			watchPaused(ch, pausedSeq)
 			pausedSeq++
 			continue
 		}
 		go ch.Resume(seq)
 		seq++
 	}
+	m.updateIntervalFloor()
 	return nil
 }
 
+// watchPaused checks the status of the paused channel for the Web UI until it's resumed, see CheckOnlineWhilePaused.
+func watchPaused(ch *channel.Channel, startSeq int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch.PauseCancelFunc = cancel
+	go ch.CheckOnlineWhilePaused(ctx, startSeq)
+}
+
+// SetRuntime applies the settings changed while running, see entity.RuntimeConfig. The channels left at the previous
+// defaults of the splitting and compression take the new ones, and are saved if any did.
+func (m *Manager) SetRuntime(settings *entity.RuntimeConfig) error {
+	prev := server.Config.Runtime()
+	server.Config.SetRuntime(settings)
+
+	changed := false
+	m.Channels.Range(func(_, value any) bool {
+		if value.(*channel.Channel).ApplyRuntime(prev, settings) {
+			changed = true
+		}
+		return true
+	})
+	if !changed {
+		return nil
+	}
+	return m.SaveConfig()
+}
+
+// updateIntervalFloor raises the interval of the checks for the number of channels, see `--max-checks-per-minute`,
+// and warns when it changes the configured one.
+func (m *Manager) updateIntervalFloor() {
+	channels := 0
+	m.Channels.Range(func(_, _ any) bool {
+		channels++
+		return true
+	})
+	floor := internal.IntervalFloor(channels, server.Config.MaxChecksPerMinute)
+	if !server.Config.SetIntervalFloor(floor) {
+		return
+	}
+	if interval := server.Config.Runtime().Interval; floor > interval {
+		log.Printf("WARNING: checking %d channel(s) every %d min(s) is above --max-checks-per-minute %d, which risks an API ban; checking every %d min(s) instead, raise --max-checks-per-minute or set it to 0 to accept the risk", channels, interval, server.Config.MaxChecksPerMinute, floor)
+	}
+}
+
 // CreateChannel starts monitoring an M3U8 stream
 func (m *Manager) CreateChannel(conf *entity.ChannelConfig, shouldSave bool) error {
 	conf.Sanitize()
+	if err := validateChannel(conf); err != nil {
+		return fmt.Errorf("%w: %s", internal.ErrInvalidSettings, err.Error())
+	}
 	ch := channel.New(conf)
 
 	// prevent duplicate channels
 	_, ok := m.Channels.Load(conf.Username)
 	if ok {
-		return fmt.Errorf("channel %s already exists", conf.Username)
+		return fmt.Errorf("%w: %s", internal.ErrChannelExists, conf.Username)
 	}
 	m.Channels.Store(conf.Username, ch)
+	m.updateIntervalFloor()
 
-	go ch.Resume(0)
+	// A channel added paused is never resumed in between, not even for a moment
+	if conf.IsPaused {
+		ch.Info("channel added paused, waiting for resume")
+		watchPaused(ch, 0)
+	} else {
+		go ch.Resume(0)
+	}
 
 	if shouldSave {
 		if err := m.SaveConfig(); err != nil {
@@ -120,10 +189,11 @@ func (m *Manager) CreateChannel(conf *entity.ChannelConfig, shouldSave bool) err
 func (m *Manager) StopChannel(username string) error {
 	thing, ok := m.Channels.Load(username)
 	if !ok {
-		return nil
+		return internal.ErrChannelNotFound
 	}
 	thing.(*channel.Channel).Stop()
 	m.Channels.Delete(username)
+	m.updateIntervalFloor()
 
 	if err := m.SaveConfig(); err != nil {
 		return fmt.Errorf("save config: %w", err)
@@ -135,7 +205,7 @@ func (m *Manager) StopChannel(username string) error {
 func (m *Manager) PauseChannel(username string) error {
 	thing, ok := m.Channels.Load(username)
 	if !ok {
-		return nil
+		return internal.ErrChannelNotFound
 	}
 	thing.(*channel.Channel).Pause()
 
@@ -149,7 +219,7 @@ func (m *Manager) PauseChannel(username string) error {
 func (m *Manager) ResumeChannel(username string) error {
 	thing, ok := m.Channels.Load(username)
 	if !ok {
-		return nil
+		return internal.ErrChannelNotFound
 	}
 	thing.(*channel.Channel).Resume(0)
 
@@ -159,6 +229,157 @@ func (m *Manager) ResumeChannel(username string) error {
 	return nil
 }
 
+// WakeChannel wakes up a dormant channel.
+func (m *Manager) WakeChannel(username string) error {
+	thing, ok := m.Channels.Load(username)
+	if !ok {
+		return internal.ErrChannelNotFound
+	}
+	thing.(*channel.Channel).Wake()
+	return nil
+}
+
+// RecheckChannel checks the channel right away instead of waiting for the interval.
+func (m *Manager) RecheckChannel(username string) error {
+	thing, ok := m.Channels.Load(username)
+	if !ok {
+		return internal.ErrChannelNotFound
+	}
+	return thing.(*channel.Channel).Recheck()
+}
+
+// Shutdown stops every channel and waits up to timeout for them to finish their recordings, compressions and uploads,
+// the uploads still running then are canceled.
+// The channels stay in the config, so they're resumed on the next start.
+func (m *Manager) Shutdown(timeout time.Duration) {
+	var wg sync.WaitGroup
+	m.Channels.Range(func(key, value any) bool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value.(*channel.Channel).Shutdown()
+		}()
+		return true
+	})
+
+	// The recordings finalized by the channels may start compressions and uploads, they're waited for too
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		channel.WaitCompressions()
+		channel.WaitUploads()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("shutdown: channels, compressions and uploads did not finish within %s, canceling the uploads and the queued compressions", timeout)
+		channel.CancelCompressions()
+		channel.CancelUploads()
+	}
+}
+
+// Recover finalizes the recordings a previous run left behind in the pattern directories (`--recover`),
+// the files written since `before` belong to this run and are left alone. Each file is finalized
+// with the settings of its channel, or the global ones if the channel isn't in the list,
+// `--recover-concurrency` of them at a time with the progress logged. The files of a channel that's
+// recording by then are skipped, their markers are kept for the next `--recover`.
+func (m *Manager) Recover(before time.Time) {
+	var channels []*channel.Channel
+	m.Channels.Range(func(key, value any) bool {
+		channels = append(channels, value.(*channel.Channel))
+		return true
+	})
+
+	// A pattern without a directory of its own would scan the working directory, it's left out
+	var dirs []string
+	if dir := internal.PatternDir(server.Config.Pattern); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	skip := []string{server.Config.OutputDir, server.Config.TempDir, internal.ConfDir}
+	for _, ch := range channels {
+		if dir := internal.PatternDir(ch.Config.Pattern); dir != "" {
+			dirs = append(dirs, dir)
+		}
+		skip = append(skip, ch.Config.OutputDir)
+	}
+
+	var (
+		orphans []string
+		seen    = map[string]bool{}
+	)
+	for _, dir := range dirs {
+		found, err := channel.FindOrphans(dir, skip, before)
+		if err != nil {
+			log.Printf("recover: scan %s: %s", dir, err.Error())
+			continue
+		}
+		for _, path := range found {
+			if !seen[path] { // in nested pattern directories
+				seen[path] = true
+				orphans = append(orphans, path)
+			}
+		}
+	}
+	if len(orphans) == 0 {
+		return
+	}
+	log.Printf("recover: finalizing %d recording(s) left behind", len(orphans))
+
+	// With `--recover-concurrency` a few at a time, so a crash with many orphans doesn't compress them all at once
+	limit := len(orphans)
+	if n := server.Config.RecoverConcurrency; n > 0 && n < limit {
+		limit = n
+	}
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		finalized int
+		slots     = make(chan struct{}, limit)
+	)
+	for _, path := range orphans {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ch := recoveryChannel(path, channels)
+			if ch.Recording() {
+				log.Printf("recover: %s: skipped, %s is recording, it's left for the next run", path, ch.Config.Username)
+			} else if err := ch.Recover(path); err != nil {
+				log.Printf("recover: %s: %s", path, err.Error())
+			}
+			mu.Lock()
+			finalized++
+			log.Printf("recover: %d/%d done, %s", finalized, len(orphans), filepath.Base(path))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	log.Printf("recover: finished %d recording(s)", len(orphans))
+}
+
+// recoveryChannel returns the channel of the recording, by the per-model folder or the longest username
+// the filename starts with. An unknown channel is named after the start of the filename and uses the global settings.
+func recoveryChannel(path string, channels []*channel.Channel) *channel.Channel {
+	name := filepath.Base(path)
+	var found *channel.Channel
+	for _, ch := range channels {
+		username := ch.Config.Username
+		if filepath.Base(filepath.Dir(path)) == username {
+			return ch
+		}
+		if strings.HasPrefix(name, username+"_") && (found == nil || len(username) > len(found.Config.Username)) {
+			found = ch
+		}
+	}
+	if found != nil {
+		return found
+	}
+	username, _, _ := strings.Cut(name, "_")
+	return channel.New(&entity.ChannelConfig{Username: username, Compress: server.Config.Runtime().Compress})
+}
+
 // ChannelInfo returns a list of channel information for the web UI.
 func (m *Manager) ChannelInfo() []*entity.ChannelInfo {
 	var channels []*entity.ChannelInfo
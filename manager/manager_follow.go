@@ -0,0 +1,104 @@
+package manager
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/channel"
+	"github.com/teacat/chaturbate-dvr/chaturbate"
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// AutoFollow adds the followed channels that are online every `--auto-follow-interval` minutes until ctx is done
+// (`--auto-follow`). With `--auto-follow-remove` the channels it added are removed again once they're off the list,
+// unless they're recording. The channels added by hand are never removed.
+func (m *Manager) AutoFollow(ctx context.Context) {
+	client := chaturbate.NewClient()
+	ticker := time.NewTicker(time.Duration(server.Config.AutoFollowInterval) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		usernames, err := client.GetFollowed(ctx, server.Config.AutoFollowEndpoint)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR auto-follow: %s", err.Error())
+		} else {
+			m.syncFollowed(usernames, server.Config.AutoFollowRemove)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncFollowed adds the followed channels that aren't tracked yet with the defaults of new channels,
+// and removes the channels added by AutoFollow that aren't followed anymore if remove is set.
+func (m *Manager) syncFollowed(usernames []string, remove bool) {
+	followed := map[string]bool{}
+	var added, removed []string
+	defaults := server.Config.Runtime()
+	for _, username := range usernames {
+		conf := &entity.ChannelConfig{
+			Username:    username,
+			Framerate:   server.Config.Framerate,
+			Resolution:  server.Config.Resolution,
+			Pattern:     server.Config.Pattern,
+			MaxDuration: defaults.MaxDuration,
+			MaxFilesize: defaults.MaxFilesize,
+			MaxBitrate:  server.Config.MaxBitrate,
+			Resolutions: server.Config.Resolutions,
+			Schedule:    server.Config.Schedule,
+			Window:      server.Config.Window,
+			Compress:    defaults.Compress,
+			Priority:    server.Config.Priority,
+			CreatedAt:   time.Now().Unix(),
+			AutoFollow:  true,
+		}
+		conf.Sanitize()
+		followed[conf.Username] = true
+		if _, ok := m.Channels.Load(conf.Username); ok || conf.Username == "" {
+			continue
+		}
+		if err := m.CreateChannel(conf, false); err != nil {
+			log.Printf("ERROR auto-follow: add %s: %s", conf.Username, err.Error())
+			continue
+		}
+		added = append(added, conf.Username)
+	}
+
+	if remove {
+		m.Channels.Range(func(key, value any) bool {
+			ch := value.(*channel.Channel)
+			// A channel that's recording is removed once it's no longer followed on a later sync,
+			// Shutdown waits for the file of one that just started recording to be finalized
+			if ch.Config.AutoFollow && !followed[ch.Config.Username] && !ch.Recording() {
+				ch.Shutdown()
+				m.Channels.Delete(key)
+				removed = append(removed, ch.Config.Username)
+			}
+			return true
+		})
+		m.updateIntervalFloor()
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	if len(added) > 0 {
+		log.Printf("auto-follow: added %s", strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		log.Printf("auto-follow: removed %s, no longer followed or online", strings.Join(removed, ", "))
+	}
+	if err := m.SaveConfig(); err != nil {
+		log.Printf("ERROR auto-follow: save config: %s", err.Error())
+	}
+}
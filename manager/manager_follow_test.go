@@ -0,0 +1,52 @@
+package manager
+
+import (
+	"os"
+	"testing"
+
+	"github.com/teacat/chaturbate-dvr/channel"
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+func TestSyncFollowedRemovesOnlyUnfollowedAutoFollowChannels(t *testing.T) {
+	// The channels are saved to the conf directory of the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd() error = %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Chdir() error = %v", err)
+	}
+	prevConfig := server.Config
+	t.Cleanup(func() {
+		server.Config = prevConfig
+		_ = os.Chdir(wd)
+	})
+	server.Config = &entity.Config{Interval: 1, Pattern: "{{.Username}}"}
+
+	m := &Manager{}
+	for _, conf := range []*entity.ChannelConfig{
+		{Username: "alice", Pattern: "{{.Username}}", AutoFollow: true},
+		{Username: "bob", Pattern: "{{.Username}}", AutoFollow: true},
+		{Username: "carol", Pattern: "{{.Username}}"},
+	} {
+		m.Channels.Store(conf.Username, channel.New(conf))
+	}
+
+	m.syncFollowed([]string{"bob"}, false)
+	if _, ok := m.Channels.Load("alice"); !ok {
+		t.Fatal("alice removed without --auto-follow-remove")
+	}
+
+	m.syncFollowed([]string{"bob"}, true)
+	for username, want := range map[string]bool{"alice": false, "bob": true, "carol": true} {
+		if _, ok := m.Channels.Load(username); ok != want {
+			t.Errorf("%s tracked = %v, want %v", username, ok, want)
+		}
+	}
+	channels, problems, err := decodeChannels(mustReadFile(t, ChannelsPath))
+	if err != nil || len(problems) != 0 || len(channels) != 2 {
+		t.Fatalf("saved channels = %+v, %q, %v, want bob and carol", channels, problems, err)
+	}
+}
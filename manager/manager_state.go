@@ -0,0 +1,211 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/template"
+
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/index"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+const (
+	// ChannelsPath is the file of the channels and their settings.
+	ChannelsPath = internal.ConfDir + "/channels.json"
+	// RecordingsPath is the index of the completed recordings, it's rebuilt from the files if it's missing.
+	RecordingsPath = internal.ConfDir + "/recordings.json"
+	// TotalsPath is the lifetime totals of the completed recordings, they're seeded from the index if it's missing.
+	TotalsPath = internal.ConfDir + "/totals.json"
+)
+
+// decodeChannels decodes the channels file entry by entry, so an invalid entry doesn't take the others down.
+// It returns the valid channels and a problem for each dropped entry, or an error if the file isn't a JSON array at all.
+func decodeChannels(b []byte) ([]*entity.ChannelConfig, []string, error) {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return nil, nil, fmt.Errorf("not a JSON array of channels: %w", err)
+	}
+
+	var (
+		channels []*entity.ChannelConfig
+		problems []string
+		seen     = map[string]bool{}
+	)
+	for i, raw := range raws {
+		var conf *entity.ChannelConfig
+		if err := json.Unmarshal(raw, &conf); err != nil || conf == nil {
+			problems = append(problems, fmt.Sprintf("entry %d: not a channel: %s", i+1, errString(err, "null")))
+			continue
+		}
+		if err := validateChannel(conf); err != nil {
+			problems = append(problems, fmt.Sprintf("entry %d (%q): %s", i+1, conf.Username, err.Error()))
+			continue
+		}
+		if seen[conf.Username] {
+			problems = append(problems, fmt.Sprintf("entry %d (%q): duplicate of an earlier entry", i+1, conf.Username))
+			continue
+		}
+		seen[conf.Username] = true
+		channels = append(channels, conf)
+	}
+	return channels, problems, nil
+}
+
+// validateChannel returns why the channel can't be recorded as configured, nil if it can.
+func validateChannel(conf *entity.ChannelConfig) error {
+	sanitized := *conf
+	sanitized.Sanitize()
+	switch {
+	case conf.Username == "":
+		return errors.New("empty username")
+	case sanitized.Username != conf.Username:
+		return fmt.Errorf("invalid username, only letters, digits, _ and - are allowed")
+	case conf.Resolution < 0, conf.Framerate < 0, conf.MaxDuration < 0, conf.MaxFilesize < 0, conf.MaxBitrate < 0:
+		return errors.New("negative resolution, framerate, max_duration, max_filesize or max_bitrate")
+	case conf.Pattern == "":
+		return errors.New("empty pattern")
+	case sanitized.OutputDir != "" && !server.Config.OutputDirAllowed(sanitized.OutputDir):
+		return fmt.Errorf("invalid output_dir %q, it must be inside --output-dir or --output-dir-roots", conf.OutputDir)
+	}
+	if _, err := template.New("filename").Parse(conf.Pattern); err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	if conf.Schedule != "" {
+		if _, err := internal.ParseCron(conf.Schedule); err != nil {
+			return fmt.Errorf("invalid schedule: %w", err)
+		}
+	}
+	if conf.Window != "" {
+		if _, err := internal.ParseWindow(conf.Window); err != nil {
+			return fmt.Errorf("invalid %w", err)
+		}
+	}
+	for _, resolution := range conf.Resolutions {
+		if resolution <= 0 {
+			return fmt.Errorf("invalid resolution %d in resolutions", resolution)
+		}
+	}
+	return nil
+}
+
+// errString returns the message of err, or fallback if it's nil.
+func errString(err error, fallback string) string {
+	if err == nil {
+		return fallback
+	}
+	return err.Error()
+}
+
+// ValidateState checks the channels file and the recordings index and reports the problems to w (`--validate-state`).
+// With repair the invalid channels are dropped and a corrupt index is removed so it's rebuilt on the next start,
+// the original files are backed up next to them first. It returns an error if problems are left.
+func ValidateState(w io.Writer, repair bool) error {
+	problems := validateChannelsFile(w, ChannelsPath, repair)
+	problems += validateRecordingsFile(w, RecordingsPath, repair)
+	if problems > 0 && !repair {
+		return fmt.Errorf("%d problem(s) found, run with --repair to fix them", problems)
+	}
+	return nil
+}
+
+// validateChannelsFile reports the problems of the channels file at path and returns how many there are.
+func validateChannelsFile(w io.Writer, path string, repair bool) int {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(w, "%s: doesn't exist, no channels\n", path)
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s: %s\n", path, err.Error())
+		return 1
+	}
+
+	channels, problems, err := decodeChannels(b)
+	if err != nil {
+		// Nothing can be salvaged, the channels have to be added again
+		problems = []string{err.Error()}
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(w, "%s: %s\n", path, problem)
+	}
+	if len(problems) == 0 {
+		fmt.Fprintf(w, "%s: ok, %d channel(s)\n", path, len(channels))
+		return 0
+	}
+	if !repair {
+		return len(problems)
+	}
+
+	backup, err := backupFile(path, b)
+	if err != nil {
+		fmt.Fprintf(w, "%s: repair: %s\n", path, err.Error())
+		return len(problems)
+	}
+	if channels == nil {
+		channels = []*entity.ChannelConfig{}
+	}
+	clean, err := json.MarshalIndent(channels, "", "  ")
+	if err == nil {
+		err = writeChannelsFile(path, clean)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s: repair: %s\n", path, err.Error())
+		return len(problems)
+	}
+	fmt.Fprintf(w, "%s: repaired, kept %d channel(s), the original is backed up to %s\n", path, len(channels), backup)
+	return len(problems)
+}
+
+// validateRecordingsFile reports whether the recordings index at path can be loaded, it returns 1 if it can't.
+func validateRecordingsFile(w io.Writer, path string, repair bool) int {
+	_, exists, err := index.Open(path)
+	if err == nil {
+		if exists {
+			fmt.Fprintf(w, "%s: ok\n", path)
+		} else {
+			fmt.Fprintf(w, "%s: doesn't exist, it's rebuilt from the files on the next start\n", path)
+		}
+		return 0
+	}
+	fmt.Fprintf(w, "%s: %s\n", path, err.Error())
+	if !repair {
+		return 1
+	}
+
+	// The index is rebuilt from the files when it's missing
+	b, readErr := os.ReadFile(path)
+	backup, err := backupFile(path, b)
+	if readErr == nil && err == nil {
+		err = os.Remove(path)
+	}
+	if err := errors.Join(readErr, err); err != nil {
+		fmt.Fprintf(w, "%s: repair: %s\n", path, err.Error())
+		return 1
+	}
+	fmt.Fprintf(w, "%s: repaired, removed to be rebuilt from the files on the next start, the original is backed up to %s\n", path, backup)
+	return 1
+}
+
+// writeChannelsFile writes the channels to path readable by the owner only, since they have the room passwords.
+// The mode of an existing file is tightened too, it was written world-readable before.
+func writeChannelsFile(path string, b []byte) error {
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// backupFile writes b to a timestamped copy next to path, e.g. `channels.json.20240102-150405.bak`,
+// readable by the owner only like the file it backs up.
+func backupFile(path string, b []byte) (string, error) {
+	backup := fmt.Sprintf("%s.%s.bak", path, server.Config.Now().Format("20060102-150405"))
+	if err := os.WriteFile(backup, b, 0600); err != nil {
+		return "", fmt.Errorf("back up: %w", err)
+	}
+	return backup, nil
+}
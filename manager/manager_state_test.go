@@ -0,0 +1,181 @@
+package manager
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/teacat/chaturbate-dvr/entity"
+)
+
+func TestValidateChannel(t *testing.T) {
+	t.Parallel()
+
+	valid := entity.ChannelConfig{Username: "alice", Pattern: "{{.Username}}_{{.Year}}"}
+	// Without a config the output directories must be inside the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd() error = %v", err)
+	}
+	inside, outside := filepath.Join(wd, "videos"), filepath.Join(filepath.Dir(wd), "elsewhere")
+	tests := []struct {
+		name   string
+		modify func(c *entity.ChannelConfig)
+		want   string // part of the error, empty if it's valid
+	}{
+		{"valid", func(*entity.ChannelConfig) {}, ""},
+		{"empty username", func(c *entity.ChannelConfig) { c.Username = "" }, "empty username"},
+		{"invalid username", func(c *entity.ChannelConfig) { c.Username = "al ice" }, "invalid username"},
+		{"negative resolution", func(c *entity.ChannelConfig) { c.Resolution = -1 }, "negative"},
+		{"empty pattern", func(c *entity.ChannelConfig) { c.Pattern = "" }, "empty pattern"},
+		{"invalid pattern", func(c *entity.ChannelConfig) { c.Pattern = "{{.Username" }, "invalid pattern"},
+		{"invalid schedule", func(c *entity.ChannelConfig) { c.Schedule = "* *" }, "invalid schedule"},
+		{"invalid window", func(c *entity.ChannelConfig) { c.Window = "25:00-26:00" }, "invalid window"},
+		{"invalid resolutions", func(c *entity.ChannelConfig) { c.Resolutions = []int{720, 0} }, "invalid resolution 0"},
+		{"output dir", func(c *entity.ChannelConfig) { c.OutputDir = "videos/alice" }, ""},
+		{"absolute output dir", func(c *entity.ChannelConfig) { c.OutputDir = inside }, ""},
+		{"output dir outside", func(c *entity.ChannelConfig) { c.OutputDir = outside }, "invalid output_dir"},
+		{"output dir traversal", func(c *entity.ChannelConfig) { c.OutputDir = "videos/../../etc" }, "invalid output_dir"},
+		{"output dir parent", func(c *entity.ChannelConfig) { c.OutputDir = " .. " }, "invalid output_dir"},
+	}
+	for _, tt := range tests {
+		conf := valid
+		tt.modify(&conf)
+		err := validateChannel(&conf)
+		if (tt.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: validateChannel() = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeChannelsSkipsInvalidEntries(t *testing.T) {
+	t.Parallel()
+
+	b := []byte(`[
+		{"username": "alice", "pattern": "{{.Username}}"},
+		42,
+		null,
+		{"username": "bob", "pattern": ""},
+		{"username": "alice", "pattern": "{{.Username}}_2"},
+		{"username": "carol", "pattern": "{{.Username}}"}
+	]`)
+	channels, problems, err := decodeChannels(b)
+	if err != nil {
+		t.Fatalf("decodeChannels() error = %v", err)
+	}
+	if len(channels) != 2 || channels[0].Username != "alice" || channels[1].Username != "carol" {
+		t.Fatalf("decodeChannels() channels = %+v, want alice and carol", channels)
+	}
+	want := []string{"entry 2: not a channel", "entry 3: not a channel: null", `entry 4 ("bob"): empty pattern`, `entry 5 ("alice"): duplicate`}
+	if len(problems) != len(want) {
+		t.Fatalf("decodeChannels() problems = %q, want %d", problems, len(want))
+	}
+	for i, problem := range problems {
+		if !strings.HasPrefix(problem, want[i]) {
+			t.Errorf("problem %d = %q, want %q...", i, problem, want[i])
+		}
+	}
+
+	if _, _, err := decodeChannels([]byte(`{"username": "alice"}`)); err == nil {
+		t.Fatal("decodeChannels() of an object, want an error")
+	}
+}
+
+func TestValidateChannelsFileRepairBacksUpAndDropsInvalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "channels.json")
+	original := []byte(`[{"username": "alice", "pattern": "{{.Username}}"}, {"username": "", "pattern": "x"}]`)
+	if err := os.WriteFile(path, original, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	if n := validateChannelsFile(&out, path, false); n != 1 {
+		t.Fatalf("validateChannelsFile() = %d, want 1 problem\n%s", n, out.String())
+	}
+	if b, _ := os.ReadFile(path); !bytes.Equal(b, original) {
+		t.Fatal("validateChannelsFile() without repair changed the file")
+	}
+
+	out.Reset()
+	if n := validateChannelsFile(&out, path, true); n != 1 {
+		t.Fatalf("validateChannelsFile() with repair = %d, want the 1 problem repaired\n%s", n, out.String())
+	}
+	channels, problems, err := decodeChannels(mustReadFile(t, path))
+	if err != nil || len(problems) != 0 || len(channels) != 1 || channels[0].Username != "alice" {
+		t.Fatalf("repaired file = %+v, %q, %v, want only alice", channels, problems, err)
+	}
+	backups, _ := filepath.Glob(path + ".*.bak")
+	if len(backups) != 1 || !bytes.Equal(mustReadFile(t, backups[0]), original) {
+		t.Fatalf("backups = %v, want one copy of the original", backups)
+	}
+
+	out.Reset()
+	if n := validateChannelsFile(&out, path, false); n != 0 || !strings.Contains(out.String(), "ok, 1 channel(s)") {
+		t.Fatalf("validateChannelsFile() after repair = %d\n%s", n, out.String())
+	}
+}
+
+func TestWriteChannelsFileIsOwnerOnly(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix file modes on windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "channels.json")
+	if err := os.WriteFile(path, []byte("[]"), 0777); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := writeChannelsFile(path, []byte(`[{"username": "alice"}]`)); err != nil {
+		t.Fatalf("writeChannelsFile() error = %v", err)
+	}
+	backup, err := backupFile(path, []byte("[]"))
+	if err != nil {
+		t.Fatalf("backupFile() error = %v", err)
+	}
+	for _, p := range []string{path, backup} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("mode of %s = %o, want 600", filepath.Base(p), mode)
+		}
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	return b
+}
+
+func TestOutputDirAllowedByRoots(t *testing.T) {
+	t.Parallel()
+
+	archive, trash := t.TempDir(), t.TempDir()
+	tests := []struct {
+		conf *entity.Config
+		dir  string
+		want bool
+	}{
+		{&entity.Config{OutputDir: archive}, filepath.Join(archive, "alice"), true},
+		{&entity.Config{OutputDir: archive}, trash, false},
+		{&entity.Config{OutputDir: archive, OutputDirRoots: []string{archive, trash}}, filepath.Join(trash, "bob"), true},
+		{&entity.Config{OutputDirRoots: []string{archive}}, filepath.Join(archive, "..", "etc"), false},
+		{&entity.Config{OutputDirRoots: []string{archive}}, archive + "-other", false},
+	}
+	for _, tt := range tests {
+		if got := tt.conf.OutputDirAllowed(tt.dir); got != tt.want {
+			t.Errorf("OutputDirAllowed(%q) with roots %q and output dir %q = %v, want %v", tt.dir, tt.conf.OutputDirRoots, tt.conf.OutputDir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// Event is what a notification is about.
+type Event = string
+
+const (
+	EventStarted  Event = "started"  // the channel went online and the recording started
+	EventFinished Event = "finished" // a recording was completed
+)
+
+// DefaultTemplate is the message of the notifiers without their own template.
+const DefaultTemplate = `{{ if eq .Event "started" }}{{ .Username }} is live, recording at {{ .Resolution }}p{{ if .RoomTitle }}: {{ .RoomTitle }}{{ end }}` +
+	`{{ else }}{{ .Username }} recorded {{ .Filename }} ({{ .Duration }}, {{ .Filesize }}){{ end }}`
+
+// Data is the template data of a message. The resolution and framerate are set when the recording started,
+// the file, its size and duration when it finished.
+type Data struct {
+	Event      Event  `json:"event"`
+	Username   string `json:"username"`
+	Resolution int    `json:"resolution"`
+	Framerate  int    `json:"framerate"`
+	RoomTitle  string `json:"room_title"`
+	Filename   string `json:"filename"`
+	Filesize   string `json:"filesize"` // e.g. "1.20 GB"
+	Duration   string `json:"duration"` // e.g. "1:02:03"
+}
+
+// ParseTemplate parses a message template, the default one if text is empty.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultTemplate
+	}
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// notifier sends a message to a service.
+type notifier struct {
+	name string
+	tmpl *template.Template
+	send func(ctx context.Context, message string, data Data) error
+}
+
+var (
+	notifiers     []*notifier
+	notifiersOnce sync.Once
+	client        = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Send notifies the configured notifiers in the background, the errors are logged.
+func Send(data Data) {
+	notifiersOnce.Do(func() {
+		if server.Config != nil {
+			notifiers = newNotifiers(server.Config)
+			client.Transport = internal.CreateTransport()
+		}
+	})
+	for _, n := range notifiers {
+		go func(n *notifier) {
+			if err := n.notify(context.Background(), data); err != nil {
+				log.Printf("ERROR [%s] %s notification: %s", data.Username, n.name, err.Error())
+			}
+		}(n)
+	}
+}
+
+func (n *notifier) notify(ctx context.Context, data Data) error {
+	var message strings.Builder
+	if err := n.tmpl.Execute(&message, data); err != nil {
+		return fmt.Errorf("execute template: %w", err)
+	}
+	return n.send(ctx, message.String(), data)
+}
+
+// newNotifiers returns the notifiers set up in conf. The templates were validated by the config already.
+func newNotifiers(conf *entity.Config) []*notifier {
+	var list []*notifier
+	add := func(name, text string, send func(ctx context.Context, message string, data Data) error) {
+		tmpl, err := ParseTemplate(name, text)
+		if err != nil {
+			log.Printf("ERROR %s notification: template: %s", name, err.Error())
+			return
+		}
+		list = append(list, &notifier{name: name, tmpl: tmpl, send: send})
+	}
+
+	if conf.WebhookURL != "" {
+		add("webhook", conf.WebhookTemplate, func(ctx context.Context, message string, data Data) error {
+			return postJSON(ctx, conf.WebhookURL, struct {
+				Data
+				Message string `json:"message"`
+			}{data, message})
+		})
+	}
+	if conf.DiscordWebhook != "" {
+		add("discord", conf.DiscordTemplate, func(ctx context.Context, message string, _ Data) error {
+			return postJSON(ctx, conf.DiscordWebhook, map[string]string{"content": message})
+		})
+	}
+	if conf.TelegramToken != "" && conf.TelegramChatID != "" {
+		add("telegram", conf.TelegramTemplate, func(ctx context.Context, message string, _ Data) error {
+			endpoint := "https://api.telegram.org/bot" + url.PathEscape(conf.TelegramToken) + "/sendMessage"
+			return postJSON(ctx, endpoint, map[string]string{"chat_id": conf.TelegramChatID, "text": message})
+		})
+	}
+	return list
+}
+
+// postJSON posts v as JSON to endpoint, a response other than 2xx is an error.
+func postJSON(ctx context.Context, endpoint string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL holds the webhook secret or the bot token, keep it out of the log
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("client do: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
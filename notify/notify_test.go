@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/teacat/chaturbate-dvr/entity"
+)
+
+func TestWebhookRendersTemplate(t *testing.T) {
+	t.Parallel()
+
+	got := make(chan map[string]any, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Decode() error = %v", err)
+		}
+		got <- body
+	}))
+	t.Cleanup(srv.Close)
+
+	notifiers := newNotifiers(&entity.Config{
+		WebhookURL:      srv.URL,
+		WebhookTemplate: `[{{ .Event }}] {{ .Username }} {{ .Filename }} {{ .Duration }}`,
+	})
+	if len(notifiers) != 1 {
+		t.Fatalf("newNotifiers() = %d notifier(s), want 1", len(notifiers))
+	}
+	data := Data{Event: EventFinished, Username: "alice", Filename: "alice_0.mkv", Duration: "0:10:00"}
+	if err := notifiers[0].notify(context.Background(), data); err != nil {
+		t.Fatalf("notify() error = %v", err)
+	}
+	body := <-got
+	if body["message"] != "[finished] alice alice_0.mkv 0:10:00" || body["username"] != "alice" {
+		t.Fatalf("body = %v", body)
+	}
+}
+
+func TestDefaultTemplate(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := ParseTemplate("default", "")
+	if err != nil {
+		t.Fatalf("ParseTemplate() error = %v", err)
+	}
+	for data, want := range map[Data]string{
+		{Event: EventStarted, Username: "alice", Resolution: 1080}:                                             "alice is live, recording at 1080p",
+		{Event: EventFinished, Username: "alice", Filename: "a.mkv", Duration: "1:02:03", Filesize: "1.20 GB"}: "alice recorded a.mkv (1:02:03, 1.20 GB)",
+	} {
+		var message strings.Builder
+		if err := tmpl.Execute(&message, data); err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		if message.String() != want {
+			t.Errorf("message = %q, want %q", message.String(), want)
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package router
 
 import (
+	"crypto/subtle"
 	"embed"
 	"html/template"
 	"log"
+	"net/http"
 	"path/filepath"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/teacat/chaturbate-dvr/internal"
 	"github.com/teacat/chaturbate-dvr/router/view"
 	"github.com/teacat/chaturbate-dvr/server"
 )
@@ -16,7 +20,7 @@ func SetupRouter() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 
 	r := gin.Default()
-	if err := LoadHTMLFromEmbedFS(r, view.FS, "templates/index.html", "templates/channel_info.html"); err != nil {
+	if err := LoadHTMLFromEmbedFS(r, view.FS, "templates/index.html", "templates/channel_info.html", "templates/recordings.html"); err != nil {
 		log.Fatalf("failed to load HTML templates: %v", err)
 	}
 
@@ -26,18 +30,56 @@ func SetupRouter() *gin.Engine {
 	SetupStatic(r)
 	// Register views
 	SetupViews(r)
+	// Register JSON API
+	SetupAPI(r)
 
 	return r
 }
 
-// SetupAuth applies basic authentication if credentials are provided.
+// SetupAuth applies basic authentication if credentials are provided. The API also takes `--api-token`
+// as a bearer token, and requires one of them if the token is set even without the admin credentials.
 func SetupAuth(r *gin.Engine) {
-	if server.Config.AdminUsername != "" && server.Config.AdminPassword != "" {
-		auth := gin.BasicAuth(gin.Accounts{
-			server.Config.AdminUsername: server.Config.AdminPassword,
-		})
-		r.Use(auth)
+	hasAdmin := server.Config.AdminUsername != "" && server.Config.AdminPassword != ""
+	if !hasAdmin && server.Config.APIToken == "" {
+		return
 	}
+	r.Use(func(c *gin.Context) {
+		isAPI := strings.HasPrefix(c.Request.URL.Path, "/api/")
+		switch {
+		case isAPI && server.Config.APIToken != "" && secureEqual(bearerToken(c.Request), server.Config.APIToken):
+			return
+		case hasAdmin && validAdmin(c.Request):
+			return
+		case !hasAdmin && !isAPI:
+			return
+		}
+		c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+		if isAPI {
+			abortWithAPIError(c, internal.ErrUnauthorized)
+			return
+		}
+		c.AbortWithStatus(http.StatusUnauthorized)
+	})
+}
+
+// validAdmin reports whether the request has the basic auth credentials of `--admin-username` and `--admin-password`.
+func validAdmin(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	return ok && secureEqual(username, server.Config.AdminUsername) && secureEqual(password, server.Config.AdminPassword)
+}
+
+// bearerToken returns the token of the `Authorization: Bearer` header, empty if there's none.
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// secureEqual compares the strings in constant time.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
 // SetupStatic serves static frontend files.
@@ -58,7 +100,47 @@ func SetupViews(r *gin.Engine) {
 	r.POST("/stop_channel/:username", StopChannel)
 	r.POST("/pause_channel/:username", PauseChannel)
 	r.POST("/resume_channel/:username", ResumeChannel)
+	r.POST("/wake_channel/:username", WakeChannel)
+	r.POST("/recheck_channel/:username", RecheckChannel)
+	r.GET("/poster/:username", Poster)
+	r.GET("/recordings", Recordings)
+	if dir, err := RecordingsDir(); err == nil {
+		r.StaticFS(recordingsFilesPath, gin.Dir(dir, false))
+	} else {
+		log.Printf("WARNING: the recordings aren't served: %s", err.Error())
+	}
+
+}
+
+// SetupAPI registers the JSON API handlers under `/api/v1`, and `/api` for the clients from before it was versioned.
+// The unknown paths under them respond with an APIError too.
+func SetupAPI(r *gin.Engine) {
+	registerAPI(r.Group("/api/v1"))
+	registerAPI(r.Group("/api"))
+
+	r.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			abortWithAPIError(c, internal.ErrNotFound)
+		}
+	})
+}
 
+// registerAPI registers the handlers of the JSON API on the group.
+func registerAPI(api *gin.RouterGroup) {
+	api.GET("/metrics", GetMetricsAPI)
+	api.GET("/stats", GetStatsAPI)
+	api.GET("/config", GetConfigAPI)
+	api.PATCH("/config", UpdateConfigAPI)
+	api.GET("/channels", ListChannelsAPI)
+	api.POST("/channels", CreateChannelAPI)
+	api.GET("/channels/:username", GetChannelAPI)
+	api.DELETE("/channels/:username", DeleteChannelAPI)
+	api.POST("/channels/:username/pause", PauseChannelAPI)
+	api.POST("/channels/:username/resume", ResumeChannelAPI)
+	api.POST("/channels/:username/wake", WakeChannelAPI)
+	api.POST("/channels/:username/recheck", RecheckChannelAPI)
+	api.GET("/recordings", ListRecordingsAPI)
+	api.POST("/recordings/rebuild", RebuildRecordingsAPI)
 }
 
 // LoadHTMLFromEmbedFS loads specific HTML templates from an embedded filesystem and registers them with Gin.
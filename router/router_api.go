@@ -0,0 +1,272 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/teacat/chaturbate-dvr/config"
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// APIError represents the JSON body returned when an API request fails.
+type APIError struct {
+	Error string `json:"error"` // human readable, may change between versions
+	Code  string `json:"code"`  // stable, one of the codes of apiErrorCodes
+}
+
+// apiErrorCodes are the codes of APIError by the status code.
+var apiErrorCodes = map[int]string{
+	http.StatusBadRequest:          "invalid_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusNotFound:            "not_found",
+	http.StatusConflict:            "conflict",
+	http.StatusInternalServerError: "internal_error",
+}
+
+// abortWithAPIError writes the error as JSON with a status code derived from the error.
+func abortWithAPIError(c *gin.Context, err error) {
+	status := errorStatus(err)
+	c.AbortWithStatusJSON(status, &APIError{Error: err.Error(), Code: apiErrorCodes[status]})
+}
+
+// errorStatus returns the HTTP status of an error of the manager, 500 if it's unexpected.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, internal.ErrChannelNotFound), errors.Is(err, internal.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, internal.ErrChannelRecording), errors.Is(err, internal.ErrPaused), errors.Is(err, internal.ErrChannelExists):
+		return http.StatusConflict
+	case errors.Is(err, internal.ErrInvalidQuery), errors.Is(err, internal.ErrInvalidSettings):
+		return http.StatusBadRequest
+	case errors.Is(err, internal.ErrUnauthorized):
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// ListChannelsAPI returns the information of all channels.
+func ListChannelsAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, server.Manager.ChannelInfo())
+}
+
+// GetChannelAPI returns the information of a channel.
+func GetChannelAPI(c *gin.Context) {
+	info := channelInfo(c.Param("username"))
+	if info == nil {
+		abortWithAPIError(c, internal.ErrChannelNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// channelInfo returns the information of the channel of username, nil if there's no such channel.
+func channelInfo(username string) *entity.ChannelInfo {
+	for _, info := range server.Manager.ChannelInfo() {
+		if info.Username == username {
+			return info
+		}
+	}
+	return nil
+}
+
+// CreateChannelAPIRequest is the body of CreateChannelAPI, the fields left out take the defaults of new channels.
+type CreateChannelAPIRequest struct {
+	Username     string  `json:"username" binding:"required"`
+	Framerate    *int    `json:"framerate"`
+	Resolution   *int    `json:"resolution"`
+	Pattern      *string `json:"pattern"`
+	MaxDuration  *int    `json:"max_duration"` // minutes
+	MaxFilesize  *int    `json:"max_filesize"` // MB
+	MaxBitrate   *int    `json:"max_bitrate"`  // kbps
+	Resolutions  []int   `json:"resolutions"`
+	Schedule     *string `json:"schedule"`
+	Window       *string `json:"window"`
+	RoomPassword string  `json:"room_password"`
+	Compress     *bool   `json:"compress"`
+	OutputDir    string  `json:"output_dir"`
+	Priority     *int    `json:"priority"`
+	IsPaused     bool    `json:"is_paused"`
+}
+
+// CreateChannelAPI adds a channel and returns its information with 201 Created,
+// it responds 409 Conflict if the channel exists and 400 Bad Request if the settings are invalid.
+func CreateChannelAPI(c *gin.Context) {
+	var req CreateChannelAPIRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithAPIError(c, fmt.Errorf("%w: %s", internal.ErrInvalidSettings, err.Error()))
+		return
+	}
+
+	defaults := server.Config.Runtime()
+	conf := &entity.ChannelConfig{
+		IsPaused:     req.IsPaused,
+		Username:     req.Username,
+		Framerate:    lo.FromPtrOr(req.Framerate, server.Config.Framerate),
+		Resolution:   lo.FromPtrOr(req.Resolution, server.Config.Resolution),
+		Pattern:      lo.FromPtrOr(req.Pattern, server.Config.Pattern),
+		MaxDuration:  lo.FromPtrOr(req.MaxDuration, defaults.MaxDuration),
+		MaxFilesize:  lo.FromPtrOr(req.MaxFilesize, defaults.MaxFilesize),
+		MaxBitrate:   lo.FromPtrOr(req.MaxBitrate, server.Config.MaxBitrate),
+		Resolutions:  req.Resolutions,
+		Schedule:     lo.FromPtrOr(req.Schedule, server.Config.Schedule),
+		Window:       lo.FromPtrOr(req.Window, server.Config.Window),
+		RoomPassword: req.RoomPassword,
+		Compress:     lo.FromPtrOr(req.Compress, defaults.Compress),
+		OutputDir:    req.OutputDir,
+		Priority:     lo.FromPtrOr(req.Priority, server.Config.Priority),
+		CreatedAt:    time.Now().Unix(),
+	}
+	if req.Resolutions == nil {
+		conf.Resolutions = server.Config.Resolutions
+	}
+	// CreateChannel doesn't start a paused channel
+	if err := server.Manager.CreateChannel(conf, true); err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, channelInfo(conf.Username))
+}
+
+// DeleteChannelAPI stops a channel and removes it, the recording in progress is finalized first.
+func DeleteChannelAPI(c *gin.Context) {
+	if err := server.Manager.StopChannel(c.Param("username")); err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetMetricsAPI returns the number of channels by state and the completed recordings, see entity.Metrics.
+func GetMetricsAPI(c *gin.Context) {
+	metrics := &entity.Metrics{Version: server.Config.Version}
+	for _, info := range server.Manager.ChannelInfo() {
+		metrics.Channels++
+		switch {
+		case info.IsPaused:
+			metrics.Paused++
+		case info.IsOnline:
+			metrics.Recording++
+		case info.IsDormant:
+			metrics.Dormant++
+		}
+		if info.IsQueued {
+			metrics.Queued++
+		}
+		if info.Compressing != "" {
+			metrics.Compressing++
+		}
+	}
+
+	recordings, err := listRecordings()
+	if err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	metrics.Recordings = len(recordings)
+	for _, recording := range recordings {
+		metrics.RecordingsBytes += recording.SizeBytes
+	}
+	if server.Totals != nil {
+		metrics.Lifetime = server.Totals.Stats().Total
+	}
+	c.JSON(http.StatusOK, metrics)
+}
+
+// GetStatsAPI returns the lifetime totals of the completed recordings and of each channel, including the removed ones.
+func GetStatsAPI(c *gin.Context) {
+	stats := entity.Stats{Channels: map[string]entity.RecordingTotals{}}
+	if server.Totals != nil {
+		stats = server.Totals.Stats()
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// PauseChannelAPI pauses a channel, the channel stays in the list but stops polling and recording.
+func PauseChannelAPI(c *gin.Context) {
+	if err := server.Manager.PauseChannel(c.Param("username")); err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ResumeChannelAPI resumes a paused channel, it checks the online status right away and records if live.
+func ResumeChannelAPI(c *gin.Context) {
+	if err := server.Manager.ResumeChannel(c.Param("username")); err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListRecordingsAPI returns the completed recordings, it takes the same query parameters as the gallery
+// and paginates with `limit` and `offset`, the number of matching recordings is in the `X-Total-Count` header.
+func ListRecordingsAPI(c *gin.Context) {
+	recordings, total, err := queryRecordings(c)
+	if err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.JSON(http.StatusOK, recordings)
+}
+
+// WakeChannelAPI wakes up a dormant channel, it checks the online status right away.
+func WakeChannelAPI(c *gin.Context) {
+	if err := server.Manager.WakeChannel(c.Param("username")); err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RecheckChannelAPI checks a channel right away instead of waiting for the interval, it records if live.
+// It responds 409 Conflict if the channel is already recording or paused.
+func RecheckChannelAPI(c *gin.Context) {
+	if err := server.Manager.RecheckChannel(c.Param("username")); err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RebuildRecordingsAPI rebuilds the recordings index from the files, e.g. after recordings were added by hand.
+func RebuildRecordingsAPI(c *gin.Context) {
+	if err := RebuildIndex(); err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetConfigAPI returns the settings that can be changed without a restart, see entity.RuntimeConfig.
+func GetConfigAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, server.Config.Runtime())
+}
+
+// UpdateConfigAPI changes the settings that can be changed without a restart and returns them,
+// the fields left out of the body keep their value. The changes are reverted after a restart,
+// except for the channels they applied to, see Manager.SetRuntime.
+func UpdateConfigAPI(c *gin.Context) {
+	settings := server.Config.Runtime()
+	if err := c.ShouldBindJSON(settings); err != nil {
+		abortWithAPIError(c, fmt.Errorf("%w: %s", internal.ErrInvalidSettings, err.Error()))
+		return
+	}
+	if err := config.ValidateRuntime(settings); err != nil {
+		abortWithAPIError(c, fmt.Errorf("%w: %s", internal.ErrInvalidSettings, err.Error()))
+		return
+	}
+	if err := server.Manager.SetRuntime(settings); err != nil {
+		abortWithAPIError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
@@ -7,7 +7,9 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/teacat/chaturbate-dvr/config"
 	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
 	"github.com/teacat/chaturbate-dvr/server"
 )
 
@@ -20,20 +22,27 @@ type IndexData struct {
 // Index renders the index page with channel information.
 func Index(c *gin.Context) {
 	c.HTML(200, "index.html", &IndexData{
-		Config:   server.Config,
+		Config:   server.Config.Copy(),
 		Channels: server.Manager.ChannelInfo(),
 	})
 }
 
 // CreateChannelRequest represents the request body for creating a channel.
 type CreateChannelRequest struct {
-	Username    string `form:"username" binding:"required"`
-	Framerate   int    `form:"framerate" binding:"required"`
-	Resolution  int    `form:"resolution" binding:"required"`
-	Pattern     string `form:"pattern" binding:"required"`
-	MaxDuration int    `form:"max_duration"`
-	MaxFilesize int    `form:"max_filesize"`
-	Compress    bool   `form:"compress"`
+	Username     string `form:"username" binding:"required"`
+	Framerate    int    `form:"framerate"` // 0 = any
+	Resolution   int    `form:"resolution" binding:"required"`
+	Pattern      string `form:"pattern" binding:"required"`
+	MaxDuration  int    `form:"max_duration"`
+	MaxFilesize  int    `form:"max_filesize"`
+	MaxBitrate   int    `form:"max_bitrate"` // kbps, 0 = no cap
+	Resolutions  string `form:"resolutions"` // comma-separated, e.g. "720,480"
+	Schedule     string `form:"schedule"`    // cron expression, empty = always
+	Window       string `form:"window"`      // daily window, empty = all day
+	RoomPassword string `form:"room_password"`
+	Compress     bool   `form:"compress"`
+	OutputDir    string `form:"output_dir"` // empty uses the global output directory
+	Priority     int    `form:"priority"`
 }
 
 // CreateChannel creates a new channel.
@@ -44,17 +53,44 @@ func CreateChannel(c *gin.Context) {
 		return
 	}
 
+	resolutions, err := config.ParseResolutions(req.Resolutions)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("resolutions: %w", err))
+		return
+	}
+	schedule := strings.TrimSpace(req.Schedule)
+	if schedule != "" {
+		if _, err := internal.ParseCron(schedule); err != nil {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("schedule: %w", err))
+			return
+		}
+	}
+	window := strings.TrimSpace(req.Window)
+	if window != "" {
+		if _, err := internal.ParseWindow(window); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+
 	for _, username := range strings.Split(req.Username, ",") {
 		server.Manager.CreateChannel(&entity.ChannelConfig{
-			IsPaused:    false,
-			Username:    username,
-			Framerate:   req.Framerate,
-			Resolution:  req.Resolution,
-			Pattern:     req.Pattern,
-			MaxDuration: req.MaxDuration,
-			MaxFilesize: req.MaxFilesize,
-			Compress:    req.Compress,
-			CreatedAt:   time.Now().Unix(),
+			IsPaused:     false,
+			Username:     username,
+			Framerate:    req.Framerate,
+			Resolution:   req.Resolution,
+			Pattern:      req.Pattern,
+			MaxDuration:  req.MaxDuration,
+			MaxFilesize:  req.MaxFilesize,
+			MaxBitrate:   req.MaxBitrate,
+			Resolutions:  resolutions,
+			Schedule:     schedule,
+			Window:       window,
+			RoomPassword: req.RoomPassword,
+			Compress:     req.Compress,
+			OutputDir:    req.OutputDir,
+			Priority:     req.Priority,
+			CreatedAt:    time.Now().Unix(),
 		}, true)
 	}
 	c.Redirect(http.StatusFound, "/")
@@ -81,6 +117,35 @@ func ResumeChannel(c *gin.Context) {
 	c.Redirect(http.StatusFound, "/")
 }
 
+// WakeChannel wakes up a dormant channel.
+func WakeChannel(c *gin.Context) {
+	server.Manager.WakeChannel(c.Param("username"))
+
+	c.Redirect(http.StatusFound, "/")
+}
+
+// RecheckChannel checks a channel right away instead of waiting for the interval.
+// It's refused with 409 Conflict while the channel is recording or paused.
+func RecheckChannel(c *gin.Context) {
+	if err := server.Manager.RecheckChannel(c.Param("username")); err != nil {
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Poster serves the poster of the file a channel is recording with `--poster`.
+func Poster(c *gin.Context) {
+	for _, info := range server.Manager.ChannelInfo() {
+		if info.Username == c.Param("username") && info.Poster != "" {
+			c.File(info.PosterPath)
+			return
+		}
+	}
+	c.Status(http.StatusNotFound)
+}
+
 // Updates handles the SSE connection for updates.
 func Updates(c *gin.Context) {
 	server.Manager.Subscriber(c.Writer, c.Request)
@@ -88,11 +153,15 @@ func Updates(c *gin.Context) {
 
 // UpdateConfigRequest represents the request body for updating configuration.
 type UpdateConfigRequest struct {
-	Cookies   string `form:"cookies"`
-	UserAgent string `form:"user_agent"`
+	Interval    int    `form:"interval"`
+	MaxDuration int    `form:"max_duration"`
+	MaxFilesize int    `form:"max_filesize"`
+	Compress    bool   `form:"compress"`
+	Cookies     string `form:"cookies"`
+	UserAgent   string `form:"user_agent"`
 }
 
-// UpdateConfig updates the server configuration.
+// UpdateConfig updates the settings that can be changed without a restart, see entity.RuntimeConfig.
 func UpdateConfig(c *gin.Context) {
 	var req *UpdateConfigRequest
 	if err := c.Bind(&req); err != nil {
@@ -100,7 +169,21 @@ func UpdateConfig(c *gin.Context) {
 		return
 	}
 
-	server.Config.Cookies = req.Cookies
-	server.Config.UserAgent = req.UserAgent
+	settings := &entity.RuntimeConfig{
+		Interval:    req.Interval,
+		MaxDuration: req.MaxDuration,
+		MaxFilesize: req.MaxFilesize,
+		Compress:    req.Compress,
+		Cookies:     req.Cookies,
+		UserAgent:   req.UserAgent,
+	}
+	if err := config.ValidateRuntime(settings); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err := server.Manager.SetRuntime(settings); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 	c.Redirect(http.StatusFound, "/")
 }
@@ -0,0 +1,486 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/index"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// recordingsFilesPath is the URL prefix the recordings directory is served under.
+const recordingsFilesPath = "/recordings/files"
+
+var (
+	recordingExts = map[string]bool{".mkv": true, ".mp4": true, ".ts": true}
+	thumbnailExts = []string{".webp", ".jpg", ".png", ".poster.jpg"}
+)
+
+// RecordingsDir returns the directory completed recordings end up in, `--output-dir` if set, otherwise the static
+// part of `--pattern` (e.g. "videos"). It returns ErrNoRecordingsDir if the pattern has none, or if the directory
+// holds the conf directory with the channels and their room passwords, so it's never served.
+func RecordingsDir() (string, error) {
+	dir := server.Config.OutputDir
+	if dir == "" {
+		dir = internal.PatternDir(server.Config.Pattern)
+	}
+	if dir == "" || isWithin(internal.ConfDir, dir) {
+		return "", internal.ErrNoRecordingsDir
+	}
+	return dir, nil
+}
+
+// isWithin reports whether path is dir or under it.
+func isWithin(path, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return true
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return true
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// RecordingsData is the data for the recordings gallery.
+type RecordingsData struct {
+	Config     *entity.Config
+	Recordings []*entity.Recording
+	Channels   []string // channels with recordings, for the filter
+	Channel    string
+	Query      string
+	Sort       string
+	Lifetime   string // totals of all the completed recordings, including the removed ones
+}
+
+// Recordings renders the gallery of completed recordings.
+func Recordings(c *gin.Context) {
+	recordings, err := listRecordings()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("scan recordings: %w", err))
+		return
+	}
+	channels := recordingChannels(recordings)
+	if recordings, err = filterRecordings(c, recordings); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	var lifetime string
+	if server.Totals != nil {
+		lifetime = internal.FormatTotals(server.Totals.Stats().Total)
+	}
+	c.HTML(http.StatusOK, "recordings.html", &RecordingsData{
+		Config:     server.Config.Copy(),
+		Recordings: recordings,
+		Channels:   channels,
+		Channel:    c.Query("channel"),
+		Query:      c.Query("q"),
+		Sort:       c.DefaultQuery("sort", "date"),
+		Lifetime:   lifetime,
+	})
+}
+
+// queryRecordings scans the recordings and applies the query parameters, see filterRecordings,
+// then returns the page of `limit` (0 = all) recordings from `offset` with their durations, and the total.
+func queryRecordings(c *gin.Context) ([]*entity.Recording, int, error) {
+	recordings, err := listRecordings()
+	if err != nil {
+		return nil, 0, err
+	}
+	if recordings, err = filterRecordings(c, recordings); err != nil {
+		return nil, 0, err
+	}
+	limit, err := queryInt(c, "limit")
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := queryInt(c, "offset")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(recordings)
+	page := recordings[min(offset, total):]
+	if limit > 0 && limit < len(page) {
+		page = page[:limit]
+	}
+	probeDurations(page)
+	return page, total, nil
+}
+
+// filterRecordings applies the `channel`, `q`, `from` and `to` (date or RFC 3339 time of the last modification),
+// `min_duration` (seconds) and `sort` (date, size, duration, name, channel) query parameters.
+// The durations are only probed when filtered or sorted by.
+func filterRecordings(c *gin.Context, recordings []*entity.Recording) ([]*entity.Recording, error) {
+	channel, query := c.Query("channel"), strings.ToLower(c.Query("q"))
+	from, err := queryTime(c, "from", false)
+	if err != nil {
+		return nil, err
+	}
+	to, err := queryTime(c, "to", true)
+	if err != nil {
+		return nil, err
+	}
+	minDuration, err := queryInt(c, "min_duration")
+	if err != nil {
+		return nil, err
+	}
+	sortKey := c.DefaultQuery("sort", "date")
+
+	filtered := []*entity.Recording{}
+	for _, r := range recordings {
+		if channel != "" && r.Channel != channel {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(r.Filename), query) {
+			continue
+		}
+		if (!from.IsZero() && r.ModTime < from.Unix()) || (!to.IsZero() && r.ModTime > to.Unix()) {
+			continue
+		}
+		filtered = append(filtered, r)
+	}
+
+	if minDuration > 0 || sortKey == "duration" {
+		probeDurations(filtered)
+	}
+	if minDuration > 0 {
+		filtered = slices.DeleteFunc(filtered, func(r *entity.Recording) bool {
+			return r.DurationSeconds < float64(minDuration)
+		})
+	}
+	sortRecordings(filtered, sortKey)
+	return filtered, nil
+}
+
+// queryInt parses a non-negative integer query parameter, 0 if it's empty.
+func queryInt(c *gin.Context, key string) (int, error) {
+	value := c.Query(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %s must be a non-negative integer, got %q", internal.ErrInvalidQuery, key, value)
+	}
+	return n, nil
+}
+
+// queryTime parses a time query parameter in RFC 3339 or as a date (2006-01-02) in `--timezone`,
+// a date is the end of the day if endOfDay is set. It's the zero time if the parameter is empty.
+func queryTime(c *gin.Context, key string, endOfDay bool) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, server.Config.Now().Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s must be a date (2006-01-02) or RFC 3339 time, got %q", internal.ErrInvalidQuery, key, value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return t, nil
+}
+
+// sortRecordings sorts by the key, newest and largest come first.
+func sortRecordings(recordings []*entity.Recording, key string) {
+	sort.SliceStable(recordings, func(i, j int) bool {
+		a, b := recordings[i], recordings[j]
+		switch key {
+		case "size":
+			return a.SizeBytes > b.SizeBytes
+		case "duration":
+			return a.DurationSeconds > b.DurationSeconds
+		case "name":
+			return a.Filename < b.Filename
+		case "channel":
+			if a.Channel != b.Channel {
+				return a.Channel < b.Channel
+			}
+		}
+		return a.ModTime > b.ModTime
+	})
+}
+
+// durationCache holds the probed durations by path, a changed file is probed again.
+var (
+	durationCache   = map[string]probedDuration{}
+	durationCacheMu sync.Mutex
+)
+
+// probeConcurrency is the number of ffprobe runs at the same time.
+const probeConcurrency = 4
+
+type probedDuration struct {
+	modTime int64
+	size    int64
+	seconds float64 // 0 if the probe failed, it isn't retried until the file changes
+}
+
+// probeDurations fills in the durations of the recordings with ffprobe, they stay empty if it fails (e.g. not installed).
+// The results are cached by the size and modification time of the file, failures included, and the misses are probed in parallel.
+func probeDurations(recordings []*entity.Recording) {
+	dir, err := RecordingsDir()
+	if err != nil {
+		return
+	}
+	var (
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, probeConcurrency)
+	)
+	for _, r := range recordings {
+		if r.DurationSeconds > 0 {
+			continue // known from the index
+		}
+		path := filepath.Join(dir, filepath.FromSlash(r.Filename))
+
+		durationCacheMu.Lock()
+		cached, ok := durationCache[path]
+		durationCacheMu.Unlock()
+		if ok && cached.modTime == r.ModTime && cached.size == r.SizeBytes {
+			setDuration(r, cached.seconds)
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			seconds, err := probeDuration(path)
+			if err != nil {
+				seconds = 0
+			}
+			durationCacheMu.Lock()
+			durationCache[path] = probedDuration{modTime: r.ModTime, size: r.SizeBytes, seconds: seconds}
+			durationCacheMu.Unlock()
+			setDuration(r, seconds)
+		}()
+	}
+	wg.Wait()
+}
+
+// setDuration sets the probed duration of the recording, it's left empty if the probe failed.
+func setDuration(r *entity.Recording, seconds float64) {
+	if seconds <= 0 {
+		return
+	}
+	r.DurationSeconds = seconds
+	r.Duration = internal.FormatDuration(seconds)
+}
+
+// probeDuration returns the duration of the video in seconds.
+func probeDuration(path string) (float64, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", path).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// listRecordings lists the recordings of RecordingsDir, none if there's no recordings directory.
+func listRecordings() ([]*entity.Recording, error) {
+	dir, err := RecordingsDir()
+	if errors.Is(err, internal.ErrNoRecordingsDir) {
+		return []*entity.Recording{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ListRecordings(dir)
+}
+
+// ListRecordings lists the recordings in the directory from the index, or scans it without an index.
+// Indexed recordings outside of the directory (e.g. a per-channel output directory) can't be served and are left out.
+func ListRecordings(dir string) ([]*entity.Recording, error) {
+	if server.Recordings == nil {
+		return ScanRecordings(dir)
+	}
+	entries, err := server.Recordings.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("index: %w", err)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	usernames := channelUsernames()
+
+	recordings := []*entity.Recording{}
+	for _, e := range entries {
+		rel, err := filepath.Rel(absDir, e.Path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		channel := e.Channel
+		if channel == "" {
+			channel = recordingChannel(rel, usernames)
+		}
+		modTime := time.Unix(e.ModTime, 0)
+		recordings = append(recordings, &entity.Recording{
+			Channel:         channel,
+			Filename:        rel,
+			URL:             recordingURL(rel),
+			Thumbnail:       recordingThumbnail(e.Path, rel),
+			Size:            internal.FormatFilesize(int(e.Size)),
+			SizeBytes:       e.Size,
+			ModifiedAt:      server.Config.FormatTime(modTime),
+			ModTime:         e.ModTime,
+			Duration:        internal.FormatDuration(e.Duration),
+			DurationSeconds: e.Duration,
+			Degraded:        e.Degraded,
+		})
+	}
+	return recordings, nil
+}
+
+// RebuildIndex replaces the recordings index with a scan of the recordings directory.
+func RebuildIndex() error {
+	dir, err := RecordingsDir()
+	if err != nil {
+		return err
+	}
+	recordings, err := ScanRecordings(dir)
+	if err != nil {
+		return fmt.Errorf("scan recordings: %w", err)
+	}
+	entries := make([]*index.Entry, 0, len(recordings))
+	for _, r := range recordings {
+		path, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(r.Filename)))
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &index.Entry{Path: path, Channel: r.Channel, Size: r.SizeBytes, ModTime: r.ModTime})
+	}
+	return server.Recordings.Rebuild(entries)
+}
+
+// channelUsernames returns the usernames of the channels, used to infer the channel of a recording.
+func channelUsernames() []string {
+	var usernames []string
+	for _, info := range server.Manager.ChannelInfo() {
+		usernames = append(usernames, info.Username)
+	}
+	return usernames
+}
+
+// ScanRecordings lists the recordings in the directory and its subdirectories.
+// Sidecar tracks and the files that are still being recorded are skipped.
+func ScanRecordings(dir string) ([]*entity.Recording, error) {
+	var usernames []string
+	active := map[string]bool{}
+	for _, info := range server.Manager.ChannelInfo() {
+		usernames = append(usernames, info.Username)
+		if info.Filename != "" {
+			active[filepath.Clean(info.Filename)] = true
+		}
+	}
+
+	var recordings []*entity.Recording
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				return filepath.SkipDir // nothing recorded yet
+			}
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || !recordingExts[filepath.Ext(name)] || active[filepath.Clean(p)] {
+			return nil
+		}
+		if strings.Contains(name, ".video.") || strings.Contains(name, ".audio.") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed while scanning
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		recordings = append(recordings, &entity.Recording{
+			Channel:    recordingChannel(rel, usernames),
+			Filename:   rel,
+			URL:        recordingURL(rel),
+			Thumbnail:  recordingThumbnail(p, rel),
+			Size:       internal.FormatFilesize(int(info.Size())),
+			SizeBytes:  info.Size(),
+			ModifiedAt: server.Config.FormatTime(info.ModTime()),
+			ModTime:    info.ModTime().Unix(),
+		})
+		return nil
+	})
+	return recordings, err
+}
+
+// recordingChannel infers the channel from the per-model folder, or from the
+// longest known username the filename starts with (e.g. `alice_2024-01-01_...`).
+func recordingChannel(rel string, usernames []string) string {
+	if dir := path.Dir(rel); dir != "." {
+		return path.Base(dir)
+	}
+	var channel string
+	for _, username := range usernames {
+		if strings.HasPrefix(rel, username+"_") && len(username) > len(channel) {
+			channel = username
+		}
+	}
+	return channel
+}
+
+// recordingThumbnail returns the URL of the thumbnail next to the recording, if any.
+func recordingThumbnail(p, rel string) string {
+	base := strings.TrimSuffix(p, filepath.Ext(p))
+	for _, ext := range thumbnailExts {
+		if _, err := os.Stat(base + ext); err == nil {
+			return recordingURL(strings.TrimSuffix(rel, path.Ext(rel)) + ext)
+		}
+	}
+	return ""
+}
+
+// recordingURL returns the escaped URL of a path relative to the recordings directory.
+func recordingURL(rel string) string {
+	return (&url.URL{Path: recordingsFilesPath + "/" + rel}).EscapedPath()
+}
+
+// recordingChannels returns the sorted unique channels of the recordings.
+func recordingChannels(recordings []*entity.Recording) []string {
+	seen := map[string]bool{}
+	var channels []string
+	for _, r := range recordings {
+		if r.Channel != "" && !seen[r.Channel] {
+			seen[r.Channel] = true
+			channels = append(channels, r.Channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
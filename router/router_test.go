@@ -0,0 +1,399 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/teacat/chaturbate-dvr/entity"
+	"github.com/teacat/chaturbate-dvr/internal"
+	"github.com/teacat/chaturbate-dvr/server"
+)
+
+// fakeManager keeps the channels in memory, it records the calls the handlers make.
+type fakeManager struct {
+	channels []*entity.ChannelConfig
+	calls    []string
+}
+
+func (m *fakeManager) find(username string) int {
+	for i, conf := range m.channels {
+		if conf.Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *fakeManager) CreateChannel(conf *entity.ChannelConfig, shouldSave bool) error {
+	m.calls = append(m.calls, "create "+conf.Username)
+	if m.find(conf.Username) != -1 {
+		return internal.ErrChannelExists
+	}
+	m.channels = append(m.channels, conf)
+	return nil
+}
+
+func (m *fakeManager) StopChannel(username string) error {
+	m.calls = append(m.calls, "stop "+username)
+	i := m.find(username)
+	if i == -1 {
+		return internal.ErrChannelNotFound
+	}
+	m.channels = append(m.channels[:i], m.channels[i+1:]...)
+	return nil
+}
+
+func (m *fakeManager) PauseChannel(username string) error {
+	m.calls = append(m.calls, "pause "+username)
+	return m.setPaused(username, true)
+}
+
+func (m *fakeManager) ResumeChannel(username string) error {
+	m.calls = append(m.calls, "resume "+username)
+	return m.setPaused(username, false)
+}
+
+func (m *fakeManager) setPaused(username string, paused bool) error {
+	i := m.find(username)
+	if i == -1 {
+		return internal.ErrChannelNotFound
+	}
+	m.channels[i].IsPaused = paused
+	return nil
+}
+
+func (m *fakeManager) WakeChannel(username string) error {
+	if m.find(username) == -1 {
+		return internal.ErrChannelNotFound
+	}
+	return nil
+}
+
+func (m *fakeManager) RecheckChannel(username string) error {
+	i := m.find(username)
+	if i == -1 {
+		return internal.ErrChannelNotFound
+	}
+	if m.channels[i].IsPaused {
+		return internal.ErrPaused
+	}
+	return nil
+}
+
+func (m *fakeManager) SetRuntime(settings *entity.RuntimeConfig) error {
+	m.calls = append(m.calls, "set runtime")
+	server.Config.SetRuntime(settings)
+	return nil
+}
+
+func (m *fakeManager) ChannelInfo() []*entity.ChannelInfo {
+	var infos []*entity.ChannelInfo
+	for _, conf := range m.channels {
+		infos = append(infos, &entity.ChannelInfo{Username: conf.Username, IsPaused: conf.IsPaused})
+	}
+	return infos
+}
+
+func (m *fakeManager) Publish(name string, ch *entity.ChannelInfo)       {}
+func (m *fakeManager) Subscriber(w http.ResponseWriter, r *http.Request) {}
+func (m *fakeManager) LoadConfig() error                                 { return nil }
+func (m *fakeManager) SaveConfig() error                                 { return nil }
+
+// setupTest sets the config and the manager of the server for the test, and returns a router with the auth
+// and the API, and a page standing in for the Web UI at `/`.
+func setupTest(t *testing.T, conf *entity.Config) (*gin.Engine, *fakeManager) {
+	t.Helper()
+
+	prevConfig, prevManager := server.Config, server.Manager
+	t.Cleanup(func() { server.Config, server.Manager = prevConfig, prevManager })
+
+	m := &fakeManager{}
+	server.Config, server.Manager = conf, m
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	SetupAuth(r)
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, "index") })
+	SetupAPI(r)
+	return r, m
+}
+
+// serve sends the request to the router, the body is sent as JSON if it's not empty.
+func serve(r *gin.Engine, method, path, body string, modify func(req *http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if modify != nil {
+		modify(req)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSetupAuth(t *testing.T) {
+	basic := func(username, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(username, password) }
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	tests := []struct {
+		name   string
+		conf   entity.Config
+		path   string
+		modify func(*http.Request)
+		want   int
+	}{
+		{"no auth, UI", entity.Config{}, "/", nil, http.StatusOK},
+		{"no auth, API", entity.Config{}, "/api/v1/channels", nil, http.StatusOK},
+
+		{"admin, UI without credentials", entity.Config{AdminUsername: "admin", AdminPassword: "pw"}, "/", nil, http.StatusUnauthorized},
+		{"admin, UI with basic auth", entity.Config{AdminUsername: "admin", AdminPassword: "pw"}, "/", basic("admin", "pw"), http.StatusOK},
+		{"admin, UI with wrong password", entity.Config{AdminUsername: "admin", AdminPassword: "pw"}, "/", basic("admin", "nope"), http.StatusUnauthorized},
+		{"admin, API with basic auth", entity.Config{AdminUsername: "admin", AdminPassword: "pw"}, "/api/v1/channels", basic("admin", "pw"), http.StatusOK},
+		{"admin, API without credentials", entity.Config{AdminUsername: "admin", AdminPassword: "pw"}, "/api/channels", nil, http.StatusUnauthorized},
+
+		{"token, UI stays open", entity.Config{APIToken: "secret"}, "/", nil, http.StatusOK},
+		{"token, API with token", entity.Config{APIToken: "secret"}, "/api/v1/channels", bearer("secret"), http.StatusOK},
+		{"token, API with wrong token", entity.Config{APIToken: "secret"}, "/api/v1/channels", bearer("guess"), http.StatusUnauthorized},
+		{"token, API without token", entity.Config{APIToken: "secret"}, "/api/channels", nil, http.StatusUnauthorized},
+
+		{"both, API with token", entity.Config{AdminUsername: "admin", AdminPassword: "pw", APIToken: "secret"}, "/api/v1/channels", bearer("secret"), http.StatusOK},
+		{"both, API with basic auth", entity.Config{AdminUsername: "admin", AdminPassword: "pw", APIToken: "secret"}, "/api/v1/channels", basic("admin", "pw"), http.StatusOK},
+		{"both, UI with token", entity.Config{AdminUsername: "admin", AdminPassword: "pw", APIToken: "secret"}, "/", bearer("secret"), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		conf := tt.conf
+		r, _ := setupTest(t, &conf)
+		w := serve(r, http.MethodGet, tt.path, "", tt.modify)
+		if w.Code != tt.want {
+			t.Errorf("%s: GET %s = %d, want %d", tt.name, tt.path, w.Code, tt.want)
+			continue
+		}
+		if w.Code != http.StatusUnauthorized {
+			continue
+		}
+		if w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tt.name)
+		}
+		if strings.HasPrefix(tt.path, "/api/") {
+			assertAPIError(t, w, http.StatusUnauthorized, "unauthorized")
+		}
+	}
+}
+
+func TestChannelsAPI(t *testing.T) {
+	r, m := setupTest(t, &entity.Config{Pattern: "{{.Username}}", Resolution: 1080, Framerate: 30})
+
+	w := serve(r, http.MethodPost, "/api/v1/channels", `{"username": "alice", "resolution": 720}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /channels = %d, want 201\n%s", w.Code, w.Body.String())
+	}
+	if conf := m.channels[0]; conf.Resolution != 720 || conf.Framerate != 30 || conf.Pattern != "{{.Username}}" {
+		t.Errorf("created channel = %+v, want resolution 720 and the defaults of the config", conf)
+	}
+
+	// A paused channel is created paused, not created and then paused
+	m.calls = nil
+	if w := serve(r, http.MethodPost, "/api/v1/channels", `{"username": "bob", "is_paused": true}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("POST /channels paused = %d, want 201", w.Code)
+	}
+	if len(m.calls) != 1 || m.calls[0] != "create bob" || !m.channels[1].IsPaused {
+		t.Errorf("calls = %q, paused = %v, want only the creation of a paused channel", m.calls, m.channels[1].IsPaused)
+	}
+
+	var infos []*entity.ChannelInfo
+	w = serve(r, http.MethodGet, "/api/v1/channels", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil || len(infos) != 2 {
+		t.Fatalf("GET /channels = %s, %v, want 2 channels", w.Body.String(), err)
+	}
+
+	var info entity.ChannelInfo
+	w = serve(r, http.MethodGet, "/api/channels/bob", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &info); w.Code != http.StatusOK || err != nil || info.Username != "bob" || !info.IsPaused {
+		t.Fatalf("GET /channels/bob = %d %s, want the paused bob", w.Code, w.Body.String())
+	}
+
+	if w := serve(r, http.MethodPost, "/api/v1/channels/bob/resume", "", nil); w.Code != http.StatusNoContent || m.channels[1].IsPaused {
+		t.Errorf("POST /channels/bob/resume = %d, paused = %v, want 204 and resumed", w.Code, m.channels[1].IsPaused)
+	}
+	if w := serve(r, http.MethodDelete, "/api/v1/channels/alice", "", nil); w.Code != http.StatusNoContent || len(m.channels) != 1 {
+		t.Errorf("DELETE /channels/alice = %d, %d channel(s) left, want 204 and 1", w.Code, len(m.channels))
+	}
+}
+
+func TestConfigAPI(t *testing.T) {
+	r, m := setupTest(t, &entity.Config{Interval: 1, MaxDuration: 60, UserAgent: "agent", Pattern: "{{.Username}}"})
+
+	var settings entity.RuntimeConfig
+	w := serve(r, http.MethodGet, "/api/v1/config", "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &settings); w.Code != http.StatusOK || err != nil || settings.MaxDuration != 60 || settings.UserAgent != "agent" {
+		t.Fatalf("GET /config = %d %s, want the runtime settings", w.Code, w.Body.String())
+	}
+
+	// The fields left out keep their value
+	w = serve(r, http.MethodPatch, "/api/v1/config", `{"interval": 5, "max_filesize": 1024}`, nil)
+	settings = entity.RuntimeConfig{}
+	if err := json.Unmarshal(w.Body.Bytes(), &settings); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("PATCH /config = %d %s, want 200", w.Code, w.Body.String())
+	}
+	want := entity.RuntimeConfig{Interval: 5, MaxDuration: 60, MaxFilesize: 1024, UserAgent: "agent"}
+	if settings != want || *server.Config.Runtime() != want {
+		t.Fatalf("PATCH /config = %+v, config = %+v, want %+v", settings, *server.Config.Runtime(), want)
+	}
+	if len(m.calls) != 1 || m.calls[0] != "set runtime" {
+		t.Errorf("calls = %q, want the settings applied by the manager", m.calls)
+	}
+
+	// Invalid settings change nothing
+	for _, body := range []string{`{"interval": 0}`, `{"max_duration": -1}`, `{"interval": "5"}`} {
+		w := serve(r, http.MethodPatch, "/api/v1/config", body, nil)
+		assertAPIError(t, w, http.StatusBadRequest, "invalid_request")
+	}
+	if *server.Config.Runtime() != want || len(m.calls) != 1 {
+		t.Fatalf("config = %+v after invalid settings, want %+v", *server.Config.Runtime(), want)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	r, m := setupTest(t, &entity.Config{Pattern: "{{.Username}}"})
+	m.channels = []*entity.ChannelConfig{{Username: "alice", IsPaused: true}}
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodPost, "/api/v1/channels", `{"username": "alice"}`, http.StatusConflict, "conflict"},
+		{http.MethodPost, "/api/v1/channels", `{"resolution": 720}`, http.StatusBadRequest, "invalid_request"},
+		{http.MethodPost, "/api/v1/channels", `{"username":`, http.StatusBadRequest, "invalid_request"},
+		{http.MethodGet, "/api/v1/channels/bob", "", http.StatusNotFound, "not_found"},
+		{http.MethodDelete, "/api/v1/channels/bob", "", http.StatusNotFound, "not_found"},
+		{http.MethodPost, "/api/v1/channels/bob/pause", "", http.StatusNotFound, "not_found"},
+		{http.MethodPost, "/api/v1/channels/alice/recheck", "", http.StatusConflict, "conflict"},
+		{http.MethodGet, "/api/v1/nothing", "", http.StatusNotFound, "not_found"},
+	}
+	for _, tt := range tests {
+		w := serve(r, tt.method, tt.path, tt.body, nil)
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			assertAPIError(t, w, tt.status, tt.code)
+		})
+	}
+}
+
+func TestListRecordingsAPI(t *testing.T) {
+	dir := t.TempDir()
+	r, m := setupTest(t, &entity.Config{Pattern: "{{.Username}}", OutputDir: dir})
+	m.channels = []*entity.ChannelConfig{{Username: "alice"}, {Username: "bob"}}
+	for _, f := range []struct {
+		name string
+		size int
+		day  int
+	}{
+		{"alice_1.mp4", 30, 1},
+		{"alice_2.mp4", 10, 3},
+		{"bob_1.ts", 20, 2},
+	} {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, bytes.Repeat([]byte("x"), f.size), 0666); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		modTime := time.Date(2024, 1, f.day, 12, 0, 0, 0, time.Local)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Chtimes() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string // the filenames in order
+		total int
+	}{
+		{"", "alice_2.mp4,bob_1.ts,alice_1.mp4", 3},
+		{"channel=alice", "alice_2.mp4,alice_1.mp4", 2},
+		{"q=BOB", "bob_1.ts", 1},
+		{"from=2024-01-02", "alice_2.mp4,bob_1.ts", 2},
+		{"to=2024-01-02", "bob_1.ts,alice_1.mp4", 2},
+		{"sort=size", "alice_1.mp4,bob_1.ts,alice_2.mp4", 3},
+		{"sort=name", "alice_1.mp4,alice_2.mp4,bob_1.ts", 3},
+		{"sort=channel&limit=2", "alice_2.mp4,alice_1.mp4", 3},
+		{"limit=1&offset=1", "bob_1.ts", 3},
+		{"offset=5", "", 3},
+		{"min_duration=1", "", 0}, // the files can't be probed
+	}
+	for _, tt := range tests {
+		w := serve(r, http.MethodGet, "/api/v1/recordings?"+tt.query, "", nil)
+		var recordings []*entity.Recording
+		if err := json.Unmarshal(w.Body.Bytes(), &recordings); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET /recordings?%s = %d %s, want 200", tt.query, w.Code, w.Body.String())
+		}
+		var names []string
+		for _, recording := range recordings {
+			names = append(names, recording.Filename)
+		}
+		if got, total := strings.Join(names, ","), w.Header().Get("X-Total-Count"); got != tt.want || total != strconv.Itoa(tt.total) {
+			t.Errorf("GET /recordings?%s = %s with a total of %s, want %s and %d", tt.query, got, total, tt.want, tt.total)
+		}
+	}
+
+	for _, query := range []string{"limit=-1", "offset=x", "min_duration=1.5", "from=yesterday"} {
+		assertAPIError(t, serve(r, http.MethodGet, "/api/v1/recordings?"+query, "", nil), http.StatusBadRequest, "invalid_request")
+	}
+}
+
+func TestProbeDurationsCachesFailures(t *testing.T) {
+	dir := t.TempDir()
+	setupTest(t, &entity.Config{Pattern: "{{.Username}}", OutputDir: dir})
+	path := filepath.Join(dir, "alice_1.mp4")
+	if err := os.WriteFile(path, []byte("not a video"), 0666); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	recording := &entity.Recording{Filename: "alice_1.mp4", ModTime: 1, SizeBytes: 11}
+	probeDurations([]*entity.Recording{recording})
+	durationCacheMu.Lock()
+	cached, ok := durationCache[path]
+	durationCacheMu.Unlock()
+	if !ok || cached.seconds != 0 || recording.Duration != "" {
+		t.Fatalf("cache = %+v, %v, duration = %q, want the failure cached and no duration", cached, ok, recording.Duration)
+	}
+
+	// A cached duration is used as is until the file changes
+	durationCacheMu.Lock()
+	durationCache[path] = probedDuration{modTime: 1, size: 11, seconds: 90}
+	durationCacheMu.Unlock()
+	probeDurations([]*entity.Recording{recording})
+	if recording.DurationSeconds != 90 {
+		t.Fatalf("duration = %v, want the cached 90", recording.DurationSeconds)
+	}
+	changed := &entity.Recording{Filename: "alice_1.mp4", ModTime: 2, SizeBytes: 11}
+	probeDurations([]*entity.Recording{changed})
+	if changed.DurationSeconds != 0 {
+		t.Fatalf("duration = %v after the file changed, want it probed again", changed.DurationSeconds)
+	}
+}
+
+// assertAPIError fails the test unless the response is an APIError with the status and the code.
+func assertAPIError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+
+	var apiErr APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil {
+		t.Fatalf("response %d is not an APIError: %q", w.Code, w.Body.String())
+	}
+	if w.Code != status || apiErr.Code != code || apiErr.Error == "" {
+		t.Errorf("response = %d %+v, want %d with code %q", w.Code, apiErr, status, code)
+	}
+}
@@ -13,6 +13,9 @@ type IManager interface {
 	StopChannel(username string) error
 	PauseChannel(username string) error
 	ResumeChannel(username string) error
+	WakeChannel(username string) error
+	RecheckChannel(username string) error
+	SetRuntime(settings *entity.RuntimeConfig) error
 	ChannelInfo() []*entity.ChannelInfo
 	Publish(name string, ch *entity.ChannelInfo)
 	Subscriber(w http.ResponseWriter, r *http.Request)
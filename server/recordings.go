@@ -0,0 +1,9 @@
+package server
+
+import "github.com/teacat/chaturbate-dvr/index"
+
+// Recordings is the index of completed recordings, nil when the Web UI isn't running.
+var Recordings *index.Index
+
+// Totals are the lifetime totals of the completed recordings, nil when the Web UI isn't running.
+var Totals *index.Totals